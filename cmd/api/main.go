@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"github.com/sirupsen/logrus"
 	"os"
+	"strconv"
 	"time"
 	"trace/pkg/api"
 	"trace/pkg/database"
@@ -15,23 +18,79 @@ func main() {
 	addr := envOr("LISTEN_ADDRESS", "0.0.0.0:8080")
 	mongoUri := envOr("MONGO_URI", "mongodb://localhost")
 	databaseName := envOr("DATABASE_NAME", "prod")
+	// use DATABASE_DRIVER=memory to run without mongo
+	databaseDriver := envOr("DATABASE_DRIVER", database.DriverMongo)
+
+	queryTimeout, err := time.ParseDuration(envOr("QUERY_TIMEOUT", "10s"))
+	if err != nil {
+		logrus.Fatalf("Invalid QUERY_TIMEOUT: %s", err)
+	}
+
+	// EXPOSURE_RULES is the exposure rules as json, see trace.ExposureRules
+	exposureRules := trace.DefaultExposureRules
+	if rules := os.Getenv("EXPOSURE_RULES"); rules != "" {
+		if err := json.Unmarshal([]byte(rules), &exposureRules); err != nil {
+			logrus.Fatalf("Invalid EXPOSURE_RULES: %s", err)
+		}
+	}
+
+	// RETENTION_DAYS is how many days events are kept. They are kept forever if it isn't set
+	var retention trace.RetentionPolicy
+	if days := os.Getenv("RETENTION_DAYS"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			logrus.Fatalf("Invalid RETENTION_DAYS: %s", err)
+		}
+		retention = trace.RetentionPolicy{
+			Period:         time.Duration(n) * 24 * time.Hour,
+			Mode:           trace.RetentionMode(envOr("RETENTION_MODE", string(trace.RetentionPurge))),
+			RemoveStudents: os.Getenv("RETENTION_REMOVE_STUDENTS") == "true",
+		}
+	}
+	if err := retention.Validate(); err != nil {
+		logrus.Fatalf("Invalid retention policy: %s", err)
+	}
 
 	config := api.Config{
 		DatabaseConfig: database.Config{
+			Driver:       databaseDriver,
 			MongoURI:     mongoUri,
 			DatabaseName: databaseName,
+			QueryTimeout: queryTimeout,
 		},
-		Timeout:        3 * time.Hour,
+		Timeout:       3 * time.Hour,
+		ExposureRules: exposureRules,
+		Retention:     retention,
+		// the first admin is only created if there are no users
+		Username: envOr("ADMIN_USERNAME", os.Getenv("USERNAME")),
+		Password: envOr("ADMIN_PASSWORD", os.Getenv("PASSWORD")),
 	}
 
 	// we're using the global database
-	_, err := database.Connect(config.DatabaseConfig)
+	store, err := database.Open(config.DatabaseConfig)
 	if err != nil {
 		logrus.Fatalf("Could not connect to database: %s", err)
 	}
 
+	// the schema is migrated before anything reads it. Use MIGRATE=false to run the
+	// migrations by hand with cmd/migrate instead
+	if db, ok := store.(*database.Database); ok {
+		if envOr("MIGRATE", "true") == "true" {
+			if _, err := db.Migrate(context.Background(), false); err != nil {
+				logrus.Fatalf("Could not migrate the database: %s", err)
+			}
+		}
+
+		// the api can still run without the indexes, it will just be slower and
+		// duplicate handles will only be caught by the checks in CreateStudent
+		if err := db.EnsureIndexes(context.Background()); err != nil {
+			logrus.Errorf("Could not create the indexes, the pending migrations may have to be applied: %s", err)
+		}
+	}
+
 	// see the function docs for more info (trace/timeout.go)
-	go trace.TimeoutEventThread()
+	go trace.TimeoutEventThread(context.Background())
+	go trace.RetentionThread(context.Background(), config.Retention)
 
 	if err := api.Listen(addr, &config); err != nil {
 		logrus.Fatalf("Failed to listen on %s: %s", addr, err)
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"github.com/sirupsen/logrus"
 	"time"
 	"trace/pkg/database"
 )
 
 func main() {
+	ctx := context.Background()
+
 	databaseConfig := database.Config{
 		MongoURI:     "mongodb://localhost",
 		DatabaseName: "dev",
@@ -17,7 +20,7 @@ func main() {
 		logrus.Fatalf("Could not connect to database: %s", err)
 	}
 
-	_ = db.Database.Drop(nil)
+	_ = db.Database.Drop(ctx)
 
 	students := map[string][]string {
 		"Ryan McCrystal": {"ryan", "_ryan"},
@@ -34,13 +37,18 @@ func main() {
 			Name:           name,
 			StudentHandles: handles,
 		}
-		db.CreateStudent(&newStudent)
+		if err := db.CreateStudent(ctx, &newStudent); err != nil {
+			logrus.Fatalf("Could not create student %s: %s", name, err)
+		}
 	}
 
 	for _, locationName := range locations {
-		db.CreateLocation(&database.Location{
+		err := db.CreateLocation(ctx, &database.Location{
 			Timeout: 4 * time.Hour,
 			Name: locationName,
 		})
+		if err != nil {
+			logrus.Fatalf("Could not create location %s: %s", locationName, err)
+		}
 	}
 }
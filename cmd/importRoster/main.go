@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"github.com/sirupsen/logrus"
+	"os"
+	"strings"
+	"time"
+	"trace/pkg/database"
+	"trace/pkg/trace"
+)
+
+// importRoster creates or updates students from a roster CSV exported by the
+// student information system, see trace.ImportRoster. The report is printed as json.
+//
+//	go run ./cmd/importRoster -dry-run roster.csv
+func main() {
+	options := trace.RosterOptions{}
+	flag.StringVar(&options.Mapping.Name, "name-column", trace.DefaultRosterMapping.Name, "the column with the student's name")
+	flag.StringVar(&options.Mapping.Email, "email-column", trace.DefaultRosterMapping.Email, "the column with the student's email")
+	flag.StringVar(&options.Mapping.ExternalID, "external-id-column", trace.DefaultRosterMapping.ExternalID, "the column with the student's id in the student information system")
+	handles := flag.String("handle-columns", strings.Join(trace.DefaultRosterMapping.Handles, ","), "the comma separated columns with the ids students scan with")
+	flag.BoolVar(&options.DryRun, "dry-run", false, "only print what would be changed")
+	flag.BoolVar(&options.ArchiveMissing, "archive-missing", false, "archive imported students that aren't in the roster")
+	flag.Parse()
+	options.Mapping.Handles = strings.Split(*handles, ",")
+
+	if flag.NArg() != 1 {
+		logrus.Fatalf("Usage: importRoster [flags] roster.csv")
+	}
+	file, err := os.Open(flag.Arg(0))
+	if err != nil {
+		logrus.Fatalf("Could not open roster: %s", err)
+	}
+	defer file.Close()
+
+	// the database is configured the same way as the api
+	_, err = database.Open(database.Config{
+		MongoURI:     envOr("MONGO_URI", "mongodb://localhost"),
+		DatabaseName: envOr("DATABASE_NAME", "prod"),
+		QueryTimeout: 10 * time.Second,
+	})
+	if err != nil {
+		logrus.Fatalf("Could not connect to database: %s", err)
+	}
+
+	ctx := context.Background()
+	report, err := trace.ImportRoster(ctx, file, options)
+	if err != nil {
+		logrus.Fatalf("Could not import roster: %s", err)
+	}
+
+	if !report.DryRun {
+		hostname, _ := os.Hostname()
+		err := database.DB.CreateAuditEntry(ctx, &database.AuditEntry{
+			Time:      time.Now(),
+			Actor:     "importRoster",
+			Action:    database.AuditImportRoster,
+			TargetIDs: report.TargetIDs(),
+			Details: map[string]interface{}{
+				"file":            flag.Arg(0),
+				"created":         len(report.Created),
+				"updated":         len(report.Updated),
+				"unchanged":       report.Unchanged,
+				"archived":        len(report.Archived),
+				"errors":          len(report.Errors),
+				"archive_missing": options.ArchiveMissing,
+			},
+			Request: database.AuditRequest{UserAgent: "importRoster on " + hostname},
+		})
+		if err != nil {
+			logrus.Errorf("Could not record the import in the audit log: %s", err)
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		logrus.Fatalf("Could not print report: %s", err)
+	}
+	if len(report.Errors) > 0 {
+		os.Exit(1)
+	}
+}
+
+// envOr returns an env variable by its key or the defaultValue if it is not found
+func envOr(key string, defaultValue string) string {
+	value, found := os.LookupEnv(key)
+	if !found {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"trace/pkg/database"
+)
+
+// migrate applies the pending schema migrations, see database.Migrate. The api
+// applies them when it starts unless MIGRATE=false.
+//
+//	go run ./cmd/migrate -dry-run
+func main() {
+	dryRun := flag.Bool("dry-run", false, "only check and log what the migrations would do")
+	status := flag.Bool("status", false, "only print the applied and pending migrations")
+	flag.Parse()
+
+	// the database is configured the same way as the api
+	db, err := database.Connect(database.Config{
+		MongoURI:     envOr("MONGO_URI", "mongodb://localhost"),
+		DatabaseName: envOr("DATABASE_NAME", "prod"),
+	})
+	if err != nil {
+		logrus.Fatalf("Could not connect to database: %s", err)
+	}
+
+	ctx := context.Background()
+	if *status {
+		applied, err := db.AppliedMigrations(ctx)
+		if err != nil {
+			logrus.Fatalf("Could not get the applied migrations: %s", err)
+		}
+		for _, migration := range applied {
+			fmt.Printf("applied %d: %s (%s)\n", migration.Version, migration.Description, migration.Time.Format("2006-01-02 15:04:05"))
+		}
+	}
+
+	pending, err := db.PendingMigrations(ctx)
+	if err != nil {
+		logrus.Fatalf("Could not get the pending migrations: %s", err)
+	}
+	if *status || len(pending) == 0 {
+		for _, migration := range pending {
+			fmt.Printf("pending %d: %s\n", migration.Version, migration.Description)
+		}
+		if len(pending) == 0 {
+			fmt.Println("The database is up to date")
+		}
+		return
+	}
+
+	migrated, err := db.Migrate(ctx, *dryRun)
+	for _, migration := range migrated {
+		if *dryRun {
+			fmt.Printf("would apply %d: %s\n", migration.Version, migration.Description)
+		} else {
+			fmt.Printf("applied %d: %s\n", migration.Version, migration.Description)
+		}
+	}
+	if err != nil {
+		logrus.Fatalf("Could not migrate the database: %s", err)
+	}
+}
+
+// envOr returns an env variable by its key or the defaultValue if it is not found
+func envOr(key string, defaultValue string) string {
+	value, found := os.LookupEnv(key)
+	if !found {
+		return defaultValue
+	}
+	return value
+}
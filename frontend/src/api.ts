@@ -21,54 +21,408 @@ async function sendApiRequest<T>(method: "GET" | "PUT" | "POST" | "DELETE" | "PA
     }
 }
 
+export type Role = "kiosk" | "staff" | "admin" | "health_officer";
+
+export interface TraceUser {
+    id: string,
+    username: string,
+    roles: Role[]
+}
+
+// getCurrentUser returns the user that is logged in
+export async function getCurrentUser(): Promise<TraceUser> {
+    return await sendApiRequest<TraceUser>("GET", "me");
+}
+
+export async function getUsers(): Promise<TraceUser[]> {
+    return await sendApiRequest<TraceUser[]>("GET", "user");
+}
+
+// createUser creates a user. Only admins can manage users
+export async function createUser(username: string, password: string, roles: Role[]): Promise<TraceUser> {
+    return await sendApiRequest<TraceUser>("POST", "user", {username, password, roles});
+}
+
+// editUser updates a user. If password is empty, it isn't changed
+export async function editUser(id: string, username: string, password: string, roles: Role[]): Promise<TraceUser> {
+    return await sendApiRequest<TraceUser>("PATCH", `user/${id}`, {username, password, roles});
+}
+
+export async function deleteUser(id: string): Promise<null> {
+    return await sendApiRequest("DELETE", `user/${id}`);
+}
+
+export interface TraceDevice {
+    id: string,
+    name: string,
+    location: TraceLocation,
+    revoked: boolean,
+    created_at: string,
+    last_seen: string
+}
+
+export async function getDevices(): Promise<TraceDevice[]> {
+    return await sendApiRequest<TraceDevice[]>("GET", "device");
+}
+
+// registerDevice registers a kiosk at a location. The token is only returned once
+// and has to be entered on the kiosk
+export async function registerDevice(name: string, location_id: string): Promise<{device: TraceDevice, token: string}> {
+    return await sendApiRequest("POST", "device", {name, location_id});
+}
+
+export async function editDevice(id: string, name: string, location_id: string): Promise<TraceDevice> {
+    return await sendApiRequest<TraceDevice>("PATCH", `device/${id}`, {name, location_id});
+}
+
+// revokeDevice stops a device from using its token
+export async function revokeDevice(id: string): Promise<TraceDevice> {
+    return await sendApiRequest<TraceDevice>("POST", `device/${id}/revoke`);
+}
+
+export async function deleteDevice(id: string): Promise<null> {
+    return await sendApiRequest("DELETE", `device/${id}`);
+}
+
+export interface AuditEntry {
+    id: string,
+    time: string,
+    actor_id: string,
+    actor: string,
+    action: string,
+    target_ids: string[],
+    details?: { [key: string]: any },
+    request: {
+        method: string,
+        path: string,
+        ip: string,
+        user_agent: string
+    },
+    before?: any,
+    after?: any,
+    redacted?: boolean
+}
+
+export interface AuditFilter {
+    actor_id?: string,
+    action?: string,
+    target_id?: string,
+    from?: number,
+    to?: number,
+    limit?: number
+}
+
+// getAuditEntries gets the audit log from latest to earliest. Only admins can read it
+export async function getAuditEntries(filter: AuditFilter = {}): Promise<AuditEntry[]> {
+    const params = new URLSearchParams();
+    Object.entries(filter).forEach(([key, value]) => {
+        if (value !== undefined) {
+            params.set(key, value.toString());
+        }
+    });
+    return await sendApiRequest<AuditEntry[]>("GET", `audit?${params.toString()}`);
+}
+
+export interface RetentionPolicy {
+    // period is in nanoseconds, and 0 if events are kept forever
+    period: number,
+    mode: "purge" | "anonymize",
+    remove_students: boolean
+}
+
+export interface RetentionReport {
+    dry_run: boolean,
+    mode: "purge" | "anonymize",
+    cutoff: string,
+    events: number,
+    students: TraceStudent[]
+}
+
+// getRetention gets the retention policy and what it would remove now, which is null if it is disabled
+export async function getRetention(): Promise<{policy: RetentionPolicy, report: RetentionReport | null}> {
+    return await sendApiRequest("GET", "retention");
+}
+
+// runRetention applies the retention policy now. If dry_run is true, nothing is removed
+export async function runRetention(dry_run: boolean): Promise<RetentionReport> {
+    return await sendApiRequest<RetentionReport>("POST", "retention/run", {dry_run});
+}
+
+export interface StudentExport {
+    exported_at: string,
+    student: TraceStudent,
+    events: {
+        id: string,
+        location_id: string,
+        time: string,
+        event_type: EventType,
+        source: EventSource,
+        correction?: EventCorrection,
+        voided?: EventCorrection
+    }[],
+    locations: TraceLocation[]
+}
+
+// exportStudent gets all of the data stored about a student
+export async function exportStudent(id: string): Promise<StudentExport> {
+    return await sendApiRequest<StudentExport>("GET", `student/${id}/export`);
+}
+
+// studentExportZipUrl is the url to download all of the data stored about a student as a zip file
+export function studentExportZipUrl(id: string): string {
+    return `/api/student/${id}/export?format=zip`;
+}
+
+// eraseStudent deletes a student and deletes or pseudonymizes their events. This can't be undone
+export async function eraseStudent(
+    id: string,
+    mode: "delete" | "pseudonymize",
+    reason: string
+): Promise<{mode: string, student: string, events: number, audit_entries: number}> {
+    return await sendApiRequest("POST", `student/${id}/erase`, {mode, reason});
+}
+
 export enum EventType {
     Enter,
     Leave
 }
 
+export enum EventSource {
+    Scan,
+    AutoLeave,
+    LoggedOut,
+    LoggedOutAll,
+    Transferred,
+    Manual
+}
+
+// EventCorrection records who changed the history of events by hand and why
+export interface EventCorrection {
+    reason: string,
+    time: string,
+    by: string,
+    replaces?: string
+}
+
 export interface TraceEvent {
     id: string,
     location: TraceLocation,
     student: TraceStudent,
     time: Date,
-    event_type: EventType
+    event_type: EventType,
+    source: EventSource,
+    correction?: EventCorrection,
+    voided?: EventCorrection,
+    anonymized?: boolean
+}
+
+export interface EventFilter {
+    student?: string,
+    location?: string,
+    event_type?: EventType,
+    source?: EventSource,
+    // unix times in seconds
+    from?: number,
+    to?: number,
+    voided?: boolean,
+    // "time" for earliest to latest or "-time" for latest to earliest, which is the default
+    sort?: "time" | "-time",
+    limit?: number,
+    cursor?: string
+}
+
+// getEvents gets a page of events matching the filter
+export async function getEvents(filter: EventFilter = {}): Promise<Page<TraceEvent>> {
+    const params = new URLSearchParams();
+    Object.entries(filter).forEach(([key, value]) => {
+        if (value !== undefined) {
+            params.set(key, value.toString());
+        }
+    });
+    const page = await sendApiRequest<Page<TraceEvent>>("GET", `event?${params.toString()}`);
+    page.items.forEach(event => event.time = new Date(event.time));
+    return page;
+}
+
+// createManualEvent creates an event by hand, for example when a student forgot to scan.
+// The time can be in the past, but not in the future
+export async function createManualEvent(
+    student_id: string,
+    location_id: string,
+    event_type: EventType,
+    time: Date,
+    reason: string
+): Promise<TraceEvent> {
+    return await sendApiRequest<TraceEvent>("POST", "event", {student_id, location_id, event_type, time, reason});
+}
+
+// voidEvent marks an event as wrong so it is ignored in reports
+export async function voidEvent(id: string, reason: string): Promise<TraceEvent> {
+    return await sendApiRequest<TraceEvent>("POST", `event/${id}/void`, {reason});
+}
+
+// moveEvent moves an event to another location by voiding it and creating a replacement
+export async function moveEvent(id: string, location_id: string, reason: string): Promise<{voided: TraceEvent, replacement: TraceEvent}> {
+    return await sendApiRequest("POST", `event/${id}/move`, {location_id, reason});
 }
 
 export async function scan(student_handle: string, location_id: string): Promise<TraceEvent> {
     return await sendApiRequest<TraceEvent>("POST", "scan", {student_handle, location_id});
 }
 
+export interface BatchScan {
+    student_handle: string,
+    location_id: string,
+    time: Date,
+    // generated by the client so the scan is only recorded once if it is sent again
+    idempotency_key: string
+}
+
+export interface BatchScanResult {
+    idempotency_key: string,
+    status: "created" | "duplicate" | "error",
+    event?: TraceEvent,
+    error?: string
+}
+
+// scanBatch sends scans that were recorded while offline. The results are in the same order as scans
+export async function scanBatch(scans: BatchScan[]): Promise<BatchScanResult[]> {
+    return await sendApiRequest<BatchScanResult[]>("POST", "scan/batch", {scans});
+}
+
 export interface TraceLocation {
     id: string,
     name: string,
-    timeout: number
+    timeout: number,
+    capacity: number,
+    capacity_warn_only: boolean,
+    debounce_window: number,
+    scan_intent: "" | "toggle" | "enter" | "leave",
+    archived: boolean
+}
+
+// A Page is a page of a list endpoint. next_cursor is empty on the last page
+export interface Page<T> {
+    items: T[],
+    next_cursor: string
+}
+
+// getAllPages gets every page of a list endpoint. path shouldn't have a cursor or limit
+async function getAllPages<T>(path: string): Promise<T[]> {
+    const separator = path.includes("?") ? "&" : "?";
+    let items: T[] = [];
+    let cursor = "";
+    do {
+        const page = await sendApiRequest<Page<T>>("GET", `${path}${separator}limit=500&cursor=${cursor}`);
+        items = items.concat(page.items);
+        cursor = page.next_cursor;
+    } while (cursor !== "");
+    return items;
+}
+
+// getLocations gets the locations. Archived locations are only included if archived is true
+export async function getLocations(archived: boolean = false): Promise<TraceLocation[]> {
+    return await getAllPages<TraceLocation>(`location?archived=${archived}`);
+}
+
+// deleteLocation archives a location, or deletes it and all of its events if cascade is true
+export async function deleteLocation(location_id: string, cascade: boolean = false): Promise<TraceLocation | null> {
+    return await sendApiRequest("DELETE", `location/${location_id}?cascade=${cascade}`);
 }
 
-export async function getLocations(): Promise<TraceLocation[]> {
-    return await sendApiRequest<TraceLocation[]>("GET", "location");
+export async function restoreLocation(location_id: string): Promise<TraceLocation> {
+    return await sendApiRequest<TraceLocation>("POST", `location/${location_id}/restore`);
 }
 
 export interface TraceStudent {
     id: string,
     name: string,
     email: string,
-    student_handles: string[]
+    external_id: string,
+    student_handles: string[],
+    archived: boolean
+}
+
+export interface LocationOccupancy {
+    students: { student: TraceStudent, time: Date }[],
+    occupancy: number,
+    // 0 if there is no limit
+    capacity: number
 }
 
-export async function getStudentsAtLocation(location_id: string): Promise<{ student: TraceStudent, time: Date }[]> {
-    let data = await sendApiRequest<{ student: TraceStudent, time: Date }[]>("GET", `location/${location_id}/students`);
-    data.map((st) => {
+export async function getStudentsAtLocation(location_id: string): Promise<LocationOccupancy> {
+    let data = await sendApiRequest<LocationOccupancy>("GET", `location/${location_id}/students`);
+    data.students.map((st) => {
         st.time = new Date(st.time);
     });
     return data;
 }
 
+// StreamEvent is the part of an event that is sent in streams
+export interface StreamEvent {
+    id: string,
+    student: { id: string, name: string },
+    location_id: string,
+    time: Date,
+    event_type: EventType,
+    source: EventSource
+}
+
+// streamLocation calls onEvent whenever a student enters or leaves the location, or an event
+// there is voided, with the occupancy after the event. It returns a function that closes the stream.
+export function streamLocation(
+    location_id: string,
+    onEvent: (occupancy: { occupancy: number, capacity: number }, event?: StreamEvent) => void
+): () => void {
+    const source = new EventSource(`/api/location/${location_id}/stream`);
+    source.addEventListener("occupancy", (e) => onEvent(JSON.parse((e as MessageEvent).data)));
+    for (const name of ["enter", "leave", "auto_leave", "void"]) {
+        source.addEventListener(name, (e) => {
+            const data = JSON.parse((e as MessageEvent).data);
+            onEvent(data, data.event);
+        });
+    }
+    return () => source.close();
+}
+
 export async function logoutStudent(student_id: string, location_id: string): Promise<TraceEvent> {
     return await sendApiRequest("POST", `student/${student_id}/logout`, {location_id: location_id});
 }
 
 export async function getStudents(): Promise<TraceStudent[]> {
-    return await sendApiRequest("GET", `student`);
+    return await getAllPages<TraceStudent>("student");
+}
+
+// searchStudents gets a page of the students whose name, email or handles contain search
+export async function searchStudents(search: string, cursor: string = ""): Promise<Page<TraceStudent>> {
+    const params = new URLSearchParams({search, cursor});
+    return await sendApiRequest<Page<TraceStudent>>("GET", `student?${params.toString()}`);
+}
+
+export type PresenceEnd = "scan" | "auto_leave" | "logged_out" | "logged_out_all" | "transferred" | "manual" | "ongoing";
+
+export interface TimelineEntry {
+    location: TraceLocation,
+    enter_time: Date,
+    leave_time: Date,
+    end_reason: PresenceEnd
+}
+
+// getStudentTimeline gets where a student was between the from and to unix times and how they left each location
+export async function getStudentTimeline(student_id: string, from?: number, to?: number): Promise<TimelineEntry[]> {
+    const params = new URLSearchParams();
+    if (from !== undefined) {
+        params.set("from", from.toString());
+    }
+    if (to !== undefined) {
+        params.set("to", to.toString());
+    }
+    const timeline = await sendApiRequest<TimelineEntry[]>("GET", `student/${student_id}/timeline?${params.toString()}`);
+    timeline.forEach(entry => {
+        entry.enter_time = new Date(entry.enter_time);
+        entry.leave_time = new Date(entry.leave_time);
+    });
+    return timeline;
 }
 
 export async function logoutAll(location_id: string): Promise<null> {
@@ -83,36 +437,88 @@ export async function createStudents(students: TraceStudent[]): Promise<TraceStu
     return await sendApiRequest("POST", "students", students);
 }
 
+export interface RosterMapping {
+    name_column?: string,
+    email_column?: string,
+    external_id_column?: string,
+    // the comma separated columns with the ids students scan with
+    handle_columns?: string
+}
+
+export interface RosterReport {
+    dry_run: boolean,
+    created: TraceStudent[],
+    updated: TraceStudent[],
+    unchanged: number,
+    archived: TraceStudent[],
+    errors: {row: number, message: string}[]
+}
+
+// importRoster creates or updates students from a roster CSV. If dry_run is true, nothing is changed
+export async function importRoster(
+    csv: string,
+    mapping: RosterMapping = {},
+    dry_run: boolean = false,
+    archive_missing: boolean = false
+): Promise<RosterReport> {
+    const params = new URLSearchParams({...mapping, dry_run: `${dry_run}`, archive_missing: `${archive_missing}`});
+    return await sendApiRequest<RosterReport>("POST", `students/import?${params}`, csv);
+}
+
 export async function editStudent(id: string, newStudent: TraceStudent): Promise<null> {
     return await sendApiRequest("PATCH", `student/${id}`, newStudent);
 }
 
-export async function deleteStudent(student_id: string): Promise<null> {
-    return await sendApiRequest("DELETE", `student/${student_id}`);
+// deleteStudent archives a student, or deletes them and all of their events if cascade is true
+export async function deleteStudent(student_id: string, cascade: boolean = false): Promise<TraceStudent | null> {
+    return await sendApiRequest("DELETE", `student/${student_id}?cascade=${cascade}`);
+}
+
+export async function restoreStudent(student_id: string): Promise<TraceStudent> {
+    return await sendApiRequest<TraceStudent>("POST", `student/${student_id}/restore`);
 }
 
 
+export type Risk = "none" | "casual" | "close";
+
 export interface ContactReport {
     target_student: TraceStudent,
     start_date: Date,
     end_date: Date,
+    depth: number,
+    min_risk: Risk,
     contacts: {
         student: TraceStudent,
-        seconds_together: number
+        seconds_together: number,
+        depth: number,
+        risk: Risk,
+        exposure_seconds: number,
+        via: {
+            student: TraceStudent,
+            seconds_together: number
+        }[],
+        overlaps: {
+            location: TraceLocation,
+            with: TraceStudent,
+            start_time: number,
+            end_time: number
+        }[]
     }[]
 }
 
 export async function generateContactReport(
     student_id: string,
     start_time: Date,
-    end_time: Date
+    end_time: Date,
+    depth: number = 1,
+    min_risk: Risk = "none"
 ): Promise<ContactReport> {
     console.log(start_time, end_time);
     console.log({start_time: start_time?.getTime() / 1000, end_time: end_time?.getTime() / 1000})
     let data = await sendApiRequest<ContactReport>(
         "POST",
         `trace/${student_id}`,
-        {start_time: Math.round(start_time?.getTime() / 1000), end_time: Math.round(end_time?.getTime() / 1000)});
+        {start_time: Math.round(start_time?.getTime() / 1000), end_time: Math.round(end_time?.getTime() / 1000), depth, min_risk});
 
     data.start_date = start_time;
     // assert(data.start_date.getSeconds() == start_time?.getSeconds());
@@ -120,7 +526,7 @@ export async function generateContactReport(
     // assert(data.end_date.getSeconds() == end_time?.getSeconds());
 
     data.contacts = data.contacts.filter(({student, seconds_together}) => seconds_together !== 0);
-    data.contacts.sort((a, b) => (a.seconds_together < b.seconds_together) ? 1 : -1);
+    data.contacts.sort((a, b) => (a.depth !== b.depth) ? a.depth - b.depth : b.seconds_together - a.seconds_together);
 
     return data;
 }
@@ -131,6 +537,28 @@ export interface LocationVisit {
     enter_time: Date,
 }
 
+export interface LocationStats {
+    location: TraceLocation,
+    from: string,
+    to: string,
+    visits: number,
+    days: { [date: string]: number },
+    hours: number[]
+}
+
+// getLocationStats counts the visits to a location between the from and to unix times,
+// including the visits of students who were removed
+export async function getLocationStats(location_id: string, from?: number, to?: number): Promise<LocationStats> {
+    const params = new URLSearchParams();
+    if (from !== undefined) {
+        params.set("from", from.toString());
+    }
+    if (to !== undefined) {
+        params.set("to", to.toString());
+    }
+    return await sendApiRequest<LocationStats>("GET", `location/${location_id}/stats?${params.toString()}`);
+}
+
 export async function getLocationVisits(location_id: string): Promise<LocationVisit[]> {
     let data = await sendApiRequest<LocationVisit[]>("GET", `location/${location_id}/visits`)
     data.map(el => {
@@ -1,5 +1,5 @@
 import React, {useCallback, useEffect, useState} from "react";
-import {getStudentsAtLocation, logoutAll, logoutStudent, TraceStudent, TraceEvent, TraceLocation} from "../api";
+import {getStudentsAtLocation, logoutAll, streamLocation, logoutStudent, TraceStudent, TraceEvent, TraceLocation} from "../api";
 import {formatAMPM, onCatch, onCatchPrefix} from "./util";
 import {Button, Card, HTMLTable, ICardProps, Spinner} from "@blueprintjs/core";
 import moment from "moment";
@@ -7,11 +7,13 @@ import moment from "moment";
 export default function CurrentlyInLocation({location, ...props}: { location: TraceLocation } & ICardProps) {
     let [loading, setLoading] = useState(true);
     let [students, setStudents] = useState<{ student: TraceStudent, time: Date }[]>([]);
+    let [capacity, setCapacity] = useState(0);
 
     const updateStudents = useCallback(() => {
         getStudentsAtLocation(location.id)
             .then(st => {
-                setStudents(st);
+                setStudents(st.students);
+                setCapacity(st.capacity);
                 setLoading(false);
                 setLogoutAllLoading(false);
             })
@@ -23,14 +25,16 @@ export default function CurrentlyInLocation({location, ...props}: { location: Tr
         updateStudents()
     }, [location, updateStudents]);
 
-    // TODO: Use websockets or something for this?
+    // update the students whenever someone enters or leaves
     useEffect(() => {
         if (!location) {
             return
         }
-        let intervalID = setInterval(updateStudents, 1000);
-
-        return () => clearInterval(intervalID)
+        return streamLocation(location.id, (_, event) => {
+            if (event) {
+                updateStudents();
+            }
+        });
     }, [location, updateStudents])
 
     const [logoutAllLoading, setLogoutAllLoading] = useState(false);
@@ -44,7 +48,7 @@ export default function CurrentlyInLocation({location, ...props}: { location: Tr
 
     return <Card {...props} className="max-w-3xl w-full m-8 p-8">
         <h1 className="bp3-heading text-center">
-            Currently in {location.name} ({students.length})
+            Currently in {location.name} ({capacity > 0 ? `${students.length}/${capacity}` : students.length})
         </h1>
         <Button minimal className="mx-auto block my-3" onClick={handleLogoutAllPress} loading={logoutAllLoading}>
             <h4 className="bp3-text-muted bp3-heading text-center m-auto">
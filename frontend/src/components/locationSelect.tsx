@@ -39,7 +39,7 @@ export default function LocationSelect({activeLocation, onSelect}: { activeLocat
 // We have to use a generator for this so we can update the location list
 function createLocationGenerator(setLocations: Dispatch<SetStateAction<Api.TraceLocation[]>>): (name: string) => Api.TraceLocation {
     return name => {
-        const newLocation = {name: "test", id: "hello", timeout: 1};
+        const newLocation = {name: "test", id: "hello", timeout: 1, capacity: 0, capacity_warn_only: false, debounce_window: 0, scan_intent: "" as const, archived: false};
         setLocations(prevState => [...prevState, newLocation]);
         return newLocation
     }
@@ -23,7 +23,7 @@ export function CreateStudentDialogue({isOpen, handleClose}: { isOpen: boolean,
         className="pb-0"
     >
         <StudentEdit
-            student={{name: "", email: "", id: "", student_handles: [""]}}
+            student={{name: "", email: "", id: "", external_id: "", student_handles: [""], archived: false}}
             onSubmit={onSubmit}
             heading={<H2>Create Student</H2>}
             submitButtonText="Create"
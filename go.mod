@@ -7,6 +7,7 @@ require (
 	github.com/gin-contrib/static v0.0.0-20200916080430-d45d9a37d28e
 	github.com/gin-gonic/gin v1.6.3
 	github.com/sirupsen/logrus v1.4.2
-	github.com/stretchr/testify v1.4.0
-	go.mongodb.org/mongo-driver v1.4.1
+	github.com/stretchr/testify v1.6.1
+	go.mongodb.org/mongo-driver v1.5.4
+	golang.org/x/crypto v0.0.0-20200302210943-78000ba7a073
 )
@@ -1,13 +1,15 @@
 package api
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/gin-contrib/static"
 	"github.com/gin-gonic/gin"
-	"github.com/sirupsen/logrus"
-	"os"
+	"trace/pkg/auth"
 	"trace/pkg/controllers"
 	"trace/pkg/database"
+	"trace/pkg/trace"
 )
 
 const frontendDirectory = "frontend/build"
@@ -20,47 +22,104 @@ func Listen(addr string, config *Config) error {
 
 	GlobalConfig = config
 
+	if err := config.ExposureRules.Validate(); err != nil {
+		return fmt.Errorf("invalid exposure rules: %w", err)
+	}
+	trace.Rules = config.ExposureRules
+
+	if err := config.Retention.Validate(); err != nil {
+		return err
+	}
+	trace.Retention = config.Retention
+
+	if err := auth.BootstrapAdmin(context.Background(), config.Username, config.Password); err != nil {
+		return fmt.Errorf("could not create the first admin: %w", err)
+	}
+
 	r := gin.Default()
 
 	r.Use(gin.Recovery())
 
-	username := os.Getenv("USERNAME")
-	password := os.Getenv("PASSWORD")
+	// every request needs a user. Each route group below only allows some roles,
+	// and admins are allowed everywhere
+	r.Use(controllers.Authenticate)
 
-	if username != "" && password != "" {
-		logrus.WithFields(logrus.Fields{
-			"username": username,
-			"password": password,
-		}).Debugf("Enabling authentication")
-
-		r.Use(gin.BasicAuth(gin.Accounts{
-			username: password,
-		}))
-	}
+	kiosk := database.RoleKiosk
+	staff := database.RoleStaff
+	admin := database.RoleAdmin
+	healthOfficer := database.RoleHealthOfficer
 
 	api := r.Group("/api")
 
-	api.POST("scan", controllers.OnScan)
-
-	api.POST("location", controllers.CreateLocation)
-	api.GET("location", controllers.GetLocations)
-	api.GET("location/:id", controllers.GetLocationByID)
-	api.GET("location/:id/students", controllers.GetStudentsAtLocation)
-	api.DELETE("location/:id", controllers.DeleteLocation)
-	api.PATCH("location/:id", controllers.UpdateLocation)
-	api.GET("location/:id/visits", controllers.VisitedLocationToday)
-	api.POST("location/:id/logoutAll", controllers.LogoutAllStudentsAtLocation)
-
-	api.POST("student", controllers.CreateStudent)
-	api.POST("students", controllers.CreateStudents)
-	api.GET("student", controllers.GetStudents)
-	api.GET("student/:id", controllers.GetStudentByID)
-	api.GET("student/:id/location", controllers.GetStudentLocation)
-	api.DELETE("student/:id", controllers.DeleteStudent)
-	api.PATCH("student/:id", controllers.UpdateStudent)
-	api.POST("student/:id/logout", controllers.LogoutStudent)
-
-	api.POST("trace/:id", controllers.GenerateContactReport)
+	api.GET("me", controllers.GetCurrentUser)
+	api.GET("device/me", controllers.GetCurrentDevice)
+
+	// kiosks scan students in and out of their location. Devices can only scan at theirs
+	scans := api.Group("", controllers.RequireRoleOrDevice(kiosk, staff))
+	scans.POST("scan", controllers.OnScan)
+	scans.POST("scan/batch", controllers.OnScanBatch)
+
+	// everyone needs to see the locations and students
+	view := api.Group("", controllers.RequireRole(kiosk, staff, healthOfficer))
+	view.GET("location", controllers.GetLocations)
+	view.GET("location/:id", controllers.GetLocationByID)
+
+	// staff see who is at each location and log students out
+	occupancy := api.Group("", controllers.RequireRole(staff, healthOfficer))
+	occupancy.GET("location/:id/students", controllers.GetStudentsAtLocation)
+	occupancy.GET("location/:id/stream", controllers.LocationStream)
+	occupancy.GET("location/:id/visits", controllers.VisitedLocationToday)
+	occupancy.GET("location/:id/stats", controllers.GetLocationStats)
+	occupancy.GET("student", controllers.GetStudents)
+	occupancy.GET("student/:id", controllers.GetStudentByID)
+	occupancy.GET("student/:id/location", controllers.GetStudentLocation)
+	occupancy.GET("student/:id/timeline", controllers.GetStudentTimeline)
+	occupancy.GET("stream", controllers.Stream)
+
+	logout := api.Group("", controllers.RequireRole(staff))
+	logout.POST("location/:id/logoutAll", controllers.LogoutAllStudentsAtLocation)
+	logout.POST("student/:id/logout", controllers.LogoutStudent)
+
+	// staff correct events when a kiosk was wrong or a student didn't scan
+	corrections := api.Group("", controllers.RequireRole(staff))
+	corrections.GET("event", controllers.GetEvents)
+	corrections.GET("event/:id", controllers.GetEventByID)
+	corrections.POST("event", controllers.CreateManualEvent)
+	corrections.POST("event/:id/void", controllers.VoidEvent)
+	corrections.POST("event/:id/move", controllers.MoveEvent)
+
+	// health officers run contact reports
+	tracing := api.Group("", controllers.RequireRole(healthOfficer))
+	tracing.POST("trace/:id", controllers.GenerateContactReport)
+
+	// admins manage students, locations, users and devices and read the audit log
+	manage := api.Group("", controllers.RequireRole(admin))
+	manage.POST("location", controllers.CreateLocation)
+	manage.DELETE("location/:id", controllers.DeleteLocation)
+	manage.PATCH("location/:id", controllers.UpdateLocation)
+	manage.POST("location/:id/restore", controllers.RestoreLocation)
+	manage.POST("student", controllers.CreateStudent)
+	manage.POST("students", controllers.CreateStudents)
+	manage.POST("students/import", controllers.ImportRoster)
+	manage.DELETE("student/:id", controllers.DeleteStudent)
+	manage.PATCH("student/:id", controllers.UpdateStudent)
+	manage.POST("student/:id/restore", controllers.RestoreStudent)
+	manage.GET("student/:id/export", controllers.ExportStudent)
+	manage.POST("student/:id/erase", controllers.EraseStudent)
+	manage.GET("user", controllers.GetUsers)
+	manage.POST("user", controllers.CreateUser)
+	manage.GET("user/:id", controllers.GetUserByID)
+	manage.PATCH("user/:id", controllers.UpdateUser)
+	manage.DELETE("user/:id", controllers.DeleteUser)
+	manage.GET("device", controllers.GetDevices)
+	manage.POST("device", controllers.RegisterDevice)
+	manage.GET("device/:id", controllers.GetDeviceByID)
+	manage.PATCH("device/:id", controllers.UpdateDevice)
+	manage.POST("device/:id/revoke", controllers.RevokeDevice)
+	manage.DELETE("device/:id", controllers.DeleteDevice)
+	manage.GET("audit", controllers.GetAuditEntries)
+	manage.GET("retention", controllers.GetRetention)
+	manage.POST("retention/run", controllers.RunRetention)
 
 	// Serve React frontend
 	r.Use(static.Serve("/", static.LocalFile("frontend/build", false)))
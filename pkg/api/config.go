@@ -7,6 +7,7 @@ import (
 	"os"
 	"time"
 	"trace/pkg/database"
+	"trace/pkg/trace"
 )
 
 type Config struct {
@@ -16,7 +17,13 @@ type Config struct {
 	// TODO: Make this per location?
 	Timeout time.Duration `json:"timeout"`
 
-	// The Username and Password to login to the website
+	// The rules used to decide how risky each contact in a contact report is
+	ExposureRules trace.ExposureRules `json:"exposure_rules"`
+
+	// How long the history of where students were is kept. Events are kept forever by default
+	Retention trace.RetentionPolicy `json:"retention"`
+
+	// The Username and Password of the admin that is created if there are no users
 	Username string `json:"username"`
 	Password string `json:"password"`
 }
@@ -25,7 +32,8 @@ type Config struct {
 var GlobalConfig *Config
 
 var DefaultConfig = Config{
-	Timeout: 3 * time.Hour,
+	Timeout:       3 * time.Hour,
+	ExposureRules: trace.DefaultExposureRules,
 }
 
 // LoadConfig loads a config from filename. If the file does not exist,
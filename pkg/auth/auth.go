@@ -0,0 +1,206 @@
+// auth manages the user accounts that can log in to the API
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+	"trace/pkg/database"
+)
+
+// the shortest password a user can have
+const minPasswordLength = 8
+
+var (
+	// ErrInvalidCredentials is returned by Authenticate when the username or password is wrong
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	// ErrInvalidUser is returned when a user can't be created or updated because a field is invalid
+	ErrInvalidUser = errors.New("invalid user")
+	// ErrLastAdmin is returned when a change would leave nobody who can manage users
+	ErrLastAdmin = errors.New("there must be at least one admin")
+)
+
+// dummyHash is compared against when a user doesn't exist so it takes
+// the same time as when they do
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+// Authenticate returns the user with username if password is their password.
+// Otherwise, the error will be ErrInvalidCredentials. Passwords that were checked
+// recently are remembered, see credentialCache.
+func Authenticate(ctx context.Context, username string, password string) (database.User, error) {
+	key := credentials.key(username, password)
+	if user, found, err := credentials.lookup(ctx, key, username); err != nil || found {
+		return user, err
+	}
+
+	user, err := database.DB.GetUserByUsername(ctx, username)
+	if errors.Is(err, database.ErrNotFound) {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return database.User{}, ErrInvalidCredentials
+	} else if err != nil {
+		return database.User{}, err
+	}
+
+	if err := bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(password)); err != nil {
+		return database.User{}, ErrInvalidCredentials
+	}
+
+	credentials.remember(key, user)
+	return user, nil
+}
+
+// invalidUserf creates an error that wraps ErrInvalidUser with a formatted message
+func invalidUserf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s: %w", fmt.Sprintf(format, args...), ErrInvalidUser)
+}
+
+// setFields validates the fields of a user and sets them. If password is
+// empty, the password will not be changed.
+func setFields(ctx context.Context, user *database.User, username string, password string, roles []database.Role) error {
+	if username == "" {
+		return invalidUserf("no username specified")
+	}
+	if len(roles) == 0 {
+		return invalidUserf("no roles specified")
+	}
+	for _, role := range roles {
+		if !role.Valid() {
+			return invalidUserf("invalid role %s", role)
+		}
+	}
+
+	// check that nobody else has the username
+	existing, err := database.DB.GetUserByUsername(ctx, username)
+	if err == nil && existing.ID != user.ID {
+		return &database.Error{Kind: database.ErrDuplicateUsername, Message: fmt.Sprintf("username %s is already in use", username)}
+	} else if err != nil && !errors.Is(err, database.ErrNotFound) {
+		return err
+	}
+
+	if password != "" || len(user.PasswordHash) == 0 {
+		if len(password) < minPasswordLength {
+			return invalidUserf("passwords must be at least %d characters", minPasswordLength)
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		user.PasswordHash = hash
+	}
+
+	user.Username = username
+	user.Roles = roles
+	return nil
+}
+
+// CreateUser creates a user with a hashed password
+func CreateUser(ctx context.Context, username string, password string, roles []database.Role) (database.User, error) {
+	var user database.User
+	if err := setFields(ctx, &user, username, password, roles); err != nil {
+		return database.User{}, err
+	}
+
+	if err := database.DB.CreateUser(ctx, &user); err != nil {
+		return database.User{}, err
+	}
+
+	return user, nil
+}
+
+// UpdateUser updates the username, password and roles of a user. If password is
+// empty, the password will not be changed.
+func UpdateUser(ctx context.Context, id primitive.ObjectID, username string, password string, roles []database.Role) (database.User, error) {
+	user, err := database.DB.GetUserByID(ctx, id)
+	if err != nil {
+		return database.User{}, err
+	}
+
+	wasAdmin := user.HasRole(database.RoleAdmin)
+	if err := setFields(ctx, &user, username, password, roles); err != nil {
+		return database.User{}, err
+	}
+	if wasAdmin && !user.HasRole(database.RoleAdmin) {
+		if err := checkNotLastAdmin(ctx, id); err != nil {
+			return database.User{}, err
+		}
+	}
+
+	if err := database.DB.UpdateUser(ctx, id, &user); err != nil {
+		return database.User{}, err
+	}
+
+	return user, nil
+}
+
+// DeleteUser deletes a user unless they are the last admin
+func DeleteUser(ctx context.Context, id primitive.ObjectID) error {
+	user, err := database.DB.GetUserByID(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if user.HasRole(database.RoleAdmin) {
+		if err := checkNotLastAdmin(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	return database.DB.DeleteUser(ctx, id)
+}
+
+// checkNotLastAdmin returns ErrLastAdmin if the user with id is the only admin
+func checkNotLastAdmin(ctx context.Context, id primitive.ObjectID) error {
+	users, err := database.DB.GetUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if user.ID != id && user.HasRole(database.RoleAdmin) {
+			return nil
+		}
+	}
+	return ErrLastAdmin
+}
+
+// the username of the admin created by BootstrapAdmin if none was specified
+const defaultAdminUsername = "admin"
+
+// BootstrapAdmin creates an admin with username and password if there are no users,
+// so there is always someone who can create the other users. If they are empty, the
+// admin is called admin and has a random password, which is only logged once.
+func BootstrapAdmin(ctx context.Context, username string, password string) error {
+	users, err := database.DB.GetUsers(ctx)
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return nil
+	}
+
+	generated := username == "" || password == ""
+	if generated {
+		passwordBytes := make([]byte, 12)
+		if _, err := rand.Read(passwordBytes); err != nil {
+			return err
+		}
+		username, password = defaultAdminUsername, hex.EncodeToString(passwordBytes)
+	}
+
+	if _, err := CreateUser(ctx, username, password, []database.Role{database.RoleAdmin}); err != nil {
+		return err
+	}
+
+	if generated {
+		log.Warnf("No admin was specified, so an admin was created with the username %s and the password %s. "+
+			"It won't be shown again, so log in and change it now", username, password)
+	} else {
+		log.WithField("username", username).Infof("Created the first admin")
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"trace/pkg/database"
+)
+
+func TestAuthenticate(t *testing.T) {
+	database.DB = database.NewMemoryStore()
+	ctx := context.Background()
+
+	user, err := CreateUser(ctx, "nurse", "correct horse", []database.Role{database.RoleHealthOfficer})
+	assert.NoError(t, err)
+	assert.NotEqual(t, []byte("correct horse"), user.PasswordHash, "passwords are hashed")
+
+	authenticated, err := Authenticate(ctx, "nurse", "correct horse")
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, authenticated.ID)
+
+	_, err = Authenticate(ctx, "nurse", "wrong password")
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+	_, err = Authenticate(ctx, "nobody", "correct horse")
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+
+	_, err = CreateUser(ctx, "nurse", "another password", []database.Role{database.RoleStaff})
+	assert.True(t, errors.Is(err, database.ErrDuplicateUsername))
+	_, err = CreateUser(ctx, "kiosk", "short", []database.Role{database.RoleKiosk})
+	assert.True(t, errors.Is(err, ErrInvalidUser))
+	_, err = CreateUser(ctx, "kiosk", "long enough", []database.Role{"janitor"})
+	assert.True(t, errors.Is(err, ErrInvalidUser))
+
+	// changing the roles doesn't change the password
+	_, err = UpdateUser(ctx, user.ID, "nurse", "", []database.Role{database.RoleStaff})
+	assert.NoError(t, err)
+	authenticated, err = Authenticate(ctx, "nurse", "correct horse")
+	assert.NoError(t, err)
+	assert.Equal(t, []database.Role{database.RoleStaff}, authenticated.Roles)
+
+	// the remembered password stops working when it is changed
+	_, err = UpdateUser(ctx, user.ID, "nurse", "battery staple", []database.Role{database.RoleStaff})
+	assert.NoError(t, err)
+	_, err = Authenticate(ctx, "nurse", "correct horse")
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+	_, err = Authenticate(ctx, "nurse", "battery staple")
+	assert.NoError(t, err)
+}
+
+func TestLastAdmin(t *testing.T) {
+	database.DB = database.NewMemoryStore()
+	ctx := context.Background()
+
+	assert.NoError(t, BootstrapAdmin(ctx, "admin", "password"))
+	assert.NoError(t, BootstrapAdmin(ctx, "other", "password"), "the admin is only created if there are no users")
+	users, _ := database.DB.GetUsers(ctx)
+	if !assert.Len(t, users, 1) {
+		return
+	}
+	admin := users[0]
+	assert.True(t, admin.HasRole(database.RoleHealthOfficer), "admins have every role")
+
+	_, err := UpdateUser(ctx, admin.ID, "admin", "", []database.Role{database.RoleStaff})
+	assert.True(t, errors.Is(err, ErrLastAdmin))
+	assert.True(t, errors.Is(DeleteUser(ctx, admin.ID), ErrLastAdmin))
+
+	_, err = CreateUser(ctx, "second", "password", []database.Role{database.RoleAdmin})
+	assert.NoError(t, err)
+	assert.NoError(t, DeleteUser(ctx, admin.ID))
+
+	// an admin is created even if no username and password were specified
+	database.DB = database.NewMemoryStore()
+	assert.NoError(t, BootstrapAdmin(ctx, "", ""))
+	users, _ = database.DB.GetUsers(ctx)
+	if assert.Len(t, users, 1) {
+		assert.Equal(t, defaultAdminUsername, users[0].Username)
+		assert.True(t, users[0].HasRole(database.RoleAdmin))
+	}
+}
+
+func TestDeviceToken(t *testing.T) {
+	database.DB = database.NewMemoryStore()
+	ctx := context.Background()
+
+	location := database.Location{Name: "Library"}
+	assert.NoError(t, database.DB.CreateLocation(ctx, &location))
+
+	_, _, err := RegisterDevice(ctx, "", location.Ref())
+	assert.True(t, errors.Is(err, ErrInvalidDevice))
+
+	device, token, err := RegisterDevice(ctx, "Library kiosk", location.Ref())
+	assert.NoError(t, err)
+	assert.NotEqual(t, []byte(token), device.TokenHash, "tokens are hashed")
+
+	authenticated, err := AuthenticateDevice(ctx, token)
+	assert.NoError(t, err)
+	assert.Equal(t, device.ID, authenticated.ID)
+	assert.False(t, authenticated.LastSeen.IsZero())
+
+	_, err = AuthenticateDevice(ctx, "not a token")
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+
+	_, err = RevokeDevice(ctx, device.ID)
+	assert.NoError(t, err)
+	_, err = AuthenticateDevice(ctx, token)
+	assert.True(t, errors.Is(err, ErrInvalidCredentials), "revoked tokens can't be used")
+}
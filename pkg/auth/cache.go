@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sync"
+	"time"
+	"trace/pkg/database"
+)
+
+const (
+	// how long a username and password are remembered after they are checked. Browsers
+	// send them with every request, and bcrypt is too slow to run every time.
+	credentialCacheTTL = 5 * time.Minute
+	// the most credentials that are remembered at once
+	maxCachedCredentials = 10000
+)
+
+// credentials are the usernames and passwords that were checked recently
+var credentials = newCredentialCache()
+
+// A credentialCache remembers which user a username and password belong to. The passwords
+// aren't stored, only an HMAC of them with a key that is made when the server starts.
+type credentialCache struct {
+	secret []byte
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]cachedCredential
+}
+
+type cachedCredential struct {
+	user primitive.ObjectID
+	// passwordHash is the hash the password was checked against, so the
+	// credential is forgotten when the password changes
+	passwordHash []byte
+	expires      time.Time
+}
+
+func newCredentialCache() *credentialCache {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return &credentialCache{secret: secret, entries: make(map[[sha256.Size]byte]cachedCredential)}
+}
+
+// key returns the key a username and password are remembered by
+func (cache *credentialCache) key(username string, password string) [sha256.Size]byte {
+	mac := hmac.New(sha256.New, cache.secret)
+	mac.Write([]byte(username))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+
+	var key [sha256.Size]byte
+	copy(key[:], mac.Sum(nil))
+	return key
+}
+
+// lookup returns the user that was remembered with key if they still have the same username
+// and password. found is false if the credentials have to be checked again.
+func (cache *credentialCache) lookup(ctx context.Context, key [sha256.Size]byte, username string) (user database.User, found bool, err error) {
+	cache.mu.Lock()
+	entry, found := cache.entries[key]
+	cache.mu.Unlock()
+	if !found || time.Now().After(entry.expires) {
+		return database.User{}, false, nil
+	}
+
+	user, err = database.DB.GetUserByID(ctx, entry.user)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		return database.User{}, false, err
+	}
+	if err != nil || user.Username != username || !bytes.Equal(user.PasswordHash, entry.passwordHash) {
+		cache.forget(key)
+		return database.User{}, false, nil
+	}
+	return user, true, nil
+}
+
+// remember remembers that key belongs to user
+func (cache *credentialCache) remember(key [sha256.Size]byte, user database.User) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	now := time.Now()
+	if len(cache.entries) >= maxCachedCredentials {
+		for k, entry := range cache.entries {
+			if now.After(entry.expires) {
+				delete(cache.entries, k)
+			}
+		}
+		if len(cache.entries) >= maxCachedCredentials {
+			return
+		}
+	}
+
+	cache.entries[key] = cachedCredential{user: user.ID, passwordHash: user.PasswordHash, expires: now.Add(credentialCacheTTL)}
+}
+
+// forget forgets the credentials with key
+func (cache *credentialCache) forget(key [sha256.Size]byte) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	delete(cache.entries, key)
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+	"trace/pkg/database"
+)
+
+// the number of random bytes in a device token
+const deviceTokenBytes = 32
+
+// LastSeen is only updated this often so devices don't write to the database on every request
+const lastSeenInterval = time.Minute
+
+// ErrInvalidDevice is returned when a device can't be registered because a field is invalid
+var ErrInvalidDevice = errors.New("invalid device")
+
+// hashToken returns the SHA-256 hash of a device token. Tokens are random, so they
+// don't need a slow hash like passwords do.
+func hashToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// RegisterDevice creates a device for a kiosk at location and returns it with its token.
+// The token is only returned here, so it has to be given to the kiosk right away.
+func RegisterDevice(ctx context.Context, name string, location database.LocationRef) (database.Device, string, error) {
+	if name == "" {
+		return database.Device{}, "", fmt.Errorf("no device name specified: %w", ErrInvalidDevice)
+	}
+	if _, err := location.Get(ctx); err != nil {
+		return database.Device{}, "", err
+	}
+
+	tokenBytes := make([]byte, deviceTokenBytes)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return database.Device{}, "", err
+	}
+	token := hex.EncodeToString(tokenBytes)
+
+	device := database.Device{
+		Name:      name,
+		Location:  location,
+		TokenHash: hashToken(token),
+		CreatedAt: time.Now(),
+	}
+	if err := database.DB.CreateDevice(ctx, &device); err != nil {
+		return database.Device{}, "", err
+	}
+
+	log.WithFields(log.Fields{"name": name, "id": device.ID.Hex()}).Infof("Registered a device")
+	return device, token, nil
+}
+
+// AuthenticateDevice returns the device with token. If there isn't one or
+// it was revoked, the error will be ErrInvalidCredentials
+func AuthenticateDevice(ctx context.Context, token string) (database.Device, error) {
+	device, err := database.DB.GetDeviceByTokenHash(ctx, hashToken(token))
+	if errors.Is(err, database.ErrNotFound) {
+		return database.Device{}, ErrInvalidCredentials
+	} else if err != nil {
+		return database.Device{}, err
+	}
+
+	if device.Revoked {
+		return database.Device{}, ErrInvalidCredentials
+	}
+
+	now := time.Now()
+	if now.Sub(device.LastSeen) > lastSeenInterval {
+		if err := database.DB.SetDeviceLastSeen(ctx, device.ID, now); err != nil {
+			return database.Device{}, err
+		}
+		device.LastSeen = now
+	}
+
+	return device, nil
+}
+
+// RevokeDevice stops a device from logging in
+func RevokeDevice(ctx context.Context, id primitive.ObjectID) (database.Device, error) {
+	device, err := database.DB.GetDeviceByID(ctx, id)
+	if err != nil {
+		return database.Device{}, err
+	}
+
+	device.Revoked = true
+	if err := database.DB.UpdateDevice(ctx, id, &device); err != nil {
+		return database.Device{}, err
+	}
+
+	log.WithFields(log.Fields{"name": device.Name, "id": device.ID.Hex()}).Infof("Revoked a device")
+	return device, nil
+}
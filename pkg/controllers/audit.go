@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"strconv"
+	"time"
+	"trace/pkg/database"
+)
+
+// the number of audit entries returned if no limit is requested, and the most that can be
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// recordAudit adds entry to the audit log with the logged in user or device and the
+// request filled in. before and after are snapshots of the target, which should be
+// nil if it didn't exist before or after the action. Failing to write the entry
+// doesn't fail the request since the action has already been done, so it is logged instead.
+func recordAudit(c *gin.Context, entry database.AuditEntry, before interface{}, after interface{}) {
+	entry.Time = time.Now()
+	if user, found := CurrentUser(c); found {
+		entry.ActorID = user.ID
+		entry.Actor = user.Username
+	} else if device, found := CurrentDevice(c); found {
+		entry.ActorID = device.ID
+		entry.Actor = device.Name
+	}
+	entry.Request = database.AuditRequest{
+		Method:    c.Request.Method,
+		Path:      c.Request.URL.Path,
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	}
+	entry.Before = auditSnapshot(before)
+	entry.After = auditSnapshot(after)
+
+	// the entry is written even if the client has gone away
+	if err := database.DB.CreateAuditEntry(context.Background(), &entry); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"action": entry.Action,
+			"actor":  entry.Actor,
+		}).Errorf("Failed to write audit entry: %s", err)
+	}
+}
+
+// auditSnapshot returns the JSON of obj, or nil if obj is nil or can't be marshalled
+func auditSnapshot(obj interface{}) json.RawMessage {
+	if obj == nil {
+		return nil
+	}
+	snapshot, err := json.Marshal(obj)
+	if err != nil {
+		logrus.Warnf("Failed to snapshot %T for the audit log: %s", obj, err)
+		return nil
+	}
+	return snapshot
+}
+
+// GET /api/audit
+// Returns the audit log from latest to earliest. The entries can be filtered with the
+// actor_id, action and target_id query parameters and the from and to unix times.
+// At most limit entries are returned.
+func GetAuditEntries(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	filter := database.AuditFilter{
+		Action: database.AuditAction(c.Query("action")),
+		Limit:  defaultAuditLimit,
+	}
+
+	var err error
+	if filter.ActorID, err = queryObjectID(c, "actor_id"); err != nil {
+		Errorf(c, http.StatusUnprocessableEntity, "invalid actor_id: %s", err)
+		return
+	}
+	if filter.TargetID, err = queryObjectID(c, "target_id"); err != nil {
+		Errorf(c, http.StatusUnprocessableEntity, "invalid target_id: %s", err)
+		return
+	}
+	if filter.From, err = queryUnixTime(c, "from"); err != nil {
+		Errorf(c, http.StatusUnprocessableEntity, "invalid from time: %s", err)
+		return
+	}
+	if filter.To, err = queryUnixTime(c, "to"); err != nil {
+		Errorf(c, http.StatusUnprocessableEntity, "invalid to time: %s", err)
+		return
+	}
+	if limit := c.Query("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit < 1 || filter.Limit > maxAuditLimit {
+			Errorf(c, http.StatusUnprocessableEntity, "limit must be between 1 and %d", maxAuditLimit)
+			return
+		}
+	}
+
+	entries, err := database.DB.GetAuditEntries(ctx, filter)
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+	Success(c, http.StatusOK, entries)
+}
+
+// queryObjectID parses the query parameter key as an ObjectID. If it
+// isn't in the query, the zero ObjectID is returned
+func queryObjectID(c *gin.Context, key string) (primitive.ObjectID, error) {
+	value := c.Query(key)
+	if value == "" {
+		return primitive.NilObjectID, nil
+	}
+	return primitive.ObjectIDFromHex(value)
+}
+
+// queryUnixTime parses the query parameter key as a unix time in seconds. If it
+// isn't in the query, the zero time is returned
+func queryUnixTime(c *gin.Context, key string) (time.Time, error) {
+	value := c.Query(key)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(seconds, 0), nil
+}
@@ -0,0 +1,184 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"trace/pkg/auth"
+	"trace/pkg/database"
+)
+
+// the keys the logged in user or device are stored at in the gin context
+const (
+	userKey   = "user"
+	deviceKey = "device"
+)
+
+// the number of times a client can fail to log in within failedLoginWindow before its
+// logins are refused without being checked, so it can't use up the CPU guessing passwords
+const (
+	maxFailedLogins   = 10
+	failedLoginWindow = time.Minute
+)
+
+// failedLogins counts the failed logins of each client IP
+var failedLogins = newLoginLimiter()
+
+// A loginLimiter counts the failed logins of each client in fixed windows of failedLoginWindow
+type loginLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*failedLoginCount
+}
+
+type failedLoginCount struct {
+	count       int
+	windowStart time.Time
+}
+
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{clients: make(map[string]*failedLoginCount)}
+}
+
+// blocked returns true if client failed to log in too many times in the current window
+func (limiter *loginLimiter) blocked(client string) bool {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	failures, found := limiter.clients[client]
+	return found && time.Since(failures.windowStart) < failedLoginWindow && failures.count >= maxFailedLogins
+}
+
+// fail records a failed login by client
+func (limiter *loginLimiter) fail(client string) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := time.Now()
+	failures, found := limiter.clients[client]
+	if !found || now.Sub(failures.windowStart) >= failedLoginWindow {
+		// forget the clients whose windows ended so the map doesn't grow forever
+		for other, otherFailures := range limiter.clients {
+			if now.Sub(otherFailures.windowStart) >= failedLoginWindow {
+				delete(limiter.clients, other)
+			}
+		}
+		failures = &failedLoginCount{windowStart: now}
+		limiter.clients[client] = failures
+	}
+	failures.count++
+}
+
+// Authenticate is middleware that logs in the user using HTTP basic authentication,
+// or the device if the request has a bearer token. If the request doesn't have a
+// valid username and password or token, it is aborted with 401 Unauthorized so
+// the browser asks for them. Clients that fail to log in too many times are refused
+// with 429 Too Many Requests until failedLoginWindow has passed.
+func Authenticate(c *gin.Context) {
+	if failedLogins.blocked(c.ClientIP()) {
+		c.Header("Retry-After", strconv.Itoa(int(failedLoginWindow.Seconds())))
+		Errorf(c, http.StatusTooManyRequests, "too many failed logins, try again later")
+		return
+	}
+
+	if token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "); token != c.GetHeader("Authorization") {
+		authenticateDevice(c, token)
+		return
+	}
+
+	username, password, ok := c.Request.BasicAuth()
+	if !ok {
+		unauthorized(c, errors.New("authentication required"))
+		return
+	}
+
+	user, err := auth.Authenticate(c.Request.Context(), username, password)
+	if errors.Is(err, auth.ErrInvalidCredentials) {
+		failedLogins.fail(c.ClientIP())
+		unauthorized(c, err)
+		return
+	} else if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	c.Set(userKey, user)
+	c.Next()
+}
+
+// authenticateDevice logs in the device with token
+func authenticateDevice(c *gin.Context, token string) {
+	device, err := auth.AuthenticateDevice(c.Request.Context(), token)
+	if errors.Is(err, auth.ErrInvalidCredentials) {
+		failedLogins.fail(c.ClientIP())
+		Errorf(c, http.StatusUnauthorized, "invalid or revoked device token")
+		return
+	} else if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	c.Set(deviceKey, device)
+	c.Next()
+}
+
+// unauthorized asks the client to authenticate
+func unauthorized(c *gin.Context, err error) {
+	c.Header("WWW-Authenticate", `Basic realm="trace"`)
+	Error(c, http.StatusUnauthorized, err)
+}
+
+// CurrentUser returns the user that was logged in by Authenticate
+func CurrentUser(c *gin.Context) (database.User, bool) {
+	user, found := c.Get(userKey)
+	if !found {
+		return database.User{}, false
+	}
+	return user.(database.User), true
+}
+
+// CurrentDevice returns the device that was logged in by Authenticate
+func CurrentDevice(c *gin.Context) (database.Device, bool) {
+	device, found := c.Get(deviceKey)
+	if !found {
+		return database.Device{}, false
+	}
+	return device.(database.Device), true
+}
+
+// RequireRoleOrDevice is RequireRole except devices are allowed too
+func RequireRoleOrDevice(roles ...database.Role) gin.HandlerFunc {
+	requireRole := RequireRole(roles...)
+	return func(c *gin.Context) {
+		if _, found := CurrentDevice(c); found {
+			c.Next()
+			return
+		}
+		requireRole(c)
+	}
+}
+
+// RequireRole returns middleware that only allows users with one of roles.
+// Admins are always allowed and devices never are. It must be used after Authenticate.
+func RequireRole(roles ...database.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if device, found := CurrentDevice(c); found {
+			Errorf(c, http.StatusForbidden, "device %s is only allowed to scan", device.Name)
+			return
+		}
+
+		user, found := CurrentUser(c)
+		if !found {
+			unauthorized(c, errors.New("authentication required"))
+			return
+		}
+		if !user.HasRole(roles...) {
+			Errorf(c, http.StatusForbidden, "user %s is not allowed to do this", user.Username)
+			return
+		}
+		c.Next()
+	}
+}
@@ -1,52 +1,212 @@
 package controllers
 
 import (
+	"errors"
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"net/http"
+	"sort"
 	"time"
 	"trace/pkg/database"
 	"trace/pkg/trace"
 )
 
+// the maximum depth that can be requested in a contact report
+const maxContactDepth = 5
+
+type exposure struct {
+	Student         database.Student `json:"student"`
+	SecondsTogether int              `json:"seconds_together"`
+}
+
+type contactOverlap struct {
+	Location  database.Location `json:"location"`
+	With      database.Student  `json:"with"`
+	StartTime int64             `json:"start_time"`
+	EndTime   int64             `json:"end_time"`
+}
+
 type contact struct {
 	Student         database.Student `json:"student"`
 	SecondsTogether int              `json:"seconds_together"`
+	// Depth is 1 for students who were in contact with the target student,
+	// 2 for students who were in contact with them, and so on
+	Depth int `json:"depth"`
+	// Risk is close, casual or none and ExposureSeconds is the weighted time used to decide it
+	Risk            trace.Risk       `json:"risk"`
+	ExposureSeconds int              `json:"exposure_seconds"`
+	Via             []exposure       `json:"via"`
+	Overlaps        []contactOverlap `json:"overlaps"`
 }
 
 type contactReport struct {
 	TargetStudent database.Student `json:"target_student"`
 	StartDate     int64            `json:"start_date"`
 	EndDate       int64            `json:"end_date"`
+	Depth         int              `json:"depth"`
+	MinRisk       trace.Risk       `json:"min_risk"`
 	Contacts      []contact        `json:"contacts"`
 }
 
 // GET /api/v1/trace/:id
 func GenerateContactReport(c *gin.Context) {
-	student, err := database.DB.GetStudentByIDString(c.Param("id"))
+	ctx := c.Request.Context()
+
+	student, err := database.DB.GetStudentByIDString(ctx, c.Param("id"))
 	if err != nil {
-		Error(c, http.StatusUnprocessableEntity, err)
+		DatabaseError(c, err)
 		return
 	}
 
 	scanRequest := struct {
 		StartTime int64 `json:"start_time"`
 		EndTime   int64 `json:"end_time"`
-	}{}
+		Depth     int   `json:"depth"`
+		// MinRisk filters out the contacts with a lower risk
+		MinRisk string `json:"min_risk"`
+	}{Depth: 1}
 
 	if !BindJSON(c, &scanRequest) {
 		return
 	}
 
-	report, err := trace.GenerateContactReport(&student, time.Unix(scanRequest.StartTime, 0), time.Unix(scanRequest.EndTime, 0), 1)
+	if scanRequest.Depth < 1 || scanRequest.Depth > maxContactDepth {
+		Errorf(c, http.StatusUnprocessableEntity, "depth must be between 1 and %d", maxContactDepth)
+		return
+	}
+
+	minRisk, err := trace.ParseRisk(scanRequest.MinRisk)
 	if err != nil {
-		Error(c, http.StatusInternalServerError, err)
+		Error(c, http.StatusUnprocessableEntity, err)
 		return
 	}
 
-	newReport := contactReport{TargetStudent: student, StartDate: scanRequest.StartTime, EndDate: scanRequest.EndTime}
-	for s, t := range report.Contacts[0] {
-		newReport.Contacts = append(newReport.Contacts, contact{Student: s.Get(), SecondsTogether: int(t.Seconds())})
+	report, err := trace.GenerateContactReport(ctx, &student, time.Unix(scanRequest.StartTime, 0), time.Unix(scanRequest.EndTime, 0), scanRequest.Depth, trace.Rules)
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	// every student in the report is looked up once
+	students := make(map[database.StudentRef]database.Student)
+	getStudent := func(ref database.StudentRef) (database.Student, error) {
+		if s, found := students[ref]; found {
+			return s, nil
+		}
+		s, err := ref.Get(ctx)
+		if errors.Is(err, database.ErrNotFound) {
+			// the student was deleted, but their events are still in the report
+			s = database.Student{ID: primitive.ObjectID(ref)}
+		} else if err != nil {
+			return database.Student{}, err
+		}
+		students[ref] = s
+		return s, nil
+	}
+	students[student.Ref()] = student
+
+	locations := make(map[database.LocationRef]database.Location)
+	getLocation := func(ref database.LocationRef) (database.Location, error) {
+		if l, found := locations[ref]; found {
+			return l, nil
+		}
+		l, err := ref.Get(ctx)
+		if errors.Is(err, database.ErrNotFound) {
+			l = database.Location{ID: primitive.ObjectID(ref)}
+		} else if err != nil {
+			return database.Location{}, err
+		}
+		locations[ref] = l
+		return l, nil
+	}
+
+	newReport := contactReport{
+		TargetStudent: student,
+		StartDate:     scanRequest.StartTime,
+		EndDate:       scanRequest.EndTime,
+		Depth:         scanRequest.Depth,
+		MinRisk:       minRisk,
+		Contacts:      make([]contact, 0),
+	}
+	for depth, contacts := range report.Contacts {
+		for s, reportContact := range contacts {
+			if !reportContact.Risk.AtLeast(minRisk) {
+				continue
+			}
+
+			contactStudent, err := getStudent(s)
+			if err != nil {
+				DatabaseError(c, err)
+				return
+			}
+
+			newContact := contact{
+				Student:         contactStudent,
+				SecondsTogether: int(reportContact.Duration.Seconds()),
+				Depth:           depth + 1,
+				Risk:            reportContact.Risk,
+				ExposureSeconds: int(reportContact.Exposure.Seconds()),
+				Via:             make([]exposure, 0, len(reportContact.Via)),
+			}
+			for via, t := range reportContact.Via {
+				viaStudent, err := getStudent(via)
+				if err != nil {
+					DatabaseError(c, err)
+					return
+				}
+				newContact.Via = append(newContact.Via, exposure{Student: viaStudent, SecondsTogether: int(t.Seconds())})
+			}
+			sort.Slice(newContact.Via, func(i, j int) bool {
+				return newContact.Via[i].SecondsTogether > newContact.Via[j].SecondsTogether
+			})
+
+			newContact.Overlaps = make([]contactOverlap, 0, len(reportContact.Overlaps))
+			for _, o := range reportContact.Overlaps {
+				location, err := getLocation(o.Location)
+				if err != nil {
+					DatabaseError(c, err)
+					return
+				}
+				source, err := getStudent(o.Source)
+				if err != nil {
+					DatabaseError(c, err)
+					return
+				}
+				newContact.Overlaps = append(newContact.Overlaps, contactOverlap{
+					Location:  location,
+					With:      source,
+					StartTime: o.Start.Unix(),
+					EndTime:   o.End.Unix(),
+				})
+			}
+
+			newReport.Contacts = append(newReport.Contacts, newContact)
+		}
+	}
+
+	// closest contacts first, then the ones who spent the most time together
+	sort.Slice(newReport.Contacts, func(i, j int) bool {
+		if newReport.Contacts[i].Depth != newReport.Contacts[j].Depth {
+			return newReport.Contacts[i].Depth < newReport.Contacts[j].Depth
+		}
+		return newReport.Contacts[i].SecondsTogether > newReport.Contacts[j].SecondsTogether
+	})
+
+	// the target and every contact so it can be found who has seen a student's contacts
+	targets := []primitive.ObjectID{student.ID}
+	for _, reportContact := range newReport.Contacts {
+		targets = append(targets, reportContact.Student.ID)
 	}
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditContactReport,
+		TargetIDs: targets,
+		Details: map[string]interface{}{
+			"start_time": scanRequest.StartTime,
+			"end_time":   scanRequest.EndTime,
+			"depth":      scanRequest.Depth,
+			"min_risk":   minRisk,
+		},
+	}, nil, nil)
 
 	Success(c, http.StatusOK, newReport)
 }
@@ -1,50 +1,40 @@
 package controllers
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"strings"
 	"testing"
 	"time"
+	"trace/pkg/auth"
 	"trace/pkg/database"
+	"trace/pkg/trace"
 )
 
-var TestDatabase *database.Database
+var TestDatabase *database.MemoryStore
 
 var TestStudent *database.Student
 var TestLocation *database.Location
 
 func init() {
-	logrus.SetLevel(logrus.TraceLevel)
-
-	var err error
-
-	// Get the mongo URI from env var
-	mongoURI, found := os.LookupEnv("TEST_MONGO_URI")
-	// Set it to localhost by default
-	if !found {
-		mongoURI = "mongodb://localhost"
-	}
+	ctx := context.Background()
 
-	TestDatabase, err = database.Connect(database.Config{
-		MongoURI:     mongoURI,
-		DatabaseName: "tests",
-	})
-
-	if err != nil {
-		logrus.Fatalf("Could not connect to database: %s", err)
-	}
+	logrus.SetLevel(logrus.TraceLevel)
 
-	// Purge the test database
-	_ = TestDatabase.Database.Drop(nil)
-	logrus.Infof("Purged the tests database")
+	TestDatabase = database.NewMemoryStore()
+	database.DB = TestDatabase
 
 	// Add an example student for the test
 	TestStudent = &database.Student{
@@ -52,13 +42,13 @@ func init() {
 		Email:          "baaron@gmail.com",
 		StudentHandles: []string{"testhandle"},
 	}
-	TestDatabase.CreateStudent(TestStudent)
+	TestDatabase.CreateStudent(ctx, TestStudent)
 
 	TestLocation = &database.Location{
 		Name:    "Library",
 		Timeout: 1 * time.Hour,
 	}
-	TestDatabase.CreateLocation(TestLocation)
+	TestDatabase.CreateLocation(ctx, TestLocation)
 }
 
 func sendTestRequest(handler func(ctx *gin.Context), json []byte) (code int, body []byte) {
@@ -79,7 +69,8 @@ func sendTestRequest(handler func(ctx *gin.Context), json []byte) (code int, bod
 }
 
 func TestOnScan(t *testing.T) {
-	// TODO: this doesn't pass
+	ctx := context.Background()
+
 	code, resp := sendTestRequest(OnScan, []byte(fmt.Sprintf(`
 {
 	"student_handle": "testhandle",
@@ -88,11 +79,438 @@ func TestOnScan(t *testing.T) {
 
 	assert.Equal(t, 201, code)
 
-	var createdEvent database.Event
-	assert.NoError(t, json.Unmarshal(resp, &createdEvent), "failed to unmarshal response")
+	// The refs in the event are serialized as objects, so only decode the fields we need
+	var body struct {
+		Data struct {
+			ID        primitive.ObjectID `json:"id"`
+			EventType database.EventType `json:"event_type"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(resp, &body), "failed to unmarshal response")
+	createdEvent := body.Data
 
-	mostRecentEvent, found := TestDatabase.GetMostRecentEvent(TestStudent.ID)
-	assert.Truef(t, found, "no event was created")
+	mostRecentEvent, err := TestDatabase.GetMostRecentEvent(ctx, TestStudent.Ref())
+	assert.NoError(t, err, "no event was created")
 	assert.Equalf(t, mostRecentEvent.ID, createdEvent.ID, "the returned event id %s did not match the most recent event id %s", createdEvent.ID, mostRecentEvent.ID)
-	assert.Equal(t, createdEvent.EventType, database.EventEnter, "incorrect event type %s was created", createdEvent.EventType)
+	assert.EqualValues(t, database.EventEnter, createdEvent.EventType, "incorrect event type %d was created", createdEvent.EventType)
+}
+
+func TestDatabaseError(t *testing.T) {
+	tests := map[error]int{
+		database.ErrNotFound:                             http.StatusNotFound,
+		database.ErrInvalidID:                            http.StatusUnprocessableEntity,
+		database.ErrDuplicateHandle:                      http.StatusConflict,
+		fmt.Errorf("query: %w", database.ErrUnavailable): http.StatusServiceUnavailable,
+		context.DeadlineExceeded:                         http.StatusServiceUnavailable,
+		errors.New("unexpected"):                         http.StatusInternalServerError,
+	}
+
+	for err, expectedCode := range tests {
+		code, resp := sendTestRequest(func(c *gin.Context) {
+			DatabaseError(c, err)
+		}, nil)
+
+		assert.Equalf(t, expectedCode, code, "wrong status code for error %s", err)
+
+		var body struct {
+			Success bool   `json:"success"`
+			Error   string `json:"error"`
+		}
+		assert.NoError(t, json.Unmarshal(resp, &body), "failed to unmarshal response")
+		assert.False(t, body.Success)
+		assert.NotEmpty(t, body.Error)
+	}
+}
+
+func TestGetStudentByIDNotFound(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request, _ = http.NewRequest("GET", "/", nil)
+	c.Params = gin.Params{{Key: "id", Value: primitive.NewObjectID().Hex()}}
+
+	GetStudentByID(c)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestLocationStream(t *testing.T) {
+	r := gin.New()
+	r.GET("/location/:id/stream", LocationStream)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/location/" + TestLocation.ID.Hex() + "/stream")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	reader := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		line, err := reader.ReadString('\n')
+		assert.NoError(t, err)
+		return strings.TrimSpace(line)
+	}
+
+	assert.Equal(t, "event:occupancy", readEvent())
+
+	// skip the rest of the occupancy event
+	for readEvent() != "" {
+	}
+
+	student := database.Student{Name: "Cai Noel", StudentHandles: []string{"streamhandle"}}
+	assert.NoError(t, TestDatabase.CreateStudent(context.Background(), &student))
+	event, userError, err := trace.HandleScan(context.Background(), TestLocation.Ref(), "streamhandle")
+	assert.NoError(t, err)
+	assert.NoError(t, userError)
+
+	assert.Equal(t, "event:enter", readEvent())
+	data := readEvent()
+	assert.Contains(t, data, `"occupancy":`)
+	assert.Contains(t, data, `"name":"Cai Noel"`)
+	assert.NotContains(t, data, "streamhandle", "the student's handles aren't sent to everyone watching the stream")
+	readEvent()
+
+	// corrections are streamed too
+	_, err = trace.VoidEvent(context.Background(), event.ID, "scanned by mistake", primitive.NilObjectID)
+	assert.NoError(t, err)
+	assert.Equal(t, "event:void", readEvent())
+	assert.Contains(t, readEvent(), `"occupancy":`)
+}
+
+func TestRequireRole(t *testing.T) {
+	database.DB = database.NewMemoryStore()
+	defer func() { database.DB = TestDatabase }()
+
+	ctx := context.Background()
+	_, err := auth.CreateUser(ctx, "kiosk", "kiosk password", []database.Role{database.RoleKiosk})
+	assert.NoError(t, err)
+	_, err = auth.CreateUser(ctx, "admin", "admin password", []database.Role{database.RoleAdmin})
+	assert.NoError(t, err)
+
+	r := gin.New()
+	r.Use(Authenticate)
+	r.GET("/staff", RequireRole(database.RoleStaff), func(c *gin.Context) {
+		Success(c, http.StatusOK, nil)
+	})
+
+	request := func(username string, password string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/staff", nil)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, request("", ""))
+	assert.Equal(t, http.StatusUnauthorized, request("kiosk", "wrong password"))
+	assert.Equal(t, http.StatusForbidden, request("kiosk", "kiosk password"))
+	assert.Equal(t, http.StatusOK, request("admin", "admin password"))
+}
+
+func TestFailedLoginLimit(t *testing.T) {
+	database.DB = database.NewMemoryStore()
+	failedLogins = newLoginLimiter()
+	defer func() {
+		database.DB = TestDatabase
+		failedLogins = newLoginLimiter()
+	}()
+
+	_, err := auth.CreateUser(context.Background(), "staff", "staff password", []database.Role{database.RoleStaff})
+	assert.NoError(t, err)
+
+	r := gin.New()
+	r.Use(Authenticate)
+	r.GET("/staff", RequireRole(database.RoleStaff), func(c *gin.Context) {
+		Success(c, http.StatusOK, nil)
+	})
+
+	request := func(password string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/staff", nil)
+		req.SetBasicAuth("staff", password)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for i := 0; i < maxFailedLogins; i++ {
+		assert.Equal(t, http.StatusUnauthorized, request("wrong password"))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, request("wrong password"))
+	assert.Equal(t, http.StatusTooManyRequests, request("staff password"), "the password isn't checked until the window ends")
+}
+
+func TestDeviceScan(t *testing.T) {
+	database.DB = database.NewMemoryStore()
+	defer func() { database.DB = TestDatabase }()
+
+	ctx := context.Background()
+	library := database.Location{Name: "Library", Timeout: time.Hour}
+	gym := database.Location{Name: "Gym", Timeout: time.Hour}
+	assert.NoError(t, database.DB.CreateLocation(ctx, &library))
+	assert.NoError(t, database.DB.CreateLocation(ctx, &gym))
+	student := database.Student{Name: "Ben Aaron", StudentHandles: []string{"devicehandle"}}
+	assert.NoError(t, database.DB.CreateStudent(ctx, &student))
+
+	_, token, err := auth.RegisterDevice(ctx, "Library kiosk", library.Ref())
+	assert.NoError(t, err)
+
+	r := gin.New()
+	r.Use(Authenticate)
+	r.POST("/scan", RequireRoleOrDevice(database.RoleKiosk), OnScan)
+	r.GET("/student", RequireRole(database.RoleStaff), GetStudents)
+
+	request := func(method string, url string, body string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusCreated, request("POST", "/scan", `{"student_handle":"devicehandle"}`), "devices scan at their location")
+	assert.Equal(t, http.StatusCreated, request("POST", "/scan", fmt.Sprintf(`{"location_id":"%s","student_handle":"devicehandle"}`, library.ID.Hex())))
+	assert.Equal(t, http.StatusForbidden, request("POST", "/scan", fmt.Sprintf(`{"location_id":"%s","student_handle":"devicehandle"}`, gym.ID.Hex())))
+	assert.Equal(t, http.StatusForbidden, request("GET", "/student", ""))
+
+	token = "not a token"
+	assert.Equal(t, http.StatusUnauthorized, request("POST", "/scan", `{"student_handle":"devicehandle"}`))
+}
+
+func TestAudit(t *testing.T) {
+	database.DB = database.NewMemoryStore()
+	defer func() { database.DB = TestDatabase }()
+
+	ctx := context.Background()
+	admin, err := auth.CreateUser(ctx, "admin", "admin password", []database.Role{database.RoleAdmin})
+	assert.NoError(t, err)
+	location := database.Location{Name: "Library", Timeout: time.Hour}
+	assert.NoError(t, database.DB.CreateLocation(ctx, &location))
+
+	r := gin.New()
+	r.Use(Authenticate)
+	r.PATCH("/location/:id", UpdateLocation)
+	r.GET("/audit", GetAuditEntries)
+
+	request := func(method string, url string, body string) (int, []byte) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.SetBasicAuth("admin", "admin password")
+		r.ServeHTTP(w, req)
+		return w.Code, w.Body.Bytes()
+	}
+
+	code, _ := request("PATCH", "/location/"+location.ID.Hex(), `{"name":"Gym"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code, "locations need a timeout")
+	code, _ = request("PATCH", "/location/"+location.ID.Hex(), `{"name":"Gym","timeout":3600000000000}`)
+	assert.Equal(t, http.StatusOK, code)
+
+	code, resp := request("GET", fmt.Sprintf("/audit?target_id=%s&action=location.update", location.ID.Hex()), "")
+	assert.Equal(t, http.StatusOK, code)
+	var body struct {
+		Data []struct {
+			ActorID primitive.ObjectID `json:"actor_id"`
+			Actor   string             `json:"actor"`
+			Request struct {
+				Method string `json:"method"`
+			} `json:"request"`
+			Before database.Location `json:"before"`
+			After  database.Location `json:"after"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(resp, &body))
+	if !assert.Len(t, body.Data, 1) {
+		return
+	}
+	entry := body.Data[0]
+	assert.Equal(t, admin.ID, entry.ActorID)
+	assert.Equal(t, "admin", entry.Actor)
+	assert.Equal(t, "PATCH", entry.Request.Method)
+	assert.Equal(t, "Library", entry.Before.Name)
+	assert.Equal(t, "Gym", entry.After.Name)
+
+	code, _ = request("GET", "/audit?target_id=nope", "")
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+}
+
+func TestExportStudentZip(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request, _ = http.NewRequest("GET", "/?format=zip", nil)
+	c.Params = gin.Params{{Key: "id", Value: TestStudent.ID.Hex()}}
+
+	ExportStudent(c)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if !assert.NoError(t, err) {
+		return
+	}
+	names := make([]string, 0)
+	for _, f := range archive.File {
+		names = append(names, f.Name)
+	}
+	assert.Equal(t, []string{"student.json", "events.json", "locations.json"}, names)
+}
+
+func TestDeleteStudent(t *testing.T) {
+	database.DB = database.NewMemoryStore()
+	defer func() { database.DB = TestDatabase }()
+
+	ctx := context.Background()
+	_, err := auth.CreateUser(ctx, "admin", "admin password", []database.Role{database.RoleAdmin})
+	assert.NoError(t, err)
+	location := database.Location{Name: "Library", Timeout: time.Hour}
+	assert.NoError(t, database.DB.CreateLocation(ctx, &location))
+	student := database.Student{Name: "Ben Aaron", StudentHandles: []string{"archivedhandle"}}
+	assert.NoError(t, database.DB.CreateStudent(ctx, &student))
+	event := database.Event{Location: location.Ref(), Student: student.Ref(), Time: time.Now(), EventType: database.EventEnter}
+	assert.NoError(t, database.DB.CreateEvent(ctx, &event))
+
+	r := gin.New()
+	r.Use(Authenticate)
+	r.GET("/student", GetStudents)
+	r.DELETE("/student/:id", DeleteStudent)
+	r.POST("/student/:id/restore", RestoreStudent)
+	r.POST("/scan", OnScan)
+
+	request := func(method string, url string, body string) (int, string) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.SetBasicAuth("admin", "admin password")
+		r.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+	scan := fmt.Sprintf(`{"location_id":"%s","student_handle":"archivedhandle"}`, location.ID.Hex())
+
+	// students are archived by default, so they are hidden and can't scan but their history is kept
+	code, _ := request("DELETE", "/student/"+student.ID.Hex(), "")
+	assert.Equal(t, http.StatusOK, code)
+	_, body := request("GET", "/student", "")
+	assert.NotContains(t, body, student.ID.Hex())
+	_, body = request("GET", "/student?archived=true", "")
+	assert.Contains(t, body, student.ID.Hex())
+	code, _ = request("POST", "/scan", scan)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	events, _ := database.DB.GetEventsByStudent(ctx, student.Ref())
+	assert.Len(t, events, 1)
+
+	code, _ = request("POST", "/student/"+student.ID.Hex()+"/restore", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = request("POST", "/scan", scan)
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, _ = request("DELETE", "/student/"+student.ID.Hex()+"?cascade=true", "")
+	assert.Equal(t, http.StatusOK, code)
+	events, _ = database.DB.GetEventsByStudent(ctx, student.Ref())
+	assert.Empty(t, events, "cascading deletes the events")
+
+	// refs to deleted students can still be marshalled
+	ref, err := json.Marshal(student.Ref())
+	assert.NoError(t, err)
+	assert.JSONEq(t, fmt.Sprintf(`{"id":"%s","deleted":true}`, student.ID.Hex()), string(ref))
+}
+
+func TestGetEvents(t *testing.T) {
+	database.DB = database.NewMemoryStore()
+	defer func() { database.DB = TestDatabase }()
+
+	ctx := context.Background()
+	_, err := auth.CreateUser(ctx, "staff", "staff password", []database.Role{database.RoleStaff})
+	assert.NoError(t, err)
+	student := database.Student{Name: "Ben Aaron"}
+	assert.NoError(t, database.DB.CreateStudent(ctx, &student))
+	baseTime := time.Now().Add(-time.Hour)
+	for i := 0; i < 3; i++ {
+		event := database.Event{Student: student.Ref(), Time: baseTime.Add(time.Duration(i) * time.Minute), EventType: database.EventEnter}
+		assert.NoError(t, database.DB.CreateEvent(ctx, &event))
+	}
+	assert.NoError(t, database.DB.CreateEvent(ctx, &database.Event{Time: baseTime, EventType: database.EventLeave}))
+
+	r := gin.New()
+	r.Use(Authenticate)
+	r.GET("/event", GetEvents)
+
+	request := func(url string) (int, Page, []database.Event) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+		req.SetBasicAuth("staff", "staff password")
+		r.ServeHTTP(w, req)
+
+		var response struct {
+			Data struct {
+				Page
+				Items []struct {
+					ID   primitive.ObjectID `json:"id"`
+					Time time.Time          `json:"time"`
+				} `json:"items"`
+			} `json:"data"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &response)
+		events := make([]database.Event, 0)
+		for _, item := range response.Data.Items {
+			events = append(events, database.Event{ID: item.ID, Time: item.Time})
+		}
+		return w.Code, response.Data.Page, events
+	}
+
+	// the events are from latest to earliest by default
+	url := fmt.Sprintf("/event?student=%s&event_type=%d&limit=2", student.ID.Hex(), database.EventEnter)
+	code, page, events := request(url)
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Len(t, events, 2) {
+		assert.True(t, events[0].Time.After(events[1].Time))
+	}
+	assert.NotEmpty(t, page.NextCursor)
+	_, page, events = request(url + "&cursor=" + page.NextCursor)
+	assert.Len(t, events, 1)
+	assert.Empty(t, page.NextCursor)
+
+	_, _, events = request(fmt.Sprintf("/event?event_type=%d", database.EventLeave))
+	assert.Len(t, events, 1)
+
+	code, _, _ = request("/event?sort=name")
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	code, _, _ = request("/event?cursor=bad")
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+}
+
+func TestGetStudentsAtLocationOccupancy(t *testing.T) {
+	database.DB = database.NewMemoryStore()
+	defer func() { database.DB = TestDatabase }()
+
+	ctx := context.Background()
+	location := database.Location{Name: "Gym", Timeout: time.Hour}
+	assert.NoError(t, database.DB.CreateLocation(ctx, &location))
+	student := database.Student{Name: "Ben Aaron"}
+	assert.NoError(t, database.DB.CreateStudent(ctx, &student))
+	// the second event is of a student who was erased and had their events pseudonymized
+	for _, ref := range []database.StudentRef{student.Ref(), database.StudentRef(primitive.NewObjectID())} {
+		event := database.Event{Location: location.Ref(), Student: ref, Time: time.Now().Add(-time.Minute), EventType: database.EventEnter}
+		assert.NoError(t, database.DB.CreateEvent(ctx, &event))
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request, _ = http.NewRequest("GET", "/", nil)
+	c.Params = gin.Params{{Key: "id", Value: location.ID.Hex()}}
+
+	GetStudentsAtLocation(c)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	response := struct {
+		Data struct {
+			Students  []interface{} `json:"students"`
+			Occupancy int           `json:"occupancy"`
+		} `json:"data"`
+	}{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Len(t, response.Data.Students, 1)
+	assert.Equal(t, 2, response.Data.Occupancy, "the occupancy is the same one the capacity is checked with")
 }
@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"trace/pkg/auth"
+	"trace/pkg/database"
+)
+
+// GET /api/device/me
+// Returns the logged in device so a kiosk knows which location it is at
+func GetCurrentDevice(c *gin.Context) {
+	device, found := CurrentDevice(c)
+	if !found {
+		Errorf(c, http.StatusForbidden, "only devices have a device")
+		return
+	}
+	Success(c, http.StatusOK, device)
+}
+
+func GetDevices(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	devices, err := database.DB.GetDevices(ctx)
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+	Success(c, http.StatusOK, devices)
+}
+
+func GetDeviceByID(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	device, err := database.DB.GetDeviceByIDString(ctx, c.Param("id"))
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+	Success(c, http.StatusOK, device)
+}
+
+// POST /api/device
+// Registers a kiosk at a location. The token in the response is only sent
+// once and has to be used as a bearer token by the kiosk.
+func RegisterDevice(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	request := struct {
+		Name       string               `json:"name"`
+		LocationID database.LocationRef `json:"location_id"`
+	}{}
+	if !BindJSON(c, &request) {
+		return
+	}
+
+	device, token, err := auth.RegisterDevice(ctx, request.Name, request.LocationID)
+	if errors.Is(err, auth.ErrInvalidDevice) {
+		Error(c, http.StatusUnprocessableEntity, err)
+		return
+	} else if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditRegisterDevice,
+		TargetIDs: []primitive.ObjectID{device.ID, primitive.ObjectID(device.Location)},
+	}, nil, device)
+
+	Success(c, http.StatusCreated, map[string]interface{}{
+		"device": device,
+		"token":  token,
+	})
+}
+
+// PATCH /api/device/:id
+// Renames a device or moves it to another location
+func UpdateDevice(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	device, err := database.DB.GetDeviceByIDString(ctx, c.Param("id"))
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	request := struct {
+		Name       string               `json:"name"`
+		LocationID database.LocationRef `json:"location_id"`
+	}{Name: device.Name, LocationID: device.Location}
+	if !BindJSON(c, &request) {
+		return
+	}
+	if request.Name == "" {
+		Errorf(c, http.StatusUnprocessableEntity, "no device name specified")
+		return
+	}
+
+	before := device
+	device.Name = request.Name
+	device.Location = request.LocationID
+	if err := database.DB.UpdateDevice(ctx, device.ID, &device); err != nil {
+		DatabaseError(c, err)
+		return
+	}
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditUpdateDevice,
+		TargetIDs: []primitive.ObjectID{device.ID},
+	}, before, device)
+	Success(c, http.StatusOK, device)
+}
+
+// POST /api/device/:id/revoke
+// Stops a device from using its token
+func RevokeDevice(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	device, err := database.DB.GetDeviceByIDString(ctx, c.Param("id"))
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	revoked, err := auth.RevokeDevice(ctx, device.ID)
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditRevokeDevice,
+		TargetIDs: []primitive.ObjectID{device.ID},
+	}, device, revoked)
+	device = revoked
+	Success(c, http.StatusOK, device)
+}
+
+func DeleteDevice(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	device, err := database.DB.GetDeviceByIDString(ctx, c.Param("id"))
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	if err := database.DB.DeleteDevice(ctx, device.ID); err != nil {
+		DatabaseError(c, err)
+		return
+	}
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditDeleteDevice,
+		TargetIDs: []primitive.ObjectID{device.ID},
+	}, device, nil)
+	Success(c, http.StatusOK, nil)
+}
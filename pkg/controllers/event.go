@@ -0,0 +1,203 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"strconv"
+	"time"
+	"trace/pkg/database"
+	"trace/pkg/trace"
+)
+
+// correctionError responds to an error returned when correcting events
+func correctionError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, trace.ErrInvalidCorrection):
+		Error(c, http.StatusUnprocessableEntity, err)
+	case errors.Is(err, trace.ErrEventVoided):
+		Error(c, http.StatusConflict, err)
+	default:
+		DatabaseError(c, err)
+	}
+}
+
+// GET /api/event?student=&location=&event_type=&source=&from=&to=&voided=false&sort=-time&limit=50&cursor=
+// Returns a page of events from latest to earliest. They can be filtered by the student
+// and location ids, the event_type and source numbers and the from and to unix times.
+// Voided events are only included if voided is true.
+func GetEvents(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	page, ok := queryPage(c, "time", true)
+	if !ok {
+		return
+	}
+	query := database.EventQuery{Voided: c.Query("voided") == "true", Page: page}
+
+	student, err := queryObjectID(c, "student")
+	if err != nil {
+		Errorf(c, http.StatusUnprocessableEntity, "invalid student: %s", err)
+		return
+	}
+	location, err := queryObjectID(c, "location")
+	if err != nil {
+		Errorf(c, http.StatusUnprocessableEntity, "invalid location: %s", err)
+		return
+	}
+	query.Student, query.Location = database.StudentRef(student), database.LocationRef(location)
+
+	if value := c.Query("event_type"); value != "" {
+		eventType, err := strconv.Atoi(value)
+		if err != nil {
+			Errorf(c, http.StatusUnprocessableEntity, "invalid event_type: %s", err)
+			return
+		}
+		query.EventType = new(database.EventType)
+		*query.EventType = database.EventType(eventType)
+	}
+	if value := c.Query("source"); value != "" {
+		source, err := strconv.Atoi(value)
+		if err != nil {
+			Errorf(c, http.StatusUnprocessableEntity, "invalid source: %s", err)
+			return
+		}
+		query.Source = new(database.EventSource)
+		*query.Source = database.EventSource(source)
+	}
+
+	if query.From, err = queryUnixTime(c, "from"); err != nil {
+		Errorf(c, http.StatusUnprocessableEntity, "invalid from time: %s", err)
+		return
+	}
+	if query.To, err = queryUnixTime(c, "to"); err != nil {
+		Errorf(c, http.StatusUnprocessableEntity, "invalid to time: %s", err)
+		return
+	}
+
+	events, next, err := database.DB.QueryEvents(ctx, query)
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	Success(c, http.StatusOK, Page{Items: events, NextCursor: next})
+}
+
+// GET /api/event/:id
+// Returns an event, including whether it was voided or corrected
+func GetEventByID(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	event, err := database.DB.GetEventByIDString(ctx, c.Param("id"))
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+	Success(c, http.StatusOK, event)
+}
+
+// POST /api/event
+// Creates an enter or leave event by hand, which can be backdated
+func CreateManualEvent(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	request := struct {
+		StudentID  database.StudentRef  `json:"student_id"`
+		LocationID database.LocationRef `json:"location_id"`
+		EventType  database.EventType   `json:"event_type"`
+		Time       time.Time            `json:"time"`
+		Reason     string               `json:"reason"`
+	}{}
+	if !BindJSON(c, &request) {
+		return
+	}
+
+	user, _ := CurrentUser(c)
+	event, err := trace.CreateManualEvent(ctx, database.Event{
+		Location:  request.LocationID,
+		Student:   request.StudentID,
+		Time:      request.Time,
+		EventType: request.EventType,
+	}, request.Reason, user.ID)
+	if err != nil {
+		correctionError(c, err)
+		return
+	}
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditCreateEvent,
+		TargetIDs: []primitive.ObjectID{event.ID, primitive.ObjectID(event.Student)},
+	}, nil, event)
+
+	Success(c, http.StatusCreated, event)
+}
+
+// POST /api/event/:id/void
+// Marks an event as wrong so it is ignored
+func VoidEvent(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	event, err := database.DB.GetEventByIDString(ctx, c.Param("id"))
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	request := struct {
+		Reason string `json:"reason"`
+	}{}
+	if !BindJSON(c, &request) {
+		return
+	}
+
+	user, _ := CurrentUser(c)
+	voided, err := trace.VoidEvent(ctx, event.ID, request.Reason, user.ID)
+	if err != nil {
+		correctionError(c, err)
+		return
+	}
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditVoidEvent,
+		TargetIDs: []primitive.ObjectID{event.ID, primitive.ObjectID(event.Student)},
+	}, event, voided)
+
+	Success(c, http.StatusOK, voided)
+}
+
+// POST /api/event/:id/move
+// Moves an event to another location by voiding it and creating a replacement.
+// Responds with the voided event and its replacement.
+func MoveEvent(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	event, err := database.DB.GetEventByIDString(ctx, c.Param("id"))
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	request := struct {
+		LocationID database.LocationRef `json:"location_id"`
+		Reason     string               `json:"reason"`
+	}{}
+	if !BindJSON(c, &request) {
+		return
+	}
+
+	user, _ := CurrentUser(c)
+	voided, replacement, err := trace.MoveEvent(ctx, event.ID, request.LocationID, request.Reason, user.ID)
+	if err != nil {
+		correctionError(c, err)
+		return
+	}
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditMoveEvent,
+		TargetIDs: []primitive.ObjectID{event.ID, replacement.ID, primitive.ObjectID(event.Student)},
+	}, event, replacement)
+
+	Success(c, http.StatusOK, map[string]interface{}{
+		"voided":      voided,
+		"replacement": replacement,
+	})
+}
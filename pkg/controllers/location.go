@@ -2,18 +2,40 @@ package controllers
 
 import (
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"net/http"
 	"time"
 	"trace/pkg/database"
 	"trace/pkg/trace"
 )
 
+// GET /api/location?search=&archived=false&sort=name&limit=50&cursor=
+// Returns a page of locations sorted by name. Archived locations are only included
+// if archived is true.
 func GetLocations(c *gin.Context) {
-	locations := database.DB.GetLocations()
-	Success(c, http.StatusOK, locations)
+	ctx := c.Request.Context()
+
+	page, ok := queryPage(c, "name", false)
+	if !ok {
+		return
+	}
+
+	locations, next, err := database.DB.QueryLocations(ctx, database.LocationQuery{
+		Search:   c.Query("search"),
+		Archived: c.Query("archived") == "true",
+		Page:     page,
+	})
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	Success(c, http.StatusOK, Page{Items: locations, NextCursor: next})
 }
 
 func CreateLocation(c *gin.Context) {
+	ctx := c.Request.Context()
+
 	var location database.Location
 	if success := BindJSON(c, &location); !success {
 		return
@@ -23,54 +45,157 @@ func CreateLocation(c *gin.Context) {
 		Errorf(c, http.StatusUnprocessableEntity, "no location name specified")
 		return
 	}
+	if !validateLocation(c, &location) {
+		return
+	}
 
-	database.DB.CreateLocation(&location)
+	if err := database.DB.CreateLocation(ctx, &location); err != nil {
+		DatabaseError(c, err)
+		return
+	}
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditCreateLocation,
+		TargetIDs: []primitive.ObjectID{location.ID},
+	}, nil, location)
 	Success(c, http.StatusCreated, location)
 }
 
+// validateLocation returns true if location is valid. If it isn't, an error
+// is sent and false is returned
+func validateLocation(c *gin.Context, location *database.Location) bool {
+	switch {
+	// students time out of a location as soon as they enter if it doesn't have a timeout,
+	// so it would always be empty and its capacity would never be enforced
+	case location.Timeout <= 0:
+		Errorf(c, http.StatusUnprocessableEntity, "timeout must be positive")
+	case location.Capacity < 0:
+		Errorf(c, http.StatusUnprocessableEntity, "capacity must not be negative")
+	case location.DebounceWindow < 0:
+		Errorf(c, http.StatusUnprocessableEntity, "debounce window must not be negative")
+	case !location.ScanIntent.Valid():
+		Errorf(c, http.StatusUnprocessableEntity, "invalid scan intent %s", location.ScanIntent)
+	default:
+		return true
+	}
+	return false
+}
+
 func GetLocationByID(c *gin.Context) {
-	location, err := database.DB.GetLocationByIDString(c.Param("id"))
+	ctx := c.Request.Context()
+
+	location, err := database.DB.GetLocationByIDString(ctx, c.Param("id"))
 	if err != nil {
-		Error(c, http.StatusUnprocessableEntity, err)
+		DatabaseError(c, err)
 		return
 	}
 
 	Success(c, http.StatusOK, location)
 }
 
+// DELETE /api/location/:id?cascade=false
+// Archives a location so nobody can scan in or out of it, but its history is kept.
+// If cascade is true, the location and all of its events are deleted instead.
 func DeleteLocation(c *gin.Context) {
-	location, err := database.DB.GetLocationByIDString(c.Param("id"))
+	ctx := c.Request.Context()
+
+	location, err := database.DB.GetLocationByIDString(ctx, c.Param("id"))
 	if err != nil {
-		Error(c, http.StatusUnprocessableEntity, err)
+		DatabaseError(c, err)
 		return
 	}
 
-	_ = database.DB.DeleteLocation(location.ID)
+	if c.Query("cascade") == "true" {
+		events, err := trace.DeleteLocation(ctx, location.Ref())
+		if err != nil {
+			DatabaseError(c, err)
+			return
+		}
+		recordAudit(c, database.AuditEntry{
+			Action:    database.AuditDeleteLocation,
+			TargetIDs: []primitive.ObjectID{location.ID},
+			Details:   map[string]interface{}{"events": events},
+		}, location, nil)
 
-	Success(c, http.StatusOK, nil)
+		Success(c, http.StatusOK, nil)
+		return
+	}
+
+	archived := location
+	archived.Archived = true
+	if err := database.DB.UpdateLocation(ctx, location.ID, &archived); err != nil {
+		DatabaseError(c, err)
+		return
+	}
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditArchiveLocation,
+		TargetIDs: []primitive.ObjectID{location.ID},
+	}, location, archived)
+
+	Success(c, http.StatusOK, archived)
+}
+
+// POST /api/location/:id/restore
+// Restores an archived location
+func RestoreLocation(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	location, err := database.DB.GetLocationByIDString(ctx, c.Param("id"))
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	restored := location
+	restored.Archived = false
+	if err := database.DB.UpdateLocation(ctx, location.ID, &restored); err != nil {
+		DatabaseError(c, err)
+		return
+	}
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditRestoreLocation,
+		TargetIDs: []primitive.ObjectID{location.ID},
+	}, location, restored)
+
+	Success(c, http.StatusOK, restored)
 }
 
 func UpdateLocation(c *gin.Context) {
-	location, err := database.DB.GetLocationByIDString(c.Param("id"))
+	ctx := c.Request.Context()
+
+	location, err := database.DB.GetLocationByIDString(ctx, c.Param("id"))
 	if err != nil {
-		Error(c, http.StatusUnprocessableEntity, err)
+		DatabaseError(c, err)
 		return
 	}
 
 	var newLocation database.Location
-	if success := BindJSON(c, &location); !success {
+	if success := BindJSON(c, &newLocation); !success {
+		return
+	}
+	// locations are only archived and restored by DeleteLocation and RestoreLocation
+	newLocation.Archived = location.Archived
+	if !validateLocation(c, &newLocation) {
 		return
 	}
 
-	_ = database.DB.UpdateLocation(location.ID, &newLocation)
+	if err := database.DB.UpdateLocation(ctx, location.ID, &newLocation); err != nil {
+		DatabaseError(c, err)
+		return
+	}
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditUpdateLocation,
+		TargetIDs: []primitive.ObjectID{location.ID},
+	}, location, newLocation)
 
 	Success(c, http.StatusOK, newLocation)
 }
 
 func GetStudentsAtLocation(c *gin.Context) {
-	location, err := database.DB.GetLocationByIDString(c.Param("id"))
+	ctx := c.Request.Context()
+
+	location, err := database.DB.GetLocationByIDString(ctx, c.Param("id"))
 	if err != nil {
-		Error(c, http.StatusUnprocessableEntity, err)
+		DatabaseError(c, err)
 		return
 	}
 
@@ -80,56 +205,129 @@ func GetStudentsAtLocation(c *gin.Context) {
 	}{time.Now()}
 	_ = c.ShouldBindJSON(&json)
 
-	students, events := trace.GetStudentsAtLocation(location.Ref(), json.Time)
+	studentsAtLocation, events, err := trace.GetStudentsAtLocation(ctx, location.Ref(), json.Time)
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	// erased students aren't listed, but they are still counted like when the capacity is checked
+	occupancy, err := trace.Occupancy(ctx, location.Ref(), json.Time)
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
 
 	/* Create a json response formatted as:
-	[{
-		"student": (student),
-		"time": (time)
-	}]
+	{
+		"students": [{
+			"student": (student),
+			"time": (time)
+		}],
+		"occupancy": (number of students, including erased ones),
+		"capacity": (location capacity, 0 if there is no limit)
+	}
 	*/
-	var resp = make([]map[string]interface{}, 0)
-	for i := range students {
-		resp = append(resp, map[string]interface{}{
-			"student": students[i],
+	var students = make([]map[string]interface{}, 0)
+	for i := range studentsAtLocation {
+		students = append(students, map[string]interface{}{
+			"student": studentsAtLocation[i],
 			"time":    events[i].Time,
 		})
 	}
 
-	Success(c, http.StatusOK, resp)
+	Success(c, http.StatusOK, map[string]interface{}{
+		"students":  students,
+		"occupancy": occupancy,
+		"capacity":  location.Capacity,
+	})
 }
 
 func LogoutAllStudentsAtLocation(c *gin.Context) {
-	location, err := database.DB.GetLocationByIDString(c.Param("id"))
+	ctx := c.Request.Context()
+
+	location, err := database.DB.GetLocationByIDString(ctx, c.Param("id"))
 	if err != nil {
-		Error(c, http.StatusUnprocessableEntity, err)
+		DatabaseError(c, err)
 		return
 	}
 
-	students, _ := trace.GetStudentsAtLocation(location.Ref(), time.Now())
+	events, err := trace.LogoutAllStudentsAtLocation(ctx, location.Ref())
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
 
-	for _, student := range students {
-		newEvent := database.Event{
-			Location:  database.LocationRef(location.ID),
-			Student:   database.StudentRef(student.ID),
-			Time:      time.Now(),
-			EventType: database.EventLeave,
-			Source:    database.EventSourceLoggedOutAll,
-		}
-		database.DB.CreateEvent(&newEvent)
+	// the location and every student that was logged out
+	targets := []primitive.ObjectID{location.ID}
+	for _, event := range events {
+		targets = append(targets, primitive.ObjectID(event.Student))
 	}
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditLogoutAll,
+		TargetIDs: targets,
+	}, nil, events)
 
 	Success(c, http.StatusCreated, nil)
 }
 
 func VisitedLocationToday(c *gin.Context) {
-	location, err := database.DB.GetLocationByIDString(c.Param("id"))
+	ctx := c.Request.Context()
+
+	location, err := database.DB.GetLocationByIDString(ctx, c.Param("id"))
 	if err != nil {
-		Error(c, http.StatusUnprocessableEntity, err)
+		DatabaseError(c, err)
 		return
 	}
 
-	visitReport := trace.GetLocationVisitors(location.Ref(), time.Now().Add(-12 * time.Hour), time.Now())
+	visitReport, err := trace.GetLocationVisitors(ctx, location.Ref(), time.Now().Add(-12 * time.Hour), time.Now())
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
 
 	Success(c, http.StatusOK, visitReport)
-}
\ No newline at end of file
+}
+
+// GET /api/location/:id/stats?from=&to=
+// Returns the number of visits to a location between the from and to unix times, including
+// the visits of students who were removed by the retention policy or erased. By default
+// it counts the visits in the last 30 days.
+func GetLocationStats(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	location, err := database.DB.GetLocationByIDString(ctx, c.Param("id"))
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	from, err := queryUnixTime(c, "from")
+	if err != nil {
+		Errorf(c, http.StatusUnprocessableEntity, "invalid from time: %s", err)
+		return
+	}
+	to, err := queryUnixTime(c, "to")
+	if err != nil {
+		Errorf(c, http.StatusUnprocessableEntity, "invalid to time: %s", err)
+		return
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if from.IsZero() {
+		from = to.AddDate(0, 0, -30)
+	}
+	if to.Before(from) {
+		Errorf(c, http.StatusUnprocessableEntity, "the from time must be before the to time")
+		return
+	}
+
+	stats, err := trace.GetLocationStats(ctx, location.Ref(), from, to)
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	Success(c, http.StatusOK, stats)
+}
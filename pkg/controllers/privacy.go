@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"trace/pkg/database"
+	"trace/pkg/trace"
+)
+
+// GET /api/student/:id/export?format=json
+// Returns all of the data stored about a student. If format is zip, the data
+// is sent as a zip file instead of in the JSON response.
+func ExportStudent(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	student, err := database.DB.GetStudentByIDString(ctx, c.Param("id"))
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "zip" {
+		Errorf(c, http.StatusUnprocessableEntity, "invalid format %s", format)
+		return
+	}
+
+	export, err := trace.ExportStudent(ctx, student.Ref())
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditExportStudent,
+		TargetIDs: []primitive.ObjectID{student.ID},
+		Details:   map[string]interface{}{"format": format, "events": len(export.Events)},
+	}, nil, nil)
+
+	if format == "json" {
+		Success(c, http.StatusOK, export)
+		return
+	}
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="student-%s.zip"`, student.ID.Hex()))
+	c.Status(http.StatusOK)
+	if err := export.WriteZip(c.Writer); err != nil {
+		// the headers were already sent, so the client will get a broken zip
+		logrus.Errorf("Failed to write the export of student %s: %s", student.ID.Hex(), err)
+	}
+	c.Abort()
+}
+
+// POST /api/student/:id/erase
+// Deletes a student and deletes or pseudonymizes their events. The mode is
+// either delete or pseudonymize.
+func EraseStudent(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	student, err := database.DB.GetStudentByIDString(ctx, c.Param("id"))
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	request := struct {
+		Mode trace.ErasureMode `json:"mode"`
+		// Reason is why the student was erased, for example who asked for it
+		Reason string `json:"reason"`
+	}{}
+	if !BindJSON(c, &request) {
+		return
+	}
+	if request.Reason == "" {
+		Errorf(c, http.StatusUnprocessableEntity, "no reason specified")
+		return
+	}
+
+	report, err := trace.EraseStudent(ctx, student.Ref(), request.Mode)
+	if errors.Is(err, trace.ErrInvalidErasure) {
+		Error(c, http.StatusUnprocessableEntity, err)
+		return
+	} else if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	// the student isn't snapshotted since the point is to not keep their data
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditEraseStudent,
+		TargetIDs: []primitive.ObjectID{student.ID},
+		Details: map[string]interface{}{
+			"mode":          report.Mode,
+			"events":        report.Events,
+			"audit_entries": report.AuditEntries,
+			"reason":        request.Reason,
+		},
+	}, nil, nil)
+
+	Success(c, http.StatusOK, report)
+}
@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+	"trace/pkg/trace"
+)
+
+// GET /api/retention
+// Returns the retention policy and what it would remove if it was applied now
+func GetRetention(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	response := map[string]interface{}{
+		"policy": trace.Retention,
+		"report": nil,
+	}
+	if trace.Retention.Enabled() {
+		report, err := trace.ApplyRetentionPolicy(ctx, trace.Retention, time.Now(), true)
+		if err != nil {
+			DatabaseError(c, err)
+			return
+		}
+		response["report"] = report
+	}
+
+	Success(c, http.StatusOK, response)
+}
+
+// POST /api/retention/run
+// Applies the retention policy now instead of waiting for it to run in the background.
+// If dry_run is true, nothing is removed and the response is what would have been.
+func RunRetention(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	request := struct {
+		DryRun bool `json:"dry_run"`
+	}{}
+	if !BindJSON(c, &request) {
+		return
+	}
+
+	report, err := trace.ApplyRetentionPolicy(ctx, trace.Retention, time.Now(), request.DryRun)
+	// the report is empty if the policy failed before anything was removed, otherwise
+	// what was removed is recorded even if removing the rest failed
+	if !request.DryRun && !report.Cutoff.IsZero() {
+		recordAudit(c, report.AuditEntry(), nil, nil)
+	}
+	if errors.Is(err, trace.ErrRetentionDisabled) {
+		Error(c, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	Success(c, http.StatusOK, report)
+}
@@ -1,42 +1,183 @@
 package controllers
 
 import (
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"net/http"
+	"time"
 	"trace/pkg/database"
 	"trace/pkg/trace"
 )
 
+// scanLocation returns the location a scan is at. Devices can only scan at their
+// location, so it is used if location is empty. Otherwise, location is used. If
+// false is returned, an error was sent and the caller should return.
+func scanLocation(c *gin.Context, location database.LocationRef) (database.LocationRef, bool) {
+	device, isDevice := CurrentDevice(c)
+	switch {
+	case !isDevice:
+		return location, true
+	case primitive.ObjectID(location).IsZero() || location == device.Location:
+		return device.Location, true
+	default:
+		Errorf(c, http.StatusForbidden, "device %s can only scan at its location", device.Name)
+		return database.LocationRef{}, false
+	}
+}
+
 // POST /api/v1/scan
-// Called whenever someone scans their barcode
+// Called whenever someone scans their barcode. Devices don't need a location_id.
 func OnScan(c *gin.Context) {
+	ctx := c.Request.Context()
+
 	scanRequest := struct {
 		StudentHandle string `json:"student_handle"`
 		LocationID    database.LocationRef `json:"location_id"`
 	}{}
 
-	BindJSON(c, &scanRequest)
+	if !BindJSON(c, &scanRequest) {
+		return
+	}
 	if scanRequest.StudentHandle == "" {
 		Errorf(c, http.StatusUnprocessableEntity, "no student handle specified")
 		return
 	}
+	location, ok := scanLocation(c, scanRequest.LocationID)
+	if !ok {
+		return
+	}
+	scanRequest.LocationID = location
 
 	log := logrus.WithFields(logrus.Fields{
 		"StudentHandle": scanRequest.StudentHandle, "LocationID": scanRequest.LocationID,
 	})
 
-	event, userError, err := trace.HandleScan(scanRequest.LocationID, scanRequest.StudentHandle)
+	event, userError, err := trace.HandleScan(ctx, scanRequest.LocationID, scanRequest.StudentHandle)
 	if err != nil {
-		log.Errorf("Internal error handling scan: %s", err)
-		Errorf(c, http.StatusInternalServerError, "internal server error: %s", err)
+		DatabaseError(c, err)
 		return
 	}
 	if userError != nil {
 		log.Warnf("User error handling scan: %s", userError)
+		if errors.Is(userError, trace.ErrLocationFull) || errors.Is(userError, trace.ErrScanDebounced) {
+			Errorf(c, http.StatusConflict, "%s", userError)
+			return
+		}
 		Errorf(c, http.StatusUnprocessableEntity, "%s", userError)
 		return
 	}
 
 	Success(c, http.StatusCreated, event)
 }
+
+// idempotencyKey scopes an idempotency key sent by a client to the device or user that
+// is logged in, so scans from two kiosks that generate the same keys aren't duplicates
+func idempotencyKey(c *gin.Context, key string) string {
+	if key == "" {
+		return ""
+	}
+	if device, found := CurrentDevice(c); found {
+		return "device:" + device.ID.Hex() + ":" + key
+	}
+	if user, found := CurrentUser(c); found {
+		return "user:" + user.ID.Hex() + ":" + key
+	}
+	return key
+}
+
+// the maximum number of scans in a batch
+const maxScanBatchSize = 1000
+
+type batchScanResult struct {
+	IdempotencyKey string `json:"idempotency_key"`
+	// Status is created, duplicate or error
+	Status string          `json:"status"`
+	Event  *database.Event `json:"event,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// POST /api/scan/batch
+// Called by kiosks to send scans that were recorded while they were offline. Each
+// scan has the time it happened and an idempotency key so the batch can be resent.
+// Devices don't need a location_id.
+func OnScanBatch(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	batchRequest := struct {
+		Scans []struct {
+			StudentHandle  string    `json:"student_handle"`
+			LocationID     string    `json:"location_id"`
+			Time           time.Time `json:"time"`
+			IdempotencyKey string    `json:"idempotency_key"`
+		} `json:"scans"`
+	}{}
+
+	if !BindJSON(c, &batchRequest) {
+		return
+	}
+	if len(batchRequest.Scans) > maxScanBatchSize {
+		Errorf(c, http.StatusUnprocessableEntity, "a batch can't have more than %d scans", maxScanBatchSize)
+		return
+	}
+
+	// the scans that could be parsed are handled and the rest are given an error
+	results := make([]batchScanResult, len(batchRequest.Scans))
+	scans := make([]trace.Scan, 0, len(batchRequest.Scans))
+	scanIndexes := make([]int, 0, len(batchRequest.Scans))
+	for i, s := range batchRequest.Scans {
+		results[i].IdempotencyKey = s.IdempotencyKey
+
+		var locationID primitive.ObjectID
+		if s.LocationID != "" {
+			var err error
+			if locationID, err = primitive.ObjectIDFromHex(s.LocationID); err != nil {
+				results[i].Status = "error"
+				results[i].Error = fmt.Sprintf("invalid location id %s", s.LocationID)
+				continue
+			}
+		}
+		location, ok := scanLocation(c, database.LocationRef(locationID))
+		if !ok {
+			return
+		}
+		if s.StudentHandle == "" {
+			results[i].Status = "error"
+			results[i].Error = "no student handle specified"
+			continue
+		}
+
+		scans = append(scans, trace.Scan{
+			Location:       location,
+			StudentHandle:  s.StudentHandle,
+			Time:           s.Time,
+			IdempotencyKey: idempotencyKey(c, s.IdempotencyKey),
+		})
+		scanIndexes = append(scanIndexes, i)
+	}
+
+	scanResults, err := trace.HandleScanBatch(ctx, scans)
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	for j, scanResult := range scanResults {
+		result := &results[scanIndexes[j]]
+		switch {
+		case scanResult.UserError != nil:
+			result.Status = "error"
+			result.Error = scanResult.UserError.Error()
+		case scanResult.Duplicate:
+			result.Status = "duplicate"
+			result.Event = &scanResult.Event
+		default:
+			result.Status = "created"
+			result.Event = &scanResult.Event
+		}
+	}
+
+	Success(c, http.StatusOK, results)
+}
@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"time"
+	"trace/pkg/database"
+	"trace/pkg/trace"
+)
+
+// the time between keep alive messages so proxies don't close idle streams
+const streamKeepAlive = 15 * time.Second
+
+// eventName is the name of an event in a stream
+func eventName(event database.Event) string {
+	switch {
+	case event.Voided != nil:
+		return "void"
+	case event.EventType == database.EventEnter:
+		return "enter"
+	case event.Source == database.EventSourceAutoLeave:
+		return "auto_leave"
+	default:
+		return "leave"
+	}
+}
+
+type locationOccupancy struct {
+	Occupancy int `json:"occupancy"`
+	Capacity  int `json:"capacity"`
+}
+
+type streamStudent struct {
+	ID   primitive.ObjectID `json:"id"`
+	Name string             `json:"name"`
+}
+
+// streamEvent is the part of an event that is sent in streams. Only the student's id and
+// name are sent, because everyone who can see the stream would see everything else.
+type streamEvent struct {
+	ID        primitive.ObjectID   `json:"id"`
+	Student   streamStudent        `json:"student"`
+	Location  primitive.ObjectID   `json:"location_id"`
+	Time      time.Time            `json:"time"`
+	EventType database.EventType   `json:"event_type"`
+	Source    database.EventSource `json:"source"`
+}
+
+func newStreamEvent(update trace.Update) streamEvent {
+	return streamEvent{
+		ID:        update.Event.ID,
+		Student:   streamStudent{ID: update.Student.ID, Name: update.Student.Name},
+		Location:  primitive.ObjectID(update.Event.Location),
+		Time:      update.Event.Time,
+		EventType: update.Event.EventType,
+		Source:    update.Event.Source,
+	}
+}
+
+type locationStreamEvent struct {
+	Event streamEvent `json:"event"`
+	locationOccupancy
+}
+
+// GET /api/location/:id/stream
+// Streams the events at a location using server-sent events. The current occupancy is
+// sent as an "occupancy" event when the stream starts and every event is sent as an
+// "enter", "leave" or "auto_leave" event along with the occupancy after it. Events that
+// are voided by a correction are sent again as a "void" event.
+func LocationStream(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	location, err := database.DB.GetLocationByIDString(ctx, c.Param("id"))
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+	locationRef := location.Ref()
+
+	// subscribe before getting the occupancy so no events are missed
+	subscription := trace.Hub.Subscribe(&locationRef)
+	defer subscription.Close()
+
+	occupancy, err := trace.Occupancy(ctx, locationRef, time.Now())
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+	setStreamHeaders(c)
+	c.SSEvent("occupancy", locationOccupancy{Occupancy: occupancy, Capacity: location.Capacity})
+
+	stream(c, subscription, func(update trace.Update) interface{} {
+		return locationStreamEvent{
+			Event:             newStreamEvent(update),
+			locationOccupancy: locationOccupancy{Occupancy: update.Occupancy, Capacity: location.Capacity},
+		}
+	})
+}
+
+// GET /api/stream
+// Streams the events at every location using server-sent events. Every event
+// is sent as an "enter", "leave", "auto_leave" or "void" event.
+func Stream(c *gin.Context) {
+	subscription := trace.Hub.Subscribe(nil)
+	defer subscription.Close()
+
+	setStreamHeaders(c)
+	stream(c, subscription, func(update trace.Update) interface{} {
+		return newStreamEvent(update)
+	})
+}
+
+// setStreamHeaders sets the headers for a stream. It has to be called before anything is written
+func setStreamHeaders(c *gin.Context) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+}
+
+// stream sends the message returned by format for every update in subscription
+// until the client disconnects
+func stream(c *gin.Context, subscription *trace.Subscription, format func(update trace.Update) interface{}) {
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	// send anything that was written before the stream started
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-keepAlive.C:
+			c.SSEvent("ping", "")
+			return true
+		case update, ok := <-subscription.Events:
+			if !ok {
+				return false
+			}
+			c.SSEvent(eventName(update.Event), format(update))
+			return true
+		}
+	})
+}
@@ -1,23 +1,46 @@
 package controllers
 
 import (
+	"errors"
 	"github.com/gin-gonic/gin"
-	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"net/http"
+	"strings"
 	"time"
 	"trace/pkg/database"
 	"trace/pkg/trace"
 )
 
+// GET /api/student?search=&archived=false&sort=name&limit=50&cursor=
+// Returns a page of students sorted by name. search matches their name, email or
+// handles and archived students are only included if archived is true.
 func GetStudents(c *gin.Context) {
-	locations := database.DB.GetStudents()
-	Success(c, http.StatusOK, locations)
+	ctx := c.Request.Context()
+
+	page, ok := queryPage(c, "name", false)
+	if !ok {
+		return
+	}
+
+	students, next, err := database.DB.QueryStudents(ctx, database.StudentQuery{
+		Search:   c.Query("search"),
+		Archived: c.Query("archived") == "true",
+		Page:     page,
+	})
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	Success(c, http.StatusOK, Page{Items: students, NextCursor: next})
 }
 
 func LogoutStudent(c *gin.Context) {
-	student, err := database.DB.GetStudentByIDString(c.Param("id"))
+	ctx := c.Request.Context()
+
+	student, err := database.DB.GetStudentByIDString(ctx, c.Param("id"))
 	if err != nil {
-		Error(c, http.StatusUnprocessableEntity, err)
+		DatabaseError(c, err)
 		return
 	}
 
@@ -28,19 +51,22 @@ func LogoutStudent(c *gin.Context) {
 		return
 	}
 
-	newEvent := database.Event{
-		Location:  body.LocationID,
-		Student:   student.Ref(),
-		Time:      time.Now(),
-		EventType: database.EventLeave,
-		Source:    database.EventSourceLoggedOut,
+	newEvent, err := trace.LogoutStudent(ctx, student.Ref(), body.LocationID)
+	if err != nil {
+		DatabaseError(c, err)
+		return
 	}
-	database.DB.CreateEvent(&newEvent)
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditLogoutStudent,
+		TargetIDs: []primitive.ObjectID{student.ID, primitive.ObjectID(body.LocationID)},
+	}, nil, newEvent)
 
 	Success(c, http.StatusCreated, newEvent)
 }
 
 func CreateStudent(c *gin.Context) {
+	ctx := c.Request.Context()
+
 	var student database.Student
 
 	if success := BindJSON(c, &student); !success {
@@ -52,12 +78,21 @@ func CreateStudent(c *gin.Context) {
 		return
 	}
 
-	database.DB.CreateStudent(&student)
+	if err := database.DB.CreateStudent(ctx, &student); err != nil {
+		DatabaseError(c, err)
+		return
+	}
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditCreateStudent,
+		TargetIDs: []primitive.ObjectID{student.ID},
+	}, nil, student)
 
 	Success(c, http.StatusCreated, student)
 }
 
 func CreateStudents(c *gin.Context) {
+	ctx := c.Request.Context()
+
 	var students []database.Student
 	if success := BindJSON(c, &students); !success {
 		return
@@ -69,39 +104,153 @@ func CreateStudents(c *gin.Context) {
 			return
 		}
 
-		database.DB.CreateStudent(&students[i])
-
+		if err := database.DB.CreateStudent(ctx, &students[i]); err != nil {
+			DatabaseError(c, err)
+			return
+		}
+		recordAudit(c, database.AuditEntry{
+			Action:    database.AuditCreateStudent,
+			TargetIDs: []primitive.ObjectID{students[i].ID},
+		}, nil, students[i])
 	}
 
 	Success(c, http.StatusCreated, students)
 }
 
+// POST /api/students/import?dry_run=false&archive_missing=false
+// Creates or updates students from a roster CSV in the request body, see trace.ImportRoster.
+// The columns can be set with name_column, email_column, external_id_column and
+// handle_columns, which is a comma separated list. If dry_run is true, nothing is
+// changed and the response is what would have been.
+func ImportRoster(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	options := trace.RosterOptions{
+		Mapping: trace.RosterMapping{
+			Name:       c.Query("name_column"),
+			Email:      c.Query("email_column"),
+			ExternalID: c.Query("external_id_column"),
+		},
+		DryRun:         c.Query("dry_run") == "true",
+		ArchiveMissing: c.Query("archive_missing") == "true",
+	}
+	if handles := c.Query("handle_columns"); handles != "" {
+		options.Mapping.Handles = strings.Split(handles, ",")
+	}
+
+	report, err := trace.ImportRoster(ctx, c.Request.Body, options)
+	if errors.Is(err, trace.ErrInvalidRoster) {
+		Error(c, http.StatusUnprocessableEntity, err)
+		return
+	} else if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	if !report.DryRun {
+		recordAudit(c, database.AuditEntry{
+			Action:    database.AuditImportRoster,
+			TargetIDs: report.TargetIDs(),
+			Details: map[string]interface{}{
+				"created":         len(report.Created),
+				"updated":         len(report.Updated),
+				"unchanged":       report.Unchanged,
+				"archived":        len(report.Archived),
+				"errors":          len(report.Errors),
+				"archive_missing": options.ArchiveMissing,
+			},
+		}, nil, nil)
+	}
+
+	Success(c, http.StatusOK, report)
+}
+
 func GetStudentByID(c *gin.Context) {
-	student, err := database.DB.GetStudentByIDString(c.Param("id"))
+	ctx := c.Request.Context()
+
+	student, err := database.DB.GetStudentByIDString(ctx, c.Param("id"))
 	if err != nil {
-		Error(c, http.StatusUnprocessableEntity, err)
+		DatabaseError(c, err)
 		return
 	}
 
 	Success(c, http.StatusOK, student)
 }
 
+// DELETE /api/student/:id?cascade=false
+// Archives a student so they can't scan anymore, but their history is kept. If
+// cascade is true, the student and all of their events are deleted instead.
 func DeleteStudent(c *gin.Context) {
-	student, err := database.DB.GetStudentByIDString(c.Param("id"))
+	ctx := c.Request.Context()
+
+	student, err := database.DB.GetStudentByIDString(ctx, c.Param("id"))
 	if err != nil {
-		Error(c, http.StatusUnprocessableEntity, err)
+		DatabaseError(c, err)
 		return
 	}
 
-	_ = database.DB.DeleteStudent(student.ID)
+	if c.Query("cascade") == "true" {
+		report, err := trace.EraseStudent(ctx, student.Ref(), trace.ErasureDelete)
+		if err != nil {
+			DatabaseError(c, err)
+			return
+		}
+		// the student isn't snapshotted since their data was erased
+		recordAudit(c, database.AuditEntry{
+			Action:    database.AuditDeleteStudent,
+			TargetIDs: []primitive.ObjectID{student.ID},
+			Details:   map[string]interface{}{"events": report.Events, "audit_entries": report.AuditEntries},
+		}, nil, nil)
+
+		Success(c, http.StatusOK, nil)
+		return
+	}
 
-	Success(c, http.StatusOK, nil)
+	archived := student
+	archived.Archived = true
+	if err := database.DB.UpdateStudent(ctx, student.ID, &archived); err != nil {
+		DatabaseError(c, err)
+		return
+	}
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditArchiveStudent,
+		TargetIDs: []primitive.ObjectID{student.ID},
+	}, student, archived)
+
+	Success(c, http.StatusOK, archived)
+}
+
+// POST /api/student/:id/restore
+// Restores an archived student
+func RestoreStudent(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	student, err := database.DB.GetStudentByIDString(ctx, c.Param("id"))
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	restored := student
+	restored.Archived = false
+	if err := database.DB.UpdateStudent(ctx, student.ID, &restored); err != nil {
+		DatabaseError(c, err)
+		return
+	}
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditRestoreStudent,
+		TargetIDs: []primitive.ObjectID{student.ID},
+	}, student, restored)
+
+	Success(c, http.StatusOK, restored)
 }
 
 func UpdateStudent(c *gin.Context) {
-	student, err := database.DB.GetStudentByIDString(c.Param("id"))
+	ctx := c.Request.Context()
+
+	student, err := database.DB.GetStudentByIDString(ctx, c.Param("id"))
 	if err != nil {
-		Error(c, http.StatusUnprocessableEntity, err)
+		DatabaseError(c, err)
 		return
 	}
 
@@ -109,19 +258,27 @@ func UpdateStudent(c *gin.Context) {
 	if success := BindJSON(c, &newStudent); !success {
 		return
 	}
+	// students are only archived and restored by DeleteStudent and RestoreStudent
+	newStudent.Archived = student.Archived
 
-	success := database.DB.UpdateStudent(student.ID, &newStudent)
-	if !success {
-		log.Panicf("Could not find student with id %s", student.ID)
+	if err := database.DB.UpdateStudent(ctx, student.ID, &newStudent); err != nil {
+		DatabaseError(c, err)
+		return
 	}
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditUpdateStudent,
+		TargetIDs: []primitive.ObjectID{student.ID},
+	}, student, newStudent)
 
-	Success(c, http.StatusOK, student)
+	Success(c, http.StatusOK, newStudent)
 }
 
 func GetStudentLocation(c *gin.Context) {
-	student, err := database.DB.GetStudentByIDString(c.Param("id"))
+	ctx := c.Request.Context()
+
+	student, err := database.DB.GetStudentByIDString(ctx, c.Param("id"))
 	if err != nil {
-		Error(c, http.StatusUnprocessableEntity, err)
+		DatabaseError(c, err)
 		return
 	}
 
@@ -131,7 +288,11 @@ func GetStudentLocation(c *gin.Context) {
 	}{time.Now()}
 	_ = c.BindJSON(&json)
 
-	location, found := trace.GetStudentLocation(database.StudentRef(student.ID), json.Time)
+	location, found, err := trace.GetStudentLocation(ctx, database.StudentRef(student.ID), json.Time)
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
 	if !found {
 		Success(c, http.StatusOK, nil)
 		return
@@ -139,3 +300,42 @@ func GetStudentLocation(c *gin.Context) {
 
 	Success(c, http.StatusOK, location)
 }
+
+// GET /api/student/:id/timeline?from=&to=
+// Returns the periods of time a student was at each location between the from and to unix
+// times, and how each one ended. By default it returns all of the student's history until now.
+func GetStudentTimeline(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	student, err := database.DB.GetStudentByIDString(ctx, c.Param("id"))
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	from, err := queryUnixTime(c, "from")
+	if err != nil {
+		Errorf(c, http.StatusUnprocessableEntity, "invalid from time: %s", err)
+		return
+	}
+	to, err := queryUnixTime(c, "to")
+	if err != nil {
+		Errorf(c, http.StatusUnprocessableEntity, "invalid to time: %s", err)
+		return
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if to.Before(from) {
+		Errorf(c, http.StatusUnprocessableEntity, "the from time must be before the to time")
+		return
+	}
+
+	timeline, err := trace.GetStudentTimeline(ctx, student.Ref(), from, to)
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	Success(c, http.StatusOK, timeline)
+}
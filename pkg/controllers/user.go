@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"trace/pkg/auth"
+	"trace/pkg/database"
+)
+
+type userRequest struct {
+	Username string          `json:"username"`
+	Password string          `json:"password"`
+	Roles    []database.Role `json:"roles"`
+}
+
+// userError responds to an error returned by the auth package
+func userError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, auth.ErrInvalidUser):
+		Error(c, http.StatusUnprocessableEntity, err)
+	case errors.Is(err, auth.ErrLastAdmin):
+		Error(c, http.StatusConflict, err)
+	default:
+		DatabaseError(c, err)
+	}
+}
+
+// GET /api/me
+// Returns the logged in user
+func GetCurrentUser(c *gin.Context) {
+	user, found := CurrentUser(c)
+	if !found {
+		unauthorized(c, errors.New("authentication required"))
+		return
+	}
+	Success(c, http.StatusOK, user)
+}
+
+func GetUsers(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	users, err := database.DB.GetUsers(ctx)
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+	Success(c, http.StatusOK, users)
+}
+
+func GetUserByID(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	user, err := database.DB.GetUserByIDString(ctx, c.Param("id"))
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+	Success(c, http.StatusOK, user)
+}
+
+func CreateUser(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	var request userRequest
+	if !BindJSON(c, &request) {
+		return
+	}
+
+	user, err := auth.CreateUser(ctx, request.Username, request.Password, request.Roles)
+	if err != nil {
+		userError(c, err)
+		return
+	}
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditCreateUser,
+		TargetIDs: []primitive.ObjectID{user.ID},
+	}, nil, user)
+	Success(c, http.StatusCreated, user)
+}
+
+// PATCH /api/user/:id
+// Updates a user. If the password is empty, it isn't changed.
+func UpdateUser(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	user, err := database.DB.GetUserByIDString(ctx, c.Param("id"))
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	var request userRequest
+	if !BindJSON(c, &request) {
+		return
+	}
+
+	newUser, err := auth.UpdateUser(ctx, user.ID, request.Username, request.Password, request.Roles)
+	if err != nil {
+		userError(c, err)
+		return
+	}
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditUpdateUser,
+		TargetIDs: []primitive.ObjectID{user.ID},
+		// the hashes aren't in the snapshots, so record whether the password was changed
+		Details: map[string]interface{}{"password_changed": request.Password != ""},
+	}, user, newUser)
+	Success(c, http.StatusOK, newUser)
+}
+
+func DeleteUser(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	user, err := database.DB.GetUserByIDString(ctx, c.Param("id"))
+	if err != nil {
+		DatabaseError(c, err)
+		return
+	}
+
+	if err := auth.DeleteUser(ctx, user.ID); err != nil {
+		userError(c, err)
+		return
+	}
+	recordAudit(c, database.AuditEntry{
+		Action:    database.AuditDeleteUser,
+		TargetIDs: []primitive.ObjectID{user.ID},
+	}, user, nil)
+	Success(c, http.StatusOK, nil)
+}
@@ -1,9 +1,14 @@
 package controllers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
 	"net/http"
+	"strconv"
+	"trace/pkg/database"
 	"unicode"
 )
 
@@ -61,13 +66,93 @@ func Errorf(c *gin.Context, code int, format string, args ...interface{}) {
 	Error(c, code, fmt.Errorf(format, args...))
 }
 
+// DatabaseError should be called when a database or trace function returns an error.
+// It responds with the status code matching the error:
+//   database.ErrNotFound          404 Not Found
+//   database.ErrInvalidID         422 Unprocessable Entity
+//   database.ErrInvalidCursor     422 Unprocessable Entity
+//   database.ErrDuplicateHandle   409 Conflict
+//   database.ErrDuplicateUsername 409 Conflict
+//   database.ErrDuplicateIdempotencyKey, database.ErrDuplicateKey 409 Conflict
+//   database.ErrUnavailable       503 Service Unavailable
+// If the request's context was cancelled, the request is aborted without a response.
+// Any other error is logged and responded to with 500 Internal Server Error
+func DatabaseError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		Error(c, http.StatusNotFound, err)
+	case errors.Is(err, database.ErrInvalidID), errors.Is(err, database.ErrInvalidCursor):
+		Error(c, http.StatusUnprocessableEntity, err)
+	case errors.Is(err, database.ErrDuplicateHandle), errors.Is(err, database.ErrDuplicateUsername),
+		errors.Is(err, database.ErrDuplicateIdempotencyKey), errors.Is(err, database.ErrDuplicateKey):
+		Error(c, http.StatusConflict, err)
+	case errors.Is(err, context.Canceled), c.Request.Context().Err() != nil:
+		// the client has gone away, so there is nobody to respond to
+		logrus.Debugf("Request to %s was cancelled: %s", c.Request.URL.Path, err)
+		c.Abort()
+	case errors.Is(err, database.ErrUnavailable):
+		logrus.Warnf("Database unavailable handling %s: %s", c.Request.URL.Path, err)
+		Error(c, http.StatusServiceUnavailable, database.ErrUnavailable)
+	case errors.Is(err, context.DeadlineExceeded):
+		// the client is still waiting, so the query took longer than the query timeout
+		logrus.Warnf("Database query timed out handling %s: %s", c.Request.URL.Path, err)
+		Errorf(c, http.StatusServiceUnavailable, "the database took too long to respond")
+	default:
+		logrus.Errorf("Internal error handling %s: %s", c.Request.URL.Path, err)
+		Errorf(c, http.StatusInternalServerError, "internal server error")
+	}
+}
+
 // BindJSON calls gin.Context.BindJSON and responds with an error if it is unsuccessful.
 // If the bool returned is false, the caller should return
 func BindJSON(c *gin.Context, obj interface{}) bool {
 	err := c.BindJSON(obj)
 	if err != nil {
+		// refs look up the referenced object when they are parsed, so the
+		// database may have failed rather than the request
+		if errors.Is(err, database.ErrUnavailable) {
+			DatabaseError(c, err)
+			return false
+		}
 		Errorf(c, http.StatusUnprocessableEntity, "failed to parse request body: %s", err)
 		return false
 	}
 	return true
-}
\ No newline at end of file
+}
+
+// A Page is the response of a list endpoint. To get the next page, the request is
+// sent again with NextCursor as the cursor query parameter. It is empty on the last page.
+type Page struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"next_cursor"`
+}
+
+// queryPage parses the cursor, limit and sort query parameters of a list endpoint.
+// sort is field to sort from first to last or -field to sort from last to first,
+// and field is the only one that can be sorted by. If the bool returned is false,
+// an error was sent and the caller should return
+func queryPage(c *gin.Context, field string, descending bool) (database.Page, bool) {
+	page := database.Page{Cursor: c.Query("cursor"), Descending: descending}
+
+	switch c.Query("sort") {
+	case "":
+	case field:
+		page.Descending = false
+	case "-" + field:
+		page.Descending = true
+	default:
+		Errorf(c, http.StatusUnprocessableEntity, "can only sort by %s or -%s", field, field)
+		return database.Page{}, false
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		var err error
+		page.Limit, err = strconv.Atoi(limit)
+		if err != nil || page.Limit < 1 || page.Limit > database.MaxPageSize {
+			Errorf(c, http.StatusUnprocessableEntity, "limit must be between 1 and %d", database.MaxPageSize)
+			return database.Page{}, false
+		}
+	}
+
+	return page, true
+}
@@ -0,0 +1,246 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// AuditAction is the kind of action recorded by an AuditEntry
+type AuditAction string
+
+const (
+	AuditCreateStudent   AuditAction = "student.create"
+	AuditUpdateStudent   AuditAction = "student.update"
+	AuditDeleteStudent   AuditAction = "student.delete"
+	AuditArchiveStudent  AuditAction = "student.archive"
+	AuditRestoreStudent  AuditAction = "student.restore"
+	AuditLogoutStudent   AuditAction = "student.logout"
+	AuditExportStudent   AuditAction = "student.export"
+	AuditEraseStudent    AuditAction = "student.erase"
+	AuditImportRoster    AuditAction = "student.import"
+	AuditCreateLocation  AuditAction = "location.create"
+	AuditUpdateLocation  AuditAction = "location.update"
+	AuditDeleteLocation  AuditAction = "location.delete"
+	AuditArchiveLocation AuditAction = "location.archive"
+	AuditRestoreLocation AuditAction = "location.restore"
+	AuditLogoutAll       AuditAction = "location.logout_all"
+	AuditCreateEvent     AuditAction = "event.create"
+	AuditVoidEvent       AuditAction = "event.void"
+	AuditMoveEvent       AuditAction = "event.move"
+	AuditContactReport   AuditAction = "trace.contact_report"
+	AuditRetention       AuditAction = "retention.run"
+	AuditCreateUser      AuditAction = "user.create"
+	AuditUpdateUser      AuditAction = "user.update"
+	AuditDeleteUser      AuditAction = "user.delete"
+	AuditRegisterDevice  AuditAction = "device.register"
+	AuditUpdateDevice    AuditAction = "device.update"
+	AuditRevokeDevice    AuditAction = "device.revoke"
+	AuditDeleteDevice    AuditAction = "device.delete"
+)
+
+// An AuditEntry records who did an administrative action and what it changed.
+// Entries are append only, so there is no way to update or delete them, except that
+// their snapshots are redacted when a student they target is erased.
+type AuditEntry struct {
+	ID   primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Time time.Time          `bson:"time" json:"time"`
+
+	// ActorID is the id of the user or device that did the action and
+	// Actor is their username or device name when they did it
+	ActorID primitive.ObjectID `bson:"actorid" json:"actor_id"`
+	Actor   string             `bson:"actor" json:"actor"`
+
+	Action AuditAction `bson:"action" json:"action"`
+	// TargetIDs are the ids of the models the action was done to
+	TargetIDs []primitive.ObjectID `bson:"targetids" json:"target_ids"`
+	// Details has any parameters of the action that aren't in the snapshots, like the dates of a contact report
+	Details map[string]interface{} `bson:"details,omitempty" json:"details,omitempty"`
+
+	Request AuditRequest `bson:"request" json:"request"`
+
+	// Before and After are the JSON of the target before and after the action.
+	// They are empty if the target didn't exist before or after.
+	Before json.RawMessage `bson:"before,omitempty" json:"before,omitempty"`
+	After  json.RawMessage `bson:"after,omitempty" json:"after,omitempty"`
+	// Redacted is true if the snapshots were removed because they had the data of an erased student
+	Redacted bool `bson:"redacted,omitempty" json:"redacted,omitempty"`
+}
+
+// AuditRequest is the request an AuditEntry was made by
+type AuditRequest struct {
+	Method    string `bson:"method" json:"method"`
+	Path      string `bson:"path" json:"path"`
+	IP        string `bson:"ip" json:"ip"`
+	UserAgent string `bson:"useragent" json:"user_agent"`
+}
+
+// AuditFilter selects the entries returned by GetAuditEntries. Zero fields match every entry.
+type AuditFilter struct {
+	ActorID  primitive.ObjectID
+	Action   AuditAction
+	TargetID primitive.ObjectID
+	// From and To are the range of times of the entries
+	From time.Time
+	To   time.Time
+	// Limit is the maximum number of entries returned
+	Limit int
+}
+
+// matches returns true if entry is selected by the filter
+func (filter AuditFilter) matches(entry AuditEntry) bool {
+	if !filter.ActorID.IsZero() && entry.ActorID != filter.ActorID {
+		return false
+	}
+	if filter.Action != "" && entry.Action != filter.Action {
+		return false
+	}
+	if !filter.From.IsZero() && entry.Time.Before(filter.From) {
+		return false
+	}
+	if !filter.To.IsZero() && entry.Time.After(filter.To) {
+		return false
+	}
+	if !filter.TargetID.IsZero() {
+		for _, id := range entry.TargetIDs {
+			if id == filter.TargetID {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// CreateAuditEntry appends an entry to the audit log and sets its ID
+func (db *Database) CreateAuditEntry(ctx context.Context, entry *AuditEntry) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	entry.ID = primitive.NewObjectID()
+	if _, err := db.Collections.Audit.InsertOne(ctx, entry); err != nil {
+		return wrapError(err)
+	}
+	return nil
+}
+
+// RedactAuditEntries removes the Before and After snapshots of every entry with target in
+// its TargetIDs. The snapshots of students and events have the data of the students they
+// are about, so this is done when a student is erased. The rest of the entry is kept so it
+// can still be seen who did what.
+func (db *Database) RedactAuditEntries(ctx context.Context, target primitive.ObjectID) (int64, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result, err := db.Collections.Audit.UpdateMany(ctx, bson.M{"targetids": target, "redacted": bson.M{"$ne": true}}, bson.M{
+		"$unset": bson.M{"before": "", "after": ""},
+		"$set":   bson.M{"redacted": true},
+	})
+	if err != nil {
+		return 0, wrapError(err)
+	}
+	return result.ModifiedCount, nil
+}
+
+// GetAuditEntries gets the audit entries selected by filter sorted from latest to earliest
+func (db *Database) GetAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	query := bson.M{}
+	if !filter.ActorID.IsZero() {
+		query["actorid"] = filter.ActorID
+	}
+	if filter.Action != "" {
+		query["action"] = filter.Action
+	}
+	if !filter.TargetID.IsZero() {
+		query["targetids"] = filter.TargetID
+	}
+	timeRange := bson.M{}
+	if !filter.From.IsZero() {
+		timeRange["$gte"] = filter.From
+	}
+	if !filter.To.IsZero() {
+		timeRange["$lte"] = filter.To
+	}
+	if len(timeRange) > 0 {
+		query["time"] = timeRange
+	}
+
+	findOptions := options.Find().SetSort(bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}})
+	if filter.Limit > 0 {
+		findOptions.SetLimit(int64(filter.Limit))
+	}
+
+	cursor, err := db.Collections.Audit.Find(ctx, query, findOptions)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	entries := make([]AuditEntry, 0)
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, wrapError(err)
+	}
+	return entries, nil
+}
+
+// CreateAuditEntry appends an entry to the audit log and sets its ID
+func (store *MemoryStore) CreateAuditEntry(ctx context.Context, entry *AuditEntry) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entry.ID = primitive.NewObjectID()
+	store.audit = append(store.audit, *entry)
+	return nil
+}
+
+// GetAuditEntries gets the audit entries selected by filter sorted from latest to earliest
+func (store *MemoryStore) GetAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError(err)
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	// entries are appended as they are created, so go backwards to get the latest first
+	entries := make([]AuditEntry, 0)
+	for i := len(store.audit) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(entries) >= filter.Limit {
+			break
+		}
+		if filter.matches(store.audit[i]) {
+			entries = append(entries, store.audit[i])
+		}
+	}
+	return entries, nil
+}
+
+// RedactAuditEntries removes the Before and After snapshots of every entry with target in its TargetIDs
+func (store *MemoryStore) RedactAuditEntries(ctx context.Context, target primitive.ObjectID) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, wrapError(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var count int64
+	for i, entry := range store.audit {
+		if entry.Redacted || !(AuditFilter{TargetID: target}).matches(entry) {
+			continue
+		}
+		entry.Before, entry.After, entry.Redacted = nil, nil, true
+		store.audit[i] = entry
+		count++
+	}
+	return count, nil
+}
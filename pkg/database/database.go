@@ -10,20 +10,28 @@ import (
 	"time"
 )
 
-// DB is a global Database that will be set after Connect is called
-var DB *Database
+// DB is a global Store that will be set after Connect or Open is called
+var DB Store
 
 // DatabaseConfig configures the connection to a Database
 type Config struct {
+	// The Store implementation to use, either DriverMongo or DriverMemory.
+	// If empty, mongo will be used
+	Driver string `json:"driver"`
+
 	// The connecting string to the mongo Database
 	// See https://docs.mongodb.com/manual/reference/connection-string/
 	MongoURI string `json:"mongo_uri"`
 
 	// The name of the Database to be used
 	DatabaseName string `json:"database_name"`
+
+	// The maximum time a single query can take before it is cancelled.
+	// If zero, queries will only be cancelled by their context
+	QueryTimeout time.Duration `json:"query_timeout"`
 }
 
-// A Database manages all of the models
+// A Database manages all of the models stored in mongo
 type Database struct {
 	Client   *mongo.Client
 	Database *mongo.Database
@@ -33,6 +41,11 @@ type Database struct {
 		Events    *mongo.Collection
 		Locations *mongo.Collection
 		Students  *mongo.Collection
+		Users     *mongo.Collection
+		Devices   *mongo.Collection
+		Audit     *mongo.Collection
+		// Migrations has the schema version, see Migrate
+		Migrations *mongo.Collection
 	}
 }
 
@@ -46,6 +59,10 @@ func newDatabase(client *mongo.Client, config Config) (Database, error) {
 	database.Collections.Events = database.Database.Collection("events")
 	database.Collections.Locations = database.Database.Collection("locations")
 	database.Collections.Students = database.Database.Collection("students")
+	database.Collections.Users = database.Database.Collection("users")
+	database.Collections.Devices = database.Database.Collection("devices")
+	database.Collections.Audit = database.Database.Collection("audit")
+	database.Collections.Migrations = database.Database.Collection("migrations")
 
 	return database, nil
 }
@@ -57,7 +74,8 @@ func Connect(config Config) (*Database, error) {
 	clientOptions := options.Client().ApplyURI(config.MongoURI)
 
 	// Create the context to time out after some seconds
-	ctx, _ := context.WithTimeout(context.Background(), time.Second*5)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
 
 	// Connect to the mongodb Database
 	client, err := mongo.Connect(ctx, clientOptions)
@@ -87,3 +105,12 @@ func Connect(config Config) (*Database, error) {
 
 	return &database, nil
 }
+
+// queryContext returns a context for a single query which will be cancelled
+// after config.QueryTimeout
+func (db *Database) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.config.QueryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, db.config.QueryTimeout)
+}
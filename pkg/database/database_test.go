@@ -1,9 +1,16 @@
 package database
 
 import (
+	"context"
+	"errors"
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -13,11 +20,10 @@ var TestDatabase *Database
 func TestConnect(t *testing.T) {
 	var err error
 
-	// Get the mongo URI from env var
+	// Get the mongo URI from env var. The mongo tests will be skipped if it isn't set
 	mongoURI, found := os.LookupEnv("TEST_MONGO_URI")
-	// Set it to localhost by default
 	if !found {
-		mongoURI = "mongodb://localhost"
+		t.Skip("TEST_MONGO_URI is not set, only the MemoryStore will be tested")
 	}
 
 	TestDatabase, err = Connect(Config{
@@ -32,60 +38,496 @@ func TestConnect(t *testing.T) {
 	// Purge the test database
 	_ = TestDatabase.Database.Drop(nil)
 	logrus.Infof("Purged the tests database")
+
+	// the unique indexes are tested too
+	if err := TestDatabase.EnsureIndexes(context.Background()); err != nil {
+		t.Fatalf("Could not create the indexes: %s", err)
+	}
+}
+
+// forEachStore runs test on a new MemoryStore and on TestDatabase if it is connected
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryStore())
+	})
+
+	if TestDatabase != nil {
+		t.Run("mongo", func(t *testing.T) {
+			test(t, TestDatabase)
+		})
+	}
 }
 
 func TestDatabase_GetMostRecentEvent(t *testing.T) {
-	if TestDatabase == nil {
-		t.Skip("TestDatabase was nil")
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		student := Student{Name: "Ben Aaron"}
+		store.CreateStudent(ctx, &student)
+
+		event1 := Event{
+			Time:    time.Now(),
+			Student: student.Ref(),
+		}
+		event2 := Event{
+			Time:    time.Now().Add(-5 * time.Second),
+			Student: student.Ref(),
+		}
+
+		store.CreateEvent(ctx, &event1)
+		store.CreateEvent(ctx, &event2)
+
+		mostRecentEvent, err := store.GetMostRecentEvent(ctx, student.Ref())
+		if err != nil {
+			t.Fatalf("Could not find the most recent event: %s", err)
+		}
+
+		if mostRecentEvent.ID != event1.ID {
+			t.Fatalf("The mostRecentEvent ID was %s while it should have been %s", mostRecentEvent.ID, event1.ID)
+		}
+
+		logrus.Infof("Found most recent event for student with mongo ID %s: %v+", student.ID, mostRecentEvent)
+	})
+}
+
+func TestDatabase_GetStudentByHandle(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		// Add an example student for the test
+		student := Student{
+			Name:           "Ben Aaron",
+			Email:          "baaron@gmail.com",
+			StudentHandles: []string{"12345", "testid1"},
+		}
+		store.CreateStudent(ctx, &student)
+
+		handle := "12345"
+		foundStudent, err := store.GetStudentByHandle(ctx, handle)
+		if err != nil {
+			t.Fatalf("Did not find any students by the handle %s: %s", handle, err)
+		}
+		if foundStudent.ID != student.ID {
+			t.Fatalf("Found the wrong student by handle. ID should be %s, ID %s", student.ID, foundStudent.ID)
+		}
+
+		logrus.Infof("Found student %v+ using handle %s", foundStudent, handle)
+	})
+}
+
+func TestDatabase_UpdateStudent(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		student := Student{Name: "Ben Aaron"}
+		store.CreateStudent(ctx, &student)
+
+		newStudent := Student{Name: "Cai Noel", StudentHandles: []string{"cai"}}
+		if err := store.UpdateStudent(ctx, student.ID, &newStudent); err != nil {
+			t.Fatalf("Could not update student %s: %s", student.ID, err)
+		}
+
+		foundStudent, err := store.GetStudentByID(ctx, student.ID)
+		if err != nil {
+			t.Fatalf("Could not find student %s after updating: %s", student.ID, err)
+		}
+		if foundStudent.Name != "Cai Noel" || newStudent.ID != student.ID {
+			t.Fatalf("Student was not updated: %v+", foundStudent)
+		}
+	})
+}
+
+func TestDatabase_DuplicateHandle(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		owner := Student{Name: "Ben Aaron", StudentHandles: []string{"duplicate1"}}
+		if err := store.CreateStudent(ctx, &owner); err != nil {
+			t.Fatalf("Could not create student: %s", err)
+		}
+		// students without handles don't conflict with each other
+		for i := 0; i < 2; i++ {
+			if err := store.CreateStudent(ctx, &Student{Name: "No handles"}); err != nil {
+				t.Fatalf("Could not create a student without handles: %s", err)
+			}
+		}
+
+		student := Student{Name: "Cai Noel", StudentHandles: []string{"duplicate2", "duplicate1"}}
+		err := store.CreateStudent(ctx, &student)
+		if !errors.Is(err, ErrDuplicateHandle) {
+			t.Fatalf("CreateStudent returned %v instead of ErrDuplicateHandle", err)
+		}
+		if !strings.Contains(err.Error(), owner.Name) {
+			t.Fatalf("The error %q doesn't name the owner of the handle", err)
+		}
+
+		student.StudentHandles = []string{"duplicate2"}
+		if err := store.CreateStudent(ctx, &student); err != nil {
+			t.Fatalf("Could not create student: %s", err)
+		}
+		// students can be updated without changing their handles
+		if err := store.UpdateStudent(ctx, student.ID, &student); err != nil {
+			t.Fatalf("Could not update student %s: %s", student.ID, err)
+		}
+		student.StudentHandles = []string{"duplicate2", "duplicate1"}
+		if err := store.UpdateStudent(ctx, student.ID, &student); !errors.Is(err, ErrDuplicateHandle) {
+			t.Fatalf("UpdateStudent returned %v instead of ErrDuplicateHandle", err)
+		}
+
+		// only one of the students created with the same handle at once is created
+		var wg sync.WaitGroup
+		var created int32
+		start := make(chan struct{})
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				if store.CreateStudent(ctx, &Student{Name: "Concurrent", StudentHandles: []string{"concurrent"}}) == nil {
+					atomic.AddInt32(&created, 1)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+		if created != 1 {
+			t.Fatalf("%d students were created with the same handle at once", created)
+		}
+	})
+}
+
+func TestDatabase_Query(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		// the names are created out of order and two are the same to check the ties
+		for _, name := range []string{"Paginate C", "Paginate A", "Paginate B", "Paginate B", "Paginate D"} {
+			store.CreateStudent(ctx, &Student{Name: name})
+		}
+		archived := Student{Name: "Paginate E", Archived: true}
+		store.CreateStudent(ctx, &archived)
+
+		var names []string
+		query := StudentQuery{Search: "paginate", Page: Page{Limit: 2}}
+		for page := 0; ; page++ {
+			students, next, err := store.QueryStudents(ctx, query)
+			if err != nil {
+				t.Fatalf("Could not query students: %s", err)
+			}
+			for _, student := range students {
+				names = append(names, student.Name)
+			}
+			if next == "" {
+				break
+			}
+			if page > 3 {
+				t.Fatalf("QueryStudents didn't stop returning pages")
+			}
+			query.Cursor = next
+		}
+		if strings.Join(names, ",") != "Paginate A,Paginate B,Paginate B,Paginate C,Paginate D" {
+			t.Fatalf("QueryStudents returned the wrong students: %v", names)
+		}
+
+		students, _, err := store.QueryStudents(ctx, StudentQuery{Search: "PAGINATE E", Archived: true})
+		if err != nil || len(students) != 1 || students[0].ID != archived.ID {
+			t.Fatalf("QueryStudents didn't find the archived student: %v %v", students, err)
+		}
+
+		student := Student{Name: "Ben Aaron"}
+		store.CreateStudent(ctx, &student)
+		baseTime := time.Now().Truncate(time.Millisecond)
+		for i := 0; i < 5; i++ {
+			store.CreateEvent(ctx, &Event{Student: student.Ref(), Time: baseTime.Add(time.Duration(i) * time.Minute)})
+		}
+		eventQuery := EventQuery{Student: student.Ref(), Page: Page{Limit: 3, Descending: true}}
+		events, next, err := store.QueryEvents(ctx, eventQuery)
+		if err != nil || len(events) != 3 || next == "" {
+			t.Fatalf("QueryEvents returned %d events and cursor %q: %v", len(events), next, err)
+		}
+		eventQuery.Cursor = next
+		events, next, err = store.QueryEvents(ctx, eventQuery)
+		if err != nil || len(events) != 2 || next != "" {
+			t.Fatalf("QueryEvents returned %d events and cursor %q on the last page: %v", len(events), next, err)
+		}
+		if !events[0].Time.Equal(baseTime.Add(time.Minute)) || !events[1].Time.Equal(baseTime) {
+			t.Fatalf("Events were not sorted from latest to earliest: %v+", events)
+		}
+
+		if _, _, err := store.QueryLocations(ctx, LocationQuery{Page: Page{Cursor: "not a cursor"}}); !errors.Is(err, ErrInvalidCursor) {
+			t.Fatalf("QueryLocations returned %v instead of ErrInvalidCursor", err)
+		}
+	})
+}
+
+func TestDatabase_GetAllEventsBetween(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		baseTime := time.Now()
+		student := Student{Name: "Ben Aaron"}
+		store.CreateStudent(ctx, &student)
+
+		// create the events out of order
+		for _, offset := range []time.Duration{-2 * time.Minute, -10 * time.Minute, -time.Minute, -3 * time.Hour} {
+			store.CreateEvent(ctx, &Event{Student: student.Ref(), Time: baseTime.Add(offset)})
+		}
+
+		// only check this student's events because the mongo database is shared between tests
+		var events []Event
+		allEvents, err := store.GetAllEventsBetween(ctx, baseTime.Add(-time.Hour), baseTime)
+		if err != nil {
+			t.Fatalf("Could not get events: %s", err)
+		}
+		for _, event := range allEvents {
+			if event.Student == student.Ref() {
+				events = append(events, event)
+			}
+		}
+		if len(events) != 3 {
+			t.Fatalf("Found %d events in the last hour when there should have been 3", len(events))
+		}
+		for i := 1; i < len(events); i++ {
+			if events[i].Time.Before(events[i-1].Time) {
+				t.Fatalf("Events were not sorted from earliest to latest: %v+", events)
+			}
+		}
+	})
+}
+
+func TestDatabase_GetStudentEventsBetween(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		baseTime := time.Now()
+		student := Student{Name: "Ben Aaron"}
+		store.CreateStudent(ctx, &student)
+
+		for _, offset := range []time.Duration{-2 * time.Minute, -10 * time.Minute, -3 * time.Hour} {
+			store.CreateEvent(ctx, &Event{Student: student.Ref(), Time: baseTime.Add(offset)})
+		}
+		store.CreateEvent(ctx, &Event{Student: StudentRef(primitive.NewObjectID()), Time: baseTime.Add(-time.Minute)})
+		store.CreateEvent(ctx, &Event{Student: student.Ref(), Time: baseTime.Add(-time.Minute), Voided: &EventCorrection{Reason: "wrong student"}})
+
+		events, err := store.GetStudentEventsBetween(ctx, student.Ref(), baseTime.Add(-time.Hour), baseTime)
+		if err != nil {
+			t.Fatalf("Could not get events: %s", err)
+		}
+		if len(events) != 2 {
+			t.Fatalf("Found %d of the student's events in the last hour when there should have been 2", len(events))
+		}
+		if !events[0].Time.Before(events[1].Time) {
+			t.Fatalf("Events were not sorted from earliest to latest: %+v", events)
+		}
+	})
+}
+
+func TestDatabase_GetEventByIdempotencyKey(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		key := primitive.NewObjectID().Hex()
+		event := Event{Time: time.Now(), IdempotencyKey: key}
+		store.CreateEvent(ctx, &event)
+		store.CreateEvent(ctx, &Event{Time: time.Now()})
+
+		foundEvent, err := store.GetEventByIdempotencyKey(ctx, key)
+		if err != nil {
+			t.Fatalf("Could not get event by idempotency key: %s", err)
+		}
+		if foundEvent.ID != event.ID {
+			t.Fatalf("Found event %s by idempotency key instead of %s", foundEvent.ID, event.ID)
+		}
+
+		if _, err := store.GetEventByIdempotencyKey(ctx, "not a key"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("GetEventByIdempotencyKey returned %v instead of ErrNotFound", err)
+		}
+
+		if err := store.CreateEvent(ctx, &Event{Time: time.Now(), IdempotencyKey: key}); !errors.Is(err, ErrDuplicateIdempotencyKey) {
+			t.Fatalf("Creating an event with a used idempotency key returned %v instead of ErrDuplicateIdempotencyKey", err)
+		}
+	})
+}
+
+func TestDatabase_VoidEvent(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		event := Event{Time: time.Now(), EventType: EventEnter}
+		store.CreateEvent(ctx, &event)
+
+		voided, err := store.VoidEvent(ctx, event.ID, &EventCorrection{Reason: "wrong location"})
+		if err != nil {
+			t.Fatalf("Could not void event: %s", err)
+		}
+		if voided.Voided == nil || voided.Voided.Reason != "wrong location" || !voided.Time.Equal(event.Time) {
+			t.Fatalf("VoidEvent returned %+v", voided)
+		}
+
+		if _, err := store.VoidEvent(ctx, event.ID, &EventCorrection{Reason: "again"}); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Voiding an event twice returned %v instead of ErrNotFound", err)
+		}
+
+		if err := store.UnvoidEvent(ctx, event.ID); err != nil {
+			t.Fatalf("Could not unvoid event: %s", err)
+		}
+		if found, _ := store.GetEventByID(ctx, event.ID); found.Voided != nil {
+			t.Fatalf("The event is still voided after UnvoidEvent")
+		}
+		if err := store.UnvoidEvent(ctx, primitive.NewObjectID()); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("UnvoidEvent returned %v instead of ErrNotFound for a missing event", err)
+		}
+	})
+}
+
+func TestDuplicateKeyIndex(t *testing.T) {
+	err := mongo.WriteException{WriteErrors: mongo.WriteErrors{{
+		Code:    11000,
+		Message: "E11000 duplicate key error collection: prod.events index: idempotencykey_unique dup key: { idempotencykey: \"a\" }",
+	}}}
+	if !errors.Is(wrapError(err), ErrDuplicateIdempotencyKey) {
+		t.Fatalf("A duplicate idempotency key was wrapped as %v", wrapError(err))
 	}
 
-	studentID, _ := primitive.ObjectIDFromHex("000000000000000000000001")
-	event1 := Event{
-		Time:      time.Now(),
-		StudentID: studentID,
+	err.WriteErrors[0].Message = "E11000 duplicate key error collection: prod.students index: studenthandles_unique dup key: { studenthandles: \"a\" }"
+	if !errors.Is(wrapError(err), ErrDuplicateHandle) {
+		t.Fatalf("A duplicate student handle was wrapped as %v", wrapError(err))
 	}
-	event2 := Event{
-		Time:      time.Now().Add(-5 * time.Second),
-		StudentID: studentID,
+
+	err.WriteErrors[0].Message = "E11000 duplicate key error collection: prod.users index: username_1 dup key: { username: \"a\" }"
+	if wrapped := wrapError(err); !errors.Is(wrapped, ErrDuplicateKey) || errors.Is(wrapped, ErrDuplicateHandle) {
+		t.Fatalf("A duplicate key in another index was wrapped as %v", wrapped)
 	}
+}
 
-	TestDatabase.CreateEvent(&event1)
-	TestDatabase.CreateEvent(&event2)
+func TestDatabase_GetAuditEntries(t *testing.T) {
+	ctx := context.Background()
 
-	// Get the most recent event with an empty student ID
-	mostRecentEvent, ok := TestDatabase.GetMostRecentEvent(studentID)
-	if !ok {
-		t.Fatalf("Could not find the most recent event")
-	}
+	forEachStore(t, func(t *testing.T, store Store) {
+		target := primitive.NewObjectID()
+		start := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+		store.CreateAuditEntry(ctx, &AuditEntry{Time: start, Action: AuditCreateStudent, TargetIDs: []primitive.ObjectID{target}})
+		store.CreateAuditEntry(ctx, &AuditEntry{Time: start.Add(time.Minute), Action: AuditUpdateStudent, TargetIDs: []primitive.ObjectID{target}})
+		store.CreateAuditEntry(ctx, &AuditEntry{Time: start.Add(time.Minute), Action: AuditUpdateStudent})
+
+		entries, err := store.GetAuditEntries(ctx, AuditFilter{TargetID: target})
+		if err != nil {
+			t.Fatalf("Could not get audit entries: %s", err)
+		}
+		if len(entries) != 2 || entries[0].Action != AuditUpdateStudent {
+			t.Fatalf("Got %v instead of the two entries for the target from latest to earliest", entries)
+		}
 
-	if mostRecentEvent.ID != event1.ID {
-		t.Fatalf("The mostRecentEvent ID was %s while it should have been %s", mostRecentEvent.ID, event1.ID)
+		entries, err = store.GetAuditEntries(ctx, AuditFilter{TargetID: target, Action: AuditCreateStudent, To: start})
+		if err != nil {
+			t.Fatalf("Could not get audit entries: %s", err)
+		}
+		if len(entries) != 1 || entries[0].Action != AuditCreateStudent {
+			t.Fatalf("Got %v instead of the entry created by the action", entries)
+		}
+	})
+}
+
+func TestDatabase_NotFound(t *testing.T) {
+	ctx := context.Background()
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		id := primitive.NewObjectID()
+
+		if _, err := store.GetStudentByID(ctx, id); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("GetStudentByID returned %v instead of ErrNotFound", err)
+		}
+		if err := store.DeleteLocation(ctx, id); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("DeleteLocation returned %v instead of ErrNotFound", err)
+		}
+		if _, err := store.GetStudentByHandle(ctx, "not a handle"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("GetStudentByHandle returned %v instead of ErrNotFound", err)
+		}
+		if _, err := store.GetEventByIDString(ctx, "not an id"); !errors.Is(err, ErrInvalidID) {
+			t.Fatalf("GetEventByIDString returned %v instead of ErrInvalidID", err)
+		}
+	})
+}
+
+func TestDatabase_CancelledContext(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if _, err := store.GetStudents(ctx); !errors.Is(err, context.Canceled) {
+			t.Fatalf("GetStudents returned %v with a cancelled context", err)
+		}
+
+		ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		defer cancel()
+
+		if _, err := store.GetAllEventsBetween(ctx, time.Unix(0, 0), time.Now()); !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrUnavailable) {
+			t.Fatalf("GetAllEventsBetween returned %v instead of the context's error after the deadline", err)
+		}
+	})
+}
+
+func TestIsUnavailableError(t *testing.T) {
+	tests := []struct {
+		err         error
+		unavailable bool
+	}{
+		{topology.ServerSelectionError{Wrapped: topology.ErrServerSelectionTimeout}, true},
+		{topology.ConnectionError{Wrapped: errors.New("connection refused")}, true},
+		{mongo.CommandError{Labels: []string{"NetworkError"}}, true},
+		{mongo.ErrClientDisconnected, true},
+		// the caller ended the context, so mongo may be fine
+		{topology.ServerSelectionError{Wrapped: context.Canceled}, false},
+		{context.DeadlineExceeded, false},
+		{mongo.CommandError{Code: 11000}, false},
 	}
 
-	logrus.Infof("Found most recent event for student with mongo ID %s: %v+", studentID, mostRecentEvent)
+	for _, test := range tests {
+		if isUnavailableError(test.err) != test.unavailable {
+			t.Errorf("isUnavailableError(%v) was %t", test.err, !test.unavailable)
+		}
+	}
 }
 
-func TestDatabase_GetStudentByHandle(t *testing.T) {
+func TestMigrations(t *testing.T) {
+	for i, migration := range Migrations {
+		if migration.Version != i+1 {
+			t.Fatalf("Migration %d has version %d, migrations have to be in order starting at 1", i, migration.Version)
+		}
+	}
+
 	if TestDatabase == nil {
-		t.Skip("TestDatabase was nil")
+		t.Skip("TEST_MONGO_URI is not set")
 	}
+	ctx := context.Background()
 
-	// Add an example student for the test
-	student := Student{
-		Name:           "Ben Aaron",
-		Email:          "baaron@gmail.com",
-		StudentHandles: []string{"12345", "testid1"},
+	if _, err := TestDatabase.Migrate(ctx, true); err != nil {
+		t.Fatalf("Could not dry run the migrations: %s", err)
+	}
+	if applied, _ := TestDatabase.AppliedMigrations(ctx); len(applied) != 0 {
+		t.Fatalf("A dry run applied %d migrations", len(applied))
 	}
-	TestDatabase.CreateStudent(&student)
 
-	handle := "12345"
-	foundStudent, found := TestDatabase.GetStudentByHandle(handle)
-	if !found {
-		t.Fatalf("Did not find any students by the handle %s", handle)
+	if _, err := TestDatabase.Migrate(ctx, false); err != nil {
+		t.Fatalf("Could not migrate: %s", err)
 	}
-	if foundStudent.ID != student.ID {
-		t.Fatalf("Found the wrong student by handle. ID should be %s, ID %s", student.ID, foundStudent.ID)
+	pending, err := TestDatabase.PendingMigrations(ctx)
+	if err != nil || len(pending) != 0 {
+		t.Fatalf("There are %d pending migrations after migrating: %v", len(pending), err)
 	}
 
-	logrus.Infof("Found student %v+ using handle %s", foundStudent, handle)
+	// only one instance can migrate at a time
+	unlock, err := TestDatabase.lockMigrations(ctx)
+	if err != nil {
+		t.Fatalf("Could not lock the migrations: %s", err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 2*migrationLockRetry)
+	defer cancel()
+	if _, err := TestDatabase.Migrate(waitCtx, false); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Migrating while the migrations were locked returned %v", err)
+	}
+	unlock()
+	if _, err := TestDatabase.Migrate(ctx, false); err != nil {
+		t.Fatalf("Could not migrate after the migrations were unlocked: %s", err)
+	}
 }
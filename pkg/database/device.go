@@ -0,0 +1,64 @@
+package database
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+)
+
+// A Device is a kiosk that scans students in and out of a single location.
+// It logs in with a token instead of a username and password.
+type Device struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name     string             `bson:"name" json:"name"`
+	Location LocationRef        `bson:"location" json:"location"`
+
+	// TokenHash is the SHA-256 hash of the device's token. The token itself is never stored.
+	TokenHash []byte `bson:"tokenhash" json:"-"`
+	// Revoked devices can't log in anymore
+	Revoked bool `bson:"revoked" json:"revoked"`
+
+	CreatedAt time.Time `bson:"createdat" json:"created_at"`
+	// LastSeen is the last time the device used the API
+	LastSeen time.Time `bson:"lastseen" json:"last_seen"`
+}
+
+// GetDeviceByTokenHash gets the device with the TokenHash hash. If the device
+// could not be found, the error will be ErrNotFound
+func (db *Database) GetDeviceByTokenHash(ctx context.Context, hash []byte) (device Device, err error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result := db.Collections.Devices.FindOne(ctx, bson.M{"tokenhash": hash})
+
+	if err := result.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return Device{}, notFoundf("device was not found")
+		}
+		return Device{}, wrapError(err)
+	}
+
+	if err := result.Decode(&device); err != nil {
+		return Device{}, wrapError(err)
+	}
+
+	return device, nil
+}
+
+// SetDeviceLastSeen sets the LastSeen time of a device without changing anything else
+func (db *Database) SetDeviceLastSeen(ctx context.Context, id primitive.ObjectID, lastSeen time.Time) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result, err := db.Collections.Devices.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"lastseen": lastSeen}})
+	if err != nil {
+		return wrapError(err)
+	}
+	if result.MatchedCount == 0 {
+		return notFoundf("no Devices found with id %s", id.Hex())
+	}
+
+	return nil
+}
@@ -0,0 +1,166 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+	"strings"
+)
+
+// The errors returned by a Store can be compared to these using errors.Is
+var (
+	// ErrNotFound is returned when a model could not be found
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidID is returned when an ID could not be parsed into an ObjectID
+	ErrInvalidID = errors.New("invalid id")
+	// ErrDuplicateHandle is returned when a student handle is already used by another student
+	ErrDuplicateHandle = errors.New("student handle is already in use")
+	// ErrDuplicateUsername is returned when a username is already used by another user
+	ErrDuplicateUsername = errors.New("username is already in use")
+	// ErrDuplicateIdempotencyKey is returned when an event is created with the
+	// IdempotencyKey of an event that already exists
+	ErrDuplicateIdempotencyKey = errors.New("idempotency key was already used")
+	// ErrDuplicateKey is returned when a document conflicts with another one in a
+	// unique index that none of the errors above are for
+	ErrDuplicateKey = errors.New("duplicate key")
+	// ErrInvalidCursor is returned when the cursor of a Page could not be parsed
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrUnavailable is returned when the database could not be reached
+	ErrUnavailable = errors.New("database is unavailable")
+)
+
+// An Error is returned by a Store when an operation fails. Kind is one of the
+// errors above and Message describes what went wrong.
+type Error struct {
+	Kind    error
+	Message string
+}
+
+func (err *Error) Error() string {
+	return err.Message
+}
+
+// Unwrap returns Kind so errors.Is can be used on an Error
+func (err *Error) Unwrap() error {
+	return err.Kind
+}
+
+// notFoundf creates an ErrNotFound Error with a formatted message
+func notFoundf(format string, args ...interface{}) error {
+	return &Error{Kind: ErrNotFound, Message: fmt.Sprintf(format, args...)}
+}
+
+// parseObjectID parses a hex ObjectID and returns an ErrInvalidID Error if it is invalid
+func parseObjectID(id string) (primitive.ObjectID, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return primitive.NilObjectID, &Error{Kind: ErrInvalidID, Message: fmt.Sprintf("invalid id %s", id)}
+	}
+	return objectID, nil
+}
+
+// wrapError converts an error returned by the mongo driver into an Error if it
+// matches one of the errors above. Other errors are returned unchanged.
+func wrapError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if index, ok := duplicateKeyIndex(err); ok {
+		switch index {
+		case studentHandlesIndex:
+			return &Error{Kind: ErrDuplicateHandle, Message: err.Error()}
+		case idempotencyKeyIndex:
+			return &Error{Kind: ErrDuplicateIdempotencyKey, Message: err.Error()}
+		default:
+			return &Error{Kind: ErrDuplicateKey, Message: err.Error()}
+		}
+	}
+
+	if isUnavailableError(err) {
+		return &Error{Kind: ErrUnavailable, Message: fmt.Sprintf("database is unavailable: %s", err)}
+	}
+
+	return err
+}
+
+// isDuplicateKeyError returns true if err was caused by a unique index
+func isDuplicateKeyError(err error) bool {
+	_, ok := duplicateKeyIndex(err)
+	return ok
+}
+
+// duplicateKeyIndex returns the name of the unique index that caused err and true if err
+// is a duplicate key error. The driver doesn't return the index by itself, so it is read
+// from the message, which looks like
+// "E11000 duplicate key error collection: prod.events index: idempotencykey_unique dup key: ...".
+// The name is empty if the message doesn't have it.
+func duplicateKeyIndex(err error) (string, bool) {
+	var message string
+	var writeException mongo.WriteException
+	var commandError mongo.CommandError
+	switch {
+	case errors.As(err, &writeException):
+		for _, writeError := range writeException.WriteErrors {
+			if writeError.Code == 11000 {
+				message = writeError.Message
+				break
+			}
+		}
+		if message == "" {
+			return "", false
+		}
+	case errors.As(err, &commandError) && commandError.Code == 11000:
+		message = commandError.Message
+	default:
+		return "", false
+	}
+
+	const prefix = " index: "
+	start := strings.Index(message, prefix)
+	if start < 0 {
+		return "", true
+	}
+	index := message[start+len(prefix):]
+	if end := strings.IndexByte(index, ' '); end >= 0 {
+		index = index[:end]
+	}
+	return index, true
+}
+
+// isUnavailableError returns true if err was caused by not being able to reach mongo.
+// Errors caused by a context ending aren't, even if the driver was selecting a server or
+// using a connection when it ended, because the caller may have cancelled it or given it
+// a short deadline. The caller knows which it was, so they are returned unchanged.
+func isUnavailableError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var serverSelectionError topology.ServerSelectionError
+	var connectionError topology.ConnectionError
+	return errors.Is(err, mongo.ErrClientDisconnected) || errors.As(err, &serverSelectionError) ||
+		errors.As(err, &connectionError) || mongo.IsNetworkError(err)
+}
+
+// A conflictChecker is a model with fields that must be unique between models,
+// like student handles
+type conflictChecker interface {
+	// checkConflicts returns an Error if the model conflicts with a model in the
+	// store other than the one with the id
+	checkConflicts(ctx context.Context, store Store, id primitive.ObjectID) error
+}
+
+// checkConflicts checks a model for conflicts before it is saved with the id if it is
+// a conflictChecker. Mongo's unique indexes also catch conflicts, but their errors
+// don't say which model the conflict is with.
+func checkConflicts(ctx context.Context, store Store, id primitive.ObjectID, model interface{}) error {
+	checker, ok := model.(conflictChecker)
+	if !ok {
+		return nil
+	}
+	return checker.checkConflicts(ctx, store, id)
+}
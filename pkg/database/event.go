@@ -25,94 +25,337 @@ const (
 	EventSourceAutoLeave           // When a student leaves the library by not singing out for a period of time
 	EventSourceLoggedOut           // When a student is manually logged out through the console
 	EventSourceLoggedOutAll        // When the log out all button is clicked
+	EventSourceTransferred         // When a student leaves a location by scanning into another one
+	EventSourceManual              // When an event is created by hand to correct the history
 )
 
 // An Event represents a student either entering or leaving a location
 type Event struct {
 	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	Location  LocationRef        `json:"location"`
-	Student   StudentRef         `json:"student"`
-	Time      time.Time          `json:"time"`
-	EventType EventType          `json:"event_type"`
-	Source    EventSource        `json:"source"`
+	Location  LocationRef        `bson:"location" json:"location"`
+	Student   StudentRef         `bson:"student" json:"student"`
+	Time      time.Time          `bson:"time" json:"time"`
+	EventType EventType          `bson:"eventtype" json:"event_type"`
+	Source    EventSource        `bson:"source" json:"source"`
+
+	// IdempotencyKey is a key generated by the client that created the event so the
+	// same event is never created twice. It is unique, and keys sent to the api start
+	// with the device or user that sent them.
+	IdempotencyKey string `bson:"idempotencykey,omitempty" json:"idempotency_key,omitempty"`
+
+	// Correction is why the event was created if it was created by hand
+	Correction *EventCorrection `bson:"correction,omitempty" json:"correction,omitempty"`
+	// Voided is set when the event was found to be wrong. Voided events are kept so
+	// the history can be audited, but they are ignored everywhere else.
+	Voided *EventCorrection `bson:"voided,omitempty" json:"voided,omitempty"`
+	// Anonymized events were older than the retention period, so the student was removed
+	// from them. They are only kept for the statistics of their location, which get them
+	// with GetLocationEventsBetween, and are ignored everywhere else.
+	Anonymized bool `bson:"anonymized,omitempty" json:"anonymized,omitempty"`
+}
+
+// An EventCorrection records who changed the history of events by hand and why
+type EventCorrection struct {
+	Reason string    `bson:"reason" json:"reason"`
+	Time   time.Time `bson:"time" json:"time"`
+	// By is the id of the user who made the correction
+	By primitive.ObjectID `bson:"by" json:"by"`
+	// Replaces is the event that was voided when this one was created, if it was moved
+	Replaces *primitive.ObjectID `bson:"replaces,omitempty" json:"replaces,omitempty"`
 }
 
+// activeEvents adds to an event query so voided and anonymized events are ignored
+func activeEvents(filter bson.M) bson.M {
+	filter["voided"] = bson.M{"$exists": false}
+	filter["anonymized"] = bson.M{"$ne": true}
+	return filter
+}
 
 // GetMostRecentEvent gets the most recent event created by the specified studentID
-// If the event is found, it will be returned, otherwise, found will be false.
-// If there is an error getting the most recent event, it will be returned
-func (db *Database) GetMostRecentEvent(studentRef StudentRef) (event Event, found bool) {
-	return db.GetMostRecentEventBetween(studentRef, time.Unix(0, 0), time.Now())
+// If there is no event, the error will be ErrNotFound
+func (db *Database) GetMostRecentEvent(ctx context.Context, studentRef StudentRef) (event Event, err error) {
+	return db.GetMostRecentEventBetween(ctx, studentRef, time.Unix(0, 0), time.Now())
 }
 
 // GetMostRecentEventBetween gets the most recent event between two time intervals
-func (db *Database) GetMostRecentEventBetween(studentRef StudentRef, minTime time.Time, maxTime time.Time) (event Event, found bool) {
-	result := db.Collections.Events.FindOne(context.TODO(), bson.D{
-		{"student", studentRef},
-		{"time", bson.M{"$lt": maxTime}},
-		{"time", bson.M{"$gt": minTime}},
-	}, &options.FindOneOptions{
-		Sort: bson.D{{"time", -1}},
+func (db *Database) GetMostRecentEventBetween(ctx context.Context, studentRef StudentRef, minTime time.Time, maxTime time.Time) (event Event, err error) {
+	return db.getMostRecentEvent(ctx, activeEvents(bson.M{
+		"student": studentRef,
+		"time":    bson.M{"$gt": minTime, "$lt": maxTime},
+	}))
+}
+
+// GetMostRecentEventBetweenWithType gets the most recent event between two time intervals and filters by an event type
+func (db *Database) GetMostRecentEventBetweenWithType(ctx context.Context, studentRef StudentRef, minTime time.Time, maxTime time.Time, eventType EventType) (event Event, err error) {
+	return db.getMostRecentEvent(ctx, activeEvents(bson.M{
+		"student":   studentRef,
+		"eventtype": eventType,
+		"time":      bson.M{"$gt": minTime, "$lt": maxTime},
+	}))
+}
+
+// getMostRecentEvent gets the latest event matching filter. If there is no
+// event, the error will be ErrNotFound
+func (db *Database) getMostRecentEvent(ctx context.Context, filter bson.M) (event Event, err error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	// events created at the same time are sorted by their ids, which increase as they are created
+	result := db.Collections.Events.FindOne(ctx, filter, &options.FindOneOptions{
+		Sort: bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}},
 	})
 
-	err := result.Err()
-	// If the event was not found
-	if err == mongo.ErrNoDocuments {
-		return Event{}, false
-	} else if err != nil { // If there was another error
-		panic(err)
+	if err := result.Err(); err != nil {
+		// If the event was not found
+		if err == mongo.ErrNoDocuments {
+			return Event{}, notFoundf("no events found")
+		}
+		return Event{}, wrapError(err)
 	}
 
 	if err := result.Decode(&event); err != nil {
-		panic(err)
+		return Event{}, wrapError(err)
 	}
 
-	return event, true
+	return event, nil
 }
 
-// GetMostRecentEventBetweenWithType gets the most recent event between two time intervals and filters by an event type
-func (db *Database) GetMostRecentEventBetweenWithType(studentRef StudentRef, minTime time.Time, maxTime time.Time, eventType EventType) (event Event, found bool) {
-	result := db.Collections.Events.FindOne(context.TODO(), bson.D{
-		{"student", studentRef},
-		{"eventtype", eventType},
-		{"time", bson.M{"$lt": maxTime}},
-		{"time", bson.M{"$gt": minTime}},
-	}, &options.FindOneOptions{
-		Sort: bson.D{{"time", -1}},
-	})
+// GetEventByIdempotencyKey gets the event created with the IdempotencyKey key, even if it
+// was voided so it isn't created again. If there is no event, the error will be ErrNotFound
+func (db *Database) GetEventByIdempotencyKey(ctx context.Context, key string) (event Event, err error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result := db.Collections.Events.FindOne(ctx, bson.M{"idempotencykey": key})
 
-	err := result.Err()
-	// If the event was not found
-	if err == mongo.ErrNoDocuments {
-		return Event{}, false
-	} else if err != nil { // If there was another error
-		panic(err)
+	if err := result.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return Event{}, notFoundf("event with idempotency key %s was not found", key)
+		}
+		return Event{}, wrapError(err)
 	}
 
 	if err := result.Decode(&event); err != nil {
-		panic(err)
+		return Event{}, wrapError(err)
 	}
 
-	return event, true
+	return event, nil
 }
 
-// GetAllEventsBetween gets all of the events between minTime and maxTime.
+// GetAllEventsBetween gets all of the events that weren't voided or anonymized between minTime and maxTime.
 // The events will be sorted by earliest to latest.
-func (db *Database) GetAllEventsBetween(minTime time.Time, maxTime time.Time) []Event {
-	cursor, err := db.Collections.Events.Find(context.TODO(), bson.D{
-		{"time", bson.M{"$lt": maxTime}},
-		{"time", bson.M{"$gt": minTime}},
+func (db *Database) GetAllEventsBetween(ctx context.Context, minTime time.Time, maxTime time.Time) ([]Event, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	cursor, err := db.Collections.Events.Find(ctx, activeEvents(bson.M{
+		"time": bson.M{"$gt": minTime, "$lt": maxTime},
+	}), &options.FindOptions{
+		Sort: bson.D{{Key: "time", Value: 1}, {Key: "_id", Value: 1}},
+	})
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	events := make([]Event, 0)
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, wrapError(err)
+	}
+
+	return events, nil
+}
+
+// GetStudentEventsBetween gets the events of a student that weren't voided between minTime and
+// maxTime sorted from earliest to latest
+func (db *Database) GetStudentEventsBetween(ctx context.Context, studentRef StudentRef, minTime time.Time, maxTime time.Time) ([]Event, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	cursor, err := db.Collections.Events.Find(ctx, activeEvents(bson.M{
+		"student": studentRef,
+		"time":    bson.M{"$gt": minTime, "$lt": maxTime},
+	}), &options.FindOptions{
+		Sort: bson.D{{Key: "time", Value: 1}, {Key: "_id", Value: 1}},
+	})
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	events := make([]Event, 0)
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, wrapError(err)
+	}
+
+	return events, nil
+}
+
+// GetLocationEventsBetween gets the events that weren't voided at a location between minTime
+// and maxTime sorted from earliest to latest. Unlike GetAllEventsBetween, anonymized events
+// are included, so they should only be used for statistics that don't need the students.
+func (db *Database) GetLocationEventsBetween(ctx context.Context, locationRef LocationRef, minTime time.Time, maxTime time.Time) ([]Event, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	cursor, err := db.Collections.Events.Find(ctx, bson.M{
+		"location": locationRef,
+		"time":     bson.M{"$gt": minTime, "$lt": maxTime},
+		"voided":   bson.M{"$exists": false},
 	}, &options.FindOptions{
-		Sort: bson.D{{"time", 1}},
+		Sort: bson.D{{Key: "time", Value: 1}, {Key: "_id", Value: 1}},
+	})
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	events := make([]Event, 0)
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, wrapError(err)
+	}
+
+	return events, nil
+}
+
+// PurgeEventsBefore deletes every event before t, including voided and anonymized events,
+// and returns the number deleted. If dryRun is true, nothing is deleted and the number that
+// would have been is returned.
+func (db *Database) PurgeEventsBefore(ctx context.Context, t time.Time, dryRun bool) (int64, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	filter := bson.M{"time": bson.M{"$lt": t}}
+	if dryRun {
+		count, err := db.Collections.Events.CountDocuments(ctx, filter)
+		return count, wrapError(err)
+	}
+
+	result, err := db.Collections.Events.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, wrapError(err)
+	}
+	return result.DeletedCount, nil
+}
+
+// AnonymizeEventsBefore removes the student from every event before t and returns the
+// number of events changed. If dryRun is true, nothing is changed and the number that
+// would have been is returned.
+func (db *Database) AnonymizeEventsBefore(ctx context.Context, t time.Time, dryRun bool) (int64, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	filter := bson.M{"time": bson.M{"$lt": t}, "anonymized": bson.M{"$ne": true}}
+	if dryRun {
+		count, err := db.Collections.Events.CountDocuments(ctx, filter)
+		return count, wrapError(err)
+	}
+
+	result, err := db.Collections.Events.UpdateMany(ctx, filter, bson.M{"$set": bson.M{
+		"student":    primitive.NilObjectID,
+		"anonymized": true,
+	}})
+	if err != nil {
+		return 0, wrapError(err)
+	}
+	return result.ModifiedCount, nil
+}
+
+// GetEventsByStudent gets every event of a student sorted from earliest to latest,
+// including the events that were voided
+func (db *Database) GetEventsByStudent(ctx context.Context, studentRef StudentRef) ([]Event, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	cursor, err := db.Collections.Events.Find(ctx, bson.M{"student": studentRef}, &options.FindOptions{
+		Sort: bson.D{{Key: "time", Value: 1}, {Key: "_id", Value: 1}},
 	})
 	if err != nil {
-		panic(err)
+		return nil, wrapError(err)
 	}
 
 	events := make([]Event, 0)
-	if err := cursor.All(nil, &events); err != nil {
-		panic(err)
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, wrapError(err)
+	}
+
+	return events, nil
+}
+
+// DeleteEventsByStudent deletes every event of a student and returns the number deleted
+func (db *Database) DeleteEventsByStudent(ctx context.Context, studentRef StudentRef) (int64, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result, err := db.Collections.Events.DeleteMany(ctx, bson.M{"student": studentRef})
+	if err != nil {
+		return 0, wrapError(err)
+	}
+	return result.DeletedCount, nil
+}
+
+// DeleteEventsByLocation deletes every event at a location and returns the number deleted
+func (db *Database) DeleteEventsByLocation(ctx context.Context, locationRef LocationRef) (int64, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result, err := db.Collections.Events.DeleteMany(ctx, bson.M{"location": locationRef})
+	if err != nil {
+		return 0, wrapError(err)
+	}
+	return result.DeletedCount, nil
+}
+
+// PseudonymizeEventsByStudent replaces the student of every one of their events with pseudonym
+// and returns the number of events changed. The events aren't anonymized, so they are still
+// counted like the events of any student who was deleted.
+func (db *Database) PseudonymizeEventsByStudent(ctx context.Context, studentRef StudentRef, pseudonym StudentRef) (int64, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result, err := db.Collections.Events.UpdateMany(ctx, bson.M{"student": studentRef}, bson.M{"$set": bson.M{
+		"student": pseudonym,
+	}})
+	if err != nil {
+		return 0, wrapError(err)
+	}
+	return result.ModifiedCount, nil
+}
+
+// VoidEvent sets Voided on an event that wasn't voided yet without changing anything else,
+// so two corrections of the same event can't both succeed. It returns the voided event.
+// If the event doesn't exist or was already voided, the error will be ErrNotFound.
+func (db *Database) VoidEvent(ctx context.Context, id primitive.ObjectID, correction *EventCorrection) (Event, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result := db.Collections.Events.FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "voided": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"voided": correction}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After))
+
+	if err := result.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return Event{}, notFoundf("no Events that weren't voided found with id %s", id.Hex())
+		}
+		return Event{}, wrapError(err)
 	}
 
-	return events
+	var event Event
+	if err := result.Decode(&event); err != nil {
+		return Event{}, wrapError(err)
+	}
+	return event, nil
+}
+
+// UnvoidEvent removes Voided from an event without changing anything else
+func (db *Database) UnvoidEvent(ctx context.Context, id primitive.ObjectID) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result, err := db.Collections.Events.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$unset": bson.M{"voided": ""}})
+	if err != nil {
+		return wrapError(err)
+	}
+	if result.MatchedCount == 0 {
+		return notFoundf("no Events found with id %s", id.Hex())
+	}
+	return nil
 }
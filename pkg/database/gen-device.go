@@ -0,0 +1,199 @@
+// This file was automatically generated by genny.
+// Any changes will be lost if this file is regenerated.
+// see https://github.com/cheekybits/genny
+
+// This file contains generic code for implementing basic methods
+// for each device such as references, Get by ID, Update, etc...
+// If you're not modifying these functions, you shouldn't have to worry
+// about regenerating code. However, if you updated this file, to update
+// the changes for each of the devices you would have to install
+// genny https://github.com/cheekybits/genny and run go generate.
+
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DeviceStore contains the basic methods every Store implements for Devices
+type DeviceStore interface {
+	CreateDevice(ctx context.Context, device *Device) error
+	GetDevices(ctx context.Context) ([]Device, error)
+	GetDeviceByID(ctx context.Context, id primitive.ObjectID) (Device, error)
+	GetDeviceByIDString(ctx context.Context, id string) (Device, error)
+	DeleteDevice(ctx context.Context, id primitive.ObjectID) error
+	UpdateDevice(ctx context.Context, id primitive.ObjectID, newDevice *Device) error
+}
+
+// DeviceRef is a reference to a Device which, when serialized, will return
+// the json of the referenced object.
+//
+// Be careful for circular references.
+type DeviceRef primitive.ObjectID
+
+func (ref DeviceRef) GetBSON() (interface{}, error) {
+	return primitive.ObjectID(ref), nil
+}
+
+// MarshalJSON returns the json of the referenced object, or null if the ref is empty.
+// If the object was deleted, only its id is returned, see deletedRef.
+func (ref DeviceRef) MarshalJSON() ([]byte, error) {
+	if primitive.ObjectID(ref).IsZero() {
+		return []byte("null"), nil
+	}
+
+	obj, err := DB.GetDeviceByID(context.Background(), primitive.ObjectID(ref))
+	if errors.Is(err, ErrNotFound) {
+		return json.Marshal(deletedRef{ID: primitive.ObjectID(ref), Deleted: true})
+	} else if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(obj)
+}
+
+// Same functionality is ObjectID.UnmarshalJSON except it returns an error if the referenced object doesn't exist
+func (ref *DeviceRef) UnmarshalJSON(b []byte) error {
+	id := primitive.ObjectID(*ref)
+	if err := id.UnmarshalJSON(b); err != nil {
+		return err
+	}
+	if _, err := DB.GetDeviceByID(context.Background(), id); err != nil {
+		return err
+	}
+
+	*ref = DeviceRef(id)
+	return nil
+}
+
+// Get gets the referenced object. If it doesn't exist, the error will be ErrNotFound
+func (ref DeviceRef) Get(ctx context.Context) (Device, error) {
+	return DB.GetDeviceByID(ctx, primitive.ObjectID(ref))
+}
+
+// Ref creates a reference to the object
+func (obj Device) Ref() DeviceRef {
+	return DeviceRef(obj.ID)
+}
+
+// CreateDevice creates a Device and adds it to the database. The
+// ID element of the newly created Device will be set if it is successful
+func (db *Database) CreateDevice(ctx context.Context, device *Device) error {
+	if err := checkConflicts(ctx, db, device.ID, device); err != nil {
+		return err
+	}
+
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result, err := db.Collections.Devices.InsertOne(ctx, device)
+	if err != nil {
+		return wrapError(err)
+	}
+
+	device.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// GetDevices returns a list of all devices stored in the database.
+func (db *Database) GetDevices(ctx context.Context) ([]Device, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	cur, err := db.Collections.Devices.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	devices := make([]Device, 0)
+	if err := cur.All(ctx, &devices); err != nil {
+		return nil, wrapError(err)
+	}
+
+	return devices, nil
+}
+
+// GetDeviceByID gets a device by their ID. If not found, the error will be ErrNotFound
+func (db *Database) GetDeviceByID(ctx context.Context, id primitive.ObjectID) (device Device, err error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result := db.Collections.Devices.FindOne(ctx, bson.M{"_id": id})
+
+	if err := result.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return Device{}, notFoundf("no Devices found with id %s", id.Hex())
+		}
+		return Device{}, wrapError(err)
+	}
+
+	if err := result.Decode(&device); err != nil {
+		return Device{}, wrapError(err)
+	}
+
+	return device, nil
+}
+
+// GetDeviceByIDString gets a device by its ID as a string. If the ID could not be
+// parsed into an object ID, the error will be ErrInvalidID. If the device could not be
+// found, it will be ErrNotFound
+func (db *Database) GetDeviceByIDString(ctx context.Context, id string) (Device, error) {
+	objectID, err := parseObjectID(id)
+	if err != nil {
+		return Device{}, err
+	}
+
+	return db.GetDeviceByID(ctx, objectID)
+}
+
+// DeleteDevice deletes a device from the database by ID. If the device could not be
+// found, the error will be ErrNotFound
+func (db *Database) DeleteDevice(ctx context.Context, id primitive.ObjectID) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result := db.Collections.Devices.FindOneAndDelete(ctx, bson.M{"_id": id})
+
+	if err := result.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return notFoundf("no Devices found with id %s", id.Hex())
+		}
+		return wrapError(err)
+	}
+	return nil
+}
+
+// UpdateDevice finds a device by its ID and updates it. newDevice will be set to the
+// updated device if it is successful. If the device could not be found, the error
+// will be ErrNotFound
+func (db *Database) UpdateDevice(ctx context.Context, id primitive.ObjectID, newDevice *Device) error {
+	if err := checkConflicts(ctx, db, id, newDevice); err != nil {
+		return err
+	}
+
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result := db.Collections.Devices.FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$set": newDevice},
+		options.FindOneAndUpdate().SetReturnDocument(options.After))
+
+	if err := result.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return notFoundf("no Devices found with id %s", id.Hex())
+		}
+		return wrapError(err)
+	}
+
+	if err := result.Decode(newDevice); err != nil {
+		return wrapError(err)
+	}
+
+	return nil
+}
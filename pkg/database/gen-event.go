@@ -14,13 +14,24 @@ package database
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// EventStore contains the basic methods every Store implements for Events
+type EventStore interface {
+	CreateEvent(ctx context.Context, event *Event) error
+	GetEvents(ctx context.Context) ([]Event, error)
+	GetEventByID(ctx context.Context, id primitive.ObjectID) (Event, error)
+	GetEventByIDString(ctx context.Context, id string) (Event, error)
+	DeleteEvent(ctx context.Context, id primitive.ObjectID) error
+	UpdateEvent(ctx context.Context, id primitive.ObjectID, newEvent *Event) error
+}
+
 // EventRef is a reference to a Event which, when serialized, will return
 // the json of the referenced object.
 //
@@ -31,10 +42,18 @@ func (ref EventRef) GetBSON() (interface{}, error) {
 	return primitive.ObjectID(ref), nil
 }
 
+// MarshalJSON returns the json of the referenced object, or null if the ref is empty.
+// If the object was deleted, only its id is returned, see deletedRef.
 func (ref EventRef) MarshalJSON() ([]byte, error) {
-	obj, found := DB.GetEventByID(primitive.ObjectID(ref))
-	if !found {
-		return nil, fmt.Errorf("could not find Event with id %s", ref)
+	if primitive.ObjectID(ref).IsZero() {
+		return []byte("null"), nil
+	}
+
+	obj, err := DB.GetEventByID(context.Background(), primitive.ObjectID(ref))
+	if errors.Is(err, ErrNotFound) {
+		return json.Marshal(deletedRef{ID: primitive.ObjectID(ref), Deleted: true})
+	} else if err != nil {
+		return nil, err
 	}
 
 	return json.Marshal(obj)
@@ -46,22 +65,17 @@ func (ref *EventRef) UnmarshalJSON(b []byte) error {
 	if err := id.UnmarshalJSON(b); err != nil {
 		return err
 	}
-	_, found := DB.GetEventByID(id)
-	if !found {
-		return fmt.Errorf("object not found")
+	if _, err := DB.GetEventByID(context.Background(), id); err != nil {
+		return err
 	}
 
 	*ref = EventRef(id)
 	return nil
 }
 
-// Gets the referenced object and panics if it doesn't exist
-func (ref EventRef) Get() Event {
-	obj, found := DB.GetEventByID(primitive.ObjectID(ref))
-	if !found {
-		panic("could not find object")
-	}
-	return obj
+// Get gets the referenced object. If it doesn't exist, the error will be ErrNotFound
+func (ref EventRef) Get(ctx context.Context) (Event, error) {
+	return DB.GetEventByID(ctx, primitive.ObjectID(ref))
 }
 
 // Ref creates a reference to the object
@@ -71,94 +85,115 @@ func (obj Event) Ref() EventRef {
 
 // CreateEvent creates a Event and adds it to the database. The
 // ID element of the newly created Event will be set if it is successful
-func (db *Database) CreateEvent(event *Event) {
-	result, err := db.Collections.Events.InsertOne(context.TODO(), event)
+func (db *Database) CreateEvent(ctx context.Context, event *Event) error {
+	if err := checkConflicts(ctx, db, event.ID, event); err != nil {
+		return err
+	}
+
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result, err := db.Collections.Events.InsertOne(ctx, event)
 	if err != nil {
-		panic(err)
+		return wrapError(err)
 	}
 
 	event.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
 }
 
 // GetEvents returns a list of all events stored in the database.
-func (db *Database) GetEvents() []Event {
-	cur, err := db.Collections.Events.Find(context.TODO(), bson.D{})
+func (db *Database) GetEvents(ctx context.Context) ([]Event, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	cur, err := db.Collections.Events.Find(ctx, bson.D{})
 	if err != nil {
-		panic(err)
+		return nil, wrapError(err)
 	}
 
 	events := make([]Event, 0)
-	if err := cur.All(context.TODO(), &events); err != nil {
-		panic(err)
+	if err := cur.All(ctx, &events); err != nil {
+		return nil, wrapError(err)
 	}
 
-	return events
+	return events, nil
 }
 
-// GetEventByID gets a event by their ID. If not found, found will be false and
-// err will be nil.
-func (db *Database) GetEventByID(id primitive.ObjectID) (event Event, found bool) {
-	result := db.Collections.Events.FindOne(nil, bson.M{"_id": id})
+// GetEventByID gets a event by their ID. If not found, the error will be ErrNotFound
+func (db *Database) GetEventByID(ctx context.Context, id primitive.ObjectID) (event Event, err error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
 
-	err := result.Err()
-	if err != nil {
+	result := db.Collections.Events.FindOne(ctx, bson.M{"_id": id})
+
+	if err := result.Err(); err != nil {
 		if err == mongo.ErrNoDocuments {
-			return Event{}, false
+			return Event{}, notFoundf("no Events found with id %s", id.Hex())
 		}
-		panic(err)
+		return Event{}, wrapError(err)
 	}
 
 	if err := result.Decode(&event); err != nil {
-		panic(err)
+		return Event{}, wrapError(err)
 	}
 
-	found = true
-	return
+	return event, nil
 }
 
 // GetEventByIDString gets a event by its ID as a string. If the ID could not be
-// parsed into an object ID or the event could not be found, an error will be returned
-func (db *Database) GetEventByIDString(id string) (Event, error) {
-	objectID, err := primitive.ObjectIDFromHex(id)
+// parsed into an object ID, the error will be ErrInvalidID. If the event could not be
+// found, it will be ErrNotFound
+func (db *Database) GetEventByIDString(ctx context.Context, id string) (Event, error) {
+	objectID, err := parseObjectID(id)
 	if err != nil {
 		return Event{}, err
 	}
 
-	event, found := db.GetEventByID(objectID)
-	if !found {
-		return Event{}, fmt.Errorf("no Events found with id %s", objectID.Hex())
-	}
-
-	return event, nil
+	return db.GetEventByID(ctx, objectID)
 }
 
 // DeleteEvent deletes a event from the database by ID. If the event could not be
-// found, success will be false
-func (db *Database) DeleteEvent(id primitive.ObjectID) bool {
-	result := db.Collections.Events.FindOneAndDelete(nil, bson.M{"_id": id})
+// found, the error will be ErrNotFound
+func (db *Database) DeleteEvent(ctx context.Context, id primitive.ObjectID) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
 
-	err := result.Err()
-	if err != nil {
+	result := db.Collections.Events.FindOneAndDelete(ctx, bson.M{"_id": id})
+
+	if err := result.Err(); err != nil {
 		if err == mongo.ErrNoDocuments {
-			return false
+			return notFoundf("no Events found with id %s", id.Hex())
 		}
-		panic(err)
+		return wrapError(err)
 	}
-	return true
+	return nil
 }
 
-// UpdateEvent finds a event by its ID and updates it
-func (db *Database) UpdateEvent(id primitive.ObjectID, newEvent *Event) bool {
-	result := db.Collections.Locations.FindOneAndUpdate(nil, bson.M{"_id": id}, bson.M{"$set": newEvent})
-	err := result.Err()
-	if err != nil {
+// UpdateEvent finds a event by its ID and updates it. newEvent will be set to the
+// updated event if it is successful. If the event could not be found, the error
+// will be ErrNotFound
+func (db *Database) UpdateEvent(ctx context.Context, id primitive.ObjectID, newEvent *Event) error {
+	if err := checkConflicts(ctx, db, id, newEvent); err != nil {
+		return err
+	}
+
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result := db.Collections.Events.FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$set": newEvent},
+		options.FindOneAndUpdate().SetReturnDocument(options.After))
+
+	if err := result.Err(); err != nil {
 		if err == mongo.ErrNoDocuments {
-			return false
+			return notFoundf("no Events found with id %s", id.Hex())
 		}
-		panic(err)
+		return wrapError(err)
 	}
 
-	err = result.Decode(newEvent)
+	if err := result.Decode(newEvent); err != nil {
+		return wrapError(err)
+	}
 
-	return true
+	return nil
 }
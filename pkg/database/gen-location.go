@@ -14,13 +14,24 @@ package database
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// LocationStore contains the basic methods every Store implements for Locations
+type LocationStore interface {
+	CreateLocation(ctx context.Context, location *Location) error
+	GetLocations(ctx context.Context) ([]Location, error)
+	GetLocationByID(ctx context.Context, id primitive.ObjectID) (Location, error)
+	GetLocationByIDString(ctx context.Context, id string) (Location, error)
+	DeleteLocation(ctx context.Context, id primitive.ObjectID) error
+	UpdateLocation(ctx context.Context, id primitive.ObjectID, newLocation *Location) error
+}
+
 // LocationRef is a reference to a Location which, when serialized, will return
 // the json of the referenced object.
 //
@@ -31,10 +42,18 @@ func (ref LocationRef) GetBSON() (interface{}, error) {
 	return primitive.ObjectID(ref), nil
 }
 
+// MarshalJSON returns the json of the referenced object, or null if the ref is empty.
+// If the object was deleted, only its id is returned, see deletedRef.
 func (ref LocationRef) MarshalJSON() ([]byte, error) {
-	obj, found := DB.GetLocationByID(primitive.ObjectID(ref))
-	if !found {
-		return nil, fmt.Errorf("could not find Location with id %s", ref)
+	if primitive.ObjectID(ref).IsZero() {
+		return []byte("null"), nil
+	}
+
+	obj, err := DB.GetLocationByID(context.Background(), primitive.ObjectID(ref))
+	if errors.Is(err, ErrNotFound) {
+		return json.Marshal(deletedRef{ID: primitive.ObjectID(ref), Deleted: true})
+	} else if err != nil {
+		return nil, err
 	}
 
 	return json.Marshal(obj)
@@ -46,22 +65,17 @@ func (ref *LocationRef) UnmarshalJSON(b []byte) error {
 	if err := id.UnmarshalJSON(b); err != nil {
 		return err
 	}
-	_, found := DB.GetLocationByID(id)
-	if !found {
-		return fmt.Errorf("object not found")
+	if _, err := DB.GetLocationByID(context.Background(), id); err != nil {
+		return err
 	}
 
 	*ref = LocationRef(id)
 	return nil
 }
 
-// Gets the referenced object and panics if it doesn't exist
-func (ref LocationRef) Get() Location {
-	obj, found := DB.GetLocationByID(primitive.ObjectID(ref))
-	if !found {
-		panic("could not find object")
-	}
-	return obj
+// Get gets the referenced object. If it doesn't exist, the error will be ErrNotFound
+func (ref LocationRef) Get(ctx context.Context) (Location, error) {
+	return DB.GetLocationByID(ctx, primitive.ObjectID(ref))
 }
 
 // Ref creates a reference to the object
@@ -71,94 +85,115 @@ func (obj Location) Ref() LocationRef {
 
 // CreateLocation creates a Location and adds it to the database. The
 // ID element of the newly created Location will be set if it is successful
-func (db *Database) CreateLocation(location *Location) {
-	result, err := db.Collections.Locations.InsertOne(context.TODO(), location)
+func (db *Database) CreateLocation(ctx context.Context, location *Location) error {
+	if err := checkConflicts(ctx, db, location.ID, location); err != nil {
+		return err
+	}
+
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result, err := db.Collections.Locations.InsertOne(ctx, location)
 	if err != nil {
-		panic(err)
+		return wrapError(err)
 	}
 
 	location.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
 }
 
 // GetLocations returns a list of all locations stored in the database.
-func (db *Database) GetLocations() []Location {
-	cur, err := db.Collections.Locations.Find(context.TODO(), bson.D{})
+func (db *Database) GetLocations(ctx context.Context) ([]Location, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	cur, err := db.Collections.Locations.Find(ctx, bson.D{})
 	if err != nil {
-		panic(err)
+		return nil, wrapError(err)
 	}
 
 	locations := make([]Location, 0)
-	if err := cur.All(context.TODO(), &locations); err != nil {
-		panic(err)
+	if err := cur.All(ctx, &locations); err != nil {
+		return nil, wrapError(err)
 	}
 
-	return locations
+	return locations, nil
 }
 
-// GetLocationByID gets a location by their ID. If not found, found will be false and
-// err will be nil.
-func (db *Database) GetLocationByID(id primitive.ObjectID) (location Location, found bool) {
-	result := db.Collections.Locations.FindOne(nil, bson.M{"_id": id})
+// GetLocationByID gets a location by their ID. If not found, the error will be ErrNotFound
+func (db *Database) GetLocationByID(ctx context.Context, id primitive.ObjectID) (location Location, err error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
 
-	err := result.Err()
-	if err != nil {
+	result := db.Collections.Locations.FindOne(ctx, bson.M{"_id": id})
+
+	if err := result.Err(); err != nil {
 		if err == mongo.ErrNoDocuments {
-			return Location{}, false
+			return Location{}, notFoundf("no Locations found with id %s", id.Hex())
 		}
-		panic(err)
+		return Location{}, wrapError(err)
 	}
 
 	if err := result.Decode(&location); err != nil {
-		panic(err)
+		return Location{}, wrapError(err)
 	}
 
-	found = true
-	return
+	return location, nil
 }
 
 // GetLocationByIDString gets a location by its ID as a string. If the ID could not be
-// parsed into an object ID or the location could not be found, an error will be returned
-func (db *Database) GetLocationByIDString(id string) (Location, error) {
-	objectID, err := primitive.ObjectIDFromHex(id)
+// parsed into an object ID, the error will be ErrInvalidID. If the location could not be
+// found, it will be ErrNotFound
+func (db *Database) GetLocationByIDString(ctx context.Context, id string) (Location, error) {
+	objectID, err := parseObjectID(id)
 	if err != nil {
 		return Location{}, err
 	}
 
-	location, found := db.GetLocationByID(objectID)
-	if !found {
-		return Location{}, fmt.Errorf("no Locations found with id %s", objectID.Hex())
-	}
-
-	return location, nil
+	return db.GetLocationByID(ctx, objectID)
 }
 
 // DeleteLocation deletes a location from the database by ID. If the location could not be
-// found, success will be false
-func (db *Database) DeleteLocation(id primitive.ObjectID) bool {
-	result := db.Collections.Locations.FindOneAndDelete(nil, bson.M{"_id": id})
+// found, the error will be ErrNotFound
+func (db *Database) DeleteLocation(ctx context.Context, id primitive.ObjectID) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
 
-	err := result.Err()
-	if err != nil {
+	result := db.Collections.Locations.FindOneAndDelete(ctx, bson.M{"_id": id})
+
+	if err := result.Err(); err != nil {
 		if err == mongo.ErrNoDocuments {
-			return false
+			return notFoundf("no Locations found with id %s", id.Hex())
 		}
-		panic(err)
+		return wrapError(err)
 	}
-	return true
+	return nil
 }
 
-// UpdateLocation finds a location by its ID and updates it
-func (db *Database) UpdateLocation(id primitive.ObjectID, newLocation *Location) bool {
-	result := db.Collections.Locations.FindOneAndUpdate(nil, bson.M{"_id": id}, bson.M{"$set": newLocation})
-	err := result.Err()
-	if err != nil {
+// UpdateLocation finds a location by its ID and updates it. newLocation will be set to the
+// updated location if it is successful. If the location could not be found, the error
+// will be ErrNotFound
+func (db *Database) UpdateLocation(ctx context.Context, id primitive.ObjectID, newLocation *Location) error {
+	if err := checkConflicts(ctx, db, id, newLocation); err != nil {
+		return err
+	}
+
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result := db.Collections.Locations.FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$set": newLocation},
+		options.FindOneAndUpdate().SetReturnDocument(options.After))
+
+	if err := result.Err(); err != nil {
 		if err == mongo.ErrNoDocuments {
-			return false
+			return notFoundf("no Locations found with id %s", id.Hex())
 		}
-		panic(err)
+		return wrapError(err)
 	}
 
-	err = result.Decode(newLocation)
+	if err := result.Decode(newLocation); err != nil {
+		return wrapError(err)
+	}
 
-	return true
+	return nil
 }
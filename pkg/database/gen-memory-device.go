@@ -0,0 +1,139 @@
+// This file was automatically generated by genny.
+// Any changes will be lost if this file is regenerated.
+// see https://github.com/cheekybits/genny
+
+// This file contains generic code for implementing the basic methods
+// for each device on the MemoryStore. Like the template of the Mongo methods,
+// if you update this file you will have to install genny https://github.com/cheekybits/genny
+// and run go generate to update the generated code for each of the devices.
+
+package database
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// CreateDevice creates a Device and adds it to the store. The
+// ID element of the newly created Device will be set if it is successful
+func (store *MemoryStore) CreateDevice(ctx context.Context, device *Device) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(err)
+	}
+	if err := checkConflicts(ctx, store, device.ID, device); err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if device.ID.IsZero() {
+		device.ID = primitive.NewObjectID()
+	}
+	if _, found := store.devices[device.ID]; found {
+		return fmt.Errorf("Device with id %s already exists", device.ID.Hex())
+	}
+	if err := store.checkUnique(device); err != nil {
+		return err
+	}
+
+	store.devices[device.ID] = *device
+	return nil
+}
+
+// GetDevices returns a list of all devices in the store in the order they were created.
+func (store *MemoryStore) GetDevices(ctx context.Context) ([]Device, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError(err)
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	devices := make([]Device, 0, len(store.devices))
+	for _, device := range store.devices {
+		devices = append(devices, device)
+	}
+	// ObjectIDs start with their creation time and a counter, so sorting by them
+	// keeps the same order mongo returns documents in
+	sort.Slice(devices, func(i, j int) bool {
+		return bytes.Compare(devices[i].ID[:], devices[j].ID[:]) < 0
+	})
+
+	return devices, nil
+}
+
+// GetDeviceByID gets a device by their ID. If not found, the error will be ErrNotFound
+func (store *MemoryStore) GetDeviceByID(ctx context.Context, id primitive.ObjectID) (Device, error) {
+	if err := ctx.Err(); err != nil {
+		return Device{}, wrapError(err)
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	device, found := store.devices[id]
+	if !found {
+		return Device{}, notFoundf("no Devices found with id %s", id.Hex())
+	}
+	return device, nil
+}
+
+// GetDeviceByIDString gets a device by its ID as a string. If the ID could not be
+// parsed into an object ID, the error will be ErrInvalidID. If the device could not be
+// found, it will be ErrNotFound
+func (store *MemoryStore) GetDeviceByIDString(ctx context.Context, id string) (Device, error) {
+	objectID, err := parseObjectID(id)
+	if err != nil {
+		return Device{}, err
+	}
+
+	return store.GetDeviceByID(ctx, objectID)
+}
+
+// DeleteDevice deletes a device from the store by ID. If the device could not be
+// found, the error will be ErrNotFound
+func (store *MemoryStore) DeleteDevice(ctx context.Context, id primitive.ObjectID) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, found := store.devices[id]; !found {
+		return notFoundf("no Devices found with id %s", id.Hex())
+	}
+	delete(store.devices, id)
+	return nil
+}
+
+// UpdateDevice finds a device by its ID and replaces it. newDevice will be set to the
+// updated device if it is successful. If the device could not be found, the error
+// will be ErrNotFound
+func (store *MemoryStore) UpdateDevice(ctx context.Context, id primitive.ObjectID, newDevice *Device) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(err)
+	}
+	if err := checkConflicts(ctx, store, id, newDevice); err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, found := store.devices[id]; !found {
+		return notFoundf("no Devices found with id %s", id.Hex())
+	}
+
+	newDevice.ID = id
+	if err := store.checkUnique(newDevice); err != nil {
+		return err
+	}
+	store.devices[id] = *newDevice
+	return nil
+}
@@ -0,0 +1,139 @@
+// This file was automatically generated by genny.
+// Any changes will be lost if this file is regenerated.
+// see https://github.com/cheekybits/genny
+
+// This file contains generic code for implementing the basic methods
+// for each event on the MemoryStore. Like the template of the Mongo methods,
+// if you update this file you will have to install genny https://github.com/cheekybits/genny
+// and run go generate to update the generated code for each of the events.
+
+package database
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// CreateEvent creates a Event and adds it to the store. The
+// ID element of the newly created Event will be set if it is successful
+func (store *MemoryStore) CreateEvent(ctx context.Context, event *Event) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(err)
+	}
+	if err := checkConflicts(ctx, store, event.ID, event); err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if event.ID.IsZero() {
+		event.ID = primitive.NewObjectID()
+	}
+	if _, found := store.events[event.ID]; found {
+		return fmt.Errorf("Event with id %s already exists", event.ID.Hex())
+	}
+	if err := store.checkUnique(event); err != nil {
+		return err
+	}
+
+	store.events[event.ID] = *event
+	return nil
+}
+
+// GetEvents returns a list of all events in the store in the order they were created.
+func (store *MemoryStore) GetEvents(ctx context.Context) ([]Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError(err)
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	events := make([]Event, 0, len(store.events))
+	for _, event := range store.events {
+		events = append(events, event)
+	}
+	// ObjectIDs start with their creation time and a counter, so sorting by them
+	// keeps the same order mongo returns documents in
+	sort.Slice(events, func(i, j int) bool {
+		return bytes.Compare(events[i].ID[:], events[j].ID[:]) < 0
+	})
+
+	return events, nil
+}
+
+// GetEventByID gets a event by their ID. If not found, the error will be ErrNotFound
+func (store *MemoryStore) GetEventByID(ctx context.Context, id primitive.ObjectID) (Event, error) {
+	if err := ctx.Err(); err != nil {
+		return Event{}, wrapError(err)
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	event, found := store.events[id]
+	if !found {
+		return Event{}, notFoundf("no Events found with id %s", id.Hex())
+	}
+	return event, nil
+}
+
+// GetEventByIDString gets a event by its ID as a string. If the ID could not be
+// parsed into an object ID, the error will be ErrInvalidID. If the event could not be
+// found, it will be ErrNotFound
+func (store *MemoryStore) GetEventByIDString(ctx context.Context, id string) (Event, error) {
+	objectID, err := parseObjectID(id)
+	if err != nil {
+		return Event{}, err
+	}
+
+	return store.GetEventByID(ctx, objectID)
+}
+
+// DeleteEvent deletes a event from the store by ID. If the event could not be
+// found, the error will be ErrNotFound
+func (store *MemoryStore) DeleteEvent(ctx context.Context, id primitive.ObjectID) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, found := store.events[id]; !found {
+		return notFoundf("no Events found with id %s", id.Hex())
+	}
+	delete(store.events, id)
+	return nil
+}
+
+// UpdateEvent finds a event by its ID and replaces it. newEvent will be set to the
+// updated event if it is successful. If the event could not be found, the error
+// will be ErrNotFound
+func (store *MemoryStore) UpdateEvent(ctx context.Context, id primitive.ObjectID, newEvent *Event) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(err)
+	}
+	if err := checkConflicts(ctx, store, id, newEvent); err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, found := store.events[id]; !found {
+		return notFoundf("no Events found with id %s", id.Hex())
+	}
+
+	newEvent.ID = id
+	if err := store.checkUnique(newEvent); err != nil {
+		return err
+	}
+	store.events[id] = *newEvent
+	return nil
+}
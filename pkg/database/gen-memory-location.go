@@ -0,0 +1,139 @@
+// This file was automatically generated by genny.
+// Any changes will be lost if this file is regenerated.
+// see https://github.com/cheekybits/genny
+
+// This file contains generic code for implementing the basic methods
+// for each location on the MemoryStore. Like the template of the Mongo methods,
+// if you update this file you will have to install genny https://github.com/cheekybits/genny
+// and run go generate to update the generated code for each of the locations.
+
+package database
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// CreateLocation creates a Location and adds it to the store. The
+// ID element of the newly created Location will be set if it is successful
+func (store *MemoryStore) CreateLocation(ctx context.Context, location *Location) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(err)
+	}
+	if err := checkConflicts(ctx, store, location.ID, location); err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if location.ID.IsZero() {
+		location.ID = primitive.NewObjectID()
+	}
+	if _, found := store.locations[location.ID]; found {
+		return fmt.Errorf("Location with id %s already exists", location.ID.Hex())
+	}
+	if err := store.checkUnique(location); err != nil {
+		return err
+	}
+
+	store.locations[location.ID] = *location
+	return nil
+}
+
+// GetLocations returns a list of all locations in the store in the order they were created.
+func (store *MemoryStore) GetLocations(ctx context.Context) ([]Location, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError(err)
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	locations := make([]Location, 0, len(store.locations))
+	for _, location := range store.locations {
+		locations = append(locations, location)
+	}
+	// ObjectIDs start with their creation time and a counter, so sorting by them
+	// keeps the same order mongo returns documents in
+	sort.Slice(locations, func(i, j int) bool {
+		return bytes.Compare(locations[i].ID[:], locations[j].ID[:]) < 0
+	})
+
+	return locations, nil
+}
+
+// GetLocationByID gets a location by their ID. If not found, the error will be ErrNotFound
+func (store *MemoryStore) GetLocationByID(ctx context.Context, id primitive.ObjectID) (Location, error) {
+	if err := ctx.Err(); err != nil {
+		return Location{}, wrapError(err)
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	location, found := store.locations[id]
+	if !found {
+		return Location{}, notFoundf("no Locations found with id %s", id.Hex())
+	}
+	return location, nil
+}
+
+// GetLocationByIDString gets a location by its ID as a string. If the ID could not be
+// parsed into an object ID, the error will be ErrInvalidID. If the location could not be
+// found, it will be ErrNotFound
+func (store *MemoryStore) GetLocationByIDString(ctx context.Context, id string) (Location, error) {
+	objectID, err := parseObjectID(id)
+	if err != nil {
+		return Location{}, err
+	}
+
+	return store.GetLocationByID(ctx, objectID)
+}
+
+// DeleteLocation deletes a location from the store by ID. If the location could not be
+// found, the error will be ErrNotFound
+func (store *MemoryStore) DeleteLocation(ctx context.Context, id primitive.ObjectID) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, found := store.locations[id]; !found {
+		return notFoundf("no Locations found with id %s", id.Hex())
+	}
+	delete(store.locations, id)
+	return nil
+}
+
+// UpdateLocation finds a location by its ID and replaces it. newLocation will be set to the
+// updated location if it is successful. If the location could not be found, the error
+// will be ErrNotFound
+func (store *MemoryStore) UpdateLocation(ctx context.Context, id primitive.ObjectID, newLocation *Location) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(err)
+	}
+	if err := checkConflicts(ctx, store, id, newLocation); err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, found := store.locations[id]; !found {
+		return notFoundf("no Locations found with id %s", id.Hex())
+	}
+
+	newLocation.ID = id
+	if err := store.checkUnique(newLocation); err != nil {
+		return err
+	}
+	store.locations[id] = *newLocation
+	return nil
+}
@@ -0,0 +1,139 @@
+// This file was automatically generated by genny.
+// Any changes will be lost if this file is regenerated.
+// see https://github.com/cheekybits/genny
+
+// This file contains generic code for implementing the basic methods
+// for each student on the MemoryStore. Like the template of the Mongo methods,
+// if you update this file you will have to install genny https://github.com/cheekybits/genny
+// and run go generate to update the generated code for each of the students.
+
+package database
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// CreateStudent creates a Student and adds it to the store. The
+// ID element of the newly created Student will be set if it is successful
+func (store *MemoryStore) CreateStudent(ctx context.Context, student *Student) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(err)
+	}
+	if err := checkConflicts(ctx, store, student.ID, student); err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if student.ID.IsZero() {
+		student.ID = primitive.NewObjectID()
+	}
+	if _, found := store.students[student.ID]; found {
+		return fmt.Errorf("Student with id %s already exists", student.ID.Hex())
+	}
+	if err := store.checkUnique(student); err != nil {
+		return err
+	}
+
+	store.students[student.ID] = *student
+	return nil
+}
+
+// GetStudents returns a list of all students in the store in the order they were created.
+func (store *MemoryStore) GetStudents(ctx context.Context) ([]Student, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError(err)
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	students := make([]Student, 0, len(store.students))
+	for _, student := range store.students {
+		students = append(students, student)
+	}
+	// ObjectIDs start with their creation time and a counter, so sorting by them
+	// keeps the same order mongo returns documents in
+	sort.Slice(students, func(i, j int) bool {
+		return bytes.Compare(students[i].ID[:], students[j].ID[:]) < 0
+	})
+
+	return students, nil
+}
+
+// GetStudentByID gets a student by their ID. If not found, the error will be ErrNotFound
+func (store *MemoryStore) GetStudentByID(ctx context.Context, id primitive.ObjectID) (Student, error) {
+	if err := ctx.Err(); err != nil {
+		return Student{}, wrapError(err)
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	student, found := store.students[id]
+	if !found {
+		return Student{}, notFoundf("no Students found with id %s", id.Hex())
+	}
+	return student, nil
+}
+
+// GetStudentByIDString gets a student by its ID as a string. If the ID could not be
+// parsed into an object ID, the error will be ErrInvalidID. If the student could not be
+// found, it will be ErrNotFound
+func (store *MemoryStore) GetStudentByIDString(ctx context.Context, id string) (Student, error) {
+	objectID, err := parseObjectID(id)
+	if err != nil {
+		return Student{}, err
+	}
+
+	return store.GetStudentByID(ctx, objectID)
+}
+
+// DeleteStudent deletes a student from the store by ID. If the student could not be
+// found, the error will be ErrNotFound
+func (store *MemoryStore) DeleteStudent(ctx context.Context, id primitive.ObjectID) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, found := store.students[id]; !found {
+		return notFoundf("no Students found with id %s", id.Hex())
+	}
+	delete(store.students, id)
+	return nil
+}
+
+// UpdateStudent finds a student by its ID and replaces it. newStudent will be set to the
+// updated student if it is successful. If the student could not be found, the error
+// will be ErrNotFound
+func (store *MemoryStore) UpdateStudent(ctx context.Context, id primitive.ObjectID, newStudent *Student) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(err)
+	}
+	if err := checkConflicts(ctx, store, id, newStudent); err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, found := store.students[id]; !found {
+		return notFoundf("no Students found with id %s", id.Hex())
+	}
+
+	newStudent.ID = id
+	if err := store.checkUnique(newStudent); err != nil {
+		return err
+	}
+	store.students[id] = *newStudent
+	return nil
+}
@@ -0,0 +1,139 @@
+// This file was automatically generated by genny.
+// Any changes will be lost if this file is regenerated.
+// see https://github.com/cheekybits/genny
+
+// This file contains generic code for implementing the basic methods
+// for each user on the MemoryStore. Like the template of the Mongo methods,
+// if you update this file you will have to install genny https://github.com/cheekybits/genny
+// and run go generate to update the generated code for each of the users.
+
+package database
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// CreateUser creates a User and adds it to the store. The
+// ID element of the newly created User will be set if it is successful
+func (store *MemoryStore) CreateUser(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(err)
+	}
+	if err := checkConflicts(ctx, store, user.ID, user); err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if user.ID.IsZero() {
+		user.ID = primitive.NewObjectID()
+	}
+	if _, found := store.users[user.ID]; found {
+		return fmt.Errorf("User with id %s already exists", user.ID.Hex())
+	}
+	if err := store.checkUnique(user); err != nil {
+		return err
+	}
+
+	store.users[user.ID] = *user
+	return nil
+}
+
+// GetUsers returns a list of all users in the store in the order they were created.
+func (store *MemoryStore) GetUsers(ctx context.Context) ([]User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError(err)
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	users := make([]User, 0, len(store.users))
+	for _, user := range store.users {
+		users = append(users, user)
+	}
+	// ObjectIDs start with their creation time and a counter, so sorting by them
+	// keeps the same order mongo returns documents in
+	sort.Slice(users, func(i, j int) bool {
+		return bytes.Compare(users[i].ID[:], users[j].ID[:]) < 0
+	})
+
+	return users, nil
+}
+
+// GetUserByID gets a user by their ID. If not found, the error will be ErrNotFound
+func (store *MemoryStore) GetUserByID(ctx context.Context, id primitive.ObjectID) (User, error) {
+	if err := ctx.Err(); err != nil {
+		return User{}, wrapError(err)
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	user, found := store.users[id]
+	if !found {
+		return User{}, notFoundf("no Users found with id %s", id.Hex())
+	}
+	return user, nil
+}
+
+// GetUserByIDString gets a user by its ID as a string. If the ID could not be
+// parsed into an object ID, the error will be ErrInvalidID. If the user could not be
+// found, it will be ErrNotFound
+func (store *MemoryStore) GetUserByIDString(ctx context.Context, id string) (User, error) {
+	objectID, err := parseObjectID(id)
+	if err != nil {
+		return User{}, err
+	}
+
+	return store.GetUserByID(ctx, objectID)
+}
+
+// DeleteUser deletes a user from the store by ID. If the user could not be
+// found, the error will be ErrNotFound
+func (store *MemoryStore) DeleteUser(ctx context.Context, id primitive.ObjectID) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, found := store.users[id]; !found {
+		return notFoundf("no Users found with id %s", id.Hex())
+	}
+	delete(store.users, id)
+	return nil
+}
+
+// UpdateUser finds a user by its ID and replaces it. newUser will be set to the
+// updated user if it is successful. If the user could not be found, the error
+// will be ErrNotFound
+func (store *MemoryStore) UpdateUser(ctx context.Context, id primitive.ObjectID, newUser *User) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(err)
+	}
+	if err := checkConflicts(ctx, store, id, newUser); err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, found := store.users[id]; !found {
+		return notFoundf("no Users found with id %s", id.Hex())
+	}
+
+	newUser.ID = id
+	if err := store.checkUnique(newUser); err != nil {
+		return err
+	}
+	store.users[id] = *newUser
+	return nil
+}
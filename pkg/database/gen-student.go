@@ -14,13 +14,24 @@ package database
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// StudentStore contains the basic methods every Store implements for Students
+type StudentStore interface {
+	CreateStudent(ctx context.Context, student *Student) error
+	GetStudents(ctx context.Context) ([]Student, error)
+	GetStudentByID(ctx context.Context, id primitive.ObjectID) (Student, error)
+	GetStudentByIDString(ctx context.Context, id string) (Student, error)
+	DeleteStudent(ctx context.Context, id primitive.ObjectID) error
+	UpdateStudent(ctx context.Context, id primitive.ObjectID, newStudent *Student) error
+}
+
 // StudentRef is a reference to a Student which, when serialized, will return
 // the json of the referenced object.
 //
@@ -31,10 +42,18 @@ func (ref StudentRef) GetBSON() (interface{}, error) {
 	return primitive.ObjectID(ref), nil
 }
 
+// MarshalJSON returns the json of the referenced object, or null if the ref is empty.
+// If the object was deleted, only its id is returned, see deletedRef.
 func (ref StudentRef) MarshalJSON() ([]byte, error) {
-	obj, found := DB.GetStudentByID(primitive.ObjectID(ref))
-	if !found {
-		return nil, fmt.Errorf("could not find Student with id %s", ref)
+	if primitive.ObjectID(ref).IsZero() {
+		return []byte("null"), nil
+	}
+
+	obj, err := DB.GetStudentByID(context.Background(), primitive.ObjectID(ref))
+	if errors.Is(err, ErrNotFound) {
+		return json.Marshal(deletedRef{ID: primitive.ObjectID(ref), Deleted: true})
+	} else if err != nil {
+		return nil, err
 	}
 
 	return json.Marshal(obj)
@@ -46,22 +65,17 @@ func (ref *StudentRef) UnmarshalJSON(b []byte) error {
 	if err := id.UnmarshalJSON(b); err != nil {
 		return err
 	}
-	_, found := DB.GetStudentByID(id)
-	if !found {
-		return fmt.Errorf("object not found")
+	if _, err := DB.GetStudentByID(context.Background(), id); err != nil {
+		return err
 	}
 
 	*ref = StudentRef(id)
 	return nil
 }
 
-// Gets the referenced object and panics if it doesn't exist
-func (ref StudentRef) Get() Student {
-	obj, found := DB.GetStudentByID(primitive.ObjectID(ref))
-	if !found {
-		panic("could not find object")
-	}
-	return obj
+// Get gets the referenced object. If it doesn't exist, the error will be ErrNotFound
+func (ref StudentRef) Get(ctx context.Context) (Student, error) {
+	return DB.GetStudentByID(ctx, primitive.ObjectID(ref))
 }
 
 // Ref creates a reference to the object
@@ -71,99 +85,115 @@ func (obj Student) Ref() StudentRef {
 
 // CreateStudent creates a Student and adds it to the database. The
 // ID element of the newly created Student will be set if it is successful
-func (db *Database) CreateStudent(student *Student) {
-	result, err := db.Collections.Students.InsertOne(context.TODO(), student)
+func (db *Database) CreateStudent(ctx context.Context, student *Student) error {
+	if err := checkConflicts(ctx, db, student.ID, student); err != nil {
+		return err
+	}
+
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result, err := db.Collections.Students.InsertOne(ctx, student)
 	if err != nil {
-		panic(err)
+		return wrapError(err)
 	}
 
 	student.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
 }
 
 // GetStudents returns a list of all students stored in the database.
-func (db *Database) GetStudents() []Student {
-	cur, err := db.Collections.Students.Find(context.TODO(), bson.D{})
+func (db *Database) GetStudents(ctx context.Context) ([]Student, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	cur, err := db.Collections.Students.Find(ctx, bson.D{})
 	if err != nil {
-		panic(err)
+		return nil, wrapError(err)
 	}
 
 	students := make([]Student, 0)
-	if err := cur.All(context.TODO(), &students); err != nil {
-		panic(err)
+	if err := cur.All(ctx, &students); err != nil {
+		return nil, wrapError(err)
 	}
 
-	return students
+	return students, nil
 }
 
-// GetStudentByID gets a student by their ID. If not found, found will be false and
-// err will be nil.
-func (db *Database) GetStudentByID(id primitive.ObjectID) (student Student, found bool) {
-	result := db.Collections.Students.FindOne(nil, bson.M{"_id": id})
+// GetStudentByID gets a student by their ID. If not found, the error will be ErrNotFound
+func (db *Database) GetStudentByID(ctx context.Context, id primitive.ObjectID) (student Student, err error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
 
-	err := result.Err()
-	if err != nil {
+	result := db.Collections.Students.FindOne(ctx, bson.M{"_id": id})
+
+	if err := result.Err(); err != nil {
 		if err == mongo.ErrNoDocuments {
-			return Student{}, false
+			return Student{}, notFoundf("no Students found with id %s", id.Hex())
 		}
-		panic(err)
+		return Student{}, wrapError(err)
 	}
 
 	if err := result.Decode(&student); err != nil {
-		panic(err)
+		return Student{}, wrapError(err)
 	}
 
-	found = true
-	return
+	return student, nil
 }
 
 // GetStudentByIDString gets a student by its ID as a string. If the ID could not be
-// parsed into an object ID or the student could not be found, an error will be returned
-func (db *Database) GetStudentByIDString(id string) (Student, error) {
-	objectID, err := primitive.ObjectIDFromHex(id)
+// parsed into an object ID, the error will be ErrInvalidID. If the student could not be
+// found, it will be ErrNotFound
+func (db *Database) GetStudentByIDString(ctx context.Context, id string) (Student, error) {
+	objectID, err := parseObjectID(id)
 	if err != nil {
 		return Student{}, err
 	}
 
-	student, found := db.GetStudentByID(objectID)
-	if !found {
-		return Student{}, fmt.Errorf("no Students found with id %s", objectID.Hex())
-	}
-
-	return student, nil
+	return db.GetStudentByID(ctx, objectID)
 }
 
 // DeleteStudent deletes a student from the database by ID. If the student could not be
-// found, success will be false
-func (db *Database) DeleteStudent(id primitive.ObjectID) bool {
-	result := db.Collections.Students.FindOneAndDelete(nil, bson.M{"_id": id})
+// found, the error will be ErrNotFound
+func (db *Database) DeleteStudent(ctx context.Context, id primitive.ObjectID) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
 
-	err := result.Err()
-	if err != nil {
+	result := db.Collections.Students.FindOneAndDelete(ctx, bson.M{"_id": id})
+
+	if err := result.Err(); err != nil {
 		if err == mongo.ErrNoDocuments {
-			return false
+			return notFoundf("no Students found with id %s", id.Hex())
 		}
-		panic(err)
+		return wrapError(err)
 	}
-	return true
+	return nil
 }
 
-// UpdateStudent finds a student by its ID and updates it
-func (db *Database) UpdateStudent(id primitive.ObjectID, newStudent *Student) bool {
-	//result := db.Collections.Locations.FindOneAndUpdate(nil, bson.M{"_id": id}, bson.M{"$set": *newStudent})
-	a := db.Collections.Students.FindOne(nil, bson.M{"_id": id})
-	if a.Err() != nil {
-		panic(a.Err())
+// UpdateStudent finds a student by its ID and updates it. newStudent will be set to the
+// updated student if it is successful. If the student could not be found, the error
+// will be ErrNotFound
+func (db *Database) UpdateStudent(ctx context.Context, id primitive.ObjectID, newStudent *Student) error {
+	if err := checkConflicts(ctx, db, id, newStudent); err != nil {
+		return err
 	}
-	result := db.Collections.Locations.FindOneAndUpdate(nil, bson.M{"_id": id}, bson.D{{"$set", bson.D{{"name", "SKDJLJLKS"}}}})
-	err := result.Err()
-	if err != nil {
+
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result := db.Collections.Students.FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$set": newStudent},
+		options.FindOneAndUpdate().SetReturnDocument(options.After))
+
+	if err := result.Err(); err != nil {
 		if err == mongo.ErrNoDocuments {
-			return false
+			return notFoundf("no Students found with id %s", id.Hex())
 		}
-		panic(err)
+		return wrapError(err)
 	}
 
-	err = result.Decode(newStudent)
+	if err := result.Decode(newStudent); err != nil {
+		return wrapError(err)
+	}
 
-	return true
+	return nil
 }
@@ -0,0 +1,199 @@
+// This file was automatically generated by genny.
+// Any changes will be lost if this file is regenerated.
+// see https://github.com/cheekybits/genny
+
+// This file contains generic code for implementing basic methods
+// for each user such as references, Get by ID, Update, etc...
+// If you're not modifying these functions, you shouldn't have to worry
+// about regenerating code. However, if you updated this file, to update
+// the changes for each of the users you would have to install
+// genny https://github.com/cheekybits/genny and run go generate.
+
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// UserStore contains the basic methods every Store implements for Users
+type UserStore interface {
+	CreateUser(ctx context.Context, user *User) error
+	GetUsers(ctx context.Context) ([]User, error)
+	GetUserByID(ctx context.Context, id primitive.ObjectID) (User, error)
+	GetUserByIDString(ctx context.Context, id string) (User, error)
+	DeleteUser(ctx context.Context, id primitive.ObjectID) error
+	UpdateUser(ctx context.Context, id primitive.ObjectID, newUser *User) error
+}
+
+// UserRef is a reference to a User which, when serialized, will return
+// the json of the referenced object.
+//
+// Be careful for circular references.
+type UserRef primitive.ObjectID
+
+func (ref UserRef) GetBSON() (interface{}, error) {
+	return primitive.ObjectID(ref), nil
+}
+
+// MarshalJSON returns the json of the referenced object, or null if the ref is empty.
+// If the object was deleted, only its id is returned, see deletedRef.
+func (ref UserRef) MarshalJSON() ([]byte, error) {
+	if primitive.ObjectID(ref).IsZero() {
+		return []byte("null"), nil
+	}
+
+	obj, err := DB.GetUserByID(context.Background(), primitive.ObjectID(ref))
+	if errors.Is(err, ErrNotFound) {
+		return json.Marshal(deletedRef{ID: primitive.ObjectID(ref), Deleted: true})
+	} else if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(obj)
+}
+
+// Same functionality is ObjectID.UnmarshalJSON except it returns an error if the referenced object doesn't exist
+func (ref *UserRef) UnmarshalJSON(b []byte) error {
+	id := primitive.ObjectID(*ref)
+	if err := id.UnmarshalJSON(b); err != nil {
+		return err
+	}
+	if _, err := DB.GetUserByID(context.Background(), id); err != nil {
+		return err
+	}
+
+	*ref = UserRef(id)
+	return nil
+}
+
+// Get gets the referenced object. If it doesn't exist, the error will be ErrNotFound
+func (ref UserRef) Get(ctx context.Context) (User, error) {
+	return DB.GetUserByID(ctx, primitive.ObjectID(ref))
+}
+
+// Ref creates a reference to the object
+func (obj User) Ref() UserRef {
+	return UserRef(obj.ID)
+}
+
+// CreateUser creates a User and adds it to the database. The
+// ID element of the newly created User will be set if it is successful
+func (db *Database) CreateUser(ctx context.Context, user *User) error {
+	if err := checkConflicts(ctx, db, user.ID, user); err != nil {
+		return err
+	}
+
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result, err := db.Collections.Users.InsertOne(ctx, user)
+	if err != nil {
+		return wrapError(err)
+	}
+
+	user.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// GetUsers returns a list of all users stored in the database.
+func (db *Database) GetUsers(ctx context.Context) ([]User, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	cur, err := db.Collections.Users.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	users := make([]User, 0)
+	if err := cur.All(ctx, &users); err != nil {
+		return nil, wrapError(err)
+	}
+
+	return users, nil
+}
+
+// GetUserByID gets a user by their ID. If not found, the error will be ErrNotFound
+func (db *Database) GetUserByID(ctx context.Context, id primitive.ObjectID) (user User, err error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result := db.Collections.Users.FindOne(ctx, bson.M{"_id": id})
+
+	if err := result.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return User{}, notFoundf("no Users found with id %s", id.Hex())
+		}
+		return User{}, wrapError(err)
+	}
+
+	if err := result.Decode(&user); err != nil {
+		return User{}, wrapError(err)
+	}
+
+	return user, nil
+}
+
+// GetUserByIDString gets a user by its ID as a string. If the ID could not be
+// parsed into an object ID, the error will be ErrInvalidID. If the user could not be
+// found, it will be ErrNotFound
+func (db *Database) GetUserByIDString(ctx context.Context, id string) (User, error) {
+	objectID, err := parseObjectID(id)
+	if err != nil {
+		return User{}, err
+	}
+
+	return db.GetUserByID(ctx, objectID)
+}
+
+// DeleteUser deletes a user from the database by ID. If the user could not be
+// found, the error will be ErrNotFound
+func (db *Database) DeleteUser(ctx context.Context, id primitive.ObjectID) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result := db.Collections.Users.FindOneAndDelete(ctx, bson.M{"_id": id})
+
+	if err := result.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return notFoundf("no Users found with id %s", id.Hex())
+		}
+		return wrapError(err)
+	}
+	return nil
+}
+
+// UpdateUser finds a user by its ID and updates it. newUser will be set to the
+// updated user if it is successful. If the user could not be found, the error
+// will be ErrNotFound
+func (db *Database) UpdateUser(ctx context.Context, id primitive.ObjectID, newUser *User) error {
+	if err := checkConflicts(ctx, db, id, newUser); err != nil {
+		return err
+	}
+
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result := db.Collections.Users.FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$set": newUser},
+		options.FindOneAndUpdate().SetReturnDocument(options.After))
+
+	if err := result.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return notFoundf("no Users found with id %s", id.Hex())
+		}
+		return wrapError(err)
+	}
+
+	if err := result.Decode(newUser); err != nil {
+		return wrapError(err)
+	}
+
+	return nil
+}
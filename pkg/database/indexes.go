@@ -0,0 +1,72 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// how long creating the indexes can take. Building them on a large events collection
+// can take much longer than a query, but it only has to be done once.
+const indexTimeout = 5 * time.Minute
+
+// the names of the unique indexes, so wrapError can tell which one a duplicate key error came from
+const (
+	studentHandlesIndex = "studenthandles_unique"
+	idempotencyKeyIndex = "idempotencykey_unique"
+)
+
+// indexes are the indexes created on each collection by EnsureIndexes
+func (db *Database) indexes() map[*mongo.Collection][]mongo.IndexModel {
+	return map[*mongo.Collection][]mongo.IndexModel{
+		db.Collections.Students: {
+			// a handle can only belong to one student, otherwise a scan would sign in
+			// whichever student mongo returned first. Students without handles aren't
+			// in the index, so they don't conflict with each other.
+			{
+				Keys: bson.D{{Key: "studenthandles", Value: 1}},
+				Options: options.Index().SetName(studentHandlesIndex).SetUnique(true).
+					SetPartialFilterExpression(bson.M{"studenthandles": bson.M{"$type": "string"}}),
+			},
+		},
+		db.Collections.Events: {
+			{Keys: bson.D{{Key: "time", Value: 1}}},
+			{Keys: bson.D{{Key: "student", Value: 1}, {Key: "time", Value: 1}}},
+			{Keys: bson.D{{Key: "location", Value: 1}, {Key: "time", Value: 1}}},
+			// the same scan can't create two events, even if a batch is sent twice at once.
+			// Events without a key aren't in the index.
+			{
+				Keys:    bson.D{{Key: "idempotencykey", Value: 1}},
+				Options: options.Index().SetName(idempotencyKeyIndex).SetUnique(true).SetSparse(true),
+			},
+		},
+		db.Collections.Devices: {
+			{Keys: bson.D{{Key: "tokenhash", Value: 1}}},
+		},
+	}
+}
+
+// EnsureIndexes creates the indexes used by the queries. Indexes that already exist
+// aren't changed, so it is safe to call again. The api calls it every time it starts,
+// even if it doesn't migrate the database, and the migrations call it after they fix
+// the documents that would stop an index from being created.
+func (db *Database) EnsureIndexes(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, indexTimeout)
+	defer cancel()
+
+	for collection, indexes := range db.indexes() {
+		names, err := collection.Indexes().CreateMany(ctx, indexes)
+		if isDuplicateKeyError(err) {
+			return fmt.Errorf("could not create the indexes on %s because some of the documents conflict, "+
+				"they have to be fixed before the index can be created: %w", collection.Name(), wrapError(err))
+		} else if err != nil {
+			return fmt.Errorf("could not create the indexes on %s: %w", collection.Name(), wrapError(err))
+		}
+		log.Debugf("Created indexes %v on %s", names, collection.Name())
+	}
+	return nil
+}
@@ -7,8 +7,47 @@ import (
 
 // A Location represents any location at the school that can be signed in or out
 type Location struct {
-	ID      primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	Name    string             `json:"name"`
+	ID   primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name string             `bson:"name" json:"name"`
 	// The time it takes for a student to automatically time out
-	Timeout time.Duration      `json:"timeout"`
-}
\ No newline at end of file
+	Timeout time.Duration `bson:"timeout" json:"timeout"`
+
+	// The maximum number of students that can be at the location at once. If it is 0,
+	// there is no limit. Students can't enter a full location unless CapacityWarnOnly is
+	// set, in which case they can enter and a warning is logged.
+	Capacity         int  `bson:"capacity" json:"capacity"`
+	CapacityWarnOnly bool `bson:"capacitywarnonly" json:"capacity_warn_only"`
+
+	// Scans by a student within DebounceWindow of their last scan at the location are
+	// ignored so scanning twice by accident doesn't sign them out. If it is 0, no
+	// scans are ignored.
+	DebounceWindow time.Duration `bson:"debouncewindow" json:"debounce_window"`
+	// ScanIntent is what happens when a student scans at the location
+	ScanIntent ScanIntent `bson:"scanintent" json:"scan_intent"`
+
+	// Archived locations were deleted, but are kept so the history of who was there
+	// still has their name. Nobody can scan in or out of them.
+	Archived bool `bson:"archived" json:"archived"`
+}
+
+// ScanIntent determines whether scans at a location sign students in, out or both
+type ScanIntent string
+
+const (
+	// ScanIntentToggle signs students out if they are at the location and in if they aren't
+	ScanIntentToggle ScanIntent = "toggle"
+	// ScanIntentEnter always signs students in, for example at a kiosk at the entrance
+	ScanIntentEnter ScanIntent = "enter"
+	// ScanIntentLeave only signs students out, for example at a kiosk at the exit
+	ScanIntentLeave ScanIntent = "leave"
+)
+
+// Valid returns true if intent is one of the ScanIntents. An empty intent is ScanIntentToggle
+func (intent ScanIntent) Valid() bool {
+	switch intent {
+	case "", ScanIntentToggle, ScanIntentEnter, ScanIntentLeave:
+		return true
+	default:
+		return false
+	}
+}
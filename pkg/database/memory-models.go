@@ -0,0 +1,146 @@
+//go:build generate
+// +build generate
+
+// This file contains generic code for implementing the basic methods
+// for each model on the MemoryStore. Like the template of the Mongo methods,
+// if you update this file you will have to install genny https://github.com/cheekybits/genny
+// and run go generate to update the generated code for each of the models.
+
+package database
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/cheekybits/genny/generic"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sort"
+)
+
+//go:generate genny -in=$GOFILE -out=gen-memory-student.go		-tag=generate gen "Model=Student model=student"
+//go:generate genny -in=$GOFILE -out=gen-memory-event.go		-tag=generate gen "Model=Event model=event"
+//go:generate genny -in=$GOFILE -out=gen-memory-location.go 	-tag=generate gen "Model=Location model=location"
+//go:generate genny -in=$GOFILE -out=gen-memory-user.go		-tag=generate gen "Model=User model=user"
+//go:generate genny -in=$GOFILE -out=gen-memory-device.go		-tag=generate gen "Model=Device model=device"
+
+type Model generic.Type
+
+// CreateModel creates a Model and adds it to the store. The
+// ID element of the newly created Model will be set if it is successful
+func (store *MemoryStore) CreateModel(ctx context.Context, model *Model) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(err)
+	}
+	if err := checkConflicts(ctx, store, model.ID, model); err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if model.ID.IsZero() {
+		model.ID = primitive.NewObjectID()
+	}
+	if _, found := store.models[model.ID]; found {
+		return fmt.Errorf("Model with id %s already exists", model.ID.Hex())
+	}
+	if err := store.checkUnique(model); err != nil {
+		return err
+	}
+
+	store.models[model.ID] = *model
+	return nil
+}
+
+// GetModels returns a list of all models in the store in the order they were created.
+func (store *MemoryStore) GetModels(ctx context.Context) ([]Model, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, wrapError(err)
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	models := make([]Model, 0, len(store.models))
+	for _, model := range store.models {
+		models = append(models, model)
+	}
+	// ObjectIDs start with their creation time and a counter, so sorting by them
+	// keeps the same order mongo returns documents in
+	sort.Slice(models, func(i, j int) bool {
+		return bytes.Compare(models[i].ID[:], models[j].ID[:]) < 0
+	})
+
+	return models, nil
+}
+
+// GetModelByID gets a model by their ID. If not found, the error will be ErrNotFound
+func (store *MemoryStore) GetModelByID(ctx context.Context, id primitive.ObjectID) (Model, error) {
+	if err := ctx.Err(); err != nil {
+		return Model{}, wrapError(err)
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	model, found := store.models[id]
+	if !found {
+		return Model{}, notFoundf("no Models found with id %s", id.Hex())
+	}
+	return model, nil
+}
+
+// GetModelByIDString gets a model by its ID as a string. If the ID could not be
+// parsed into an object ID, the error will be ErrInvalidID. If the model could not be
+// found, it will be ErrNotFound
+func (store *MemoryStore) GetModelByIDString(ctx context.Context, id string) (Model, error) {
+	objectID, err := parseObjectID(id)
+	if err != nil {
+		return Model{}, err
+	}
+
+	return store.GetModelByID(ctx, objectID)
+}
+
+// DeleteModel deletes a model from the store by ID. If the model could not be
+// found, the error will be ErrNotFound
+func (store *MemoryStore) DeleteModel(ctx context.Context, id primitive.ObjectID) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, found := store.models[id]; !found {
+		return notFoundf("no Models found with id %s", id.Hex())
+	}
+	delete(store.models, id)
+	return nil
+}
+
+// UpdateModel finds a model by its ID and replaces it. newModel will be set to the
+// updated model if it is successful. If the model could not be found, the error
+// will be ErrNotFound
+func (store *MemoryStore) UpdateModel(ctx context.Context, id primitive.ObjectID, newModel *Model) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(err)
+	}
+	if err := checkConflicts(ctx, store, id, newModel); err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, found := store.models[id]; !found {
+		return notFoundf("no Models found with id %s", id.Hex())
+	}
+
+	newModel.ID = id
+	if err := store.checkUnique(newModel); err != nil {
+		return err
+	}
+	store.models[id] = *newModel
+	return nil
+}
@@ -0,0 +1,397 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A MemoryStore is a Store that keeps all of its models in memory. Nothing
+// is persisted, so it should only be used for tests and demos.
+type MemoryStore struct {
+	mu sync.RWMutex
+
+	students  map[primitive.ObjectID]Student
+	locations map[primitive.ObjectID]Location
+	events    map[primitive.ObjectID]Event
+	users     map[primitive.ObjectID]User
+	devices   map[primitive.ObjectID]Device
+
+	// the audit log is append only, so it is kept in the order it was written
+	audit []AuditEntry
+}
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		students:  make(map[primitive.ObjectID]Student),
+		locations: make(map[primitive.ObjectID]Location),
+		events:    make(map[primitive.ObjectID]Event),
+		users:     make(map[primitive.ObjectID]User),
+		devices:   make(map[primitive.ObjectID]Device),
+	}
+}
+
+// checkUnique returns an Error if model has the same value as another model in a field
+// mongo has a unique index on, which can't be checked before the model is saved because
+// it could change in between. The store has to be locked.
+func (store *MemoryStore) checkUnique(model interface{}) error {
+	switch model := model.(type) {
+	case *Student:
+		for _, handle := range model.StudentHandles {
+			for id, other := range store.students {
+				if id == model.ID {
+					continue
+				}
+				for _, otherHandle := range other.StudentHandles {
+					if otherHandle == handle {
+						return &Error{
+							Kind:    ErrDuplicateHandle,
+							Message: fmt.Sprintf("student handle %s is already used by %s (%s)", handle, other.Name, id.Hex()),
+						}
+					}
+				}
+			}
+		}
+	case *Event:
+		if model.IdempotencyKey == "" {
+			return nil
+		}
+		for id, other := range store.events {
+			if id != model.ID && other.IdempotencyKey == model.IdempotencyKey {
+				return &Error{
+					Kind:    ErrDuplicateIdempotencyKey,
+					Message: fmt.Sprintf("idempotency key %s was already used by event %s", model.IdempotencyKey, id.Hex()),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// GetStudentByHandle gets a student by the StudentHandles member. If the
+// student could not be found, the error will be ErrNotFound
+func (store *MemoryStore) GetStudentByHandle(ctx context.Context, handle string) (Student, error) {
+	students, err := store.GetStudents(ctx)
+	if err != nil {
+		return Student{}, err
+	}
+
+	for _, student := range students {
+		for _, studentHandle := range student.StudentHandles {
+			if studentHandle == handle {
+				return student, nil
+			}
+		}
+	}
+
+	return Student{}, notFoundf("student with handle %s was not found", handle)
+}
+
+// GetUserByUsername gets a user by their username. If the user could not be
+// found, the error will be ErrNotFound
+func (store *MemoryStore) GetUserByUsername(ctx context.Context, username string) (User, error) {
+	users, err := store.GetUsers(ctx)
+	if err != nil {
+		return User{}, err
+	}
+
+	for _, user := range users {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+
+	return User{}, notFoundf("user %s was not found", username)
+}
+
+// GetDeviceByTokenHash gets the device with the TokenHash hash. If the device
+// could not be found, the error will be ErrNotFound
+func (store *MemoryStore) GetDeviceByTokenHash(ctx context.Context, hash []byte) (Device, error) {
+	devices, err := store.GetDevices(ctx)
+	if err != nil {
+		return Device{}, err
+	}
+
+	for _, device := range devices {
+		if bytes.Equal(device.TokenHash, hash) {
+			return device, nil
+		}
+	}
+
+	return Device{}, notFoundf("device was not found")
+}
+
+// SetDeviceLastSeen sets the LastSeen time of a device without changing anything else
+func (store *MemoryStore) SetDeviceLastSeen(ctx context.Context, id primitive.ObjectID, lastSeen time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	device, found := store.devices[id]
+	if !found {
+		return notFoundf("no Devices found with id %s", id.Hex())
+	}
+	device.LastSeen = lastSeen
+	store.devices[id] = device
+	return nil
+}
+
+// GetMostRecentEvent gets the most recent event created by the specified studentID
+// If there is no event, the error will be ErrNotFound
+func (store *MemoryStore) GetMostRecentEvent(ctx context.Context, studentRef StudentRef) (Event, error) {
+	return store.GetMostRecentEventBetween(ctx, studentRef, time.Unix(0, 0), time.Now())
+}
+
+// GetMostRecentEventBetween gets the most recent event between two time intervals
+func (store *MemoryStore) GetMostRecentEventBetween(ctx context.Context, studentRef StudentRef, minTime time.Time, maxTime time.Time) (Event, error) {
+	return store.getMostRecentEvent(ctx, func(event Event) bool {
+		return event.Voided == nil && !event.Anonymized && event.Student == studentRef &&
+			event.Time.After(minTime) && event.Time.Before(maxTime)
+	})
+}
+
+// GetMostRecentEventBetweenWithType gets the most recent event between two time intervals and filters by an event type
+func (store *MemoryStore) GetMostRecentEventBetweenWithType(ctx context.Context, studentRef StudentRef, minTime time.Time, maxTime time.Time, eventType EventType) (Event, error) {
+	return store.getMostRecentEvent(ctx, func(event Event) bool {
+		return event.Voided == nil && !event.Anonymized && event.Student == studentRef && event.EventType == eventType &&
+			event.Time.After(minTime) && event.Time.Before(maxTime)
+	})
+}
+
+// GetAllEventsBetween gets all of the events that weren't voided or anonymized between minTime and maxTime.
+// The events will be sorted by earliest to latest.
+func (store *MemoryStore) GetAllEventsBetween(ctx context.Context, minTime time.Time, maxTime time.Time) ([]Event, error) {
+	return store.filterEvents(ctx, func(event Event) bool {
+		return event.Voided == nil && !event.Anonymized && event.Time.After(minTime) && event.Time.Before(maxTime)
+	})
+}
+
+// GetStudentEventsBetween gets the events of a student that weren't voided between minTime and
+// maxTime sorted from earliest to latest
+func (store *MemoryStore) GetStudentEventsBetween(ctx context.Context, studentRef StudentRef, minTime time.Time, maxTime time.Time) ([]Event, error) {
+	return store.filterEvents(ctx, func(event Event) bool {
+		return event.Voided == nil && !event.Anonymized && event.Student == studentRef &&
+			event.Time.After(minTime) && event.Time.Before(maxTime)
+	})
+}
+
+// GetLocationEventsBetween gets the events that weren't voided at a location between minTime
+// and maxTime sorted from earliest to latest, including the anonymized ones
+func (store *MemoryStore) GetLocationEventsBetween(ctx context.Context, locationRef LocationRef, minTime time.Time, maxTime time.Time) ([]Event, error) {
+	return store.filterEvents(ctx, func(event Event) bool {
+		return event.Voided == nil && event.Location == locationRef && event.Time.After(minTime) && event.Time.Before(maxTime)
+	})
+}
+
+// GetEventByIdempotencyKey gets the event created with the IdempotencyKey key, even if it
+// was voided so it isn't created again. If there is no event, the error will be ErrNotFound
+func (store *MemoryStore) GetEventByIdempotencyKey(ctx context.Context, key string) (Event, error) {
+	events, err := store.filterEvents(ctx, func(event Event) bool {
+		return event.IdempotencyKey == key
+	})
+	if err != nil {
+		return Event{}, err
+	}
+	if len(events) == 0 {
+		return Event{}, notFoundf("event with idempotency key %s was not found", key)
+	}
+
+	return events[0], nil
+}
+
+// getMostRecentEvent returns the latest event that matches filter. If there is
+// no event, the error will be ErrNotFound
+func (store *MemoryStore) getMostRecentEvent(ctx context.Context, filter func(event Event) bool) (Event, error) {
+	events, err := store.filterEvents(ctx, filter)
+	if err != nil {
+		return Event{}, err
+	}
+	if len(events) == 0 {
+		return Event{}, notFoundf("no events found")
+	}
+
+	return events[len(events)-1], nil
+}
+
+// filterEvents returns all events that match filter sorted from earliest to latest
+func (store *MemoryStore) filterEvents(ctx context.Context, filter func(event Event) bool) ([]Event, error) {
+	allEvents, err := store.GetEvents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]Event, 0)
+	for _, event := range allEvents {
+		if filter(event) {
+			events = append(events, event)
+		}
+	}
+
+	// GetEvents is sorted by creation, so a stable sort keeps events with
+	// the same time in the order they were created
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+
+	return events, nil
+}
+
+// PurgeEventsBefore deletes every event before t, including voided and anonymized events,
+// and returns the number deleted. If dryRun is true, nothing is deleted and the number that
+// would have been is returned.
+func (store *MemoryStore) PurgeEventsBefore(ctx context.Context, t time.Time, dryRun bool) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, wrapError(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var count int64
+	for id, event := range store.events {
+		if event.Time.Before(t) {
+			count++
+			if !dryRun {
+				delete(store.events, id)
+			}
+		}
+	}
+	return count, nil
+}
+
+// AnonymizeEventsBefore removes the student from every event before t and returns the
+// number of events changed. If dryRun is true, nothing is changed and the number that
+// would have been is returned.
+func (store *MemoryStore) AnonymizeEventsBefore(ctx context.Context, t time.Time, dryRun bool) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, wrapError(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var count int64
+	for id, event := range store.events {
+		if event.Time.Before(t) && !event.Anonymized {
+			count++
+			if !dryRun {
+				event.Student = StudentRef(primitive.NilObjectID)
+				event.Anonymized = true
+				store.events[id] = event
+			}
+		}
+	}
+	return count, nil
+}
+
+// GetEventsByStudent gets every event of a student sorted from earliest to latest,
+// including the events that were voided
+func (store *MemoryStore) GetEventsByStudent(ctx context.Context, studentRef StudentRef) ([]Event, error) {
+	return store.filterEvents(ctx, func(event Event) bool {
+		return event.Student == studentRef
+	})
+}
+
+// DeleteEventsByStudent deletes every event of a student and returns the number deleted
+func (store *MemoryStore) DeleteEventsByStudent(ctx context.Context, studentRef StudentRef) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, wrapError(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var count int64
+	for id, event := range store.events {
+		if event.Student == studentRef {
+			count++
+			delete(store.events, id)
+		}
+	}
+	return count, nil
+}
+
+// DeleteEventsByLocation deletes every event at a location and returns the number deleted
+func (store *MemoryStore) DeleteEventsByLocation(ctx context.Context, locationRef LocationRef) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, wrapError(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var count int64
+	for id, event := range store.events {
+		if event.Location == locationRef {
+			count++
+			delete(store.events, id)
+		}
+	}
+	return count, nil
+}
+
+// PseudonymizeEventsByStudent replaces the student of every one of their events with pseudonym
+// and returns the number of events changed.
+func (store *MemoryStore) PseudonymizeEventsByStudent(ctx context.Context, studentRef StudentRef, pseudonym StudentRef) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, wrapError(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var count int64
+	for id, event := range store.events {
+		if event.Student == studentRef {
+			count++
+			event.Student = pseudonym
+			store.events[id] = event
+		}
+	}
+	return count, nil
+}
+
+// VoidEvent sets Voided on an event that wasn't voided yet without changing anything else.
+// If the event doesn't exist or was already voided, the error will be ErrNotFound.
+func (store *MemoryStore) VoidEvent(ctx context.Context, id primitive.ObjectID, correction *EventCorrection) (Event, error) {
+	if err := ctx.Err(); err != nil {
+		return Event{}, wrapError(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	event, found := store.events[id]
+	if !found || event.Voided != nil {
+		return Event{}, notFoundf("no Events that weren't voided found with id %s", id.Hex())
+	}
+	event.Voided = correction
+	store.events[id] = event
+	return event, nil
+}
+
+// UnvoidEvent removes Voided from an event without changing anything else
+func (store *MemoryStore) UnvoidEvent(ctx context.Context, id primitive.ObjectID) error {
+	if err := ctx.Err(); err != nil {
+		return wrapError(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	event, found := store.events[id]
+	if !found {
+		return notFoundf("no Events found with id %s", id.Hex())
+	}
+	event.Voided = nil
+	store.events[id] = event
+	return nil
+}
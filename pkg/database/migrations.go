@@ -0,0 +1,312 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"strings"
+	"time"
+)
+
+// A Migration updates the documents stored in mongo after a model changes, so the
+// data from older versions can still be read.
+type Migration struct {
+	// Version is the schema version after the migration is applied
+	Version     int
+	Description string
+	// Up applies the migration. It has to be safe to run again if it fails partway
+	// through. If dryRun is true, nothing should be changed and it should only
+	// check and log what it would do.
+	Up func(ctx context.Context, db *Database, dryRun bool) error
+}
+
+// Migrations are all of the migrations in order of their versions. New migrations are
+// added to the end, and migrations that were released must never be changed.
+var Migrations = []Migration{
+	{
+		Version:     1,
+		Description: "check for duplicate student handles and create the indexes",
+		Up:          migrateIndexes,
+	},
+	{
+		Version:     2,
+		Description: "void events created twice with the same idempotency key and make the keys unique",
+		Up:          migrateUniqueIdempotencyKeys,
+	},
+}
+
+// the _id of the document in the migrations collection with the schema version
+const schemaVersionID = "schema"
+
+const (
+	// the _id of the document in the migrations collection that is locked while migrating
+	migrationLockID = "lock"
+	// how long a lock lasts, so the migrations can still be applied if the instance
+	// that locked them stopped before it unlocked them
+	migrationLockTTL = 30 * time.Minute
+	// how often to try to lock the migrations while another instance is migrating
+	migrationLockRetry = time.Second
+)
+
+// schemaVersion is the document that records which migrations were applied
+type schemaVersion struct {
+	ID      string             `bson:"_id"`
+	Version int                `bson:"version"`
+	Applied []AppliedMigration `bson:"applied"`
+}
+
+// An AppliedMigration records when a migration was applied
+type AppliedMigration struct {
+	Version     int       `bson:"version" json:"version"`
+	Description string    `bson:"description" json:"description"`
+	Time        time.Time `bson:"time" json:"time"`
+}
+
+// AppliedMigrations returns the migrations that were applied to the database from
+// earliest to latest. The last one is the current schema version.
+func (db *Database) AppliedMigrations(ctx context.Context) ([]AppliedMigration, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	var version schemaVersion
+	err := db.Collections.Migrations.FindOne(ctx, bson.M{"_id": schemaVersionID}).Decode(&version)
+	if err == mongo.ErrNoDocuments {
+		return []AppliedMigration{}, nil
+	} else if err != nil {
+		return nil, wrapError(err)
+	}
+
+	return version.Applied, nil
+}
+
+// PendingMigrations returns the migrations that haven't been applied to the database yet.
+// It returns an error if the database was migrated by a newer version of trace.
+func (db *Database) PendingMigrations(ctx context.Context) ([]Migration, error) {
+	applied, err := db.AppliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	current, latest := 0, 0
+	if len(applied) > 0 {
+		current = applied[len(applied)-1].Version
+	}
+	if len(Migrations) > 0 {
+		latest = Migrations[len(Migrations)-1].Version
+	}
+	if current > latest {
+		return nil, fmt.Errorf("the database schema version %d is newer than the latest migration %d, "+
+			"it was migrated by a newer version of trace", current, latest)
+	}
+
+	pending := make([]Migration, 0)
+	for _, migration := range Migrations {
+		if migration.Version > current {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies the pending migrations in order and returns them. The schema version is
+// recorded after each migration, so if one fails the ones before it aren't applied again.
+// The migrations are locked while they are applied, so if several instances start at the
+// same time the others wait and then find that there is nothing left to migrate.
+//
+// If dryRun is true, the migrations only check and log what they would do. Since nothing
+// is changed, migrations that depend on an earlier pending one may not be accurate.
+func (db *Database) Migrate(ctx context.Context, dryRun bool) ([]Migration, error) {
+	if !dryRun {
+		unlock, err := db.lockMigrations(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+
+	pending, err := db.PendingMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, migration := range pending {
+		logger := log.WithFields(log.Fields{"version": migration.Version, "dry_run": dryRun})
+		logger.Infof("Applying migration %d: %s", migration.Version, migration.Description)
+
+		if err := migration.Up(ctx, db, dryRun); err != nil {
+			return pending[:i], fmt.Errorf("migration %d failed: %w", migration.Version, err)
+		}
+		if dryRun {
+			continue
+		}
+
+		applied := AppliedMigration{
+			Version:     migration.Version,
+			Description: migration.Description,
+			Time:        time.Now(),
+		}
+		_, err := db.Collections.Migrations.UpdateOne(ctx, bson.M{"_id": schemaVersionID}, bson.M{
+			"$set":  bson.M{"version": migration.Version},
+			"$push": bson.M{"applied": applied},
+		}, options.Update().SetUpsert(true))
+		if err != nil {
+			return pending[:i], fmt.Errorf("could not record migration %d: %w", migration.Version, wrapError(err))
+		}
+	}
+
+	return pending, nil
+}
+
+// lockMigrations waits until no other instance is migrating and locks the migrations.
+// The returned function unlocks them.
+func (db *Database) lockMigrations(ctx context.Context) (unlock func(), err error) {
+	owner := primitive.NewObjectID()
+	waiting := false
+
+	for {
+		// the lock is only taken if it doesn't exist or expired. If another instance has
+		// it, the upsert tries to insert a second document with its _id and fails.
+		now := time.Now()
+		_, err := db.Collections.Migrations.UpdateOne(ctx,
+			bson.M{"_id": migrationLockID, "expires": bson.M{"$lt": now}},
+			bson.M{"$set": bson.M{"owner": owner, "expires": now.Add(migrationLockTTL)}},
+			options.Update().SetUpsert(true))
+		if err == nil {
+			break
+		} else if !isDuplicateKeyError(err) {
+			return nil, fmt.Errorf("could not lock the migrations: %w", wrapError(err))
+		}
+
+		if !waiting {
+			log.Infof("Waiting for another instance to finish migrating the database")
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for another instance to migrate: %w", ctx.Err())
+		case <-time.After(migrationLockRetry):
+		}
+	}
+
+	return func() {
+		// the migrations may have failed because ctx was cancelled, so it isn't used
+		_, err := db.Collections.Migrations.DeleteOne(context.Background(), bson.M{"_id": migrationLockID, "owner": owner})
+		if err != nil {
+			log.Errorf("Could not unlock the migrations, they will be locked until the lock expires: %s", err)
+		}
+	}, nil
+}
+
+// migrateIndexes creates the indexes. The unique index on student handles can't be
+// created while two students share a handle, so they are found first to say which
+// students have to be fixed.
+//
+// This is the first migration, which came with the explicit bson tags on the models.
+// No documents have to be rewritten for them, since every tag is the lowercase field
+// name the driver used before the tags were added, and ID was already stored as _id.
+// A tag that renames a field needs its own migration with a $rename.
+func migrateIndexes(ctx context.Context, db *Database, dryRun bool) error {
+	cur, err := db.Collections.Students.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$unwind", Value: "$studenthandles"}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$studenthandles",
+			"ids":   bson.M{"$addToSet": "$_id"},
+			"names": bson.M{"$addToSet": "$name"},
+		}}},
+		{{Key: "$match", Value: bson.M{"ids.1": bson.M{"$exists": true}}}},
+	})
+	if err != nil {
+		return wrapError(err)
+	}
+
+	var duplicates []struct {
+		Handle string   `bson:"_id"`
+		Names  []string `bson:"names"`
+	}
+	if err := cur.All(ctx, &duplicates); err != nil {
+		return wrapError(err)
+	}
+	if len(duplicates) > 0 {
+		conflicts := make([]string, 0, len(duplicates))
+		for _, duplicate := range duplicates {
+			conflicts = append(conflicts, fmt.Sprintf("%s is used by %s", duplicate.Handle, strings.Join(duplicate.Names, ", ")))
+		}
+		return &Error{
+			Kind:    ErrDuplicateHandle,
+			Message: fmt.Sprintf("student handles are used by more than one student: %s", strings.Join(conflicts, "; ")),
+		}
+	}
+
+	if dryRun {
+		for collection, indexes := range db.indexes() {
+			log.Infof("Would create %d indexes on %s", len(indexes), collection.Name())
+		}
+		return nil
+	}
+	return db.EnsureIndexes(ctx)
+}
+
+// migrateUniqueIdempotencyKeys replaces the idempotency key index with a unique one. Before it
+// was unique, a batch sent twice at once could create the same events twice, so every copy
+// of an event after the first is voided and has its key removed.
+func migrateUniqueIdempotencyKeys(ctx context.Context, db *Database, dryRun bool) error {
+	cur, err := db.Collections.Events.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"idempotencykey": bson.M{"$exists": true}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$idempotencykey", "ids": bson.M{"$push": "$_id"}}}},
+		{{Key: "$match", Value: bson.M{"ids.1": bson.M{"$exists": true}}}},
+	})
+	if err != nil {
+		return wrapError(err)
+	}
+
+	var duplicates []struct {
+		Key string               `bson:"_id"`
+		IDs []primitive.ObjectID `bson:"ids"`
+	}
+	if err := cur.All(ctx, &duplicates); err != nil {
+		return wrapError(err)
+	}
+
+	for _, duplicate := range duplicates {
+		copies := duplicate.IDs[1:]
+		if dryRun {
+			log.Infof("Would void %d copies of event %s with idempotency key %s", len(copies), duplicate.IDs[0].Hex(), duplicate.Key)
+			continue
+		}
+
+		voided := EventCorrection{
+			Reason: fmt.Sprintf("created again with the idempotency key of event %s", duplicate.IDs[0].Hex()),
+			Time:   time.Now(),
+		}
+		_, err := db.Collections.Events.UpdateMany(ctx,
+			bson.M{"_id": bson.M{"$in": copies}, "voided": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"voided": voided}})
+		if err != nil {
+			return wrapError(err)
+		}
+		_, err = db.Collections.Events.UpdateMany(ctx,
+			bson.M{"_id": bson.M{"$in": copies}},
+			bson.M{"$unset": bson.M{"idempotencykey": ""}})
+		if err != nil {
+			return wrapError(err)
+		}
+		log.Infof("Voided %d copies of event %s with idempotency key %s", len(copies), duplicate.IDs[0].Hex(), duplicate.Key)
+	}
+	if dryRun {
+		return nil
+	}
+
+	// the old index has the same keys, so it has to be dropped before the unique one is created
+	_, err = db.Collections.Events.Indexes().DropOne(ctx, "idempotencykey_1")
+	var commandError mongo.CommandError
+	if err != nil && !(errors.As(err, &commandError) && commandError.Name == "IndexNotFound") {
+		return wrapError(err)
+	}
+	return db.EnsureIndexes(ctx)
+}
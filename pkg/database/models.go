@@ -12,19 +12,32 @@ package database
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"github.com/cheekybits/genny/generic"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 //go:generate genny -in=$GOFILE -out=gen-student.go		-tag=generate gen "Model=Student model=student"
 //go:generate genny -in=$GOFILE -out=gen-event.go		-tag=generate gen "Model=Event model=event"
 //go:generate genny -in=$GOFILE -out=gen-location.go 	-tag=generate gen "Model=Location model=location"
+//go:generate genny -in=$GOFILE -out=gen-user.go		-tag=generate gen "Model=User model=user"
+//go:generate genny -in=$GOFILE -out=gen-device.go		-tag=generate gen "Model=Device model=device"
 
 type Model generic.Type
 
+// ModelStore contains the basic methods every Store implements for Models
+type ModelStore interface {
+	CreateModel(ctx context.Context, model *Model) error
+	GetModels(ctx context.Context) ([]Model, error)
+	GetModelByID(ctx context.Context, id primitive.ObjectID) (Model, error)
+	GetModelByIDString(ctx context.Context, id string) (Model, error)
+	DeleteModel(ctx context.Context, id primitive.ObjectID) error
+	UpdateModel(ctx context.Context, id primitive.ObjectID, newModel *Model) error
+}
+
 // ModelRef is a reference to a Model which, when serialized, will return
 // the json of the referenced object.
 //
@@ -35,10 +48,18 @@ func (ref ModelRef) GetBSON() (interface{}, error) {
 	return primitive.ObjectID(ref), nil
 }
 
+// MarshalJSON returns the json of the referenced object, or null if the ref is empty.
+// If the object was deleted, only its id is returned, see deletedRef.
 func (ref ModelRef) MarshalJSON() ([]byte, error) {
-	obj, found := DB.GetModelByID(primitive.ObjectID(ref))
-	if !found {
-		return nil, fmt.Errorf("could not find Model with id %s", ref)
+	if primitive.ObjectID(ref).IsZero() {
+		return []byte("null"), nil
+	}
+
+	obj, err := DB.GetModelByID(context.Background(), primitive.ObjectID(ref))
+	if errors.Is(err, ErrNotFound) {
+		return json.Marshal(deletedRef{ID: primitive.ObjectID(ref), Deleted: true})
+	} else if err != nil {
+		return nil, err
 	}
 
 	return json.Marshal(obj)
@@ -50,22 +71,17 @@ func (ref *ModelRef) UnmarshalJSON(b []byte) error {
 	if err := id.UnmarshalJSON(b); err != nil {
 		return err
 	}
-	_, found := DB.GetModelByID(id)
-	if !found {
-		return fmt.Errorf("object not found")
+	if _, err := DB.GetModelByID(context.Background(), id); err != nil {
+		return err
 	}
 
 	*ref = ModelRef(id)
 	return nil
 }
 
-// Gets the referenced object and panics if it doesn't exist
-func (ref ModelRef) Get() Model {
-	obj, found := DB.GetModelByID(primitive.ObjectID(ref))
-	if !found {
-		panic("could not find object")
-	}
-	return obj
+// Get gets the referenced object. If it doesn't exist, the error will be ErrNotFound
+func (ref ModelRef) Get(ctx context.Context) (Model, error) {
+	return DB.GetModelByID(ctx, primitive.ObjectID(ref))
 }
 
 // Ref creates a reference to the object
@@ -75,94 +91,115 @@ func (obj Model) Ref() ModelRef {
 
 // CreateModel creates a Model and adds it to the database. The
 // ID element of the newly created Model will be set if it is successful
-func (db *Database) CreateModel(model *Model) {
-	result, err := db.Collections.Models.InsertOne(context.TODO(), model)
+func (db *Database) CreateModel(ctx context.Context, model *Model) error {
+	if err := checkConflicts(ctx, db, model.ID, model); err != nil {
+		return err
+	}
+
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result, err := db.Collections.Models.InsertOne(ctx, model)
 	if err != nil {
-		panic(err)
+		return wrapError(err)
 	}
 
 	model.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
 }
 
 // GetModels returns a list of all models stored in the database.
-func (db *Database) GetModels() []Model {
-	cur, err := db.Collections.Models.Find(context.TODO(), bson.D{})
+func (db *Database) GetModels(ctx context.Context) ([]Model, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	cur, err := db.Collections.Models.Find(ctx, bson.D{})
 	if err != nil {
-		panic(err)
+		return nil, wrapError(err)
 	}
 
 	models := make([]Model, 0)
-	if err := cur.All(context.TODO(), &models); err != nil {
-		panic(err)
+	if err := cur.All(ctx, &models); err != nil {
+		return nil, wrapError(err)
 	}
 
-	return models
+	return models, nil
 }
 
-// GetModelByID gets a model by their ID. If not found, found will be false and
-// err will be nil.
-func (db *Database) GetModelByID(id primitive.ObjectID) (model Model, found bool) {
-	result := db.Collections.Models.FindOne(nil, bson.M{"_id": id})
+// GetModelByID gets a model by their ID. If not found, the error will be ErrNotFound
+func (db *Database) GetModelByID(ctx context.Context, id primitive.ObjectID) (model Model, err error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
 
-	err := result.Err()
-	if err != nil {
+	result := db.Collections.Models.FindOne(ctx, bson.M{"_id": id})
+
+	if err := result.Err(); err != nil {
 		if err == mongo.ErrNoDocuments {
-			return Model{}, false
+			return Model{}, notFoundf("no Models found with id %s", id.Hex())
 		}
-		panic(err)
+		return Model{}, wrapError(err)
 	}
 
 	if err := result.Decode(&model); err != nil {
-		panic(err)
+		return Model{}, wrapError(err)
 	}
 
-	found = true
-	return
+	return model, nil
 }
 
 // GetModelByIDString gets a model by its ID as a string. If the ID could not be
-// parsed into an object ID or the model could not be found, an error will be returned
-func (db *Database) GetModelByIDString(id string) (Model, error) {
-	objectID, err := primitive.ObjectIDFromHex(id)
+// parsed into an object ID, the error will be ErrInvalidID. If the model could not be
+// found, it will be ErrNotFound
+func (db *Database) GetModelByIDString(ctx context.Context, id string) (Model, error) {
+	objectID, err := parseObjectID(id)
 	if err != nil {
 		return Model{}, err
 	}
 
-	model, found := db.GetModelByID(objectID)
-	if !found {
-		return Model{}, fmt.Errorf("no models found with id %s", objectID.Hex())
-	}
-
-	return model, nil
+	return db.GetModelByID(ctx, objectID)
 }
 
 // DeleteModel deletes a model from the database by ID. If the model could not be
-// found, success will be false
-func (db *Database) DeleteModel(id primitive.ObjectID) bool {
-	result := db.Collections.Models.FindOneAndDelete(nil, bson.M{"_id": id})
+// found, the error will be ErrNotFound
+func (db *Database) DeleteModel(ctx context.Context, id primitive.ObjectID) error {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
 
-	err := result.Err()
-	if err != nil {
+	result := db.Collections.Models.FindOneAndDelete(ctx, bson.M{"_id": id})
+
+	if err := result.Err(); err != nil {
 		if err == mongo.ErrNoDocuments {
-			return false
+			return notFoundf("no Models found with id %s", id.Hex())
 		}
-		panic(err)
+		return wrapError(err)
 	}
-	return true
+	return nil
 }
 
-// UpdateModel finds a model by its ID and updates it
-func (db *Database) UpdateModel(id primitive.ObjectID, newModel *Model) bool {
-	result := db.Collections.Locations.FindOneAndUpdate(nil, bson.M{"_id": id}, bson.M{"$set": newModel})
-	err := result.Err()
-	if err != nil {
+// UpdateModel finds a model by its ID and updates it. newModel will be set to the
+// updated model if it is successful. If the model could not be found, the error
+// will be ErrNotFound
+func (db *Database) UpdateModel(ctx context.Context, id primitive.ObjectID, newModel *Model) error {
+	if err := checkConflicts(ctx, db, id, newModel); err != nil {
+		return err
+	}
+
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result := db.Collections.Models.FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$set": newModel},
+		options.FindOneAndUpdate().SetReturnDocument(options.After))
+
+	if err := result.Err(); err != nil {
 		if err == mongo.ErrNoDocuments {
-			return false
+			return notFoundf("no Models found with id %s", id.Hex())
 		}
-		panic(err)
+		return wrapError(err)
 	}
 
-	err = result.Decode(newModel)
+	if err := result.Decode(newModel); err != nil {
+		return wrapError(err)
+	}
 
-	return true
+	return nil
 }
@@ -0,0 +1,460 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the number of models in a page if no limit is set, and the most there can be
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+// A Page selects part of a sorted list of models. Cursor is the next cursor returned with
+// the previous page, or empty for the first page. The cursor has to be used with the same
+// query and sort order it was returned for.
+type Page struct {
+	Cursor string
+	// Limit is the most models in the page. If it is 0, DefaultPageSize is used
+	Limit int
+	// Descending sorts the models from last to first
+	Descending bool
+}
+
+// pageCursor is the position in a sorted list after the last model of a page. Name or
+// Time is the field the list is sorted by, and ID breaks ties between models with the
+// same name or time.
+type pageCursor struct {
+	Name string             `json:"n,omitempty"`
+	Time time.Time          `json:"t"`
+	ID   primitive.ObjectID `json:"id"`
+}
+
+// encode returns the cursor as an opaque string that can be used in a url
+func (cursor pageCursor) encode() string {
+	b, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor parses the cursor of page. If the page has no cursor, found will be false
+func (page Page) decodeCursor() (cursor pageCursor, found bool, err error) {
+	if page.Cursor == "" {
+		return pageCursor{}, false, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(page.Cursor)
+	if err == nil {
+		err = json.Unmarshal(b, &cursor)
+	}
+	if err != nil || cursor.ID.IsZero() {
+		return pageCursor{}, false, &Error{Kind: ErrInvalidCursor, Message: "invalid cursor " + page.Cursor}
+	}
+	return cursor, true, nil
+}
+
+func (page Page) limit() int {
+	switch {
+	case page.Limit <= 0:
+		return DefaultPageSize
+	case page.Limit > MaxPageSize:
+		return MaxPageSize
+	default:
+		return page.Limit
+	}
+}
+
+// mongoQuery adds the cursor to filter and returns the options to get the page from mongo
+// sorted by field, which is "name" or "time". One more model than the limit is requested
+// so the caller can tell if there is another page.
+func (page Page) mongoQuery(filter bson.M, field string) (bson.M, *options.FindOptions, error) {
+	cursor, found, err := page.decodeCursor()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	direction, after := 1, "$gt"
+	if page.Descending {
+		direction, after = -1, "$lt"
+	}
+
+	if found {
+		var value interface{} = cursor.Name
+		if field == "time" {
+			value = cursor.Time
+		}
+		filter = bson.M{"$and": bson.A{filter, bson.M{"$or": bson.A{
+			bson.M{field: bson.M{after: value}},
+			bson.M{field: value, "_id": bson.M{after: cursor.ID}},
+		}}}}
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: field, Value: direction}, {Key: "_id", Value: direction}}).
+		SetLimit(int64(page.limit() + 1))
+	return filter, opts, nil
+}
+
+// bounds returns the start and end of the page in a sorted list of n models. after
+// returns true if the model at i is after the cursor.
+func (page Page) bounds(n int, after func(cursor pageCursor, i int) bool) (start int, end int, err error) {
+	cursor, found, err := page.decodeCursor()
+	if err != nil {
+		return 0, 0, err
+	}
+	if found {
+		start = sort.Search(n, func(i int) bool { return after(cursor, i) })
+	}
+
+	end = start + page.limit()
+	if end > n {
+		end = n
+	}
+	return start, end, nil
+}
+
+// compareCursor compares a model with the name or time and id to the cursor in the
+// page's sort order. It returns a positive number if the model is after the cursor.
+func (page Page) compareCursor(cursor pageCursor, name string, t time.Time, id primitive.ObjectID) int {
+	c := strings.Compare(name, cursor.Name)
+	if c == 0 {
+		switch {
+		case t.Before(cursor.Time):
+			c = -1
+		case t.After(cursor.Time):
+			c = 1
+		}
+	}
+	if c == 0 {
+		c = bytes.Compare(id[:], cursor.ID[:])
+	}
+	if page.Descending {
+		return -c
+	}
+	return c
+}
+
+// searchRegex matches text containing search, ignoring case
+func searchRegex(search string) primitive.Regex {
+	return primitive.Regex{Pattern: regexp.QuoteMeta(search), Options: "i"}
+}
+
+// containsFold returns true if s contains substr, ignoring case
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// StudentQuery selects a page of students sorted by name
+type StudentQuery struct {
+	// Search matches students whose name, email or one of their handles contains it, ignoring case
+	Search string
+	// Archived includes archived students
+	Archived bool
+	Page
+}
+
+func (query StudentQuery) filter() bson.M {
+	filter := bson.M{}
+	if !query.Archived {
+		filter["archived"] = bson.M{"$ne": true}
+	}
+	if query.Search != "" {
+		regex := searchRegex(query.Search)
+		filter["$or"] = bson.A{
+			bson.M{"name": regex},
+			bson.M{"email": regex},
+			bson.M{"studenthandles": regex},
+		}
+	}
+	return filter
+}
+
+func (query StudentQuery) matches(student Student) bool {
+	if !query.Archived && student.Archived {
+		return false
+	}
+	if query.Search == "" || containsFold(student.Name, query.Search) || containsFold(student.Email, query.Search) {
+		return true
+	}
+	for _, handle := range student.StudentHandles {
+		if containsFold(handle, query.Search) {
+			return true
+		}
+	}
+	return false
+}
+
+// LocationQuery selects a page of locations sorted by name
+type LocationQuery struct {
+	// Search matches locations whose name contains it, ignoring case
+	Search string
+	// Archived includes archived locations
+	Archived bool
+	Page
+}
+
+func (query LocationQuery) filter() bson.M {
+	filter := bson.M{}
+	if !query.Archived {
+		filter["archived"] = bson.M{"$ne": true}
+	}
+	if query.Search != "" {
+		filter["name"] = searchRegex(query.Search)
+	}
+	return filter
+}
+
+func (query LocationQuery) matches(location Location) bool {
+	if !query.Archived && location.Archived {
+		return false
+	}
+	return query.Search == "" || containsFold(location.Name, query.Search)
+}
+
+// EventQuery selects a page of events sorted by time. Zero fields match every event.
+// Anonymized events are never included.
+type EventQuery struct {
+	Student  StudentRef
+	Location LocationRef
+	// EventType and Source only match events with that type or source if they aren't nil
+	EventType *EventType
+	Source    *EventSource
+	// From and To are the range of times of the events
+	From time.Time
+	To   time.Time
+	// Voided includes voided events
+	Voided bool
+	Page
+}
+
+func (query EventQuery) filter() bson.M {
+	filter := bson.M{"anonymized": bson.M{"$ne": true}}
+	if !query.Voided {
+		filter["voided"] = bson.M{"$exists": false}
+	}
+	if !primitive.ObjectID(query.Student).IsZero() {
+		filter["student"] = query.Student
+	}
+	if !primitive.ObjectID(query.Location).IsZero() {
+		filter["location"] = query.Location
+	}
+	if query.EventType != nil {
+		filter["eventtype"] = *query.EventType
+	}
+	if query.Source != nil {
+		filter["source"] = *query.Source
+	}
+	times := bson.M{}
+	if !query.From.IsZero() {
+		times["$gte"] = query.From
+	}
+	if !query.To.IsZero() {
+		times["$lte"] = query.To
+	}
+	if len(times) > 0 {
+		filter["time"] = times
+	}
+	return filter
+}
+
+func (query EventQuery) matches(event Event) bool {
+	switch {
+	case event.Anonymized, !query.Voided && event.Voided != nil:
+		return false
+	case !primitive.ObjectID(query.Student).IsZero() && event.Student != query.Student:
+		return false
+	case !primitive.ObjectID(query.Location).IsZero() && event.Location != query.Location:
+		return false
+	case query.EventType != nil && event.EventType != *query.EventType:
+		return false
+	case query.Source != nil && event.Source != *query.Source:
+		return false
+	case !query.From.IsZero() && event.Time.Before(query.From):
+		return false
+	case !query.To.IsZero() && event.Time.After(query.To):
+		return false
+	}
+	return true
+}
+
+// QueryStudents returns a page of the students selected by the query and the cursor of
+// the next page, which is empty if it is the last page
+func (db *Database) QueryStudents(ctx context.Context, query StudentQuery) ([]Student, string, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	filter, opts, err := query.mongoQuery(query.filter(), "name")
+	if err != nil {
+		return nil, "", err
+	}
+	cur, err := db.Collections.Students.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, "", wrapError(err)
+	}
+	students := make([]Student, 0)
+	if err := cur.All(ctx, &students); err != nil {
+		return nil, "", wrapError(err)
+	}
+
+	if len(students) <= query.limit() {
+		return students, "", nil
+	}
+	students = students[:query.limit()]
+	last := students[len(students)-1]
+	return students, pageCursor{Name: last.Name, ID: last.ID}.encode(), nil
+}
+
+// QueryLocations returns a page of the locations selected by the query and the cursor of
+// the next page, which is empty if it is the last page
+func (db *Database) QueryLocations(ctx context.Context, query LocationQuery) ([]Location, string, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	filter, opts, err := query.mongoQuery(query.filter(), "name")
+	if err != nil {
+		return nil, "", err
+	}
+	cur, err := db.Collections.Locations.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, "", wrapError(err)
+	}
+	locations := make([]Location, 0)
+	if err := cur.All(ctx, &locations); err != nil {
+		return nil, "", wrapError(err)
+	}
+
+	if len(locations) <= query.limit() {
+		return locations, "", nil
+	}
+	locations = locations[:query.limit()]
+	last := locations[len(locations)-1]
+	return locations, pageCursor{Name: last.Name, ID: last.ID}.encode(), nil
+}
+
+// QueryEvents returns a page of the events selected by the query and the cursor of
+// the next page, which is empty if it is the last page
+func (db *Database) QueryEvents(ctx context.Context, query EventQuery) ([]Event, string, error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	filter, opts, err := query.mongoQuery(query.filter(), "time")
+	if err != nil {
+		return nil, "", err
+	}
+	cur, err := db.Collections.Events.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, "", wrapError(err)
+	}
+	events := make([]Event, 0)
+	if err := cur.All(ctx, &events); err != nil {
+		return nil, "", wrapError(err)
+	}
+
+	if len(events) <= query.limit() {
+		return events, "", nil
+	}
+	events = events[:query.limit()]
+	last := events[len(events)-1]
+	return events, pageCursor{Time: last.Time, ID: last.ID}.encode(), nil
+}
+
+// QueryStudents returns a page of the students selected by the query and the cursor of
+// the next page, which is empty if it is the last page
+func (store *MemoryStore) QueryStudents(ctx context.Context, query StudentQuery) ([]Student, string, error) {
+	all, err := store.GetStudents(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	students := make([]Student, 0, len(all))
+	for _, student := range all {
+		if query.matches(student) {
+			students = append(students, student)
+		}
+	}
+	compare := func(cursor pageCursor, i int) int {
+		return query.compareCursor(cursor, students[i].Name, time.Time{}, students[i].ID)
+	}
+	sort.SliceStable(students, func(i, j int) bool {
+		return compare(pageCursor{Name: students[j].Name, ID: students[j].ID}, i) < 0
+	})
+
+	start, end, err := query.bounds(len(students), func(cursor pageCursor, i int) bool { return compare(cursor, i) > 0 })
+	if err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if end < len(students) {
+		next = pageCursor{Name: students[end-1].Name, ID: students[end-1].ID}.encode()
+	}
+	return students[start:end], next, nil
+}
+
+// QueryLocations returns a page of the locations selected by the query and the cursor of
+// the next page, which is empty if it is the last page
+func (store *MemoryStore) QueryLocations(ctx context.Context, query LocationQuery) ([]Location, string, error) {
+	all, err := store.GetLocations(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	locations := make([]Location, 0, len(all))
+	for _, location := range all {
+		if query.matches(location) {
+			locations = append(locations, location)
+		}
+	}
+	compare := func(cursor pageCursor, i int) int {
+		return query.compareCursor(cursor, locations[i].Name, time.Time{}, locations[i].ID)
+	}
+	sort.SliceStable(locations, func(i, j int) bool {
+		return compare(pageCursor{Name: locations[j].Name, ID: locations[j].ID}, i) < 0
+	})
+
+	start, end, err := query.bounds(len(locations), func(cursor pageCursor, i int) bool { return compare(cursor, i) > 0 })
+	if err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if end < len(locations) {
+		next = pageCursor{Name: locations[end-1].Name, ID: locations[end-1].ID}.encode()
+	}
+	return locations[start:end], next, nil
+}
+
+// QueryEvents returns a page of the events selected by the query and the cursor of
+// the next page, which is empty if it is the last page
+func (store *MemoryStore) QueryEvents(ctx context.Context, query EventQuery) ([]Event, string, error) {
+	all, err := store.GetEvents(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	events := make([]Event, 0, len(all))
+	for _, event := range all {
+		if query.matches(event) {
+			events = append(events, event)
+		}
+	}
+	compare := func(cursor pageCursor, i int) int {
+		return query.compareCursor(cursor, "", events[i].Time, events[i].ID)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return compare(pageCursor{Time: events[j].Time, ID: events[j].ID}, i) < 0
+	})
+
+	start, end, err := query.bounds(len(events), func(cursor pageCursor, i int) bool { return compare(cursor, i) > 0 })
+	if err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if end < len(events) {
+		next = pageCursor{Time: events[end-1].Time, ID: events[end-1].ID}.encode()
+	}
+	return events[start:end], next, nil
+}
@@ -0,0 +1,10 @@
+package database
+
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
+// deletedRef is the json of a ref to an object that was deleted, so responses that
+// reference it can still be sent, like {"id": <id>, "deleted": true}
+type deletedRef struct {
+	ID      primitive.ObjectID `json:"id"`
+	Deleted bool               `json:"deleted"`
+}
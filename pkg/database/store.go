@@ -0,0 +1,114 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// A Store stores all of the models used for contact tracing. Database is the
+// mongo implementation and MemoryStore keeps everything in memory, which is useful
+// for tests and demos. Errors returned by a Store can be checked against the
+// errors in errors.go using errors.Is. Every method takes a context which
+// cancels the query when it is done.
+type Store interface {
+	StudentStore
+	LocationStore
+	EventStore
+	UserStore
+	DeviceStore
+
+	// QueryStudents, QueryLocations and QueryEvents return a page of the models selected by
+	// the query and the cursor of the next page, which is empty if it is the last page
+	QueryStudents(ctx context.Context, query StudentQuery) ([]Student, string, error)
+	QueryLocations(ctx context.Context, query LocationQuery) ([]Location, string, error)
+	QueryEvents(ctx context.Context, query EventQuery) ([]Event, string, error)
+
+	// GetStudentByHandle gets a student by the StudentHandles member
+	GetStudentByHandle(ctx context.Context, handle string) (student Student, err error)
+
+	// GetUserByUsername gets a user by their username
+	GetUserByUsername(ctx context.Context, username string) (user User, err error)
+
+	// GetDeviceByTokenHash gets the device with a TokenHash
+	GetDeviceByTokenHash(ctx context.Context, hash []byte) (device Device, err error)
+	// SetDeviceLastSeen sets the LastSeen time of a device without changing anything else
+	SetDeviceLastSeen(ctx context.Context, id primitive.ObjectID, lastSeen time.Time) error
+
+	// CreateAuditEntry appends an entry to the audit log. Entries can't be changed after they are
+	// created, except by RedactAuditEntries
+	CreateAuditEntry(ctx context.Context, entry *AuditEntry) error
+	// RedactAuditEntries removes the snapshots from every audit entry targeting target and returns how many were redacted
+	RedactAuditEntries(ctx context.Context, target primitive.ObjectID) (int64, error)
+	// GetAuditEntries gets the audit entries matching filter sorted from latest to earliest
+	GetAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error)
+
+	// The event queries below ignore voided and anonymized events unless they say otherwise.
+
+	// GetMostRecentEvent gets the most recent event created by the specified student
+	GetMostRecentEvent(ctx context.Context, studentRef StudentRef) (event Event, err error)
+	// GetMostRecentEventBetween gets the most recent event created by the specified student between two times
+	GetMostRecentEventBetween(ctx context.Context, studentRef StudentRef, minTime time.Time, maxTime time.Time) (event Event, err error)
+	// GetMostRecentEventBetweenWithType is GetMostRecentEventBetween filtered by an event type
+	GetMostRecentEventBetweenWithType(ctx context.Context, studentRef StudentRef, minTime time.Time, maxTime time.Time, eventType EventType) (event Event, err error)
+	// GetEventByIdempotencyKey gets the event created with an IdempotencyKey, even if it was voided
+	GetEventByIdempotencyKey(ctx context.Context, key string) (event Event, err error)
+	// GetAllEventsBetween gets all of the events between minTime and maxTime sorted from earliest to latest
+	GetAllEventsBetween(ctx context.Context, minTime time.Time, maxTime time.Time) ([]Event, error)
+	// GetStudentEventsBetween gets the events of a student between minTime and maxTime sorted from earliest to latest
+	GetStudentEventsBetween(ctx context.Context, studentRef StudentRef, minTime time.Time, maxTime time.Time) ([]Event, error)
+	// GetLocationEventsBetween gets the events at a location between minTime and maxTime, including the anonymized ones
+	GetLocationEventsBetween(ctx context.Context, locationRef LocationRef, minTime time.Time, maxTime time.Time) ([]Event, error)
+
+	// PurgeEventsBefore deletes all events before a time, or counts them if dryRun is true
+	PurgeEventsBefore(ctx context.Context, t time.Time, dryRun bool) (int64, error)
+	// AnonymizeEventsBefore removes the students from all events before a time, or counts them if dryRun is true
+	AnonymizeEventsBefore(ctx context.Context, t time.Time, dryRun bool) (int64, error)
+
+	// GetEventsByStudent gets all of a student's events, including voided ones, sorted from earliest to latest
+	GetEventsByStudent(ctx context.Context, studentRef StudentRef) ([]Event, error)
+	// DeleteEventsByStudent deletes all of a student's events
+	DeleteEventsByStudent(ctx context.Context, studentRef StudentRef) (int64, error)
+	// DeleteEventsByLocation deletes all of the events at a location
+	DeleteEventsByLocation(ctx context.Context, locationRef LocationRef) (int64, error)
+	// PseudonymizeEventsByStudent replaces the student in all of their events with a pseudonym
+	PseudonymizeEventsByStudent(ctx context.Context, studentRef StudentRef, pseudonym StudentRef) (int64, error)
+
+	// VoidEvent sets Voided on an event if it wasn't voided yet and returns the voided event
+	VoidEvent(ctx context.Context, id primitive.ObjectID, correction *EventCorrection) (Event, error)
+	// UnvoidEvent removes Voided from an event
+	UnvoidEvent(ctx context.Context, id primitive.ObjectID) error
+}
+
+// The drivers that can be used in Config.Driver
+const (
+	DriverMongo  = "mongo"
+	DriverMemory = "memory"
+)
+
+// Open opens the Store specified by config.Driver. If no driver is specified,
+// mongo will be used. If successful, the global DB object will be set.
+func Open(config Config) (Store, error) {
+	switch config.Driver {
+	case "", DriverMongo:
+		// a nil *Database in a Store isn't == nil, so it isn't returned on errors
+		db, err := Connect(config)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case DriverMemory:
+		store := NewMemoryStore()
+		DB = store
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown database driver %s", config.Driver)
+	}
+}
+
+// assert that both implementations satisfy Store
+var (
+	_ Store = &Database{}
+	_ Store = &MemoryStore{}
+)
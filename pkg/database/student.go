@@ -2,6 +2,8 @@ package database
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -10,33 +12,65 @@ import (
 // A Student represents one member of the school who can sign in and out of a location
 type Student struct {
 	ID    primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	Name  string             `json:"name"`
-	Email string             `json:"email"`
+	Name  string             `bson:"name" json:"name"`
+	Email string             `bson:"email" json:"email"`
+	// ExternalID is the student's id in the school's student information system.
+	// Students imported from a roster are matched to existing ones by it.
+	ExternalID string `bson:"externalid" json:"external_id"`
 
 	// StudentHandles is the list of IDs that can be used to scan in and out of a location
-	StudentHandles []string `json:"student_handles"`
+	StudentHandles []string `bson:"studenthandles" json:"student_handles"`
+
+	// Archived students were deleted, but are kept so the history of where they were
+	// still has their name. They can't scan in or out.
+	Archived bool `bson:"archived" json:"archived"`
 }
 
 // GetStudentByHandle gets a student by the StudentHandles member. If the
-// student is found, found will be true. If there is an error getting the student,
-// it will be returned. Not that this error will not contain the not found error
-func (db *Database) GetStudentByHandle(handle string) (student Student, found bool) {
-	result := db.Collections.Students.FindOne(context.TODO(), bson.M{"studenthandles": bson.M{"$elemMatch": bson.M{"$eq": handle}}})
+// student could not be found, the error will be ErrNotFound
+func (db *Database) GetStudentByHandle(ctx context.Context, handle string) (student Student, err error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result := db.Collections.Students.FindOne(ctx, bson.M{"studenthandles": bson.M{"$elemMatch": bson.M{"$eq": handle}}})
 
-	err := result.Err()
-	if err != nil {
+	if err := result.Err(); err != nil {
 		// If the student cannot be found
 		if err == mongo.ErrNoDocuments {
-			return Student{}, false
+			return Student{}, notFoundf("student with handle %s was not found", handle)
 		}
-		panic(err)
+		return Student{}, wrapError(err)
 	}
 
 	if err := result.Decode(&student); err != nil {
-		panic(err)
+		return Student{}, wrapError(err)
 	}
 
-	found = true
+	return student, nil
+}
+
+// checkConflicts returns an ErrDuplicateHandle Error naming the owner if one of
+// the student's handles is used by another student
+func (student Student) checkConflicts(ctx context.Context, store Store, id primitive.ObjectID) error {
+	for i, handle := range student.StudentHandles {
+		for _, other := range student.StudentHandles[:i] {
+			if other == handle {
+				return &Error{Kind: ErrDuplicateHandle, Message: fmt.Sprintf("student handle %s is listed twice", handle)}
+			}
+		}
 
-	return
+		owner, err := store.GetStudentByHandle(ctx, handle)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if owner.ID != id {
+			return &Error{
+				Kind:    ErrDuplicateHandle,
+				Message: fmt.Sprintf("student handle %s is already used by %s (%s)", handle, owner.Name, owner.ID.Hex()),
+			}
+		}
+	}
+	return nil
 }
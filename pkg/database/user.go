@@ -0,0 +1,78 @@
+package database
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// A Role decides which parts of the API a User can access
+type Role string
+
+const (
+	// RoleKiosk can only scan students in and out
+	RoleKiosk Role = "kiosk"
+	// RoleStaff can see who is at each location and log students out
+	RoleStaff Role = "staff"
+	// RoleAdmin can manage students, locations and users, and can access everything else
+	RoleAdmin Role = "admin"
+	// RoleHealthOfficer can generate contact reports
+	RoleHealthOfficer Role = "health_officer"
+)
+
+// Valid returns true if role is one of the Roles
+func (role Role) Valid() bool {
+	switch role {
+	case RoleKiosk, RoleStaff, RoleAdmin, RoleHealthOfficer:
+		return true
+	default:
+		return false
+	}
+}
+
+// A User is an account that can log in to the API
+type User struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Username string             `bson:"username" json:"username"`
+	// PasswordHash is the bcrypt hash of the user's password
+	PasswordHash []byte `bson:"passwordhash" json:"-"`
+	Roles        []Role `bson:"roles" json:"roles"`
+}
+
+// HasRole returns true if the user has any of roles. Admins have every role.
+func (user User) HasRole(roles ...Role) bool {
+	for _, userRole := range user.Roles {
+		if userRole == RoleAdmin {
+			return true
+		}
+		for _, role := range roles {
+			if userRole == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetUserByUsername gets a user by their username. If the user could not be
+// found, the error will be ErrNotFound
+func (db *Database) GetUserByUsername(ctx context.Context, username string) (user User, err error) {
+	ctx, cancel := db.queryContext(ctx)
+	defer cancel()
+
+	result := db.Collections.Users.FindOne(ctx, bson.M{"username": username})
+
+	if err := result.Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return User{}, notFoundf("user %s was not found", username)
+		}
+		return User{}, wrapError(err)
+	}
+
+	if err := result.Decode(&user); err != nil {
+		return User{}, wrapError(err)
+	}
+
+	return user, nil
+}
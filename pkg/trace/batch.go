@@ -0,0 +1,81 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+	"trace/pkg/database"
+)
+
+// the furthest in the future a scan in a batch can be, to allow for clocks that are a little off
+const maxScanClockSkew = 5 * time.Minute
+
+// A ScanResult is the result of a Scan in HandleScanBatch
+type ScanResult struct {
+	// Event is the event created by the scan, or the event created the first time
+	// the scan was handled if it is a Duplicate
+	Event     database.Event
+	Duplicate bool
+	// UserError is why the scan couldn't be handled. If it is set, no event was created.
+	UserError error
+}
+
+// HandleScanBatch handles scans that were recorded by a client and sent later, for example by a
+// kiosk that lost its connection. The scans are handled from earliest to latest with HandleScanAt,
+// so students enter and leave locations the same way they would have if the scans were sent
+// as they happened. Every scan needs an IdempotencyKey and scans with a key that was already
+// handled aren't handled again, so a batch can be safely resent, even while it is still
+// being handled. The results are in the same
+// order as scans. If err is returned, the batch stopped and should be resent.
+func HandleScanBatch(ctx context.Context, scans []Scan) (results []ScanResult, err error) {
+	results = make([]ScanResult, len(scans))
+
+	// the indexes of scans sorted by their time
+	order := make([]int, len(scans))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return scans[order[i]].Time.Before(scans[order[j]].Time)
+	})
+
+	now := time.Now()
+	for _, i := range order {
+		scan := scans[i]
+
+		if scan.IdempotencyKey == "" {
+			results[i].UserError = errors.New("no idempotency key specified")
+			continue
+		}
+		if scan.Time.IsZero() || scan.Time.After(now.Add(maxScanClockSkew)) {
+			results[i].UserError = fmt.Errorf("invalid scan time %s", scan.Time)
+			continue
+		}
+
+		event, err := database.DB.GetEventByIdempotencyKey(ctx, scan.IdempotencyKey)
+		if err == nil {
+			results[i] = ScanResult{Event: event, Duplicate: true}
+			continue
+		} else if !errors.Is(err, database.ErrNotFound) {
+			return nil, err
+		}
+
+		event, userError, err := HandleScanAt(ctx, scan)
+		if errors.Is(err, database.ErrDuplicateIdempotencyKey) {
+			// the same scan was handled by another request since it was looked up
+			event, err = database.DB.GetEventByIdempotencyKey(ctx, scan.IdempotencyKey)
+			if err != nil {
+				return nil, err
+			}
+			results[i] = ScanResult{Event: event, Duplicate: true}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		results[i] = ScanResult{Event: event, UserError: userError}
+	}
+
+	return results, nil
+}
@@ -1,149 +1,213 @@
 package trace
 
 import (
+	"context"
 	"errors"
-	"github.com/sirupsen/logrus"
+	"sort"
 	"time"
 	"trace/pkg/database"
 )
 
 type ContactReport struct {
 	TargetStudent *database.Student
-	// Contacts is an array of maps of students to the time that they have been in the same location
-	// as the target student. Each element of this array represents the number of students in between that contact.
+	// Contacts is an array of maps of students to how they were exposed to the target student.
+	// Each element of this array represents the number of students in between that contact.
 	// For example, the 1st element of this array would be the people who have been directly in contact with
-	// TargetStudent, the 2nd element of this array would be the time spent with the first contact students, and so on
-	Contacts []map[database.StudentRef]time.Duration
+	// TargetStudent, the 2nd element of this array would be the people who have been in contact with the
+	// first contact students after they were exposed, and so on. A student is only in the first depth
+	// they were exposed at, and the target student is never a contact. There will be fewer than
+	// maxDepth elements if nobody was exposed at a depth.
+	Contacts []map[database.StudentRef]*Contact
 }
 
-// GenerateContactReport generates a contact report for the targetStudent between startTime and endTime
-func GenerateContactReport(targetStudent *database.Student, startTime time.Time, endTime time.Time, maxDepth int) (*ContactReport, error) {
-	if maxDepth < 1 {
-		return nil, errors.New("maxDepth must greater than 0")
-	}
-
-	events := database.DB.GetAllEventsBetween(startTime, endTime)
-	students := database.DB.GetStudents()
+// A Contact is a student who was exposed to the target student of a ContactReport,
+// either directly or through a chain of other contacts
+type Contact struct {
+	Student database.StudentRef
 
-	report := ContactReport{
-		TargetStudent: targetStudent,
-	}
+	// Duration is the total time the student spent with the students who exposed them.
+	// Time spent with several of them at once is only counted once.
+	Duration time.Duration
 
-	// Create the contact list
-	report.Contacts = make([]map[database.StudentRef]time.Duration, maxDepth)
-	// Make each map
-	for n := range report.Contacts {
-		report.Contacts[n] = make(map[database.StudentRef]time.Duration)
-	}
+	// FirstExposure is the earliest time the student was exposed. Only contacts the student
+	// had after this time are counted when finding the next depth of contacts.
+	FirstExposure time.Time
 
-	// Get all the students in direct contact
-	for _, student := range students {
-		if student.ID == targetStudent.ID {
-			continue
-		}
+	// Via maps each student who exposed this student to the time they spent together after
+	// that student was exposed. For direct contacts, this is the target student.
+	Via map[database.StudentRef]time.Duration
 
-		timeWithTarget := getContactTimeWith(events, targetStudent.Ref(), student.Ref())
-		report.Contacts[0][student.Ref()] = timeWithTarget
-	}
+	// Risk is the contact's Risk using the ExposureRules the report was generated with,
+	// and Exposure is the weighted time used to decide it
+	Risk     Risk
+	Exposure time.Duration
 
-	// Calculate time spent for each depth.
-	// This won't run if maxDepth is 1.
-	// O(n^4)
-	for depth := 1; depth < maxDepth; depth++ {
-		// We're now getting contact time between multiple target students who have are in [depth-1]
-		var targetStudents []database.StudentRef
-		for student := range report.Contacts[depth-1] {
-			targetStudents = append(targetStudents, student)
-		}
+	// Overlaps are the periods of time the student was exposed sorted by their start times
+	Overlaps []Overlap
+}
 
-		// If there are no more targetStudents, stop
-		if len(targetStudents) == 0 {
-			break
-		}
+// An Overlap is a period of time that a contact was at the same location as a student who exposed them
+type Overlap struct {
+	// Source is the student who exposed the contact
+	Source   database.StudentRef
+	Location database.LocationRef
+	Start    time.Time
+	End      time.Time
+}
 
-		// For all students who have been in contact with target with the targetStudent [depth-1] away
-		for _, depthTargetStudent := range targetStudents {
-			for _, student := range students {
-				if student.Ref() == depthTargetStudent {
-					continue
-				}
+func (o Overlap) Duration() time.Duration {
+	return o.End.Sub(o.Start)
+}
 
-				timeWithTarget := getContactTimeWith(events, depthTargetStudent, student.Ref())
-				report.Contacts[depth][student.Ref()] = timeWithTarget
+// mergeOverlaps merges the overlaps at the same location that happened at the same time,
+// so time spent with several students at once is only counted once. The merged overlaps
+// are sorted by their start times and have the Source of the earliest overlap in them.
+func mergeOverlaps(overlaps []Overlap) []Overlap {
+	sorted := make([]Overlap, len(overlaps))
+	copy(sorted, overlaps)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start.Before(sorted[j].Start)
+	})
+
+	merged := make([]Overlap, 0, len(sorted))
+	// the index in merged of the last overlap at each location
+	last := make(map[database.LocationRef]int)
+	for _, o := range sorted {
+		if i, found := last[o.Location]; found && !o.Start.After(merged[i].End) {
+			if o.End.After(merged[i].End) {
+				merged[i].End = o.End
 			}
+			continue
 		}
+		last[o.Location] = len(merged)
+		merged = append(merged, o)
 	}
+	return merged
+}
 
-	return &report, nil
+// totalDuration returns the time in overlaps after they are merged
+func totalDuration(overlaps []Overlap) time.Duration {
+	var total time.Duration
+	for _, o := range mergeOverlaps(overlaps) {
+		total += o.Duration()
+	}
+	return total
 }
 
-// getContactTimeWith gets the total amount of time that student1 and student2 have been in contact.
-// events must be in order from oldest to newest
-func getContactTimeWith(events []database.Event, student1 database.StudentRef, student2 database.StudentRef) time.Duration {
-	// The total time the two students have been in contact
-	var totalTime time.Duration
+// GenerateContactReport generates a contact report for the targetStudent between startTime and endTime.
+// The events are converted to the periods of time each student was at a location once, and
+// the contacts are found by sweeping over those periods, so generating a report takes
+// roughly O(events log events) for each depth. Each contact is classified using rules.
+func GenerateContactReport(ctx context.Context, targetStudent *database.Student, startTime time.Time, endTime time.Time, maxDepth int, rules ExposureRules) (*ContactReport, error) {
+	if maxDepth < 1 {
+		return nil, errors.New("maxDepth must greater than 0")
+	}
 
-	// The current location of each student. Nil if they are not in a location
-	var student1Location *database.LocationRef
-	var student2Location *database.LocationRef
+	events, err := database.DB.GetAllEventsBetween(ctx, startTime, endTime)
+	if err != nil {
+		return nil, err
+	}
 
-	// The time a student has entered their location
-	var student1UpdateTime time.Time
-	var student2UpdateTime time.Time
+	timeouts, err := locationTimeouts(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-	// Parse each event
-	for _, event := range events {
-		// Continue if the event isn't with either of the students
-		if event.Student != student1 && event.Student != student2 {
-			continue
-		}
+	index := newPresenceIndex(events, endTime, timeouts)
+
+	report := ContactReport{
+		TargetStudent: targetStudent,
+		Contacts:      make([]map[database.StudentRef]*Contact, 0, maxDepth),
+	}
+
+	// the time each student was exposed. The target student is the source of
+	// the exposure, so all of their contacts count
+	exposed := map[database.StudentRef]time.Time{
+		targetStudent.Ref(): startTime,
+	}
+	// the students whose contacts will be found for the next depth
+	sources := map[database.StudentRef]bool{
+		targetStudent.Ref(): true,
+	}
+
+	for depth := 0; depth < maxDepth; depth++ {
+		contacts := make(map[database.StudentRef]*Contact)
 
-		// True if we should subtract the two event times and update the total time
-		var shouldUpdateTotal bool
-
-		// Update the location and updateTime
-		if event.EventType == database.EventEnter {
-			switch event.Student {
-			case student1:
-				student1Location = &event.Location
-				student1UpdateTime = event.Time
-			case student2:
-				student2Location = &event.Location
-				student2UpdateTime = event.Time
+		index.sweepOverlaps(sources, func(o overlap) {
+			// students are only counted at the first depth they were exposed at
+			if _, found := exposed[o.Other]; found {
+				return
 			}
-		} else if event.EventType == database.EventLeave {
-			// We should update the total if someone leaves a location that the other student is in
-			if student1Location != nil && student2Location != nil {
-				if *student1Location == *student2Location {
-					shouldUpdateTotal = true
-				}
+
+			// only count the time after the source was exposed
+			start := o.Start
+			if sourceExposed := exposed[o.Student]; sourceExposed.After(start) {
+				start = sourceExposed
 			}
-			switch event.Student {
-			case student1:
-				student1Location = nil
-				student1UpdateTime = event.Time
-			case student2:
-				student2Location = nil
-				student2UpdateTime = event.Time
+			if !o.End.After(start) {
+				return
 			}
-		} else {
-			logrus.Warnf("Encountered invalid event type %d in getContactTimeWith", event.EventType)
-			continue
-		}
-		// TODO: Add location timeouts
 
-		if shouldUpdateTotal {
-			// Get the time spent together in the location
-			timeSpentTogether := student1UpdateTime.Sub(student2UpdateTime)
+			contact, found := contacts[o.Other]
+			if !found {
+				contact = &Contact{
+					Student:       o.Other,
+					FirstExposure: start,
+					Via:           make(map[database.StudentRef]time.Duration),
+				}
+				contacts[o.Other] = contact
+			}
 
-			// Take absolute value of timeSpentTogether
-			if timeSpentTogether < 0 {
-				timeSpentTogether = -timeSpentTogether
+			contact.Overlaps = append(contact.Overlaps, Overlap{Source: o.Student, Location: o.Location, Start: start, End: o.End})
+			if start.Before(contact.FirstExposure) {
+				contact.FirstExposure = start
 			}
+		})
 
-			totalTime += timeSpentTogether
+		// If nobody else was exposed, stop
+		if len(contacts) == 0 {
+			break
 		}
+		report.Contacts = append(report.Contacts, contacts)
+
+		// the contacts found at this depth are the sources for the next one
+		sources = make(map[database.StudentRef]bool)
+		for student, contact := range contacts {
+			overlaps := contact.Overlaps
+			sort.Slice(overlaps, func(i, j int) bool {
+				return overlaps[i].Start.Before(overlaps[j].Start)
+			})
+			contact.Risk, contact.Exposure = rules.Classify(overlaps)
+
+			// a contact can be with several sources at once, so the time is counted after merging
+			contact.Duration = totalDuration(overlaps)
+			sourceOverlaps := make(map[database.StudentRef][]Overlap)
+			for _, o := range overlaps {
+				sourceOverlaps[o.Source] = append(sourceOverlaps[o.Source], o)
+			}
+			for source, o := range sourceOverlaps {
+				contact.Via[source] = totalDuration(o)
+			}
+
+			exposed[student] = contact.FirstExposure
+			sources[student] = true
+		}
+	}
+
+	return &report, nil
+}
+
+// locationTimeouts gets the Timeout of every location
+func locationTimeouts(ctx context.Context) (map[database.LocationRef]time.Duration, error) {
+	locations, err := database.DB.GetLocations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	timeouts := make(map[database.LocationRef]time.Duration)
+	for _, location := range locations {
+		timeouts[location.Ref()] = location.Timeout
 	}
 
-	return totalTime
+	return timeouts, nil
 }
@@ -0,0 +1,146 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+	"trace/pkg/database"
+)
+
+var (
+	// ErrInvalidCorrection is returned when a correction can't be made because a field is invalid
+	ErrInvalidCorrection = errors.New("invalid correction")
+	// ErrEventVoided is returned when correcting an event that was already voided
+	ErrEventVoided = errors.New("event was already voided")
+)
+
+// newCorrection validates the reason for a correction and returns the record of it
+func newCorrection(reason string, by primitive.ObjectID) (*database.EventCorrection, error) {
+	if reason == "" {
+		return nil, fmt.Errorf("no reason specified: %w", ErrInvalidCorrection)
+	}
+	return &database.EventCorrection{Reason: reason, Time: time.Now(), By: by}, nil
+}
+
+// CreateManualEvent creates an event by hand to correct the history, for example when a
+// student didn't scan. The event can be backdated, but not in the future. Location,
+// Student, Time and EventType have to be set on event, and everything else is overwritten.
+func CreateManualEvent(ctx context.Context, event database.Event, reason string, by primitive.ObjectID) (database.Event, error) {
+	correction, err := newCorrection(reason, by)
+	if err != nil {
+		return database.Event{}, err
+	}
+	return createManualEvent(ctx, event, correction)
+}
+
+// createManualEvent is CreateManualEvent with the correction already made
+func createManualEvent(ctx context.Context, event database.Event, correction *database.EventCorrection) (database.Event, error) {
+	if event.EventType != database.EventEnter && event.EventType != database.EventLeave {
+		return database.Event{}, fmt.Errorf("invalid event type %d: %w", event.EventType, ErrInvalidCorrection)
+	}
+	if event.Time.IsZero() || event.Time.After(correction.Time) {
+		return database.Event{}, fmt.Errorf("events can't be created in the future: %w", ErrInvalidCorrection)
+	}
+	if _, err := event.Student.Get(ctx); err != nil {
+		return database.Event{}, err
+	}
+	if _, err := event.Location.Get(ctx); err != nil {
+		return database.Event{}, err
+	}
+
+	event = database.Event{
+		Location:   event.Location,
+		Student:    event.Student,
+		Time:       event.Time,
+		EventType:  event.EventType,
+		Source:     database.EventSourceManual,
+		Correction: correction,
+	}
+	if err := CreateEvent(ctx, &event); err != nil {
+		return database.Event{}, err
+	}
+
+	log.WithFields(log.Fields{"event": event.ID.Hex(), "reason": correction.Reason}).Infof("Created a manual event")
+	return event, nil
+}
+
+// VoidEvent marks an event as wrong so it is ignored when finding where students were.
+// The event isn't deleted so the correction can be audited.
+func VoidEvent(ctx context.Context, id primitive.ObjectID, reason string, by primitive.ObjectID) (database.Event, error) {
+	correction, err := newCorrection(reason, by)
+	if err != nil {
+		return database.Event{}, err
+	}
+
+	event, err := database.DB.GetEventByID(ctx, id)
+	if err != nil {
+		return database.Event{}, err
+	}
+	if event.Voided != nil {
+		return database.Event{}, ErrEventVoided
+	}
+
+	// only Voided is set, and only if nobody voided the event since it was read
+	event, err = database.DB.VoidEvent(ctx, id, correction)
+	if errors.Is(err, database.ErrNotFound) {
+		return database.Event{}, ErrEventVoided
+	} else if err != nil {
+		return database.Event{}, err
+	}
+
+	log.WithFields(log.Fields{"event": id.Hex(), "reason": reason}).Infof("Voided an event")
+	publish(ctx, event)
+	return event, nil
+}
+
+// MoveEvent corrects the location of an event by voiding it and creating a manual event
+// at location with the same student, time and type. It returns the voided event and the
+// event that replaced it. If the replacement can't be created, the event is unvoided.
+func MoveEvent(ctx context.Context, id primitive.ObjectID, location database.LocationRef, reason string, by primitive.ObjectID) (voided database.Event, replacement database.Event, err error) {
+	correction, err := newCorrection(reason, by)
+	if err != nil {
+		return database.Event{}, database.Event{}, err
+	}
+	correction.Replaces = &id
+
+	event, err := database.DB.GetEventByID(ctx, id)
+	if err != nil {
+		return database.Event{}, database.Event{}, err
+	}
+	if event.Voided != nil {
+		return database.Event{}, database.Event{}, ErrEventVoided
+	}
+	if event.Location == location {
+		return database.Event{}, database.Event{}, fmt.Errorf("event is already at the location: %w", ErrInvalidCorrection)
+	}
+	if _, err := location.Get(ctx); err != nil {
+		return database.Event{}, database.Event{}, err
+	}
+
+	voided, err = VoidEvent(ctx, id, reason, by)
+	if err != nil {
+		return database.Event{}, database.Event{}, err
+	}
+
+	replacement, err = createManualEvent(ctx, database.Event{
+		Location:  location,
+		Student:   event.Student,
+		Time:      event.Time,
+		EventType: event.EventType,
+	}, correction)
+	if err != nil {
+		// the request's context isn't used, because it failing may be why the replacement wasn't created
+		if unvoidErr := database.DB.UnvoidEvent(context.Background(), id); unvoidErr != nil {
+			log.WithError(unvoidErr).WithField("event", id.Hex()).Errorf("Couldn't unvoid an event that wasn't moved")
+		} else {
+			event.Voided = nil
+			publish(ctx, event)
+		}
+		return database.Event{}, database.Event{}, err
+	}
+
+	return voided, replacement, nil
+}
@@ -0,0 +1,89 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+	"trace/pkg/database"
+)
+
+// CreateEvent creates event in the database and publishes it to Hub. All events
+// should be created through this so everyone subscribed to Hub sees them.
+func CreateEvent(ctx context.Context, event *database.Event) error {
+	if err := database.DB.CreateEvent(ctx, event); err != nil {
+		return err
+	}
+
+	publish(ctx, *event)
+	return nil
+}
+
+// publish publishes event to Hub after it was created or corrected. The student and the
+// occupancy are only looked up if someone is subscribed to the event's location.
+func publish(ctx context.Context, event database.Event) {
+	if !Hub.Subscribed(event.Location) {
+		return
+	}
+
+	update := Update{Event: event}
+	student, err := event.Student.Get(ctx)
+	if errors.Is(err, database.ErrNotFound) {
+		student = database.Student{ID: primitive.ObjectID(event.Student)}
+	} else if err != nil {
+		log.WithError(err).WithField("event", event.ID.Hex()).Errorf("Couldn't publish an event")
+		return
+	}
+	update.Student = student
+
+	update.Occupancy, err = Occupancy(ctx, event.Location, time.Now())
+	if err != nil {
+		log.WithError(err).WithField("event", event.ID.Hex()).Errorf("Couldn't publish an event")
+		return
+	}
+
+	Hub.Publish(update)
+}
+
+// LogoutStudent creates a leave event for the student at the location at the current time
+func LogoutStudent(ctx context.Context, studentRef database.StudentRef, locationRef database.LocationRef) (database.Event, error) {
+	event := database.Event{
+		Location:  locationRef,
+		Student:   studentRef,
+		Time:      time.Now(),
+		EventType: database.EventLeave,
+		Source:    database.EventSourceLoggedOut,
+	}
+	if err := CreateEvent(ctx, &event); err != nil {
+		return database.Event{}, err
+	}
+
+	return event, nil
+}
+
+// LogoutAllStudentsAtLocation creates a leave event for every student at the location
+// at the current time and returns the events
+func LogoutAllStudentsAtLocation(ctx context.Context, locationRef database.LocationRef) ([]database.Event, error) {
+	students, _, err := GetStudentsAtLocation(ctx, locationRef, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]database.Event, 0, len(students))
+	for _, student := range students {
+		event := database.Event{
+			Location:  locationRef,
+			Student:   student.Ref(),
+			Time:      time.Now(),
+			EventType: database.EventLeave,
+			Source:    database.EventSourceLoggedOutAll,
+		}
+		if err := CreateEvent(ctx, &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,115 @@
+package trace
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"trace/pkg/database"
+)
+
+// the number of events a subscription can fall behind before events are dropped
+const subscriptionBufferSize = 64
+
+// An Update is an event published to an EventHub. Everything in it is looked up once
+// when it is published, so it doesn't have to be looked up again by every subscriber.
+type Update struct {
+	Event database.Event
+	// Student is the student of the event. Only their ID is set if they were deleted.
+	Student database.Student
+	// Occupancy is the number of students at the event's location after the event
+	Occupancy int
+}
+
+// An EventHub publishes events to everyone subscribed to it as they are created or corrected
+type EventHub struct {
+	mu          sync.Mutex
+	subscribers map[*Subscription]bool
+}
+
+// NewEventHub creates an EventHub without any subscribers
+func NewEventHub() *EventHub {
+	return &EventHub{subscribers: make(map[*Subscription]bool)}
+}
+
+// Hub is the EventHub that every event created by trace is published to
+var Hub = NewEventHub()
+
+// A Subscription receives the updates published to an EventHub on Events
+// until it is closed
+type Subscription struct {
+	Events <-chan Update
+
+	events chan Update
+	// location is the only location the subscription receives events for. If it is nil,
+	// the subscription receives events for every location
+	location *database.LocationRef
+	hub      *EventHub
+}
+
+// Subscribe subscribes to the events at location. If location is nil, the subscription
+// will receive the events for every location. The subscription must be closed when
+// it isn't needed anymore.
+func (hub *EventHub) Subscribe(location *database.LocationRef) *Subscription {
+	events := make(chan Update, subscriptionBufferSize)
+	subscription := &Subscription{
+		Events:   events,
+		events:   events,
+		location: location,
+		hub:      hub,
+	}
+
+	hub.mu.Lock()
+	hub.subscribers[subscription] = true
+	hub.mu.Unlock()
+
+	return subscription
+}
+
+// Close unsubscribes from the hub and closes Events
+func (subscription *Subscription) Close() {
+	hub := subscription.hub
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if hub.subscribers[subscription] {
+		delete(hub.subscribers, subscription)
+		close(subscription.events)
+	}
+}
+
+// Subscribed returns true if anyone is subscribed to the events at location
+func (hub *EventHub) Subscribed(location database.LocationRef) bool {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for subscription := range hub.subscribers {
+		if subscription.receives(location) {
+			return true
+		}
+	}
+	return false
+}
+
+// receives returns true if the subscription receives the events at location
+func (subscription *Subscription) receives(location database.LocationRef) bool {
+	return subscription.location == nil || *subscription.location == location
+}
+
+// Publish sends update to every subscriber. It never blocks, so if a subscriber
+// has fallen too far behind the update is dropped for that subscriber.
+func (hub *EventHub) Publish(update Update) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for subscription := range hub.subscribers {
+		if !subscription.receives(update.Event.Location) {
+			continue
+		}
+
+		select {
+		case subscription.events <- update:
+		default:
+			log.WithField("event", update.Event.ID.Hex()).Warnf("Dropped an event for a subscriber that fell behind")
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package trace
+
+import (
+	"container/heap"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"time"
+	"trace/pkg/database"
+)
+
+// A presence is a period of time that a student was at a location
+type presence struct {
+	Student   database.StudentRef
+	Location  database.LocationRef
+	Start     time.Time
+	End       time.Time
+	EndReason PresenceEnd
+}
+
+// PresenceEnd is how a student's presence at a location ended
+type PresenceEnd string
+
+const (
+	PresenceEndScan         PresenceEnd = "scan"
+	PresenceEndAutoLeave    PresenceEnd = "auto_leave"
+	PresenceEndLoggedOut    PresenceEnd = "logged_out"
+	PresenceEndLoggedOutAll PresenceEnd = "logged_out_all"
+	PresenceEndTransferred  PresenceEnd = "transferred"
+	PresenceEndManual       PresenceEnd = "manual"
+	// PresenceEndOngoing presences hadn't ended by the end time they were built with
+	PresenceEndOngoing PresenceEnd = "ongoing"
+)
+
+// presenceEnds is the PresenceEnd of a presence ended by a leave event from each source
+var presenceEnds = map[database.EventSource]PresenceEnd{
+	database.EventSourceScan:         PresenceEndScan,
+	database.EventSourceAutoLeave:    PresenceEndAutoLeave,
+	database.EventSourceLoggedOut:    PresenceEndLoggedOut,
+	database.EventSourceLoggedOutAll: PresenceEndLoggedOutAll,
+	database.EventSourceTransferred:  PresenceEndTransferred,
+	database.EventSourceManual:       PresenceEndManual,
+}
+
+// buildPresences converts events into the periods of time each student was at a location.
+// events must be in order from oldest to newest. An enter event starts a presence
+// which ends at the student's next leave event for that location or at their next
+// enter event, whichever comes first. If the student never left, the presence ends
+// when the location's timeout in timeouts runs out or at endTime, whichever comes
+// first, so contacts are correct even if the timeout events were never created.
+// Like IsStudentAtLocation, a Timeout of 0 or less runs out as soon as the student
+// enters, so nobody is ever at those locations. Locations that aren't in timeouts
+// only end at endTime. The EndReason of each presence is
+// set from the source of the event that ended it, and presences that timed out are
+// PresenceEndAutoLeave.
+func buildPresences(events []database.Event, endTime time.Time, timeouts map[database.LocationRef]time.Duration) []presence {
+	presences := make([]presence, 0)
+
+	// the presence each student is currently in
+	open := make(map[database.StudentRef]presence)
+
+	// timeout ends p at its location's timeout if that happens before end
+	timeout := func(p presence, end time.Time, reason PresenceEnd) presence {
+		p.End, p.EndReason = end, reason
+		if t, found := timeouts[p.Location]; found && p.Start.Add(t).Before(end) {
+			p.End, p.EndReason = p.Start.Add(t), PresenceEndAutoLeave
+		}
+		return p
+	}
+
+	for _, event := range events {
+		current, isOpen := open[event.Student]
+
+		switch event.EventType {
+		case database.EventEnter:
+			// a student can only be at one location, so entering ends their last presence
+			if isOpen {
+				presences = append(presences, timeout(current, event.Time, PresenceEndTransferred))
+			}
+			open[event.Student] = presence{
+				Student:  event.Student,
+				Location: event.Location,
+				Start:    event.Time,
+			}
+		case database.EventLeave:
+			if !isOpen || current.Location != event.Location {
+				continue
+			}
+			current.End = event.Time
+			current.EndReason = presenceEnds[event.Source]
+			presences = append(presences, current)
+			delete(open, event.Student)
+		default:
+			logrus.Warnf("Encountered invalid event type %d in buildPresences", event.EventType)
+		}
+	}
+
+	for _, current := range open {
+		presences = append(presences, timeout(current, endTime, PresenceEndOngoing))
+	}
+
+	return presences
+}
+
+// An overlap is a period of time that Student and Other were at the same location
+type overlap struct {
+	Student  database.StudentRef
+	Other    database.StudentRef
+	Location database.LocationRef
+	Start    time.Time
+	End      time.Time
+}
+
+func (o overlap) Duration() time.Duration {
+	return o.End.Sub(o.Start)
+}
+
+// A presenceIndex holds the presences at each location sorted by their start times
+type presenceIndex map[database.LocationRef][]presence
+
+// newPresenceIndex creates a presenceIndex from events in order from oldest to newest
+// which happened before endTime. timeouts is the Timeout of each location.
+func newPresenceIndex(events []database.Event, endTime time.Time, timeouts map[database.LocationRef]time.Duration) presenceIndex {
+	index := make(presenceIndex)
+	for _, p := range buildPresences(events, endTime, timeouts) {
+		if !p.End.After(p.Start) {
+			continue
+		}
+		index[p.Location] = append(index[p.Location], p)
+	}
+
+	for _, presences := range index {
+		sort.Slice(presences, func(i, j int) bool {
+			return presences[i].Start.Before(presences[j].Start)
+		})
+	}
+
+	return index
+}
+
+// sweepOverlaps calls found for every overlap between one of students and any other
+// student. overlap.Student is always one of students, so if both students are in
+// students the overlap will be found twice, once for each of them.
+//
+// It sweeps over the presences of each location in order of their start times and
+// keeps the presences that haven't ended yet in heaps, so it runs in
+// O(p log p + k) where p is the number of presences and k is the number of overlaps found.
+func (index presenceIndex) sweepOverlaps(students map[database.StudentRef]bool, found func(o overlap)) {
+	for location, presences := range index {
+		// all of the presences that haven't ended and the ones that belong to students
+		active := &presenceHeap{}
+		activeStudents := &presenceHeap{}
+
+		for _, p := range presences {
+			// remove the presences that ended before this one started
+			active.popEndedBy(p.Start)
+			activeStudents.popEndedBy(p.Start)
+
+			// p is compared to every active presence if it belongs to one of the students,
+			// otherwise it only has to be compared to the students' presences
+			wanted := students[p.Student]
+			candidates := activeStudents
+			if wanted {
+				candidates = active
+			}
+
+			// every active presence started before p, so the overlap starts when p starts
+			for _, other := range *candidates {
+				if other.Student == p.Student {
+					continue
+				}
+
+				end := p.End
+				if other.End.Before(end) {
+					end = other.End
+				}
+				o := overlap{Student: p.Student, Other: other.Student, Location: location, Start: p.Start, End: end}
+
+				if wanted {
+					found(o)
+				}
+				if students[other.Student] {
+					o.Student, o.Other = o.Other, o.Student
+					found(o)
+				}
+			}
+
+			heap.Push(active, p)
+			if wanted {
+				heap.Push(activeStudents, p)
+			}
+		}
+	}
+}
+
+// contactTimes returns the total time each of students has been in contact with every other student
+func (index presenceIndex) contactTimes(students map[database.StudentRef]bool) map[database.StudentRef]map[database.StudentRef]time.Duration {
+	times := make(map[database.StudentRef]map[database.StudentRef]time.Duration)
+	for student := range students {
+		times[student] = make(map[database.StudentRef]time.Duration)
+	}
+
+	index.sweepOverlaps(students, func(o overlap) {
+		times[o.Student][o.Other] += o.Duration()
+	})
+
+	return times
+}
+
+// presenceHeap is a min heap of presences ordered by their end time
+type presenceHeap []presence
+
+func (h presenceHeap) Len() int            { return len(h) }
+func (h presenceHeap) Less(i, j int) bool  { return h[i].End.Before(h[j].End) }
+func (h presenceHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *presenceHeap) Push(x interface{}) { *h = append(*h, x.(presence)) }
+func (h *presenceHeap) Pop() interface{} {
+	old := *h
+	p := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return p
+}
+
+// popEndedBy removes every presence that ended at or before t
+func (h *presenceHeap) popEndedBy(t time.Time) {
+	for h.Len() > 0 && !(*h)[0].End.After(t) {
+		heap.Pop(h)
+	}
+}
@@ -1,6 +1,7 @@
 package trace
 
 import (
+	"context"
 	log "github.com/sirupsen/logrus"
 	"time"
 	"trace/pkg/database"
@@ -15,9 +16,12 @@ type LocationVisit struct {
 // GetLocationVisitors returns a list of LocationVisit objects representing
 // who has entered a location in the time range. This will not return students who
 // are currently in the location
-func GetLocationVisitors(locationRef database.LocationRef, minTime time.Time, maxTime time.Time) []LocationVisit {
+func GetLocationVisitors(ctx context.Context, locationRef database.LocationRef, minTime time.Time, maxTime time.Time) ([]LocationVisit, error) {
 	visits := make([]LocationVisit, 0)
-	events := database.DB.GetAllEventsBetween(minTime, maxTime)
+	events, err := database.DB.GetAllEventsBetween(ctx, minTime, maxTime)
+	if err != nil {
+		return nil, err
+	}
 
 	// create and populate latest leave and enter event
 	latestLeaveEvent := make(map[database.StudentRef]database.Event)
@@ -52,5 +56,62 @@ func GetLocationVisitors(locationRef database.LocationRef, minTime time.Time, ma
 		})
 	}
 
-	return visits
+	return visits, nil
+}
+
+// DeleteLocation deletes a location and every event at it, and returns the number of events
+// deleted. Locations should usually be archived instead so the history is kept.
+func DeleteLocation(ctx context.Context, locationRef database.LocationRef) (int64, error) {
+	location, err := locationRef.Get(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// the events are deleted first so the location can still be found if it fails
+	events, err := database.DB.DeleteEventsByLocation(ctx, locationRef)
+	if err != nil {
+		return 0, err
+	}
+	if err := database.DB.DeleteLocation(ctx, location.ID); err != nil {
+		return 0, err
+	}
+
+	log.WithFields(log.Fields{"location": location.Name, "events": events}).Infof("Deleted a location and its events")
+	return events, nil
+}
+
+// LocationStats are the visits to a location between From and To
+type LocationStats struct {
+	Location database.LocationRef `json:"location"`
+	From     time.Time            `json:"from"`
+	To       time.Time            `json:"to"`
+	// Visits is the number of times a student entered the location
+	Visits int `json:"visits"`
+	// Days is the number of visits on each day in the server's time zone keyed by the date, like 2020-10-18
+	Days map[string]int `json:"days"`
+	// Hours is the number of visits that started in each hour of the day
+	Hours [24]int `json:"hours"`
+}
+
+// GetLocationStats counts the visits to a location between minTime and maxTime. Events that
+// were anonymized by the retention policy or pseudonymized when a student was erased are
+// counted too, so the statistics don't change when the students are removed.
+func GetLocationStats(ctx context.Context, locationRef database.LocationRef, minTime time.Time, maxTime time.Time) (LocationStats, error) {
+	events, err := database.DB.GetLocationEventsBetween(ctx, locationRef, minTime, maxTime)
+	if err != nil {
+		return LocationStats{}, err
+	}
+
+	stats := LocationStats{Location: locationRef, From: minTime, To: maxTime, Days: make(map[string]int)}
+	for _, event := range events {
+		if event.EventType != database.EventEnter {
+			continue
+		}
+		t := event.Time.Local()
+		stats.Visits++
+		stats.Days[t.Format("2006-01-02")]++
+		stats.Hours[t.Hour()]++
+	}
+
+	return stats, nil
 }
@@ -0,0 +1,185 @@
+package trace
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"time"
+	"trace/pkg/database"
+)
+
+// A StudentExport is all of the data stored about a student, for when they or
+// their parents ask for it
+type StudentExport struct {
+	ExportedAt time.Time        `json:"exported_at"`
+	Student    database.Student `json:"student"`
+	// Events are all of the student's events from earliest to latest, including voided ones
+	Events []ExportedEvent `json:"events"`
+	// Locations are the locations in Events
+	Locations []database.Location `json:"locations"`
+}
+
+// An ExportedEvent is an event in a StudentExport. Its location is an id so
+// the location isn't repeated for every event.
+type ExportedEvent struct {
+	ID         primitive.ObjectID        `json:"id"`
+	LocationID primitive.ObjectID        `json:"location_id"`
+	Time       time.Time                 `json:"time"`
+	EventType  database.EventType        `json:"event_type"`
+	Source     database.EventSource      `json:"source"`
+	Correction *database.EventCorrection `json:"correction,omitempty"`
+	Voided     *database.EventCorrection `json:"voided,omitempty"`
+}
+
+// ExportStudent gets all of the data stored about a student
+func ExportStudent(ctx context.Context, studentRef database.StudentRef) (StudentExport, error) {
+	student, err := studentRef.Get(ctx)
+	if err != nil {
+		return StudentExport{}, err
+	}
+
+	events, err := database.DB.GetEventsByStudent(ctx, studentRef)
+	if err != nil {
+		return StudentExport{}, err
+	}
+
+	export := StudentExport{
+		ExportedAt: time.Now(),
+		Student:    student,
+		Events:     make([]ExportedEvent, 0, len(events)),
+		Locations:  make([]database.Location, 0),
+	}
+	locations := make(map[database.LocationRef]bool)
+	for _, event := range events {
+		export.Events = append(export.Events, ExportedEvent{
+			ID:         event.ID,
+			LocationID: primitive.ObjectID(event.Location),
+			Time:       event.Time,
+			EventType:  event.EventType,
+			Source:     event.Source,
+			Correction: event.Correction,
+			Voided:     event.Voided,
+		})
+
+		if locations[event.Location] {
+			continue
+		}
+		locations[event.Location] = true
+		location, err := event.Location.Get(ctx)
+		if errors.Is(err, database.ErrNotFound) {
+			// the location was deleted, so there is nothing more to export
+			continue
+		} else if err != nil {
+			return StudentExport{}, err
+		}
+		export.Locations = append(export.Locations, location)
+	}
+
+	return export, nil
+}
+
+// WriteZip writes the export as a zip file with student.json, events.json and locations.json
+func (export StudentExport) WriteZip(w io.Writer) error {
+	archive := zip.NewWriter(w)
+
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{"student.json", export.Student},
+		{"events.json", export.Events},
+		{"locations.json", export.Locations},
+	}
+	for _, file := range files {
+		f, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     file.name,
+			Method:   zip.Deflate,
+			Modified: export.ExportedAt,
+		})
+		if err != nil {
+			return err
+		}
+
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(file.content); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// ErasureMode is how a student's events are erased by EraseStudent
+type ErasureMode string
+
+const (
+	// ErasureDelete deletes the student's events
+	ErasureDelete ErasureMode = "delete"
+	// ErasurePseudonymize replaces the student in their events with a random id that isn't
+	// stored anywhere else, so the visits to each location can still be counted
+	ErasurePseudonymize ErasureMode = "pseudonymize"
+)
+
+// ErrInvalidErasure is returned by EraseStudent when the mode is invalid
+var ErrInvalidErasure = errors.New("invalid erasure")
+
+// An ErasureReport is what was erased by EraseStudent
+type ErasureReport struct {
+	Mode    ErasureMode        `json:"mode"`
+	Student primitive.ObjectID `json:"student"`
+	// Events is the number of events that were deleted or pseudonymized
+	Events int64 `json:"events"`
+	// AuditEntries is the number of audit entries that had the student's data redacted
+	AuditEntries int64 `json:"audit_entries"`
+}
+
+// EraseStudent deletes a student and deletes or pseudonymizes all of their events. The snapshots
+// in the audit entries about the student are redacted, since the snapshots of the student and
+// their events have the student's data. This can't be undone, so the student should be
+// exported first if it is needed.
+func EraseStudent(ctx context.Context, studentRef database.StudentRef, mode ErasureMode) (ErasureReport, error) {
+	if mode != ErasureDelete && mode != ErasurePseudonymize {
+		return ErasureReport{}, fmt.Errorf("invalid erasure mode %s: %w", mode, ErrInvalidErasure)
+	}
+
+	student, err := studentRef.Get(ctx)
+	if err != nil {
+		return ErasureReport{}, err
+	}
+
+	report := ErasureReport{Mode: mode, Student: student.ID}
+
+	// the events are erased first so the student can still be found if it fails
+	if mode == ErasureDelete {
+		report.Events, err = database.DB.DeleteEventsByStudent(ctx, studentRef)
+	} else {
+		pseudonym := database.StudentRef(primitive.NewObjectID())
+		report.Events, err = database.DB.PseudonymizeEventsByStudent(ctx, studentRef, pseudonym)
+	}
+	if err != nil {
+		return ErasureReport{}, err
+	}
+
+	if err := database.DB.DeleteStudent(ctx, student.ID); err != nil {
+		return ErasureReport{}, err
+	}
+
+	report.AuditEntries, err = database.DB.RedactAuditEntries(ctx, student.ID)
+	if err != nil {
+		return ErasureReport{}, err
+	}
+
+	log.WithFields(log.Fields{
+		"student": student.ID.Hex(),
+		"mode":    mode,
+		"events":  report.Events,
+		"audit":   report.AuditEntries,
+	}).Infof("Erased a student")
+	return report, nil
+}
@@ -0,0 +1,255 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sort"
+	"time"
+	"trace/pkg/database"
+)
+
+// RetentionMode is what is done to events that are older than the retention period
+type RetentionMode string
+
+const (
+	// RetentionPurge deletes the events
+	RetentionPurge RetentionMode = "purge"
+	// RetentionAnonymize removes the students from the events, but keeps their locations and
+	// times so the number of visits to each location can still be counted
+	RetentionAnonymize RetentionMode = "anonymize"
+)
+
+// the shortest retention period allowed, so a typo can't delete the events that are still needed
+const minRetentionPeriod = 24 * time.Hour
+
+// how often RetentionThread applies the policy
+const retentionInterval = time.Hour
+
+var (
+	// ErrInvalidRetentionPolicy is returned when a RetentionPolicy doesn't make sense
+	ErrInvalidRetentionPolicy = errors.New("invalid retention policy")
+	// ErrRetentionDisabled is returned when applying a RetentionPolicy without a period
+	ErrRetentionDisabled = errors.New("no retention period is set")
+)
+
+// A RetentionPolicy decides how long the history of where students were is kept
+type RetentionPolicy struct {
+	// Period is how long events are kept. If it is zero, events are kept forever
+	Period time.Duration `json:"period"`
+	// Mode is what is done to events older than Period. If it is empty, they are purged
+	Mode RetentionMode `json:"mode"`
+	// RemoveStudents deletes the students who have left, which are the students
+	// who only have events that are older than Period
+	RemoveStudents bool `json:"remove_students"`
+}
+
+// Enabled returns true if events are removed after a period
+func (policy RetentionPolicy) Enabled() bool {
+	return policy.Period > 0
+}
+
+// Validate returns an error if the policy doesn't make sense
+func (policy RetentionPolicy) Validate() error {
+	if policy.Period < 0 {
+		return fmt.Errorf("retention period must not be negative: %w", ErrInvalidRetentionPolicy)
+	}
+	if policy.Enabled() && policy.Period < minRetentionPeriod {
+		return fmt.Errorf("retention period must be at least %s: %w", minRetentionPeriod, ErrInvalidRetentionPolicy)
+	}
+	switch policy.Mode {
+	case "", RetentionPurge, RetentionAnonymize:
+		return nil
+	default:
+		return fmt.Errorf("invalid retention mode %s: %w", policy.Mode, ErrInvalidRetentionPolicy)
+	}
+}
+
+// Retention is the policy used by the API. It is disabled by default.
+var Retention RetentionPolicy
+
+// A RetentionReport is what was removed by ApplyRetentionPolicy, or what
+// would have been if it was a dry run
+type RetentionReport struct {
+	DryRun bool          `json:"dry_run"`
+	Mode   RetentionMode `json:"mode"`
+	// Cutoff is the time events before were removed
+	Cutoff time.Time `json:"cutoff"`
+	// Events is the number of events that were purged or anonymized
+	Events int64 `json:"events"`
+	// Students are the students that left and were removed
+	Students []database.Student `json:"students"`
+	// AuditEntries is the number of audit entries about the removed students that were redacted
+	AuditEntries int64 `json:"audit_entries"`
+}
+
+// AuditEntry returns the audit entry recording what was removed. It only has the ids of the
+// removed students, since keeping their data in the audit log would defeat the policy.
+func (report RetentionReport) AuditEntry() database.AuditEntry {
+	targets := make([]primitive.ObjectID, 0, len(report.Students))
+	for _, student := range report.Students {
+		targets = append(targets, student.ID)
+	}
+	return database.AuditEntry{
+		Action:    database.AuditRetention,
+		TargetIDs: targets,
+		Details: map[string]interface{}{
+			"mode":     report.Mode,
+			"cutoff":   report.Cutoff,
+			"events":   report.Events,
+			"students": len(report.Students),
+		},
+	}
+}
+
+// ApplyRetentionPolicy purges or anonymizes the events older than policy.Period and removes
+// the students who have left if policy.RemoveStudents is set. The snapshots in the audit entries
+// about the removed students are redacted, like when a student is erased. If dryRun is true,
+// nothing is changed and the report is what would have been removed. If removing a student
+// fails, the report has what was already removed along with the error.
+func ApplyRetentionPolicy(ctx context.Context, policy RetentionPolicy, now time.Time, dryRun bool) (RetentionReport, error) {
+	if err := policy.Validate(); err != nil {
+		return RetentionReport{}, err
+	}
+	if !policy.Enabled() {
+		return RetentionReport{}, ErrRetentionDisabled
+	}
+
+	report := RetentionReport{
+		DryRun:   dryRun,
+		Mode:     policy.Mode,
+		Cutoff:   now.Add(-policy.Period),
+		Students: make([]database.Student, 0),
+	}
+	if report.Mode == "" {
+		report.Mode = RetentionPurge
+	}
+
+	// the students have to be found before their events are removed
+	if policy.RemoveStudents {
+		students, err := studentsWhoLeft(ctx, report.Cutoff, now)
+		if err != nil {
+			return RetentionReport{}, err
+		}
+		report.Students = students
+	}
+
+	var err error
+	if report.Mode == RetentionAnonymize {
+		report.Events, err = database.DB.AnonymizeEventsBefore(ctx, report.Cutoff, dryRun)
+	} else {
+		report.Events, err = database.DB.PurgeEventsBefore(ctx, report.Cutoff, dryRun)
+	}
+	if err != nil {
+		return RetentionReport{}, err
+	}
+
+	if !dryRun {
+		for i, student := range report.Students {
+			if err := removeStudent(ctx, student, &report); err != nil {
+				report.Students = report.Students[:i]
+				return report, err
+			}
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"dryRun":   dryRun,
+		"mode":     report.Mode,
+		"cutoff":   report.Cutoff,
+		"events":   report.Events,
+		"students": len(report.Students),
+		"audit":    report.AuditEntries,
+	}).Infof("Applied the retention policy")
+	return report, nil
+}
+
+// removeStudent deletes a student who left and redacts the audit entries about them
+func removeStudent(ctx context.Context, student database.Student, report *RetentionReport) error {
+	if err := database.DB.DeleteStudent(ctx, student.ID); err != nil {
+		return err
+	}
+	redacted, err := database.DB.RedactAuditEntries(ctx, student.ID)
+	report.AuditEntries += redacted
+	return err
+}
+
+// studentsWhoLeft returns the students who have events before cutoff but none after it.
+// Students without any events are kept since they were just added.
+func studentsWhoLeft(ctx context.Context, cutoff time.Time, now time.Time) ([]database.Student, error) {
+	oldEvents, err := database.DB.GetAllEventsBetween(ctx, time.Unix(0, 0), cutoff)
+	if err != nil {
+		return nil, err
+	}
+	recentEvents, err := database.DB.GetAllEventsBetween(ctx, cutoff.Add(-1), now)
+	if err != nil {
+		return nil, err
+	}
+
+	left := make(map[database.StudentRef]bool)
+	for _, event := range oldEvents {
+		left[event.Student] = true
+	}
+	for _, event := range recentEvents {
+		delete(left, event.Student)
+	}
+
+	students := make([]database.Student, 0, len(left))
+	for ref := range left {
+		student, err := ref.Get(ctx)
+		if errors.Is(err, database.ErrNotFound) {
+			// the student was already deleted
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		students = append(students, student)
+	}
+	sort.Slice(students, func(i, j int) bool {
+		return students[i].Name < students[j].Name
+	})
+
+	return students, nil
+}
+
+// recordRetention adds the audit entry of a report to the audit log. RetentionThread
+// isn't a user or device, so the entry's actor is "retention".
+func recordRetention(report RetentionReport) {
+	entry := report.AuditEntry()
+	entry.Time = time.Now()
+	entry.Actor = "retention"
+	// the entry is written even if ctx was cancelled while the policy was applied
+	if err := database.DB.CreateAuditEntry(context.Background(), &entry); err != nil {
+		log.Errorf("Failed to write the audit entry of the retention policy: %s", err)
+	}
+}
+
+// RetentionThread applies the retention policy every hour until ctx is cancelled.
+// Run it on a new goroutine using `go RetentionThread(ctx, policy)`.
+func RetentionThread(ctx context.Context, policy RetentionPolicy) {
+	if !policy.Enabled() {
+		log.Debugf("No retention period is set, events will be kept forever")
+		return
+	}
+
+	log.Debugf("RetentionThread started")
+	for {
+		report, err := ApplyRetentionPolicy(ctx, policy, time.Now(), false)
+		if err != nil {
+			log.Errorf("Error applying the retention policy: %s", err)
+		}
+		// the report is empty if the policy failed before anything was removed
+		if !report.Cutoff.IsZero() {
+			recordRetention(report)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Debugf("RetentionThread stopped")
+			return
+		case <-time.After(retentionInterval):
+		}
+	}
+}
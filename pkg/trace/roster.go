@@ -0,0 +1,342 @@
+package trace
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"strings"
+	"trace/pkg/database"
+)
+
+// A RosterMapping is the names of the columns of a roster CSV. Column names
+// aren't case sensitive.
+type RosterMapping struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	// ExternalID is the column with the student's id in the student information system
+	ExternalID string `json:"external_id"`
+	// Handles are the columns with the ids students scan with, like card numbers
+	Handles []string `json:"handles"`
+}
+
+// DefaultRosterMapping is the mapping used when a column isn't set
+var DefaultRosterMapping = RosterMapping{
+	Name:       "name",
+	Email:      "email",
+	ExternalID: "student_id",
+	Handles:    []string{"card_number"},
+}
+
+// RosterOptions are the options for ImportRoster
+type RosterOptions struct {
+	Mapping RosterMapping `json:"mapping"`
+	// If DryRun is true, nothing is changed and the report is what would have been
+	DryRun bool `json:"dry_run"`
+	// ArchiveMissing archives imported students that aren't in the roster anymore.
+	// Students that weren't imported are never archived.
+	ArchiveMissing bool `json:"archive_missing"`
+}
+
+// ErrInvalidRoster is returned by ImportRoster when the roster can't be read at all,
+// like when a column in the mapping is missing. Problems with single rows are in the
+// report instead.
+var ErrInvalidRoster = errors.New("invalid roster")
+
+// A RosterRowError is a row of a roster that wasn't imported
+type RosterRowError struct {
+	// Row is the line of the row in the CSV, where the header is line 1
+	Row     int    `json:"row"`
+	Message string `json:"message"`
+}
+
+// A RosterReport is what was changed by ImportRoster
+type RosterReport struct {
+	DryRun bool `json:"dry_run"`
+	// Created are the new students. Their ids are empty in a dry run.
+	Created []database.Student `json:"created"`
+	// Updated are the students whose name, email or handles changed, or that were restored
+	Updated []database.Student `json:"updated"`
+	// Unchanged is the number of students that were already up to date
+	Unchanged int `json:"unchanged"`
+	// Archived are the students that aren't in the roster anymore
+	Archived []database.Student `json:"archived"`
+	Errors   []RosterRowError   `json:"errors"`
+}
+
+// TargetIDs returns the ids of the students that were changed
+func (report RosterReport) TargetIDs() []primitive.ObjectID {
+	ids := make([]primitive.ObjectID, 0, len(report.Created)+len(report.Updated)+len(report.Archived))
+	for _, students := range [][]database.Student{report.Created, report.Updated, report.Archived} {
+		for _, student := range students {
+			ids = append(ids, student.ID)
+		}
+	}
+	return ids
+}
+
+// withDefaults returns the mapping with the empty columns set to the DefaultRosterMapping
+func (mapping RosterMapping) withDefaults() RosterMapping {
+	if mapping.Name == "" {
+		mapping.Name = DefaultRosterMapping.Name
+	}
+	if mapping.Email == "" {
+		mapping.Email = DefaultRosterMapping.Email
+	}
+	if mapping.ExternalID == "" {
+		mapping.ExternalID = DefaultRosterMapping.ExternalID
+	}
+	if len(mapping.Handles) == 0 {
+		mapping.Handles = DefaultRosterMapping.Handles
+	}
+	return mapping
+}
+
+// rosterColumns is the index of each column of the mapping in a roster.
+// email is -1 if the roster doesn't have an email column.
+type rosterColumns struct {
+	name, email, externalID int
+	handles                 []int
+}
+
+func findRosterColumns(header []string, mapping RosterMapping) (rosterColumns, error) {
+	indexes := make(map[string]int)
+	for i, column := range header {
+		indexes[strings.ToLower(strings.TrimSpace(column))] = i
+	}
+	find := func(column string) (int, error) {
+		i, ok := indexes[strings.ToLower(strings.TrimSpace(column))]
+		if !ok {
+			return 0, fmt.Errorf("roster has no %s column: %w", column, ErrInvalidRoster)
+		}
+		return i, nil
+	}
+
+	var columns rosterColumns
+	var err error
+	if columns.name, err = find(mapping.Name); err != nil {
+		return rosterColumns{}, err
+	}
+	if columns.externalID, err = find(mapping.ExternalID); err != nil {
+		return rosterColumns{}, err
+	}
+	// not every information system exports emails
+	if columns.email, err = find(mapping.Email); err != nil {
+		columns.email = -1
+	}
+	for _, handle := range mapping.Handles {
+		i, err := find(handle)
+		if err != nil {
+			return rosterColumns{}, err
+		}
+		columns.handles = append(columns.handles, i)
+	}
+	return columns, nil
+}
+
+// ImportRoster creates or updates a student for each row of a roster CSV. Students are
+// matched by their external id, and their name, email and handles are replaced with the
+// ones in the roster. Rows that can't be imported are skipped and added to the report's
+// Errors, so one bad row doesn't stop the rest of the roster from being imported.
+func ImportRoster(ctx context.Context, r io.Reader, options RosterOptions) (RosterReport, error) {
+	mapping := options.Mapping.withDefaults()
+
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return RosterReport{}, fmt.Errorf("roster is empty: %w", ErrInvalidRoster)
+	} else if err != nil {
+		return RosterReport{}, fmt.Errorf("%s: %w", err, ErrInvalidRoster)
+	}
+	columns, err := findRosterColumns(header, mapping)
+	if err != nil {
+		return RosterReport{}, err
+	}
+
+	students, err := database.DB.GetStudents(ctx)
+	if err != nil {
+		return RosterReport{}, err
+	}
+	byExternalID := make(map[string]database.Student)
+	handleOwners := make(map[string]database.Student)
+	for _, student := range students {
+		if student.ExternalID != "" {
+			byExternalID[student.ExternalID] = student
+		}
+		for _, handle := range student.StudentHandles {
+			handleOwners[handle] = student
+		}
+	}
+
+	report := RosterReport{
+		DryRun:   options.DryRun,
+		Created:  make([]database.Student, 0),
+		Updated:  make([]database.Student, 0),
+		Archived: make([]database.Student, 0),
+		Errors:   make([]RosterRowError, 0),
+	}
+	// the external ids in the roster, including the rows with errors so
+	// students aren't archived because of a typo in their row
+	seen := make(map[string]int)
+	// the row each handle is used by in the roster
+	handleRows := make(map[string]int)
+
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		rowError := func(format string, args ...interface{}) {
+			report.Errors = append(report.Errors, RosterRowError{Row: line, Message: fmt.Sprintf(format, args...)})
+		}
+		if err != nil {
+			rowError("%s", err)
+			continue
+		}
+
+		row := database.Student{
+			Name:           strings.TrimSpace(record[columns.name]),
+			ExternalID:     strings.TrimSpace(record[columns.externalID]),
+			StudentHandles: make([]string, 0, len(columns.handles)),
+		}
+		if columns.email >= 0 {
+			row.Email = strings.TrimSpace(record[columns.email])
+		}
+		for _, i := range columns.handles {
+			if handle := strings.TrimSpace(record[i]); handle != "" {
+				row.StudentHandles = append(row.StudentHandles, handle)
+			}
+		}
+
+		if row.ExternalID == "" {
+			rowError("no %s", mapping.ExternalID)
+			continue
+		}
+		if first, ok := seen[row.ExternalID]; ok {
+			rowError("%s %s is already used on row %d", mapping.ExternalID, row.ExternalID, first)
+			continue
+		}
+		seen[row.ExternalID] = line
+		if row.Name == "" {
+			rowError("no %s", mapping.Name)
+			continue
+		}
+
+		existing, exists := byExternalID[row.ExternalID]
+		if exists && columns.email < 0 {
+			row.Email = existing.Email
+		}
+		if handle, message := rosterHandleConflict(row, existing, handleOwners, handleRows); message != "" {
+			rowError("handle %s %s", handle, message)
+			continue
+		}
+		for _, handle := range row.StudentHandles {
+			handleRows[handle] = line
+		}
+
+		if !exists {
+			if !options.DryRun {
+				err := database.DB.CreateStudent(ctx, &row)
+				if errors.Is(err, database.ErrDuplicateHandle) {
+					// another import may have taken the handle since the students were loaded
+					rowError("%s", err)
+					continue
+				} else if err != nil {
+					return RosterReport{}, err
+				}
+			}
+			report.Created = append(report.Created, row)
+			continue
+		}
+
+		if existing.Name == row.Name && existing.Email == row.Email && !existing.Archived &&
+			equalHandles(existing.StudentHandles, row.StudentHandles) {
+			report.Unchanged++
+			continue
+		}
+		// students that come back to the school are restored
+		updated := existing
+		updated.Name = row.Name
+		updated.Email = row.Email
+		updated.StudentHandles = row.StudentHandles
+		updated.Archived = false
+		if !options.DryRun {
+			err := database.DB.UpdateStudent(ctx, existing.ID, &updated)
+			if errors.Is(err, database.ErrDuplicateHandle) {
+				rowError("%s", err)
+				continue
+			} else if err != nil {
+				return RosterReport{}, err
+			}
+		}
+		report.Updated = append(report.Updated, updated)
+	}
+
+	if options.ArchiveMissing {
+		for _, student := range students {
+			if student.ExternalID == "" || student.Archived {
+				continue
+			}
+			if _, ok := seen[student.ExternalID]; ok {
+				continue
+			}
+
+			archived := student
+			archived.Archived = true
+			if !options.DryRun {
+				if err := database.DB.UpdateStudent(ctx, student.ID, &archived); err != nil {
+					return RosterReport{}, err
+				}
+			}
+			report.Archived = append(report.Archived, archived)
+		}
+	}
+
+	if !options.DryRun {
+		log.WithFields(log.Fields{
+			"created":   len(report.Created),
+			"updated":   len(report.Updated),
+			"unchanged": report.Unchanged,
+			"archived":  len(report.Archived),
+			"errors":    len(report.Errors),
+		}).Infof("Imported a roster")
+	}
+	return report, nil
+}
+
+// rosterHandleConflict returns a handle of row and why it can't be used if it belongs to
+// another student or another row of the roster. existing is the student the row updates,
+// if there is one, since their own handles aren't conflicts.
+func rosterHandleConflict(row database.Student, existing database.Student, owners map[string]database.Student, rows map[string]int) (string, string) {
+	for i, handle := range row.StudentHandles {
+		for _, other := range row.StudentHandles[:i] {
+			if other == handle {
+				return handle, "is used twice"
+			}
+		}
+		if line, ok := rows[handle]; ok {
+			return handle, fmt.Sprintf("is already used on row %d", line)
+		}
+		if owner, ok := owners[handle]; ok && (existing.ID.IsZero() || owner.ID != existing.ID) {
+			return handle, fmt.Sprintf("is already used by %s", owner.Name)
+		}
+	}
+	return "", ""
+}
+
+// equalHandles returns true if a and b have the same handles in the same order
+func equalHandles(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
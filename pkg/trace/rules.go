@@ -0,0 +1,161 @@
+package trace
+
+import (
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+	"trace/pkg/database"
+)
+
+// Risk is how likely it is that a contact was infected by the students who exposed them
+type Risk string
+
+const (
+	RiskNone   Risk = "none"
+	RiskCasual Risk = "casual"
+	RiskClose  Risk = "close"
+)
+
+// riskLevels orders the risks from lowest to highest
+var riskLevels = map[Risk]int{
+	RiskNone:   0,
+	RiskCasual: 1,
+	RiskClose:  2,
+}
+
+// ParseRisk converts a string to a Risk. An empty string is RiskNone
+func ParseRisk(s string) (Risk, error) {
+	if s == "" {
+		return RiskNone, nil
+	}
+	if _, found := riskLevels[Risk(s)]; !found {
+		return "", fmt.Errorf("invalid risk %s", s)
+	}
+	return Risk(s), nil
+}
+
+// AtLeast returns true if r is as high as or higher than other
+func (r Risk) AtLeast(other Risk) bool {
+	return riskLevels[r] >= riskLevels[other]
+}
+
+// ExposureRules decide the Risk of each contact in a ContactReport. A contact's exposure
+// is the most time they spent with the students who exposed them in any Window, where the
+// time at each location is multiplied by that location's multiplier.
+type ExposureRules struct {
+	// CloseDuration is the exposure needed for a contact to be a close contact
+	CloseDuration time.Duration `json:"close_duration"`
+	// CasualDuration is the exposure needed for a contact to be a casual contact
+	CasualDuration time.Duration `json:"casual_duration"`
+
+	// Window is the length of the rolling window exposure is added up in. If it
+	// is 0, all of the time in the report is added up.
+	Window time.Duration `json:"window"`
+
+	// LocationMultipliers maps location IDs to how risky it is to be in contact there,
+	// for example a gym might be 2 and an outdoor area might be 0.5. Locations
+	// that aren't in the map have a multiplier of 1.
+	LocationMultipliers map[string]float64 `json:"location_multipliers"`
+}
+
+// DefaultExposureRules is 15 cumulative minutes within 24 hours for a close contact
+// and any contact at all for a casual contact
+var DefaultExposureRules = ExposureRules{
+	CloseDuration:  15 * time.Minute,
+	CasualDuration: 0,
+	Window:         24 * time.Hour,
+}
+
+// Rules are the ExposureRules the API uses for contact reports
+var Rules = DefaultExposureRules
+
+// Validate returns an error if the rules can't be used
+func (rules ExposureRules) Validate() error {
+	if rules.CasualDuration < 0 || rules.CloseDuration < rules.CasualDuration {
+		return fmt.Errorf("close_duration must be at least casual_duration, which must be at least 0")
+	}
+	if rules.Window < 0 {
+		return fmt.Errorf("window must not be negative")
+	}
+	for id, multiplier := range rules.LocationMultipliers {
+		if _, err := primitive.ObjectIDFromHex(id); err != nil {
+			return fmt.Errorf("location multiplier %s is not a valid location id", id)
+		}
+		if multiplier < 0 {
+			return fmt.Errorf("the multiplier of location %s must not be negative", id)
+		}
+	}
+	return nil
+}
+
+// multiplier returns the multiplier of location
+func (rules ExposureRules) multiplier(location database.LocationRef) float64 {
+	multiplier, found := rules.LocationMultipliers[primitive.ObjectID(location).Hex()]
+	if !found {
+		return 1
+	}
+	return multiplier
+}
+
+// Exposure returns the most weighted time spent in overlaps within any Window. Time
+// that is in more than one overlap at the same location is only counted once.
+func (rules ExposureRules) Exposure(overlaps []Overlap) time.Duration {
+	overlaps = mergeOverlaps(overlaps)
+	if rules.Window <= 0 {
+		var total time.Duration
+		for _, o := range overlaps {
+			total += rules.weighted(o, o.Start, o.End)
+		}
+		return total
+	}
+
+	// the most exposure in a window always starts at the start of an
+	// overlap or ends at the end of one, so only those windows are checked
+	windows := make([]time.Time, 0, 2*len(overlaps))
+	for _, o := range overlaps {
+		windows = append(windows, o.Start, o.End.Add(-rules.Window))
+	}
+
+	var most time.Duration
+	for _, windowStart := range windows {
+		windowEnd := windowStart.Add(rules.Window)
+
+		var total time.Duration
+		for _, o := range overlaps {
+			total += rules.weighted(o, windowStart, windowEnd)
+		}
+		if total > most {
+			most = total
+		}
+	}
+	return most
+}
+
+// weighted returns the time o was between start and end multiplied by its location's multiplier
+func (rules ExposureRules) weighted(o Overlap, start time.Time, end time.Time) time.Duration {
+	if o.Start.After(start) {
+		start = o.Start
+	}
+	if o.End.Before(end) {
+		end = o.End
+	}
+	if !end.After(start) {
+		return 0
+	}
+	return time.Duration(float64(end.Sub(start)) * rules.multiplier(o.Location))
+}
+
+// Classify returns the Risk of a contact with the exposure from overlaps
+func (rules ExposureRules) Classify(overlaps []Overlap) (Risk, time.Duration) {
+	exposure := rules.Exposure(overlaps)
+	switch {
+	case exposure <= 0:
+		return RiskNone, exposure
+	case exposure >= rules.CloseDuration:
+		return RiskClose, exposure
+	case exposure >= rules.CasualDuration:
+		return RiskCasual, exposure
+	default:
+		return RiskNone, exposure
+	}
+}
@@ -1,45 +1,176 @@
 package trace
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"time"
 	"trace/pkg/database"
 )
 
+// ErrLocationFull is returned as a userError by HandleScan when a student
+// tries to enter a location that has reached its Capacity
+var ErrLocationFull = errors.New("location is full")
+
+// ErrScanDebounced is returned as a userError by HandleScan when a student scans at a
+// location again within its DebounceWindow. No event is created.
+var ErrScanDebounced = errors.New("scan ignored because the student just scanned")
+
+// ErrNotAtLocation is returned as a userError by HandleScan when a student scans at a
+// location with ScanIntentLeave but they aren't there
+var ErrNotAtLocation = errors.New("student is not at the location")
+
+// ErrArchived is returned as a userError by HandleScan when the student or location was archived
+var ErrArchived = errors.New("archived")
+
+// A Scan is a student scanning their handle at a location
+type Scan struct {
+	Location      database.LocationRef
+	StudentHandle string
+	// Time is when the student scanned
+	Time time.Time
+	// IdempotencyKey is stored in the event so the scan can be safely retried.
+	// If it is empty, the scan will always create an event.
+	IdempotencyKey string
+}
+
 // HandleScan should be called whenever a student scans in or scans out.
 // It will return the Events that it creates or an error.
 // If the studentID cannot be found in the database, it will not be stored
 // If there is an error with the input (locationID or studentHandle is invalid), the
 // error will be returned as a userError. If there is an error accessing the database
 // or any other unexpected error, it will be returned in err
-func HandleScan(locationRef database.LocationRef, studentHandle string) (ev database.Event, userError error, err error) {
-	location := locationRef.Get()
+func HandleScan(ctx context.Context, locationRef database.LocationRef, studentHandle string) (ev database.Event, userError error, err error) {
+	return HandleScanAt(ctx, Scan{Location: locationRef, StudentHandle: studentHandle, Time: time.Now()})
+}
+
+// HandleScanAt is HandleScan for a scan that happened at scan.Time. The student enters or
+// leaves the location depending on where they were at that time.
+func HandleScanAt(ctx context.Context, scan Scan) (ev database.Event, userError error, err error) {
+	locationRef, studentHandle := scan.Location, scan.StudentHandle
 
-	student, found := database.DB.GetStudentByHandle(studentHandle)
-	if !found {
+	location, err := locationRef.Get(ctx)
+	if errors.Is(err, database.ErrNotFound) {
+		return database.Event{}, err, nil
+	} else if err != nil {
+		return database.Event{}, nil, err
+	}
+
+	student, err := database.DB.GetStudentByHandle(ctx, studentHandle)
+	if errors.Is(err, database.ErrNotFound) {
 		return database.Event{}, fmt.Errorf("student with handle %s was not found", studentHandle), nil
+	} else if err != nil {
+		return database.Event{}, nil, err
 	}
 
-	studentAtLocation, _ := IsStudentAtLocation(student.Ref(), location.Ref(), time.Now())
+	if location.Archived {
+		return database.Event{}, fmt.Errorf("location %s was %w", location.Name, ErrArchived), nil
+	}
+	if student.Archived {
+		return database.Event{}, fmt.Errorf("student %s was %w", student.Name, ErrArchived), nil
+	}
+
+	studentAtLocation, _, err := IsStudentAtLocation(ctx, student.Ref(), location.Ref(), scan.Time)
+	if err != nil {
+		return database.Event{}, nil, err
+	}
+
+	if location.DebounceWindow > 0 {
+		lastScan, err := database.DB.GetMostRecentEventBetween(ctx, student.Ref(), scan.Time.Add(-location.DebounceWindow), scan.Time)
+		if err == nil && lastScan.Location == location.Ref() && lastScan.Source == database.EventSourceScan {
+			return database.Event{}, fmt.Errorf("%s scanned at %s %s ago: %w", student.Name, location.Name,
+				scan.Time.Sub(lastScan.Time).Round(time.Second), ErrScanDebounced), nil
+		} else if err != nil && !errors.Is(err, database.ErrNotFound) {
+			return database.Event{}, nil, err
+		}
+	}
 
 	var eventType database.EventType
-	// If the student is in the location, they are leaving, otherwise they are entering
-	if studentAtLocation {
-		eventType = database.EventLeave
-	} else {
+	switch location.ScanIntent {
+	case database.ScanIntentEnter:
+		// entering again restarts the student's time at the location
 		eventType = database.EventEnter
+	case database.ScanIntentLeave:
+		if !studentAtLocation {
+			return database.Event{}, fmt.Errorf("%s is not signed in to %s: %w", student.Name, location.Name, ErrNotAtLocation), nil
+		}
+		eventType = database.EventLeave
+	default:
+		// If the student is in the location, they are leaving, otherwise they are entering
+		if studentAtLocation {
+			eventType = database.EventLeave
+		} else {
+			eventType = database.EventEnter
+		}
+	}
+
+	// students who are already at the location don't count towards its capacity again
+	if eventType == database.EventEnter && !studentAtLocation {
+		occupancy, err := Occupancy(ctx, location.Ref(), scan.Time)
+		if err != nil {
+			return database.Event{}, nil, err
+		}
+		if location.Capacity > 0 && occupancy >= location.Capacity {
+			if !location.CapacityWarnOnly {
+				return database.Event{}, fmt.Errorf("%s is full (%d/%d): %w", location.Name, occupancy, location.Capacity, ErrLocationFull), nil
+			}
+			logrus.WithFields(logrus.Fields{
+				"studentName": student.Name, "locationName": location.Name,
+				"occupancy": occupancy, "capacity": location.Capacity,
+			}).Warnf("Student entered a location that is full")
+		}
+	}
+
+	// a student can only be at one location, so entering a new one leaves the last one
+	// at the same time. The leave event is created first so the enter event is the
+	// student's most recent event, and it is deleted again if the enter event can't be
+	// created so the student is never signed out of both locations.
+	var transferEvent *database.Event
+	if eventType == database.EventEnter && !studentAtLocation {
+		previousLocation, found, err := GetStudentLocation(ctx, student.Ref(), scan.Time)
+		if err != nil {
+			return database.Event{}, nil, err
+		}
+		if found && previousLocation.ID != location.ID {
+			transferEvent = &database.Event{
+				Location:  previousLocation.Ref(),
+				Student:   student.Ref(),
+				Time:      scan.Time,
+				EventType: database.EventLeave,
+				Source:    database.EventSourceTransferred,
+			}
+			if err := database.DB.CreateEvent(ctx, transferEvent); err != nil {
+				return database.Event{}, nil, err
+			}
+
+			logrus.WithFields(logrus.Fields{
+				"studentName": student.Name, "locationName": previousLocation.Name, "newLocationName": location.Name,
+			}).Debugf("Student transferred out of a location")
+		}
 	}
 
 	event := database.Event{
-		Location: database.LocationRef(location.ID),
-		Student:  database.StudentRef(student.ID),
-		Time:       time.Now(),
-		EventType:  eventType,
-		Source:     database.EventSourceScan,
+		Location:       database.LocationRef(location.ID),
+		Student:        database.StudentRef(student.ID),
+		Time:           scan.Time,
+		EventType:      eventType,
+		Source:         database.EventSourceScan,
+		IdempotencyKey: scan.IdempotencyKey,
+	}
+
+	if err := database.DB.CreateEvent(ctx, &event); err != nil {
+		if transferEvent != nil {
+			undoTransfer(*transferEvent)
+		}
+		return database.Event{}, nil, err
 	}
 
-	database.DB.CreateEvent(&event)
+	// the events are only published once both of them were created
+	if transferEvent != nil {
+		publish(ctx, *transferEvent)
+	}
+	publish(ctx, event)
 
 	// Log the event
 	var evName string
@@ -54,3 +185,13 @@ func HandleScan(locationRef database.LocationRef, studentHandle string) (ev data
 
 	return event, nil, nil
 }
+
+// undoTransfer deletes the leave event created when a student transferred to a location
+// that they couldn't enter. It doesn't use the scan's context, because the scan failing
+// may be why the student couldn't enter.
+func undoTransfer(transferEvent database.Event) {
+	if err := database.DB.DeleteEvent(context.Background(), transferEvent.ID); err != nil {
+		logrus.WithError(err).WithField("event", transferEvent.ID.Hex()).
+			Errorf("Couldn't delete the leave event of a student who couldn't enter a location")
+	}
+}
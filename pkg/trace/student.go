@@ -1,44 +1,81 @@
 package trace
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"time"
 	"trace/pkg/database"
 )
 
-func IsStudentAtLocation(studentRef database.StudentRef, locationRef database.LocationRef, t time.Time) (bool, database.Event) {
-	location := locationRef.Get()
+// IsStudentAtLocation returns true and the enter event if the student is at the location at time t
+func IsStudentAtLocation(ctx context.Context, studentRef database.StudentRef, locationRef database.LocationRef, t time.Time) (bool, database.Event, error) {
+	location, err := locationRef.Get(ctx)
+	if err != nil {
+		return false, database.Event{}, err
+	}
 
 	// Get the event between the time and time - the location timeout
-	lastEvent, found := database.DB.GetMostRecentEventBetween(studentRef, t.Add(location.Timeout * -1), t)
+	lastEvent, err := database.DB.GetMostRecentEventBetween(ctx, studentRef, t.Add(location.Timeout * -1), t)
+	if errors.Is(err, database.ErrNotFound) {
+		// If there are no past events, assume the student is not at the location
+		return false, database.Event{}, nil
+	} else if err != nil {
+		return false, database.Event{}, err
+	}
 
-	if found && lastEvent.Location == locationRef {
+	if lastEvent.Location == locationRef {
 		switch lastEvent.EventType {
 		case database.EventLeave:
-			return false, database.Event{}
+			return false, database.Event{}, nil
 		case database.EventEnter:
-			return true, lastEvent
+			return true, lastEvent, nil
 		default:
-			panic(fmt.Sprintf("invalid event type %d", lastEvent.EventType))
+			return false, database.Event{}, fmt.Errorf("invalid event type %d", lastEvent.EventType)
 		}
 	}
 
-	// If there are no past events, assume the student is not at the location
-	return false, database.Event{}
+	return false, database.Event{}, nil
 }
 
 // GetStudentsAtLocation returns a list of all students at a location at a specific time and the corresponding events.
 // For most cases, the time should just be time.Now()
-func GetStudentsAtLocation(locationRef database.LocationRef, t time.Time) ([]database.Student, []database.Event) {
-	// iterate through all students and check if each one is at the location
+func GetStudentsAtLocation(ctx context.Context, locationRef database.LocationRef, t time.Time) ([]database.Student, []database.Event, error) {
+	enterEvents, err := eventsAtLocation(ctx, locationRef, t)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	studentsAtLocation := make([]database.Student, 0)
 	events := make([]database.Event, 0)
+	for _, event := range enterEvents {
+		student, err := event.Student.Get(ctx)
+		if errors.Is(err, database.ErrNotFound) {
+			// the student was deleted or erased, so there is nobody to return
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		studentsAtLocation = append(studentsAtLocation, student)
+		events = append(events, event)
+	}
 
-	location := locationRef.Get()
+	return studentsAtLocation, events, nil
+}
+
+// eventsAtLocation returns the enter event of every student at a location at time t,
+// including the students who were erased but had their events pseudonymized
+func eventsAtLocation(ctx context.Context, locationRef database.LocationRef, t time.Time) ([]database.Event, error) {
+	location, err := locationRef.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	// all events in the time frame sorted from earliest to latest
-	allEvents := database.DB.GetAllEventsBetween(t.Add(location.Timeout * -2 - 1 * time.Hour), t)
+	allEvents, err := database.DB.GetAllEventsBetween(ctx, t.Add(location.Timeout * -2 - 1 * time.Hour), t)
+	if err != nil {
+		return nil, err
+	}
 
 	// the latest event for each student
 	studentEvents := make(map[database.StudentRef]database.Event)
@@ -46,26 +83,56 @@ func GetStudentsAtLocation(locationRef database.LocationRef, t time.Time) ([]dat
 		studentEvents[event.Student] = event
 	}
 
-	for student, event := range studentEvents {
-		if event.EventType == database.EventEnter {
-			studentsAtLocation = append(studentsAtLocation, student.Get())
+	events := make([]database.Event, 0)
+	for _, event := range studentEvents {
+		// students are at the location if their latest event is entering it and they haven't timed out
+		if event.EventType == database.EventEnter && event.Location == locationRef &&
+			event.Time.After(t.Add(location.Timeout*-1)) {
 			events = append(events, event)
 		}
 	}
 
-	return studentsAtLocation, events
+	return events, nil
 }
 
-// GetStudentLocation returns the location a student is at. If the student is not at any location,
+// Occupancy returns the number of students at a location at time t. Students who were
+// erased are still counted if their events were pseudonymized.
+func Occupancy(ctx context.Context, locationRef database.LocationRef, t time.Time) (int, error) {
+	events, err := eventsAtLocation(ctx, locationRef, t)
+	if err != nil {
+		return 0, err
+	}
+	return len(events), nil
+}
+
+// GetStudentLocation returns the location a student is at at time t. If the student is not at any location,
 // found will be false.
-func GetStudentLocation(studentRef database.StudentRef, time time.Time) (location database.Location, found bool) {
-	lastEvent, found := database.DB.GetMostRecentEvent(studentRef)
-	if !found {
+func GetStudentLocation(ctx context.Context, studentRef database.StudentRef, t time.Time) (location database.Location, found bool, err error) {
+	lastEvent, err := database.DB.GetMostRecentEventBetween(ctx, studentRef, time.Unix(0, 0), t)
+	if errors.Is(err, database.ErrNotFound) {
 		// If there is no most recent event for this student, we can assume they are not at a location
-		return database.Location{}, false
+		return database.Location{}, false, nil
+	} else if err != nil {
+		return database.Location{}, false, err
+	}
+
+	// the student isn't anywhere if they left their last location
+	if lastEvent.EventType != database.EventEnter {
+		return database.Location{}, false, nil
+	}
+
+	location, err = lastEvent.Location.Get(ctx)
+	if errors.Is(err, database.ErrNotFound) {
+		// the location was deleted, so the student can't be there
+		return database.Location{}, false, nil
+	} else if err != nil {
+		return database.Location{}, false, err
+	}
+
+	// or if they timed out of it
+	if !lastEvent.Time.Add(location.Timeout).After(t) {
+		return database.Location{}, false, nil
 	}
 
-	location = lastEvent.Location.Get()
-	found = true
-	return
+	return location, true, nil
 }
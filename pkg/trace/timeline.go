@@ -0,0 +1,59 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"time"
+	"trace/pkg/database"
+)
+
+// A TimelineEntry is a period of time a student was at a location
+type TimelineEntry struct {
+	Location  database.LocationRef `json:"location"`
+	EnterTime time.Time            `json:"enter_time"`
+	// LeaveTime is when the student left, or the end of the timeline if EndReason is PresenceEndOngoing
+	LeaveTime time.Time   `json:"leave_time"`
+	EndReason PresenceEnd `json:"end_reason"`
+}
+
+// GetStudentTimeline returns every period of time a student was at a location between
+// minTime and maxTime from earliest to latest, built from the student's events that weren't
+// voided. Periods that started before minTime are included with their actual enter time.
+func GetStudentTimeline(ctx context.Context, studentRef database.StudentRef, minTime time.Time, maxTime time.Time) ([]TimelineEntry, error) {
+	events := make([]database.Event, 0)
+
+	// the student's last event before minTime is the start of the period they were in at minTime
+	lastEvent, err := database.DB.GetMostRecentEventBetween(ctx, studentRef, time.Unix(0, 0), minTime)
+	if err == nil {
+		events = append(events, lastEvent)
+	} else if !errors.Is(err, database.ErrNotFound) {
+		return nil, err
+	}
+
+	// the events at minTime and maxTime are included
+	rangeEvents, err := database.DB.GetStudentEventsBetween(ctx, studentRef, minTime.Add(-time.Nanosecond), maxTime.Add(time.Nanosecond))
+	if err != nil {
+		return nil, err
+	}
+	events = append(events, rangeEvents...)
+
+	timeouts, err := locationTimeouts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	timeline := make([]TimelineEntry, 0)
+	for _, p := range buildPresences(events, maxTime, timeouts) {
+		if p.End.Before(minTime) {
+			continue
+		}
+		timeline = append(timeline, TimelineEntry{
+			Location:  p.Location,
+			EnterTime: p.Start,
+			LeaveTime: p.End,
+			EndReason: p.EndReason,
+		})
+	}
+
+	return timeline, nil
+}
@@ -1,6 +1,7 @@
 package trace
 
 import (
+	"context"
 	log "github.com/sirupsen/logrus"
 	"time"
 	"trace/pkg/database"
@@ -8,8 +9,11 @@ import (
 
 // AddTimeoutEvents creates leave events for enter events that have timed out
 // using location.Timeout
-func AddTimeoutEvents(startTime time.Time, currentTime time.Time) {
-	events := database.DB.GetAllEventsBetween(startTime, currentTime)
+func AddTimeoutEvents(ctx context.Context, startTime time.Time, currentTime time.Time) error {
+	events, err := database.DB.GetAllEventsBetween(ctx, startTime, currentTime)
+	if err != nil {
+		return err
+	}
 
 	// create and populate latest leave and enter event
 	latestLeaveEvents := make(map[database.StudentRef]database.Event)
@@ -17,7 +21,10 @@ func AddTimeoutEvents(startTime time.Time, currentTime time.Time) {
 
 	// we have to get locations by id from the database a lot so instead
 	// i'm making a cache of locations
-	_locations := database.DB.GetLocations()
+	_locations, err := database.DB.GetLocations(ctx)
+	if err != nil {
+		return err
+	}
 	locations := make(map[database.LocationRef]database.Location)
 	for _, location := range _locations {
 		locations[location.Ref()] = location
@@ -56,7 +63,7 @@ func AddTimeoutEvents(startTime time.Time, currentTime time.Time) {
 					EventType: database.EventLeave,
 					Source:    database.EventSourceAutoLeave,
 				}
-				database.DB.CreateEvent(&newEvent)
+				CreateEvent(ctx, &newEvent)
 
 				log.WithFields(log.Fields{
 					"sourceEvent": enterEvent,
@@ -96,7 +103,9 @@ func AddTimeoutEvents(startTime time.Time, currentTime time.Time) {
 				EventType: database.EventLeave,
 				Source:    database.EventSourceAutoLeave,
 			}
-			database.DB.CreateEvent(&newEvent)
+			if err := CreateEvent(ctx, &newEvent); err != nil {
+				return err
+			}
 
 			log.WithFields(log.Fields{
 				"sourceEvent": enterEvent,
@@ -104,18 +113,27 @@ func AddTimeoutEvents(startTime time.Time, currentTime time.Time) {
 			}).Debugln("created implicit leave event")
 		}
 	}
+
+	return nil
 }
 
 // TimeoutEventThread should be ran whenever trace is ran... it basically creates
 // timeout events whenever a student times out of a location. run this on a new goroutine
-// using `go TimeoutEventThread()`
-func TimeoutEventThread() {
+// using `go TimeoutEventThread(ctx)`. It will return when ctx is cancelled
+func TimeoutEventThread(ctx context.Context) {
 	log.Debugf("TimeoutEventThread started")
 	for {
 		now := time.Now()
-		AddTimeoutEvents(now.Add(-6 * time.Hour), now)
+		if err := AddTimeoutEvents(ctx, now.Add(-6 * time.Hour), now); err != nil {
+			log.Errorf("Error adding timeout events: %s", err)
+		}
 
 		// run every 30 seconds
-		time.Sleep(3 * time.Second)
+		select {
+		case <-ctx.Done():
+			log.Debugf("TimeoutEventThread stopped")
+			return
+		case <-time.After(3 * time.Second):
+		}
 	}
 }
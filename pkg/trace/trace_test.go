@@ -1,15 +1,23 @@
 package trace
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
-	"os"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 	"trace/pkg/database"
 )
 
-var TestDatabase *database.Database
+var TestDatabase *database.MemoryStore
 
 var TestStudent *database.Student
 var TestLocation *database.Location
@@ -17,27 +25,16 @@ var TestLocation *database.Location
 func init() {
 	logrus.SetLevel(logrus.TraceLevel)
 
-	var err error
+	resetTestDatabase()
+}
 
-	// Get the mongo URI from env var
-	mongoURI, found := os.LookupEnv("TEST_MONGO_URI")
-	// Set it to localhost by default
-	if !found {
-		mongoURI = "mongodb://localhost"
-	}
+// resetTestDatabase replaces the global database with an empty MemoryStore
+// containing only TestStudent and TestLocation
+func resetTestDatabase() {
+	ctx := context.Background()
 
-	TestDatabase, err = database.Connect(database.Config{
-		MongoURI:     mongoURI,
-		DatabaseName: "tests",
-	})
-
-	if err != nil {
-		logrus.Fatalf("Could not connect to database: %s", err)
-	}
-
-	// Purge the test database
-	_ = TestDatabase.Database.Drop(nil)
-	logrus.Infof("Purged the tests database")
+	TestDatabase = database.NewMemoryStore()
+	database.DB = TestDatabase
 
 	// Add an example student for the test
 	TestStudent = &database.Student{
@@ -45,22 +42,24 @@ func init() {
 		Email:          "baaron@gmail.com",
 		StudentHandles: []string{"12345", "testid1"},
 	}
-	TestDatabase.CreateStudent(TestStudent)
+	TestDatabase.CreateStudent(ctx, TestStudent)
 
 	TestLocation = &database.Location{
 		Name:    "Library",
 		Timeout: 1 * time.Hour,
 	}
-	TestDatabase.CreateLocation(TestLocation)
+	TestDatabase.CreateLocation(ctx, TestLocation)
 }
 
 func TestHandleScan(t *testing.T) {
+	ctx := context.Background()
+
 	if TestDatabase == nil {
 		t.Skip("database not initialized")
 	}
 
 	// Test a student scanning into a location
-	event, userError, err := HandleScan(TestLocation.ID.Hex(), TestStudent.StudentHandles[0])
+	event, userError, err := HandleScan(ctx, TestLocation.Ref(), TestStudent.StudentHandles[0])
 	if err != nil {
 		t.Fatalf("Error handling scan: %s", err)
 	}
@@ -73,7 +72,7 @@ func TestHandleScan(t *testing.T) {
 	logrus.Infof("Successfully created event %v+ while student scanned into %s", event, TestLocation.Name)
 
 	// Test the same student scanning out of a location
-	event, userError, err = HandleScan(TestLocation.ID.Hex(), TestStudent.StudentHandles[0])
+	event, userError, err = HandleScan(ctx, TestLocation.Ref(), TestStudent.StudentHandles[0])
 	if err != nil {
 		t.Fatalf("Error handling scan: %s", err)
 	}
@@ -86,21 +85,256 @@ func TestHandleScan(t *testing.T) {
 	logrus.Infof("Successfully created event %v+ while student scanned out of %s", event, TestLocation.Name)
 }
 
+func TestHandleScanCapacity(t *testing.T) {
+	resetTestDatabase()
+	ctx := context.Background()
+
+	location := database.Location{Name: "Small room", Timeout: time.Hour, Capacity: 1}
+	assert.NoError(t, TestDatabase.CreateLocation(ctx, &location))
+	other := database.Student{Name: "Cai Noel", StudentHandles: []string{"cai"}}
+	assert.NoError(t, TestDatabase.CreateStudent(ctx, &other))
+
+	_, userError, err := HandleScan(ctx, location.Ref(), TestStudent.StudentHandles[0])
+	assert.NoError(t, err)
+	assert.NoError(t, userError)
+
+	// students at other locations don't count towards the capacity
+	_, userError, err = HandleScan(ctx, TestLocation.Ref(), "cai")
+	assert.NoError(t, err)
+	assert.NoError(t, userError)
+	_, userError, err = HandleScan(ctx, TestLocation.Ref(), "cai")
+	assert.NoError(t, err)
+	assert.NoError(t, userError)
+
+	_, userError, err = HandleScan(ctx, location.Ref(), "cai")
+	assert.NoError(t, err)
+	assert.True(t, errors.Is(userError, ErrLocationFull), "the location should be full")
+
+	occupancy, err := Occupancy(ctx, location.Ref(), time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, occupancy)
+
+	location.CapacityWarnOnly = true
+	assert.NoError(t, TestDatabase.UpdateLocation(ctx, location.ID, &location))
+	event, userError, err := HandleScan(ctx, location.Ref(), "cai")
+	assert.NoError(t, err)
+	assert.NoError(t, userError, "students can enter full locations that only warn")
+	assert.EqualValues(t, database.EventEnter, event.EventType)
+}
+
+func TestHandleScanDebounce(t *testing.T) {
+	resetTestDatabase()
+	ctx := context.Background()
+
+	location := database.Location{Name: "Gym", Timeout: time.Hour, DebounceWindow: time.Minute}
+	assert.NoError(t, TestDatabase.CreateLocation(ctx, &location))
+
+	baseTime := time.Now().Add(-time.Hour)
+	scanAt := func(minutes float64) (database.Event, error) {
+		event, userError, err := HandleScanAt(ctx, Scan{
+			Location:      location.Ref(),
+			StudentHandle: TestStudent.StudentHandles[0],
+			Time:          baseTime.Add(time.Duration(minutes * float64(time.Minute))),
+		})
+		assert.NoError(t, err)
+		return event, userError
+	}
+
+	event, userError := scanAt(0)
+	assert.NoError(t, userError)
+	assert.EqualValues(t, database.EventEnter, event.EventType)
+
+	_, userError = scanAt(0.1)
+	assert.True(t, errors.Is(userError, ErrScanDebounced), "scanning again right away is ignored")
+
+	event, userError = scanAt(5)
+	assert.NoError(t, userError)
+	assert.EqualValues(t, database.EventLeave, event.EventType, "the student can leave after the debounce window")
+}
+
+func TestHandleScanIntent(t *testing.T) {
+	resetTestDatabase()
+	ctx := context.Background()
+
+	entrance := database.Location{Name: "Entrance", Timeout: time.Hour, ScanIntent: database.ScanIntentEnter}
+	exit := database.Location{Name: "Exit", Timeout: time.Hour, ScanIntent: database.ScanIntentLeave}
+	assert.NoError(t, TestDatabase.CreateLocation(ctx, &entrance))
+	assert.NoError(t, TestDatabase.CreateLocation(ctx, &exit))
+
+	handle := TestStudent.StudentHandles[0]
+
+	_, userError, err := HandleScan(ctx, exit.Ref(), handle)
+	assert.NoError(t, err)
+	assert.True(t, errors.Is(userError, ErrNotAtLocation), "students can't leave a location they aren't at")
+
+	for i := 0; i < 2; i++ {
+		event, userError, err := HandleScan(ctx, entrance.Ref(), handle)
+		assert.NoError(t, err)
+		assert.NoError(t, userError)
+		assert.EqualValues(t, database.EventEnter, event.EventType, "scans at the entrance always enter")
+	}
+}
+
+func TestHandleScanTransfer(t *testing.T) {
+	resetTestDatabase()
+	ctx := context.Background()
+
+	gym := database.Location{Name: "Gym", Timeout: time.Hour}
+	assert.NoError(t, TestDatabase.CreateLocation(ctx, &gym))
+
+	baseTime := time.Now().Add(-time.Hour)
+	scans := []Scan{
+		{Location: TestLocation.Ref(), StudentHandle: TestStudent.StudentHandles[0], Time: baseTime, IdempotencyKey: "library"},
+		{Location: gym.Ref(), StudentHandle: TestStudent.StudentHandles[0], Time: baseTime.Add(10 * time.Minute), IdempotencyKey: "gym"},
+	}
+	results, err := HandleScanBatch(ctx, scans)
+	assert.NoError(t, err)
+	for _, result := range results {
+		assert.NoError(t, result.UserError)
+		assert.EqualValues(t, database.EventEnter, result.Event.EventType)
+	}
+
+	events, err := TestDatabase.GetAllEventsBetween(ctx, baseTime.Add(-time.Minute), time.Now())
+	assert.NoError(t, err)
+	if assert.Len(t, events, 3) {
+		transfer := events[1]
+		assert.Equal(t, TestLocation.Ref(), transfer.Location)
+		assert.EqualValues(t, database.EventLeave, transfer.EventType)
+		assert.EqualValues(t, database.EventSourceTransferred, transfer.Source)
+		assert.Equal(t, scans[1].Time, transfer.Time, "the student leaves the library when they enter the gym")
+	}
+
+	location, found, err := GetStudentLocation(ctx, TestStudent.Ref(), time.Now())
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, gym.ID, location.ID)
+
+	// the student doesn't leave the gym if they can't enter the library
+	_, _, err = HandleScanAt(ctx, Scan{Location: TestLocation.Ref(), StudentHandle: TestStudent.StudentHandles[0], Time: baseTime.Add(20 * time.Minute), IdempotencyKey: "gym"})
+	assert.True(t, errors.Is(err, database.ErrDuplicateIdempotencyKey))
+	events, err = TestDatabase.GetAllEventsBetween(ctx, baseTime.Add(-time.Minute), time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, events, 3, "the leave event is deleted")
+	location, found, err = GetStudentLocation(ctx, TestStudent.Ref(), time.Now())
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, gym.ID, location.ID)
+}
+
+func TestHandleScanBatch(t *testing.T) {
+	resetTestDatabase()
+	ctx := context.Background()
+
+	baseTime := time.Now()
+	scan := func(minutes int, key string) Scan {
+		return Scan{
+			Location:       TestLocation.Ref(),
+			StudentHandle:  TestStudent.StudentHandles[0],
+			Time:           baseTime.Add(time.Duration(minutes) * time.Minute),
+			IdempotencyKey: key,
+		}
+	}
+
+	// the scans are sent out of order
+	scans := []Scan{scan(-10, "third"), scan(-30, "first"), scan(-20, "second"), scan(-5, "")}
+	results, err := HandleScanBatch(ctx, scans)
+	assert.NoError(t, err)
+	assert.Len(t, results, 4)
+
+	assert.EqualValues(t, database.EventEnter, results[1].Event.EventType, "the first scan enters")
+	assert.EqualValues(t, database.EventLeave, results[2].Event.EventType, "the second scan leaves")
+	assert.EqualValues(t, database.EventEnter, results[0].Event.EventType, "the third scan enters")
+	assert.Equal(t, "third", results[0].Event.IdempotencyKey)
+	assert.Error(t, results[3].UserError, "scans need an idempotency key")
+	for _, result := range results[:3] {
+		assert.NoError(t, result.UserError)
+		assert.False(t, result.Duplicate)
+	}
+
+	// resending the batch doesn't create any events
+	events, _ := TestDatabase.GetEvents(ctx)
+	results, err = HandleScanBatch(ctx, scans[:3])
+	assert.NoError(t, err)
+	for _, result := range results {
+		assert.True(t, result.Duplicate)
+	}
+	resentEvents, _ := TestDatabase.GetEvents(ctx)
+	assert.Equal(t, len(events), len(resentEvents))
+
+	results, err = HandleScanBatch(ctx, []Scan{scan(60, "future")})
+	assert.NoError(t, err)
+	assert.Error(t, results[0].UserError, "scans can't be in the future")
+
+	// sending the same batch several times at once only creates each event once
+	concurrent := []Scan{scan(-4, "concurrent 1"), scan(-3, "concurrent 2"), scan(-2, "concurrent 3")}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := HandleScanBatch(ctx, concurrent)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	created := make(map[string]int)
+	resentEvents, _ = TestDatabase.GetEvents(ctx)
+	for _, event := range resentEvents {
+		created[event.IdempotencyKey]++
+	}
+	for _, s := range concurrent {
+		assert.Equal(t, 1, created[s.IdempotencyKey], "%s was created more than once", s.IdempotencyKey)
+	}
+}
+
+func TestEventHub(t *testing.T) {
+	hub := NewEventHub()
+
+	library := database.LocationRef(primitive.NewObjectID())
+	gym := database.LocationRef(primitive.NewObjectID())
+
+	all := hub.Subscribe(nil)
+	librarySubscription := hub.Subscribe(&library)
+
+	hub.Publish(Update{Event: database.Event{Location: gym}})
+	hub.Publish(Update{Event: database.Event{Location: library}})
+
+	assert.Equal(t, gym, (<-all.Events).Event.Location)
+	assert.Equal(t, library, (<-all.Events).Event.Location)
+	assert.Equal(t, library, (<-librarySubscription.Events).Event.Location, "only events at the library are received")
+	assert.True(t, hub.Subscribed(gym))
+
+	librarySubscription.Close()
+	librarySubscription.Close()
+	_, ok := <-librarySubscription.Events
+	assert.False(t, ok, "Events is closed after Close")
+
+	// publishing never blocks, even when a subscriber isn't reading
+	for i := 0; i < subscriptionBufferSize*2; i++ {
+		hub.Publish(Update{Event: database.Event{Location: library}})
+	}
+	assert.Len(t, all.Events, subscriptionBufferSize)
+	all.Close()
+	assert.False(t, hub.Subscribed(library), "nobody is subscribed after every subscription is closed")
+}
+
 func TestIsStudentAtLocation(t *testing.T) {
+	ctx := context.Background()
+
 	if TestDatabase == nil {
 		t.Skip("database not initialized")
 	}
 
 	// Create a test event with the student entering a location
 	enterEvent := database.Event{
-		LocationID: TestLocation.ID,
-		StudentID:  TestStudent.ID,
-		Time:       time.Now(),
-		EventType:  database.EventEnter,
+		Location:  TestLocation.Ref(),
+		Student:   TestStudent.Ref(),
+		Time:      time.Now(),
+		EventType: database.EventEnter,
 	}
-	TestDatabase.CreateEvent(&enterEvent)
+	TestDatabase.CreateEvent(ctx, &enterEvent)
 
-	studentAtLocation, _, err := IsStudentAtLocation(TestStudent.ID, TestLocation.ID, time.Now())
+	studentAtLocation, _, err := IsStudentAtLocation(ctx, TestStudent.Ref(), TestLocation.Ref(), time.Now())
 	if err != nil {
 		t.Fatalf("Error checking if student is at location: %s", err)
 	}
@@ -111,14 +345,14 @@ func TestIsStudentAtLocation(t *testing.T) {
 
 	// Create a test enterEvent with the student entering a location
 	leaveEvent := database.Event{
-		LocationID: TestLocation.ID,
-		StudentID:  TestStudent.ID,
-		Time:       time.Now(),
-		EventType:  database.EventLeave,
+		Location:  TestLocation.Ref(),
+		Student:   TestStudent.Ref(),
+		Time:      time.Now(),
+		EventType: database.EventLeave,
 	}
-	TestDatabase.CreateEvent(&leaveEvent)
+	TestDatabase.CreateEvent(ctx, &leaveEvent)
 
-	studentAtLocation, _, err = IsStudentAtLocation(TestStudent.ID, TestLocation.ID, time.Now())
+	studentAtLocation, _, err = IsStudentAtLocation(ctx, TestStudent.Ref(), TestLocation.Ref(), time.Now())
 	if err != nil {
 		t.Fatalf("Error checking if student is at location: %s", err)
 	}
@@ -129,23 +363,25 @@ func TestIsStudentAtLocation(t *testing.T) {
 }
 
 func TestIsStudentAtLocationAtTime(t *testing.T) {
+	ctx := context.Background()
+
 	if TestDatabase == nil {
 		t.Skip("database not initialized")
 	}
 
 	// Create a test event with the student entering a location
 	enterEvent := database.Event{
-		LocationID: TestLocation.ID,
-		StudentID:  TestStudent.ID,
-		Time:       time.Now(),
-		EventType:  database.EventEnter,
+		Location:  TestLocation.Ref(),
+		Student:   TestStudent.Ref(),
+		Time:      time.Now(),
+		EventType: database.EventEnter,
 	}
 
-	TestDatabase.CreateEvent(&enterEvent)
+	TestDatabase.CreateEvent(ctx, &enterEvent)
 	logrus.Debugf("Created enter event: %v+", enterEvent)
 
 	// Check if students were at a location an hour ago
-	studentAtLocation, _, err := IsStudentAtLocation(TestStudent.ID, TestLocation.ID, time.Now().Add(-1*time.Hour))
+	studentAtLocation, _, err := IsStudentAtLocation(ctx, TestStudent.Ref(), TestLocation.Ref(), time.Now().Add(-1*time.Hour))
 	if err != nil {
 		t.Fatalf("Error checking if student is at location: %s", err)
 	}
@@ -156,26 +392,28 @@ func TestIsStudentAtLocationAtTime(t *testing.T) {
 }
 
 func TestGetStudentsAtLocation(t *testing.T) {
+	ctx := context.Background()
+
 	if TestDatabase == nil {
 		t.Skip("database not initialized")
 	}
 
 	// Clear the events database
-	_ = database.DB.Collections.Events.Drop(nil)
+	resetTestDatabase()
 
 	// Create a test event
 	enterEvent := database.Event{
-		LocationID: TestLocation.ID,
-		StudentID:  TestStudent.ID,
-		Time:       time.Now(),
-		EventType:  database.EventEnter,
+		Location:  TestLocation.Ref(),
+		Student:   TestStudent.Ref(),
+		Time:      time.Now(),
+		EventType: database.EventEnter,
 	}
 
-	TestDatabase.CreateEvent(&enterEvent)
+	TestDatabase.CreateEvent(ctx, &enterEvent)
 
 	logrus.Debugf("Student %s entered %s", TestStudent.Name, TestLocation.Name)
 
-	studentsAtLocation, _, err := GetStudentsAtLocation(TestLocation.ID, time.Now())
+	studentsAtLocation, _, err := GetStudentsAtLocation(ctx, TestLocation.Ref(), time.Now())
 	if err != nil {
 		t.Fatalf("Error getting students at location: %s", err)
 	}
@@ -185,7 +423,7 @@ func TestGetStudentsAtLocation(t *testing.T) {
 	logrus.Infof("Found list of students at location %s: %v+", TestLocation.Name, studentsAtLocation)
 
 	// Check if there are students at the location 5 hours ago. There should be none
-	studentsAtLocation, _, err = GetStudentsAtLocation(TestLocation.ID, time.Now().Add(-5*time.Hour))
+	studentsAtLocation, _, err = GetStudentsAtLocation(ctx, TestLocation.Ref(), time.Now().Add(-5*time.Hour))
 	if err != nil {
 		t.Fatalf("Error getting students at location: %s", err)
 	}
@@ -196,8 +434,9 @@ func TestGetStudentsAtLocation(t *testing.T) {
 }
 
 func TestGenerateContactReport(t *testing.T) {
-	err := TestDatabase.Collections.Events.Drop(nil)
-	assert.NoError(t, err)
+	ctx := context.Background()
+
+	resetTestDatabase()
 
 	student1 := database.Student{
 		Name: "student1",
@@ -207,41 +446,820 @@ func TestGenerateContactReport(t *testing.T) {
 	}
 
 	// Create the students
-	TestDatabase.CreateStudent(&student1)
-	TestDatabase.CreateStudent(&student2)
+	TestDatabase.CreateStudent(ctx, &student1)
+	TestDatabase.CreateStudent(ctx, &student2)
 
 	baseTime := time.Now()
 
 	// Create test events
 
 	// student1 entered 10 minutes ago
-	TestDatabase.CreateEvent(&database.Event{
-		LocationID: TestLocation.ID,
-		StudentID:  student1.ID,
-		Time:       baseTime.Add(-10 * time.Minute),
-		EventType:  database.EventEnter,
-		Source:     0,
+	TestDatabase.CreateEvent(ctx, &database.Event{
+		Location:  TestLocation.Ref(),
+		Student:   student1.Ref(),
+		Time:      baseTime.Add(-10 * time.Minute),
+		EventType: database.EventEnter,
+		Source:    0,
 	})
 	// student2 entered 5 minutes ago
-	TestDatabase.CreateEvent(&database.Event{
-		LocationID: TestLocation.ID,
-		StudentID:  student2.ID,
-		Time:       baseTime.Add(-5 * time.Minute),
-		EventType:  database.EventEnter,
-		Source:     0,
+	TestDatabase.CreateEvent(ctx, &database.Event{
+		Location:  TestLocation.Ref(),
+		Student:   student2.Ref(),
+		Time:      baseTime.Add(-5 * time.Minute),
+		EventType: database.EventEnter,
+		Source:    0,
 	})
 	// student1 left 1 minute ago
-	TestDatabase.CreateEvent(&database.Event{
-		LocationID: TestLocation.ID,
-		StudentID:  student1.ID,
-		Time:       baseTime.Add(-1 * time.Minute),
-		EventType:  database.EventLeave,
-		Source:     0,
+	TestDatabase.CreateEvent(ctx, &database.Event{
+		Location:  TestLocation.Ref(),
+		Student:   student1.Ref(),
+		Time:      baseTime.Add(-1 * time.Minute),
+		EventType: database.EventLeave,
+		Source:    0,
 	})
 	// time student 1 and student 2 have been together: 4 minutes
 
-	contactReport, err := GenerateContactReport(&student1, time.Unix(0, 0), baseTime, 1)
+	contactReport, err := GenerateContactReport(ctx, &student1, time.Unix(0, 0), baseTime, 1, DefaultExposureRules)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 4*time.Minute, contactReport.Contacts[0][student2.Ref()].Duration)
+}
+
+func TestEventCorrections(t *testing.T) {
+	ctx := context.Background()
+
+	resetTestDatabase()
+
+	gym := database.Location{Name: "Gym", Timeout: time.Hour}
+	TestDatabase.CreateLocation(ctx, &gym)
+	student := database.Student{Name: "student"}
+	TestDatabase.CreateStudent(ctx, &student)
+	staff := primitive.NewObjectID()
+
+	baseTime := time.Now()
+
+	// TestStudent was in the library, but the other student's kiosk was set to the gym by mistake
+	TestDatabase.CreateEvent(ctx, &database.Event{
+		Location:  TestLocation.Ref(),
+		Student:   TestStudent.Ref(),
+		Time:      baseTime.Add(-30 * time.Minute),
+		EventType: database.EventEnter,
+	})
+	wrongEvent := database.Event{
+		Location:  gym.Ref(),
+		Student:   student.Ref(),
+		Time:      baseTime.Add(-20 * time.Minute),
+		EventType: database.EventEnter,
+	}
+	TestDatabase.CreateEvent(ctx, &wrongEvent)
+
+	report, err := GenerateContactReport(ctx, TestStudent, time.Unix(0, 0), baseTime, 1, DefaultExposureRules)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Contacts, "the students weren't at the same location")
+
+	_, _, err = MoveEvent(ctx, wrongEvent.ID, TestLocation.Ref(), "", staff)
+	assert.True(t, errors.Is(err, ErrInvalidCorrection), "corrections need a reason")
+
+	voided, replacement, err := MoveEvent(ctx, wrongEvent.ID, TestLocation.Ref(), "kiosk was set to the wrong location", staff)
+	assert.NoError(t, err)
+	assert.NotNil(t, voided.Voided)
+	assert.Equal(t, TestLocation.Ref(), replacement.Location)
+	assert.EqualValues(t, database.EventSourceManual, replacement.Source)
+	assert.Equal(t, wrongEvent.ID, *replacement.Correction.Replaces)
+	assert.Equal(t, staff, replacement.Correction.By)
+
+	report, err = GenerateContactReport(ctx, TestStudent, time.Unix(0, 0), baseTime, 1, DefaultExposureRules)
+	assert.NoError(t, err)
+	assert.Equal(t, 20*time.Minute, report.Contacts[0][student.Ref()].Duration, "the moved event is in the report")
+
+	_, err = VoidEvent(ctx, wrongEvent.ID, "again", staff)
+	assert.True(t, errors.Is(err, ErrEventVoided))
+
+	// the student actually left 10 minutes ago
+	_, err = CreateManualEvent(ctx, database.Event{
+		Location:  TestLocation.Ref(),
+		Student:   student.Ref(),
+		Time:      baseTime.Add(time.Hour),
+		EventType: database.EventLeave,
+	}, "forgot to scan out", staff)
+	assert.True(t, errors.Is(err, ErrInvalidCorrection), "events can't be in the future")
+	_, err = CreateManualEvent(ctx, database.Event{
+		Location:  TestLocation.Ref(),
+		Student:   student.Ref(),
+		Time:      baseTime.Add(-10 * time.Minute),
+		EventType: database.EventLeave,
+	}, "forgot to scan out", staff)
+	assert.NoError(t, err)
+
+	report, err = GenerateContactReport(ctx, TestStudent, time.Unix(0, 0), baseTime, 1, DefaultExposureRules)
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, report.Contacts[0][student.Ref()].Duration, "the backdated event is in the report")
+
+	_, found, err := GetStudentLocation(ctx, student.Ref(), baseTime)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	// the event isn't left voided if the replacement can't be created
+	deleted := database.Event{Location: gym.Ref(), Student: database.StudentRef(primitive.NewObjectID()), Time: baseTime, EventType: database.EventEnter}
+	TestDatabase.CreateEvent(ctx, &deleted)
+	_, _, err = MoveEvent(ctx, deleted.ID, TestLocation.Ref(), "the student was deleted", staff)
+	assert.True(t, errors.Is(err, database.ErrNotFound))
+	deleted, err = TestDatabase.GetEventByID(ctx, deleted.ID)
+	assert.NoError(t, err)
+	assert.Nil(t, deleted.Voided)
+}
+
+func TestApplyRetentionPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	resetTestDatabase()
+
+	// a student who left a long time ago and one who is still at the school
+	graduated := database.Student{Name: "graduated"}
+	TestDatabase.CreateStudent(ctx, &graduated)
+
+	now := time.Now()
+	for _, event := range []database.Event{
+		{Student: graduated.Ref(), Time: now.Add(-40 * 24 * time.Hour), EventType: database.EventEnter},
+		{Student: graduated.Ref(), Time: now.Add(-40*24*time.Hour + time.Hour), EventType: database.EventLeave},
+		{Student: TestStudent.Ref(), Time: now.Add(-35 * 24 * time.Hour), EventType: database.EventEnter},
+		{Student: TestStudent.Ref(), Time: now.Add(-time.Hour), EventType: database.EventEnter},
+	} {
+		event.Location = TestLocation.Ref()
+		TestDatabase.CreateEvent(ctx, &event)
+	}
+
+	policy := RetentionPolicy{Period: 30 * 24 * time.Hour, Mode: RetentionAnonymize, RemoveStudents: true}
+	assert.True(t, errors.Is(RetentionPolicy{Period: time.Hour}.Validate(), ErrInvalidRetentionPolicy))
+	_, err := ApplyRetentionPolicy(ctx, RetentionPolicy{}, now, true)
+	assert.True(t, errors.Is(err, ErrRetentionDisabled))
+
+	report, err := ApplyRetentionPolicy(ctx, policy, now, true)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, report.Events)
+	if assert.Len(t, report.Students, 1) {
+		assert.Equal(t, graduated.ID, report.Students[0].ID)
+	}
+	events, _ := TestDatabase.GetEvents(ctx)
+	assert.Len(t, events, 4, "dry runs don't change anything")
+
+	TestDatabase.CreateAuditEntry(ctx, &database.AuditEntry{
+		Action:    database.AuditCreateStudent,
+		TargetIDs: []primitive.ObjectID{graduated.ID},
+		After:     json.RawMessage(fmt.Sprintf(`{"name": %q}`, graduated.Name)),
+	})
+
+	report, err = ApplyRetentionPolicy(ctx, policy, now, false)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, report.Events)
+	_, err = TestDatabase.GetStudentByID(ctx, graduated.ID)
+	assert.True(t, errors.Is(err, database.ErrNotFound), "students who left are removed")
+
+	// the removed students' data is redacted from the audit log and isn't added back by the run's entry
+	assert.EqualValues(t, 1, report.AuditEntries)
+	recordRetention(report)
+	entries, _ := TestDatabase.GetAuditEntries(ctx, database.AuditFilter{TargetID: graduated.ID})
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, database.AuditRetention, entries[0].Action)
+		assert.Equal(t, "retention", entries[0].Actor)
+		assert.Nil(t, entries[0].Before)
+		assert.NotContains(t, fmt.Sprint(entries[0].Details), graduated.Name)
+		assert.True(t, entries[1].Redacted)
+	}
+
+	// the anonymized events are kept, but they are only used for the location's statistics
+	events, _ = TestDatabase.GetEvents(ctx)
+	assert.Len(t, events, 4)
+	events, _ = TestDatabase.GetAllEventsBetween(ctx, time.Unix(0, 0), now)
+	assert.Len(t, events, 1)
+	stats, err := GetLocationStats(ctx, TestLocation.Ref(), now.Add(-50*24*time.Hour), now)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, stats.Visits)
+	assert.Equal(t, 1, stats.Days[now.Add(-35*24*time.Hour).Local().Format("2006-01-02")])
+
+	policy.Mode = RetentionPurge
+	report, err = ApplyRetentionPolicy(ctx, policy, now, false)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, report.Events)
+	events, _ = TestDatabase.GetEvents(ctx)
+	assert.Len(t, events, 1)
+}
+
+func TestExportAndEraseStudent(t *testing.T) {
+	ctx := context.Background()
+
+	resetTestDatabase()
+
+	other := database.Student{Name: "other"}
+	TestDatabase.CreateStudent(ctx, &other)
+
+	now := time.Now()
+	for _, student := range []database.StudentRef{TestStudent.Ref(), TestStudent.Ref(), other.Ref()} {
+		TestDatabase.CreateEvent(ctx, &database.Event{
+			Location:  TestLocation.Ref(),
+			Student:   student,
+			Time:      now.Add(-10 * time.Minute),
+			EventType: database.EventEnter,
+		})
+	}
+	for _, student := range []*database.Student{TestStudent, &other} {
+		TestDatabase.CreateAuditEntry(ctx, &database.AuditEntry{
+			Action:    database.AuditCreateStudent,
+			TargetIDs: []primitive.ObjectID{student.ID},
+			After:     json.RawMessage(fmt.Sprintf(`{"name": %q}`, student.Name)),
+		})
+	}
+
+	export, err := ExportStudent(ctx, TestStudent.Ref())
+	assert.NoError(t, err)
+	assert.Equal(t, TestStudent.ID, export.Student.ID)
+	assert.Len(t, export.Events, 2)
+	if assert.Len(t, export.Locations, 1) {
+		assert.Equal(t, TestLocation.ID, export.Locations[0].ID)
+	}
+
+	_, err = EraseStudent(ctx, TestStudent.Ref(), "shred")
+	assert.True(t, errors.Is(err, ErrInvalidErasure))
+
+	report, err := EraseStudent(ctx, TestStudent.Ref(), ErasurePseudonymize)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, report.Events)
+	_, err = TestDatabase.GetStudentByID(ctx, TestStudent.ID)
+	assert.True(t, errors.Is(err, database.ErrNotFound))
+	events, _ := TestDatabase.GetEvents(ctx)
+	assert.Len(t, events, 3, "pseudonymized events are kept for statistics")
+	events, _ = TestDatabase.GetEventsByStudent(ctx, TestStudent.Ref())
+	assert.Empty(t, events)
+	occupancy, err := Occupancy(ctx, TestLocation.Ref(), now)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, occupancy, "pseudonymized students are still counted")
+
+	// the student's data is removed from the audit log, but not anyone else's
+	assert.EqualValues(t, 1, report.AuditEntries)
+	entries, _ := TestDatabase.GetAuditEntries(ctx, database.AuditFilter{TargetID: TestStudent.ID})
+	if assert.Len(t, entries, 1) {
+		assert.True(t, entries[0].Redacted)
+		assert.Nil(t, entries[0].After)
+	}
+	entries, _ = TestDatabase.GetAuditEntries(ctx, database.AuditFilter{TargetID: other.ID})
+	if assert.Len(t, entries, 1) {
+		assert.False(t, entries[0].Redacted)
+		assert.Contains(t, string(entries[0].After), other.Name)
+	}
+
+	report, err = EraseStudent(ctx, other.Ref(), ErasureDelete)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, report.Events)
+	events, _ = TestDatabase.GetEvents(ctx)
+	assert.Len(t, events, 2)
+}
+
+func TestImportRoster(t *testing.T) {
+	ctx := context.Background()
+
+	resetTestDatabase()
+
+	leaving := database.Student{Name: "Cai Noel", ExternalID: "S3", StudentHandles: []string{"cai"}}
+	TestDatabase.CreateStudent(ctx, &leaving)
+
+	roster := "Student ID,Name,Email,Card Number\n" +
+		"S1,Ryan McCrystal,ryan@school.org,1001\n" +
+		"S2,,nobody@school.org,1002\n" +
+		"S4,Taken Card,,12345\n" +
+		"S1,Ryan Again,,1003\n"
+	options := RosterOptions{
+		Mapping: RosterMapping{
+			Name:       "name",
+			Email:      "email",
+			ExternalID: "student id",
+			Handles:    []string{"card number"},
+		},
+		DryRun:         true,
+		ArchiveMissing: true,
+	}
+
+	_, err := ImportRoster(ctx, strings.NewReader("name,email\n"), options)
+	assert.True(t, errors.Is(err, ErrInvalidRoster))
+
+	report, err := ImportRoster(ctx, strings.NewReader(roster), options)
+	assert.NoError(t, err)
+	assert.Len(t, report.Created, 1)
+	assert.Len(t, report.Archived, 1)
+	if assert.Len(t, report.Errors, 3) {
+		assert.Equal(t, 3, report.Errors[0].Row)
+		assert.Contains(t, report.Errors[1].Message, TestStudent.Name)
+		assert.Contains(t, report.Errors[2].Message, "row 2")
+	}
+	students, _ := TestDatabase.GetStudents(ctx)
+	assert.Len(t, students, 2, "a dry run doesn't change anything")
+
+	options.DryRun = false
+	report, err = ImportRoster(ctx, strings.NewReader(roster), options)
+	assert.NoError(t, err)
+	if assert.Len(t, report.Created, 1) {
+		assert.False(t, report.Created[0].ID.IsZero())
+		assert.Equal(t, []string{"1001"}, report.Created[0].StudentHandles)
+	}
+	leaving, _ = TestDatabase.GetStudentByID(ctx, leaving.ID)
+	assert.True(t, leaving.Archived)
+	student, _ := TestDatabase.GetStudentByID(ctx, TestStudent.ID)
+	assert.False(t, student.Archived, "students that weren't imported aren't archived")
+
+	// importing it again only changes the students that came back
+	roster += "S3,Cai Noel,,cai\n"
+	report, err = ImportRoster(ctx, strings.NewReader(roster), options)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Created)
+	assert.Equal(t, 1, report.Unchanged)
+	if assert.Len(t, report.Updated, 1) {
+		assert.Equal(t, leaving.ID, report.Updated[0].ID)
+		assert.False(t, report.Updated[0].Archived)
+	}
+	students, _ = TestDatabase.GetStudents(ctx)
+	assert.Len(t, students, 3)
+}
+
+func TestGenerateContactReportOverlappingSources(t *testing.T) {
+	resetTestDatabase()
+	ctx := context.Background()
+
+	gym := database.Location{Name: "Gym", Timeout: time.Hour}
+	assert.NoError(t, TestDatabase.CreateLocation(ctx, &gym))
+
+	students := make([]database.Student, 4)
+	for i := range students {
+		students[i].Name = fmt.Sprintf("student%d", i)
+		assert.NoError(t, TestDatabase.CreateStudent(ctx, &students[i]))
+	}
+	target, first, second, contact := students[0], students[1], students[2], students[3]
+
+	baseTime := time.Now().Add(-24 * time.Hour)
+	visit := func(student database.Student, location database.Location, startMinute int, endMinute int) {
+		for _, event := range []database.Event{
+			{Student: student.Ref(), Location: location.Ref(), Time: baseTime.Add(time.Duration(startMinute) * time.Minute), EventType: database.EventEnter},
+			{Student: student.Ref(), Location: location.Ref(), Time: baseTime.Add(time.Duration(endMinute) * time.Minute), EventType: database.EventLeave},
+		} {
+			event := event
+			assert.NoError(t, TestDatabase.CreateEvent(ctx, &event))
+		}
+	}
+
+	// first and second are exposed by target, then contact spends 10 minutes in the gym with both of them
+	visit(target, *TestLocation, 0, 30)
+	visit(first, *TestLocation, 0, 30)
+	visit(second, *TestLocation, 0, 30)
+	visit(first, gym, 40, 50)
+	visit(second, gym, 40, 50)
+	visit(contact, gym, 40, 50)
+
+	rules := ExposureRules{CloseDuration: 15 * time.Minute, Window: 24 * time.Hour}
+	report, err := GenerateContactReport(ctx, &target, baseTime.Add(-time.Hour), baseTime.Add(2*time.Hour), 2, rules)
+	assert.NoError(t, err)
+	if !assert.Len(t, report.Contacts, 2) {
+		return
+	}
+	secondContact := report.Contacts[1][contact.Ref()]
+	if assert.NotNil(t, secondContact) {
+		assert.Equal(t, 10*time.Minute, secondContact.Duration, "the time with both sources is only counted once")
+		assert.Equal(t, 10*time.Minute, secondContact.Exposure)
+		assert.Equal(t, RiskCasual, secondContact.Risk)
+		assert.Equal(t, map[database.StudentRef]time.Duration{first.Ref(): 10 * time.Minute, second.Ref(): 10 * time.Minute}, secondContact.Via)
+		assert.Len(t, secondContact.Overlaps, 2)
+	}
+}
+
+func TestGenerateContactReportDepth(t *testing.T) {
+	resetTestDatabase()
+	ctx := context.Background()
+
+	gym := database.Location{Name: "Gym", Timeout: time.Hour}
+	assert.NoError(t, TestDatabase.CreateLocation(ctx, &gym))
+
+	students := make([]database.Student, 4)
+	for i := range students {
+		students[i].Name = fmt.Sprintf("student%d", i)
+		assert.NoError(t, TestDatabase.CreateStudent(ctx, &students[i]))
+	}
+	target, first, before, second := students[0], students[1], students[2], students[3]
+
+	baseTime := time.Now().Add(-24 * time.Hour)
+	visit := func(student database.Student, location database.Location, startMinute int, endMinute int) {
+		for _, event := range []database.Event{
+			{Student: student.Ref(), Location: location.Ref(), Time: baseTime.Add(time.Duration(startMinute) * time.Minute), EventType: database.EventEnter},
+			{Student: student.Ref(), Location: location.Ref(), Time: baseTime.Add(time.Duration(endMinute) * time.Minute), EventType: database.EventLeave},
+		} {
+			event := event
+			assert.NoError(t, TestDatabase.CreateEvent(ctx, &event))
+		}
+	}
+
+	// first is exposed by target in the library from minute 60 to 90
+	visit(target, *TestLocation, 60, 90)
+	visit(first, gym, 0, 30)
+	visit(first, *TestLocation, 30, 120)
+	// before was with first in the gym before first was exposed
+	visit(before, gym, 0, 30)
+	// second was with first in the library after target left
+	visit(second, *TestLocation, 100, 140)
+
+	report, err := GenerateContactReport(ctx, &target, baseTime.Add(-time.Hour), baseTime.Add(4*time.Hour), 3, DefaultExposureRules)
+	assert.NoError(t, err)
+
+	assert.Len(t, report.Contacts, 2, "nobody was exposed at the third depth")
+
+	assert.Len(t, report.Contacts[0], 1)
+	firstContact := report.Contacts[0][first.Ref()]
+	assert.Equal(t, 30*time.Minute, firstContact.Duration)
+	assert.Equal(t, baseTime.Add(60*time.Minute), firstContact.FirstExposure)
+	assert.Equal(t, map[database.StudentRef]time.Duration{target.Ref(): 30 * time.Minute}, firstContact.Via)
+	assert.Equal(t, RiskClose, firstContact.Risk)
+
+	assert.Len(t, report.Contacts[1], 1, "the target and contacts before the exposure aren't counted")
+	secondContact := report.Contacts[1][second.Ref()]
+	assert.Equal(t, 20*time.Minute, secondContact.Duration)
+	assert.Equal(t, baseTime.Add(100*time.Minute), secondContact.FirstExposure)
+	assert.Equal(t, map[database.StudentRef]time.Duration{first.Ref(): 20 * time.Minute}, secondContact.Via)
+	assert.Equal(t, []Overlap{{
+		Source:   first.Ref(),
+		Location: TestLocation.Ref(),
+		Start:    baseTime.Add(100 * time.Minute),
+		End:      baseTime.Add(120 * time.Minute),
+	}}, secondContact.Overlaps)
+}
+
+func TestPresenceIndex_ContactTimes(t *testing.T) {
+	student1 := database.StudentRef(primitive.NewObjectID())
+	student2 := database.StudentRef(primitive.NewObjectID())
+	student3 := database.StudentRef(primitive.NewObjectID())
+	library := database.LocationRef(primitive.NewObjectID())
+	gym := database.LocationRef(primitive.NewObjectID())
+
+	baseTime := time.Now()
+	at := func(minutes int) time.Time {
+		return baseTime.Add(time.Duration(minutes) * time.Minute)
+	}
+	event := func(student database.StudentRef, location database.LocationRef, minutes int, eventType database.EventType) database.Event {
+		return database.Event{Student: student, Location: location, Time: at(minutes), EventType: eventType}
+	}
+
+	events := []database.Event{
+		event(student1, library, 0, database.EventEnter),
+		event(student2, library, 10, database.EventEnter),
+		event(student3, gym, 15, database.EventEnter),
+		// student1 goes straight to the gym without leaving the library
+		event(student1, gym, 30, database.EventEnter),
+		event(student2, library, 40, database.EventLeave),
+		event(student3, gym, 50, database.EventLeave),
+		event(student1, gym, 60, database.EventLeave),
+	}
+
+	index := newPresenceIndex(events, at(120), nil)
+
+	contactTimes := index.contactTimes(map[database.StudentRef]bool{student1: true, student2: true})
+	assert.Equal(t, 20*time.Minute, contactTimes[student1][student2], "library overlap")
+	assert.Equal(t, 20*time.Minute, contactTimes[student1][student3], "gym overlap")
+	assert.Equal(t, 20*time.Minute, contactTimes[student2][student1], "contacts go both ways")
+	assert.Equal(t, time.Duration(0), contactTimes[student2][student3])
+	assert.NotContains(t, contactTimes, student3, "only the requested students are included")
+}
+
+func TestPresenceIndex_Timeouts(t *testing.T) {
+	student1 := database.StudentRef(primitive.NewObjectID())
+	student2 := database.StudentRef(primitive.NewObjectID())
+	student3 := database.StudentRef(primitive.NewObjectID())
+	library := database.LocationRef(primitive.NewObjectID())
+	gym := database.LocationRef(primitive.NewObjectID())
+
+	baseTime := time.Now()
+	at := func(minutes int) time.Time {
+		return baseTime.Add(time.Duration(minutes) * time.Minute)
+	}
+	event := func(student database.StudentRef, location database.LocationRef, minutes int, eventType database.EventType) database.Event {
+		return database.Event{Student: student, Location: location, Time: at(minutes), EventType: eventType}
+	}
+
+	// nobody ever scans out
+	events := []database.Event{
+		event(student1, library, 0, database.EventEnter),
+		event(student2, library, 10, database.EventEnter),
+		event(student1, gym, 60, database.EventEnter),
+		event(student3, gym, 90, database.EventEnter),
+	}
+
+	// the gym isn't in the timeouts, so it doesn't have a timeout
+	index := newPresenceIndex(events, at(120), map[database.LocationRef]time.Duration{library: 30 * time.Minute})
+
+	contactTimes := index.contactTimes(map[database.StudentRef]bool{student1: true})
+	assert.Equal(t, 20*time.Minute, contactTimes[student1][student2], "the library presences end at the timeout")
+	assert.Equal(t, 30*time.Minute, contactTimes[student1][student3], "the gym presences end at the end time")
+
+	// nobody is at a location with a timeout of 0, the same as when they scan there
+	ctx := context.Background()
+	resetTestDatabase()
+	noTimeout := database.Location{Name: "Hallway"}
+	TestDatabase.CreateLocation(ctx, &noTimeout)
+	enter := event(TestStudent.Ref(), noTimeout.Ref(), 0, database.EventEnter)
+	TestDatabase.CreateEvent(ctx, &enter)
+
+	present, _, err := IsStudentAtLocation(ctx, TestStudent.Ref(), noTimeout.Ref(), at(1))
+	assert.NoError(t, err)
+	assert.False(t, present)
+	timeouts, err := locationTimeouts(ctx)
 	assert.NoError(t, err)
+	assert.Empty(t, newPresenceIndex([]database.Event{enter}, at(120), timeouts)[noTimeout.Ref()])
+}
+
+func TestExposureRules_Classify(t *testing.T) {
+	gym := database.LocationRef(primitive.NewObjectID())
+	outside := database.LocationRef(primitive.NewObjectID())
+
+	rules := ExposureRules{
+		CloseDuration:  15 * time.Minute,
+		CasualDuration: 5 * time.Minute,
+		Window:         24 * time.Hour,
+		LocationMultipliers: map[string]float64{
+			primitive.ObjectID(gym).Hex():     2,
+			primitive.ObjectID(outside).Hex(): 0.5,
+		},
+	}
+	assert.NoError(t, rules.Validate())
+
+	baseTime := time.Now()
+	overlap := func(location database.LocationRef, startHour int, minutes int) Overlap {
+		start := baseTime.Add(time.Duration(startHour) * time.Hour)
+		return Overlap{Location: location, Start: start, End: start.Add(time.Duration(minutes) * time.Minute)}
+	}
+	library := database.LocationRef(primitive.NewObjectID())
+
+	for _, test := range []struct {
+		name     string
+		overlaps []Overlap
+		risk     Risk
+		exposure time.Duration
+	}{
+		{"no overlaps", nil, RiskNone, 0},
+		{"short", []Overlap{overlap(library, 0, 2)}, RiskNone, 2 * time.Minute},
+		{"casual", []Overlap{overlap(library, 0, 10)}, RiskCasual, 10 * time.Minute},
+		{"cumulative", []Overlap{overlap(library, 0, 10), overlap(library, 5, 10)}, RiskClose, 20 * time.Minute},
+		{"outside of the window", []Overlap{overlap(library, 0, 10), overlap(library, 30, 10)}, RiskCasual, 10 * time.Minute},
+		{"gym multiplier", []Overlap{overlap(gym, 0, 8)}, RiskClose, 16 * time.Minute},
+		{"outside multiplier", []Overlap{overlap(outside, 0, 20)}, RiskCasual, 10 * time.Minute},
+		{"several sources at once", []Overlap{overlap(library, 0, 10), overlap(library, 0, 10)}, RiskCasual, 10 * time.Minute},
+	} {
+		risk, exposure := rules.Classify(test.overlaps)
+		assert.Equal(t, test.risk, risk, test.name)
+		assert.Equal(t, test.exposure, exposure, test.name)
+	}
+
+	rules.CasualDuration = 20 * time.Minute
+	assert.Error(t, rules.Validate(), "casual contacts can't need more exposure than close contacts")
+}
+
+// generateBenchmarkEvents creates events for students visiting random locations
+// a few times a day, sorted from oldest to newest. Students sometimes scan into their
+// next location without leaving the last one.
+func generateBenchmarkEvents(seed int64, studentCount int, locationCount int, days int) ([]database.Student, []database.Event) {
+	random := rand.New(rand.NewSource(seed))
+
+	students := make([]database.Student, studentCount)
+	for i := range students {
+		students[i].ID = primitive.NewObjectID()
+	}
+	locations := make([]database.LocationRef, locationCount)
+	for i := range locations {
+		locations[i] = database.LocationRef(primitive.NewObjectID())
+	}
+
+	baseTime := time.Date(2020, 10, 1, 8, 0, 0, 0, time.UTC)
+	var events []database.Event
+	for day := 0; day < days; day++ {
+		for _, student := range students {
+			visitStart := baseTime.Add(time.Duration(day) * 24 * time.Hour)
+			for visit := 0; visit < 4; visit++ {
+				location := locations[random.Intn(len(locations))]
+				visitStart = visitStart.Add(time.Duration(random.Intn(60)) * time.Minute)
+				visitEnd := visitStart.Add(time.Duration(10+random.Intn(80)) * time.Minute)
+
+				events = append(events, database.Event{Student: student.Ref(), Location: location, Time: visitStart, EventType: database.EventEnter})
+				// the last visit of the day always ends with a leave event
+				if visit == 3 || random.Intn(5) > 0 {
+					events = append(events, database.Event{Student: student.Ref(), Location: location, Time: visitEnd, EventType: database.EventLeave})
+				}
+				visitStart = visitEnd
+			}
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+
+	return students, events
+}
+
+func benchmarkGenerateContactReport(b *testing.B, maxDepth int) {
+	students, events := generateBenchmarkEvents(1, 100, 10, 7)
+
+	store := database.NewMemoryStore()
+	database.DB = store
+	defer resetTestDatabase()
+
+	ctx := context.Background()
+	for i := range students {
+		_ = store.CreateStudent(ctx, &students[i])
+	}
+	for i := range events {
+		_ = store.CreateEvent(ctx, &events[i])
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := GenerateContactReport(ctx, &students[0], events[0].Time.Add(-time.Hour), events[len(events)-1].Time.Add(time.Hour), maxDepth, DefaultExposureRules)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkPairwiseContactReport(b *testing.B, maxDepth int) {
+	students, events := generateBenchmarkEvents(1, 100, 10, 7)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		pairwiseContactReport(events, students, students[0].Ref(), maxDepth)
+	}
+}
 
-	assert.Equal(t, 4 * time.Minute, contactReport.Contacts[0][student2.ID])
+func BenchmarkGenerateContactReport_Depth1(b *testing.B) { benchmarkGenerateContactReport(b, 1) }
+func BenchmarkGenerateContactReport_Depth2(b *testing.B) { benchmarkGenerateContactReport(b, 2) }
+func BenchmarkPairwiseContactReport_Depth1(b *testing.B) { benchmarkPairwiseContactReport(b, 1) }
+func BenchmarkPairwiseContactReport_Depth2(b *testing.B) { benchmarkPairwiseContactReport(b, 2) }
+
+// pairwiseContactReport is how GenerateContactReport calculated contacts before the
+// sweep-line over presences. It replays every event for each pair of students, which is
+// slow but simple, so it is kept to test and benchmark GenerateContactReport against.
+func pairwiseContactReport(events []database.Event, students []database.Student, target database.StudentRef, maxDepth int) []map[database.StudentRef]time.Duration {
+	contacts := make([]map[database.StudentRef]time.Duration, maxDepth)
+	for n := range contacts {
+		contacts[n] = make(map[database.StudentRef]time.Duration)
+	}
+
+	for _, student := range students {
+		if student.Ref() != target {
+			contacts[0][student.Ref()] = pairwiseContactTime(events, target, student.Ref())
+		}
+	}
+
+	for depth := 1; depth < maxDepth; depth++ {
+		for depthTarget := range contacts[depth-1] {
+			for _, student := range students {
+				if student.Ref() != depthTarget {
+					contacts[depth][student.Ref()] = pairwiseContactTime(events, depthTarget, student.Ref())
+				}
+			}
+		}
+	}
+
+	return contacts
+}
+
+// pairwiseContactTime returns the time student1 and student2 spent at the same location.
+// events must be in order from oldest to newest, and a student leaves their location when
+// they leave it or enter another one.
+func pairwiseContactTime(events []database.Event, student1 database.StudentRef, student2 database.StudentRef) time.Duration {
+	var totalTime time.Duration
+
+	// the location each student is at and when they entered it
+	locations := make(map[database.StudentRef]*database.LocationRef)
+	enterTimes := make(map[database.StudentRef]time.Time)
+
+	for _, event := range events {
+		if event.Student != student1 && event.Student != student2 {
+			continue
+		}
+		other := student1
+		if event.Student == student1 {
+			other = student2
+		}
+
+		current := locations[event.Student]
+		if current != nil && (event.EventType == database.EventEnter || *current == event.Location) {
+			// the time together ends when either student leaves
+			if otherLocation := locations[other]; otherLocation != nil && *otherLocation == *current {
+				start := enterTimes[event.Student]
+				if enterTimes[other].After(start) {
+					start = enterTimes[other]
+				}
+				totalTime += event.Time.Sub(start)
+			}
+			locations[event.Student] = nil
+		}
+
+		if event.EventType == database.EventEnter {
+			location := event.Location
+			locations[event.Student] = &location
+			enterTimes[event.Student] = event.Time
+		}
+	}
+
+	return totalTime
+}
+
+func TestGenerateContactReportMatchesPairwise(t *testing.T) {
+	ctx := context.Background()
+	defer resetTestDatabase()
+
+	for seed := int64(1); seed <= 5; seed++ {
+		students, events := generateBenchmarkEvents(seed, 30, 5, 3)
+
+		store := database.NewMemoryStore()
+		database.DB = store
+		for i := range students {
+			_ = store.CreateStudent(ctx, &students[i])
+		}
+		for i := range events {
+			_ = store.CreateEvent(ctx, &events[i])
+		}
+		startTime, endTime := events[0].Time.Add(-time.Hour), events[len(events)-1].Time.Add(time.Hour)
+
+		// the direct contacts in the report are everyone who spent time with the target student
+		report, err := GenerateContactReport(ctx, &students[0], startTime, endTime, 1, DefaultExposureRules)
+		assert.NoError(t, err)
+		if !assert.Len(t, report.Contacts, 1, "seed %d", seed) {
+			continue
+		}
+		expected := make(map[database.StudentRef]time.Duration)
+		for student, duration := range pairwiseContactReport(events, students, students[0].Ref(), 1)[0] {
+			if duration > 0 {
+				expected[student] = duration
+			}
+		}
+		actual := make(map[database.StudentRef]time.Duration)
+		for student, contact := range report.Contacts[0] {
+			actual[student] = contact.Duration
+		}
+		assert.Equal(t, expected, actual, "seed %d", seed)
+
+		// and the sweep-line finds the same contact time for every pair of students
+		all := make(map[database.StudentRef]bool)
+		for _, student := range students {
+			all[student.Ref()] = true
+		}
+		contactTimes := newPresenceIndex(events, endTime, nil).contactTimes(all)
+		for i, student1 := range students {
+			for _, student2 := range students[i+1:] {
+				assert.Equal(t, pairwiseContactTime(events, student1.Ref(), student2.Ref()), contactTimes[student1.Ref()][student2.Ref()],
+					"seed %d: %s and %s", seed, student1.ID.Hex(), student2.ID.Hex())
+			}
+		}
+	}
+}
+
+func TestGetStudentTimeline(t *testing.T) {
+	ctx := context.Background()
+
+	resetTestDatabase()
+
+	// the gym has a long timeout, so the student is there until they leave
+	gym := database.Location{Name: "Gym", Timeout: 12 * time.Hour}
+	TestDatabase.CreateLocation(ctx, &gym)
+
+	baseTime := time.Now()
+	event := func(location database.LocationRef, ago time.Duration, eventType database.EventType, source database.EventSource) *database.Event {
+		return &database.Event{
+			Location:  location,
+			Student:   TestStudent.Ref(),
+			Time:      baseTime.Add(-ago),
+			EventType: eventType,
+			Source:    source,
+		}
+	}
+	TestDatabase.CreateEvent(ctx, event(TestLocation.Ref(), 5*time.Hour, database.EventEnter, database.EventSourceScan))
+	TestDatabase.CreateEvent(ctx, event(gym.Ref(), 3*time.Hour, database.EventEnter, database.EventSourceScan))
+	TestDatabase.CreateEvent(ctx, event(gym.Ref(), 170*time.Minute, database.EventLeave, database.EventSourceLoggedOut))
+	TestDatabase.CreateEvent(ctx, event(TestLocation.Ref(), 2*time.Hour, database.EventEnter, database.EventSourceScan))
+	TestDatabase.CreateEvent(ctx, event(gym.Ref(), 110*time.Minute, database.EventEnter, database.EventSourceScan))
+	voided := event(gym.Ref(), time.Hour, database.EventLeave, database.EventSourceScan)
+	voided.Voided = &database.EventCorrection{Reason: "the student didn't leave"}
+	TestDatabase.CreateEvent(ctx, voided)
+
+	timeline, err := GetStudentTimeline(ctx, TestStudent.Ref(), time.Unix(0, 0), baseTime)
+	assert.NoError(t, err)
+	if assert.Len(t, timeline, 4) {
+		assert.Equal(t, PresenceEndAutoLeave, timeline[0].EndReason)
+		assert.True(t, timeline[0].LeaveTime.Equal(baseTime.Add(-4*time.Hour)), "the library times out after an hour")
+		assert.Equal(t, PresenceEndLoggedOut, timeline[1].EndReason)
+		assert.Equal(t, PresenceEndTransferred, timeline[2].EndReason)
+		assert.Equal(t, gym.Ref(), timeline[3].Location)
+		assert.Equal(t, PresenceEndOngoing, timeline[3].EndReason, "the leave event was voided")
+		assert.True(t, timeline[3].LeaveTime.Equal(baseTime))
+	}
+
+	timeline, err = GetStudentTimeline(ctx, TestStudent.Ref(), baseTime.Add(-3*time.Hour), baseTime.Add(-115*time.Minute))
+	assert.NoError(t, err)
+	if assert.Len(t, timeline, 2) {
+		assert.Equal(t, PresenceEndLoggedOut, timeline[0].EndReason)
+		assert.Equal(t, PresenceEndOngoing, timeline[1].EndReason)
+		assert.True(t, timeline[1].EnterTime.Equal(baseTime.Add(-2*time.Hour)))
+	}
 }